@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/throttled/throttled/v2"
+)
+
+// APIKeyLimits defines the limits applied to the requests authorized by an
+// API key. Zero values fall back to the server limits. The name identifies the
+// key in the usage accounting, and the priority orders its requests queued by
+// the worker pool.
+type APIKeyLimits struct {
+	Name             string  `json:"name"`
+	MaxAllowedSize   int     `json:"max_allowed_size"`
+	MaxAllowedPixels float64 `json:"max_allowed_resolution"`
+	Concurrency      int     `json:"concurrency"`
+	Burst            int     `json:"burst"`
+	Priority         int     `json:"priority"`
+}
+
+// APIKeys maps the accepted API keys to their limits
+type APIKeys map[string]APIKeyLimits
+
+type apiKeyContextKey struct{}
+
+// ReadAPIKeys reads the API keys limits from a JSON file
+func ReadAPIKeys(path string) (APIKeys, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys APIKeys
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API keys file: %w", err)
+	}
+
+	for key, limits := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid API keys file: empty key")
+		}
+		if limits.MaxAllowedSize < 0 || limits.MaxAllowedPixels < 0 || limits.Concurrency < 0 || limits.Burst < 0 {
+			return nil, fmt.Errorf("invalid API keys file: negative limit for key %q", key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Apply returns the server options overridden by the API key limits
+func (l APIKeyLimits) Apply(o ServerOptions) ServerOptions {
+	if l.MaxAllowedSize > 0 {
+		o.MaxAllowedSize = l.MaxAllowedSize
+	}
+	if l.MaxAllowedPixels > 0 {
+		o.MaxAllowedPixels = l.MaxAllowedPixels
+	}
+	return o
+}
+
+// requestAPIKey returns the API key sent via header or query param
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// withAPIKey stores the authorized API key in the request context
+func withAPIKey(r *http.Request, key string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+// authorizedAPIKey returns the API key authorized for the request, if any
+func authorizedAPIKey(r *http.Request) string {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(string)
+	return key
+}
+
+// throttleAPIKeys applies the concurrency quota of each API key, exposing the
+// limit state via the RateLimit-* and Retry-After response headers.
+func throttleAPIKeys(next http.Handler, o ServerOptions) http.Handler {
+	limiters := make(map[string]http.Handler, len(o.APIKeys))
+	for key, limits := range o.APIKeys {
+		if limits.Concurrency <= 0 {
+			continue
+		}
+
+		burst := limits.Burst
+		if burst == 0 {
+			burst = o.Burst
+		}
+
+		quota := throttled.RateQuota{MaxRate: throttled.PerSec(limits.Concurrency), MaxBurst: burst}
+		limiters[key] = rateLimit(next, quota, &throttled.VaryBy{Custom: authorizedAPIKey}, o)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter, ok := limiters[authorizedAPIKey(r)]; ok {
+			limiter.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
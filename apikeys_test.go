@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "keys.json")
+	_ = os.WriteFile(file, []byte(`{"foo": {"max_allowed_size": 1000, "concurrency": 5}, "bar": {}}`), 0600)
+	keys, err := ReadAPIKeys(file)
+	if err != nil {
+		t.Fatalf("Cannot read API keys: %s", err)
+	}
+	if len(keys) != 2 || keys["foo"].MaxAllowedSize != 1000 || keys["foo"].Concurrency != 5 {
+		t.Errorf("Invalid API keys: %+v", keys)
+	}
+
+	invalid := path.Join(dir, "invalid.json")
+	_ = os.WriteFile(invalid, []byte(`{"foo": {"concurrency": -1}}`), 0600)
+	if _, err := ReadAPIKeys(invalid); err == nil {
+		t.Error("Expected error for negative limit")
+	}
+}
+
+func TestAPIKeyLimitsApply(t *testing.T) {
+	o := ServerOptions{MaxAllowedSize: 100, MaxAllowedPixels: 18}
+
+	if opts := (APIKeyLimits{}).Apply(o); opts.MaxAllowedSize != 100 || opts.MaxAllowedPixels != 18 {
+		t.Errorf("Invalid default limits: %d, %f", opts.MaxAllowedSize, opts.MaxAllowedPixels)
+	}
+	if opts := (APIKeyLimits{MaxAllowedSize: 50, MaxAllowedPixels: 2}).Apply(o); opts.MaxAllowedSize != 50 || opts.MaxAllowedPixels != 2 {
+		t.Errorf("Invalid key limits: %d, %f", opts.MaxAllowedSize, opts.MaxAllowedPixels)
+	}
+}
+
+func TestAuthorizeAPIKeys(t *testing.T) {
+	o := ServerOptions{
+		APIKey:  "secret",
+		APIKeys: APIKeys{"tenant": {MaxAllowedSize: 10}},
+	}
+
+	var key string
+	handler := authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = authorizedAPIKey(r)
+	}), authProvider(o), o)
+
+	cases := []struct {
+		key    string
+		status int
+		tenant string
+	}{
+		{"secret", http.StatusOK, ""},
+		{"tenant", http.StatusOK, "tenant"},
+		{"", http.StatusUnauthorized, ""},
+		{"invalid", http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range cases {
+		key = ""
+		req := httptest.NewRequest(http.MethodGet, "/resize?key="+test.key, nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != test.status {
+			t.Errorf("Invalid response status for key %q: %d", test.key, res.Code)
+		}
+		if key != test.tenant {
+			t.Errorf("Invalid authorized key: %q != %q", key, test.tenant)
+		}
+	}
+}
+
+func TestAPIKeyMaxAllowedSize(t *testing.T) {
+	o := ServerOptions{
+		MaxAllowedPixels: 18.0,
+		APIKeys:          APIKeys{"tenant": {MaxAllowedSize: 10}},
+	}
+	LoadSources(o)
+
+	ts := httptest.NewServer(ImageMiddleware(o)(Crop))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/crop?width=300&key=tenant", "image/jpeg", strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
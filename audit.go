@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Audit events written to the security log
+const (
+	AuditInvalidAPIKey    = "invalid_api_key"
+	AuditUnauthorized     = "unauthorized"
+	AuditInvalidSignature = "invalid_signature"
+	AuditForbiddenOrigin  = "forbidden_origin"
+	AuditImageTooLarge    = "image_too_large"
+	AuditResolutionTooBig = "resolution_too_big"
+	AuditInputRejected    = "input_rejected"
+	AuditBudgetExceeded   = "budget_exceeded"
+	AuditPolicyViolation  = "policy_violation"
+)
+
+// auditMaxValueSize limits the size of the offending param values logged
+const auditMaxValueSize = 256
+
+// AuditEvent is a rejected request entry of the security log
+type AuditEvent struct {
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	ClientIP string `json:"client_ip"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Param    string `json:"param,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// AuditLog writes the requests rejected for security reasons as JSON lines,
+// separately from the access log, to be consumed by tools like fail2ban.
+// A nil AuditLog discards every event.
+type AuditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewAuditLog creates a new security log writing to the given output
+func NewAuditLog(out io.Writer) *AuditLog {
+	return &AuditLog{out: out}
+}
+
+// Log writes the audit event of the rejected request. The offending param
+// value is logged unless the param holds a secret, such as an API key.
+func (a *AuditLog) Log(r *http.Request, event, param string, err error) {
+	if a == nil {
+		return
+	}
+
+	entry := AuditEvent{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Event:    event,
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Param:    param,
+	}
+	if param != "" && event != AuditInvalidAPIKey {
+		entry.Value = truncate(r.URL.Query().Get(param), auditMaxValueSize)
+	}
+	if err != nil {
+		entry.Message = err.Error()
+	}
+
+	buf, _ := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.out.Write(append(buf, '\n'))
+}
+
+func truncate(value string, size int) string {
+	if len(value) > size {
+		return value[:size]
+	}
+	return value
+}
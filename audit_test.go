@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	audit := NewAuditLog(&out)
+
+	r := httptest.NewRequest(http.MethodGet, "/resize?url=http://internal/admin&key=secret", nil)
+	r.RemoteAddr = "203.0.113.7:4321"
+	audit.Log(r, AuditForbiddenOrigin, URLQueryKey, fmt.Errorf("%w: internal/admin", errForbiddenOrigin))
+	audit.Log(r, AuditInvalidAPIKey, "key", ErrInvalidAPIKey)
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit events, got: %s", out.String())
+	}
+
+	var event AuditEvent
+	if err := json.Unmarshal(lines[0], &event); err != nil {
+		t.Fatalf("Invalid audit event: %s", err)
+	}
+	if event.Event != AuditForbiddenOrigin || event.ClientIP != "203.0.113.7" || event.Param != "url" ||
+		event.Value != "http://internal/admin" || event.Path != "/resize" {
+		t.Errorf("Invalid audit event: %+v", event)
+	}
+
+	var keyEvent AuditEvent
+	if err := json.Unmarshal(lines[1], &keyEvent); err != nil {
+		t.Fatalf("Invalid audit event: %s", err)
+	}
+	if keyEvent.Value != "" {
+		t.Errorf("API keys must not be logged: %+v", keyEvent)
+	}
+
+	// Nil audit logs discard the events
+	var disabled *AuditLog
+	disabled.Log(r, AuditInvalidAPIKey, "key", nil)
+}
+
+func TestAuditForbiddenOrigin(t *testing.T) {
+	var out bytes.Buffer
+	origin, _ := url.Parse("http://allowed.org")
+	o := ServerOptions{
+		EnableURLSource: true,
+		AllowedOrigins:  []*url.URL{origin},
+		AuditLog:        NewAuditLog(&out),
+	}
+	LoadSources(o)
+
+	r := httptest.NewRequest(http.MethodGet, "/resize?width=100&url=http://169.254.169.254/latest", nil)
+	w := httptest.NewRecorder()
+	imageController(o, Resize)(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid response status: %d", w.Code)
+	}
+
+	var event AuditEvent
+	if err := json.Unmarshal(out.Bytes(), &event); err != nil {
+		t.Fatalf("Invalid audit event: %s", err)
+	}
+	if event.Event != AuditForbiddenOrigin || event.Value != "http://169.254.169.254/latest" {
+		t.Errorf("Invalid audit event: %+v", event)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Authorization providers selected by the -auth flag
+const (
+	AuthAPIKey   = "apikey"
+	AuthJWT      = "jwt"
+	AuthMTLS     = "mtls"
+	AuthExternal = "external"
+)
+
+// externalAuthTimeout limits the external authorization subrequests duration
+const externalAuthTimeout = 5 * time.Second
+
+// AuthProvider authorizes the requests, returning the request to serve, which
+// may carry the caller identity, or the error replied to the client
+type AuthProvider interface {
+	Authorize(r *http.Request) (*http.Request, error)
+}
+
+// authProvider returns the authorization provider of the server, the API keys
+// one if only the keys are defined, or nil if the requests are public
+func authProvider(o ServerOptions) AuthProvider {
+	if o.Auth != nil {
+		return o.Auth
+	}
+	if o.APIKey != "" || len(o.APIKeys) > 0 {
+		return apiKeyAuth{key: o.APIKey, keys: o.APIKeys}
+	}
+	return nil
+}
+
+// apiKeyAuth authorizes the requests sending the -key API key, or one of the
+// -api-keys keys, stored in the request context
+type apiKeyAuth struct {
+	key  string
+	keys APIKeys
+}
+
+func (a apiKeyAuth) Authorize(r *http.Request) (*http.Request, error) {
+	key := requestAPIKey(r)
+	if _, ok := a.keys[key]; ok && key != "" {
+		return withAPIKey(r, key), nil
+	}
+	if a.key == "" || key != a.key {
+		return nil, ErrInvalidAPIKey
+	}
+	return r, nil
+}
+
+// jwtAuth authorizes the requests sending a valid JSON Web Token as bearer
+// token, signed by the HMAC secret (HS256, HS384 and HS512) or the RSA or
+// ECDSA public key (RS256, RS384, RS512, ES256, ES384 and ES512)
+type jwtAuth struct {
+	secret    []byte
+	publicKey crypto.PublicKey
+	audience  string
+}
+
+// jwtClaims are the registered JWT claims checked by jwtAuth
+type jwtClaims struct {
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Audience  json.RawMessage `json:"aud"`
+}
+
+// NewJWTAuth returns the JWT authorization provider verifying the tokens with
+// the HMAC secret or the PEM encoded public key file, and requiring the aud
+// claim to match the audience, if any
+func NewJWTAuth(secret, publicKeyPath, audience string) (AuthProvider, error) {
+	a := jwtAuth{secret: []byte(secret), audience: audience}
+	if publicKeyPath != "" {
+		buf, err := os.ReadFile(publicKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, errors.New("invalid public key PEM file")
+		}
+		a.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(a.secret) == 0 && a.publicKey == nil {
+		return nil, errors.New("JWT secret or public key is required")
+	}
+	return a, nil
+}
+
+func (a jwtAuth) Authorize(r *http.Request) (*http.Request, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrUnauthorized
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !a.verify(header.Alg, parts[0]+"."+parts[1], signature) {
+		return nil, ErrUnauthorized
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || !claims.valid(time.Now(), a.audience) {
+		return nil, ErrUnauthorized
+	}
+	return r, nil
+}
+
+// verify checks the token signature with the key matching the algorithm.
+// The none algorithm is never accepted.
+func (a jwtAuth) verify(alg, signed string, signature []byte) bool {
+	if len(alg) != 5 {
+		return false
+	}
+
+	var hashFunc crypto.Hash
+	var newHash func() hash.Hash
+	switch alg[2:] {
+	case "256":
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case "384":
+		hashFunc, newHash = crypto.SHA384, sha512.New384
+	case "512":
+		hashFunc, newHash = crypto.SHA512, sha512.New
+	default:
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && len(a.secret) > 0:
+		h := hmac.New(newHash, a.secret)
+		h.Write([]byte(signed))
+		return hmac.Equal(signature, h.Sum(nil))
+	case strings.HasPrefix(alg, "RS"):
+		key, ok := a.publicKey.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := newHash()
+		h.Write([]byte(signed))
+		return rsa.VerifyPKCS1v15(key, hashFunc, h.Sum(nil), signature) == nil
+	case strings.HasPrefix(alg, "ES"):
+		key, ok := a.publicKey.(*ecdsa.PublicKey)
+		size := 0
+		if ok {
+			size = (key.Params().BitSize + 7) / 8
+		}
+		if !ok || len(signature) != 2*size {
+			return false
+		}
+		h := newHash()
+		h.Write([]byte(signed))
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	default:
+		return false
+	}
+}
+
+// valid checks the token expiration and activation times, and the audience
+func (c jwtClaims) valid(now time.Time, audience string) bool {
+	unix := float64(now.Unix())
+	if c.ExpiresAt != nil && unix >= *c.ExpiresAt {
+		return false
+	}
+	if c.NotBefore != nil && unix < *c.NotBefore {
+		return false
+	}
+	if audience == "" {
+		return true
+	}
+
+	// The aud claim is either a string or an array of strings
+	var audiences []string
+	if err := json.Unmarshal(c.Audience, &audiences); err != nil {
+		var single string
+		if err := json.Unmarshal(c.Audience, &single); err != nil {
+			return false
+		}
+		audiences = []string{single}
+	}
+	for _, aud := range audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJWTPart decodes the base64url encoded JSON token part
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// mtlsAuth authorizes the requests sending a TLS client certificate verified
+// against the -tls-client-ca certificates
+type mtlsAuth struct{}
+
+func (mtlsAuth) Authorize(r *http.Request) (*http.Request, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrUnauthorized
+	}
+	return r, nil
+}
+
+// externalAuth authorizes the requests via a subrequest to an authorization
+// service, like the nginx auth_request module. The request credentials are
+// forwarded, along with the original method and URI, and any 2xx status
+// allows the request, while 401 and 403 are replied to the client.
+type externalAuth struct {
+	url    string
+	client *http.Client
+}
+
+// externalAuthHeaders are the request headers forwarded to the external
+// authorization service
+var externalAuthHeaders = []string{"Authorization", "Cookie", "API-Key"}
+
+// NewExternalAuth returns the authorization provider of the external
+// authorization service URL
+func NewExternalAuth(serviceURL string) (AuthProvider, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid authorization service URL: %s", serviceURL)
+	}
+	return externalAuth{url: serviceURL, client: &http.Client{Timeout: externalAuthTimeout}}, nil
+}
+
+func (a externalAuth) Authorize(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, ErrAuthUnavailable
+	}
+	for _, name := range externalAuthHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, ErrAuthUnavailable
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return r, nil
+	case res.StatusCode == http.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	case res.StatusCode == http.StatusForbidden:
+		return nil, ErrForbidden
+	default:
+		return nil, ErrAuthUnavailable
+	}
+}
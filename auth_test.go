@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func encodeJWTPart(t *testing.T, v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	signed := encodeJWTPart(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeJWTPart(t, claims)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	auth, err := NewJWTAuth("secret", "", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	unsigned := encodeJWTPart(t, map[string]string{"alg": "none"}) + "." + encodeJWTPart(t, map[string]interface{}{"aud": "imaginary"}) + "."
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{signHS256(t, "secret", map[string]interface{}{"aud": "imaginary", "exp": now + 60}), nil},
+		{signHS256(t, "secret", map[string]interface{}{"aud": []string{"other", "imaginary"}}), nil},
+		{signHS256(t, "secret", map[string]interface{}{"aud": "imaginary", "exp": now - 60}), ErrUnauthorized},
+		{signHS256(t, "secret", map[string]interface{}{"aud": "imaginary", "nbf": now + 60}), ErrUnauthorized},
+		{signHS256(t, "secret", map[string]interface{}{"aud": "other"}), ErrUnauthorized},
+		{signHS256(t, "secret", map[string]interface{}{}), ErrUnauthorized},
+		{signHS256(t, "another secret", map[string]interface{}{"aud": "imaginary"}), ErrUnauthorized},
+		{unsigned, ErrUnauthorized},
+		{"invalid", ErrUnauthorized},
+		{"", ErrUnauthorized},
+	}
+
+	for _, test := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		if _, err := auth.Authorize(req); err != test.err {
+			t.Errorf("Invalid authorization of %q: %v", test.token, err)
+		}
+	}
+}
+
+func TestJWTAuthPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	file := path.Join(t.TempDir(), "public.pem")
+	_ = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	auth, err := NewJWTAuth("", file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := encodeJWTPart(t, map[string]string{"alg": "ES256"}) + "." + encodeJWTPart(t, map[string]string{"sub": "user"})
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	req.Header.Set("Authorization", "Bearer "+signed+"."+base64.RawURLEncoding.EncodeToString(signature))
+	if _, err := auth.Authorize(req); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// HMAC tokens are rejected without secret
+	req.Header.Set("Authorization", "Bearer "+signHS256(t, "", map[string]interface{}{}))
+	if _, err := auth.Authorize(req); err != ErrUnauthorized {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	if _, err := NewJWTAuth("", "", ""); err == nil {
+		t.Error("Expected missing secret or public key error")
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Original-URI") != "/resize?width=300" || r.Header.Get("X-Original-Method") != http.MethodPost:
+			w.WriteHeader(http.StatusBadRequest)
+		case r.Header.Get("Authorization") == "Bearer valid":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Header.Get("Authorization") == "Bearer forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer service.Close()
+
+	auth, err := NewExternalAuth(service.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method        string
+		authorization string
+		err           error
+	}{
+		{http.MethodPost, "Bearer valid", nil},
+		{http.MethodPost, "Bearer forbidden", ErrForbidden},
+		{http.MethodPost, "", ErrUnauthorized},
+		{http.MethodGet, "Bearer valid", ErrAuthUnavailable},
+	}
+
+	for _, test := range cases {
+		req := httptest.NewRequest(test.method, "/resize?width=300", nil)
+		req.Header.Set("Authorization", test.authorization)
+		if _, err := auth.Authorize(req); err != test.err {
+			t.Errorf("Invalid authorization of %s %q: %v", test.method, test.authorization, err)
+		}
+	}
+
+	if _, err := NewExternalAuth("ftp://auth.example.org"); err == nil {
+		t.Error("Expected invalid URL error")
+	}
+}
+
+func TestMTLSAuth(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	if _, err := (mtlsAuth{}).Authorize(req); err != ErrUnauthorized {
+		t.Errorf("Expected unauthorized error without TLS, got %v", err)
+	}
+}
+
+func TestAuthorizeProvider(t *testing.T) {
+	auth, _ := NewJWTAuth("secret", "", "")
+	o := ServerOptions{Auth: auth, APIKey: "ignored"}
+	handler := authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), authProvider(o), o)
+
+	for token, status := range map[string]int{
+		signHS256(t, "secret", map[string]interface{}{}): http.StatusOK,
+		"invalid": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/resize?key=ignored", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != status {
+			t.Errorf("Invalid response status for %q: %d", token, res.Code)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// autoOutputType refines the output type negotiated for type=auto with the
+// source image traits: animated images keep their format, since only their
+// first frame would be converted otherwise, and images with alpha channel are
+// converted to WebP, if accepted by the client, or PNG instead of JPEG.
+// An empty type keeps the source image format.
+func autoOutputType(negotiated, accept string, buf []byte, allowed ImageTypes) string {
+	sourceType := bimg.DetermineImageType(buf)
+	if isAnimatedImage(buf, sourceType) {
+		if ImageType(negotiated) == sourceType {
+			return negotiated
+		}
+		return ""
+	}
+
+	if negotiated != "jpeg" || !hasAlphaChannel(buf) {
+		return negotiated
+	}
+	if acceptsMediaType(accept, "image/webp") && allowed.Allows(bimg.WEBP) {
+		return "webp"
+	}
+	if allowed.Allows(bimg.PNG) {
+		return "png"
+	}
+	return ""
+}
+
+// isAnimatedImage reports whether the GIF, WebP or PNG (APNG) image has
+// several frames, walking the image structure without decoding it
+func isAnimatedImage(buf []byte, imageType bimg.ImageType) bool {
+	switch imageType {
+	case bimg.GIF:
+		return gifFrameCount(buf, 1) > 1
+	case bimg.WEBP:
+		// The VP8X chunk flags define the animation bit
+		return len(buf) > 20 && string(buf[12:16]) == "VP8X" && buf[20]&0x02 != 0
+	case bimg.PNG:
+		return pngChunk(buf, "acTL") != nil
+	default:
+		return false
+	}
+}
+
+// hasAlphaChannel reports whether the image has an alpha channel
+func hasAlphaChannel(buf []byte) bool {
+	meta, err := bimg.Metadata(buf)
+	return err == nil && meta.Alpha
+}
+
+// acceptsMediaType reports whether the Accept header explicitly accepts the
+// media type, with a non zero quality
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, v := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(v)
+		if err != nil || accepted != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func animatedGIF(frames int) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	_ = gif.EncodeAll(&buf, anim)
+	return buf.Bytes()
+}
+
+func TestIsAnimatedImage(t *testing.T) {
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00")
+	stillWebP := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00")
+
+	cases := []struct {
+		buf       []byte
+		imageType bimg.ImageType
+		animated  bool
+	}{
+		{animatedGIF(2), bimg.GIF, true},
+		{animatedGIF(1), bimg.GIF, false},
+		{webp, bimg.WEBP, true},
+		{stillWebP, bimg.WEBP, false},
+		{selfTestImage(), bimg.PNG, false},
+	}
+	for i, c := range cases {
+		if animated := isAnimatedImage(c.buf, c.imageType); animated != c.animated {
+			t.Errorf("Case %d: expected animated %t, got %t", i, c.animated, animated)
+		}
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	cases := map[string]bool{
+		"image/jpeg,image/webp":      true,
+		"image/webp;q=0.5":           true,
+		"image/webp;q=0, image/jpeg": false,
+		"image/avif,image/*;q=0.8":   false,
+		"":                           false,
+	}
+	for accept, expected := range cases {
+		if accepts := acceptsMediaType(accept, "image/webp"); accepts != expected {
+			t.Errorf("%q: expected %t, got %t", accept, expected, accepts)
+		}
+	}
+}
+
+func TestAutoOutputTypeAnimated(t *testing.T) {
+	buf := animatedGIF(2)
+	if imageType := autoOutputType("webp", "image/webp", buf, nil); imageType != "" {
+		t.Errorf("Expected the animated GIF format to be kept, got %q", imageType)
+	}
+	if imageType := autoOutputType("jpeg", "image/jpeg", animatedGIF(1), nil); imageType != "jpeg" {
+		t.Errorf("Expected the negotiated type, got %q", imageType)
+	}
+}
+
+func TestAutoOutputTypeAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 128})
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+
+	if imageType := autoOutputType("jpeg", "image/jpeg,image/webp", buf.Bytes(), nil); imageType != "webp" {
+		t.Errorf("Expected WebP output for alpha images, got %q", imageType)
+	}
+	if imageType := autoOutputType("jpeg", "image/jpeg", buf.Bytes(), nil); imageType != "png" {
+		t.Errorf("Expected PNG output for alpha images, got %q", imageType)
+	}
+
+	jpeg, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	if imageType := autoOutputType("jpeg", "image/jpeg", jpeg, nil); imageType != "jpeg" {
+		t.Errorf("Expected JPEG output for opaque images, got %q", imageType)
+	}
+}
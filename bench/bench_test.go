@@ -0,0 +1,150 @@
+// Package bench benchmarks the libvips operations behind the imaginary
+// endpoints per input class, to compare libvips upgrades. Run via the
+// bench-baseline and bench-compare make targets.
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// input is a benchmarked image class
+type input struct {
+	name string
+	load func() ([]byte, error)
+	kind bimg.ImageType
+}
+
+var inputs = []input{
+	{"small-jpeg", readTestdata("imaginary.jpg"), bimg.JPEG},
+	{"large-jpeg", readTestdata("large.jpg"), bimg.JPEG},
+	{"png", readTestdata("test.png"), bimg.PNG},
+	{"animated-gif", animatedGIF, bimg.GIF},
+	{"pdf", singlePagePDF, bimg.PDF},
+}
+
+// operations map the endpoints to the bimg options they run
+var operations = []struct {
+	name    string
+	options bimg.Options
+}{
+	{"resize", bimg.Options{Width: 300, Embed: true}},
+	{"crop", bimg.Options{Width: 300, Height: 300, Crop: true}},
+	{"smartcrop", bimg.Options{Width: 300, Height: 300, Crop: true, Gravity: bimg.GravitySmart}},
+	{"enlarge", bimg.Options{Width: 2000, Height: 2000, Enlarge: true}},
+	{"rotate", bimg.Options{Rotate: bimg.D90}},
+	{"blur", bimg.Options{GaussianBlur: bimg.GaussianBlur{Sigma: 5}}},
+	{"convert-webp", bimg.Options{Type: bimg.WEBP}},
+	{"convert-avif", bimg.Options{Type: bimg.AVIF}},
+}
+
+func TestMain(m *testing.M) {
+	// The operations cache would measure the cache lookups instead
+	bimg.Initialize()
+	bimg.VipsCacheSetMax(0)
+	code := m.Run()
+	bimg.Shutdown()
+	os.Exit(code)
+}
+
+func BenchmarkOperations(b *testing.B) {
+	for _, in := range inputs {
+		if !bimg.IsTypeSupported(in.kind) {
+			continue
+		}
+		buf, err := in.load()
+		if err != nil {
+			b.Fatalf("Cannot load %s input: %s", in.name, err)
+		}
+
+		for _, op := range operations {
+			opts := op.options
+			if opts.Type == bimg.UNKNOWN {
+				opts.Type = outputType(in.kind)
+			}
+			if !bimg.IsTypeSupportedSave(opts.Type) {
+				continue
+			}
+
+			b.Run(fmt.Sprintf("%s/%s", op.name, in.name), func(b *testing.B) {
+				b.SetBytes(int64(len(buf)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := bimg.Resize(buf, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// outputType keeps the input type, or JPEG if libvips can't save it, as the
+// imaginary endpoints do
+func outputType(kind bimg.ImageType) bimg.ImageType {
+	if bimg.IsTypeSupportedSave(kind) {
+		return kind
+	}
+	return bimg.JPEG
+}
+
+func readTestdata(name string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return os.ReadFile(filepath.Join("..", "testdata", name))
+	}
+}
+
+// animatedGIF generates a 20 frames 640x480 animated GIF
+func animatedGIF() ([]byte, error) {
+	palette := color.Palette{color.White, color.Black, color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	anim := &gif.GIF{}
+	for frame := 0; frame < 20; frame++ {
+		img := image.NewPaletted(image.Rect(0, 0, 640, 480), palette)
+		for y := 0; y < 480; y++ {
+			for x := 0; x < 640; x++ {
+				img.SetColorIndex(x, y, uint8((x/32+y/32+frame)%len(palette)))
+			}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, anim)
+	return buf.Bytes(), err
+}
+
+// singlePagePDF generates a single A4 page PDF drawing a filled rectangle
+func singlePagePDF() ([]byte, error) {
+	content := "0.2 0.4 0.8 rg 72 72 451 698 re f"
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes(), nil
+}
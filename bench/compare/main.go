@@ -0,0 +1,110 @@
+// Command compare flags the benchmarks regressions between two go test -bench
+// outputs, comparing the median time per operation of each benchmark.
+//
+//	go run ./bench/compare -threshold 10 baseline.txt current.txt
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "Maximum slowdown percentage not flagged as regression")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: compare [-threshold <percentage>] <baseline> <current>")
+		os.Exit(2)
+	}
+
+	baseline, err := readResults(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	current, err := readResults(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if regressions := compare(os.Stdout, baseline, current, *threshold); regressions > 0 {
+		fmt.Printf("\n%d regressions exceeding %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+// readResults reads the ns/op samples per benchmark name
+func readResults(path string) (map[string][]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseResults(file)
+}
+
+// parseResults parses the go test -bench output lines, such as:
+// BenchmarkOperations/resize/small-jpeg-8   500   2400000 ns/op   12.5 MB/s
+func parseResults(r io.Reader) (map[string][]float64, error) {
+	results := make(map[string][]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid benchmark line: %s", scanner.Text())
+			}
+			results[fields[0]] = append(results[fields[0]], value)
+		}
+	}
+	return results, scanner.Err()
+}
+
+// compare writes the median time delta of the benchmarks present in both
+// results, returning the number of regressions exceeding the threshold
+func compare(w io.Writer, baseline, current map[string][]float64, threshold float64) int {
+	names := make([]string, 0, len(current))
+	for name := range current {
+		if _, ok := baseline[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	regressions := 0
+	for _, name := range names {
+		before, after := median(baseline[name]), median(current[name])
+		delta := (after - before) / before * 100
+		status := "ok"
+		if delta > threshold {
+			status = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(w, "%-60s %14.0f %14.0f ns/op %+7.1f%%  %s\n", name, before, after, delta, status)
+	}
+	return regressions
+}
+
+func median(samples []float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResults(t *testing.T) {
+	output := `goos: linux
+BenchmarkOperations/resize/small-jpeg-8   	     500	   2400000 ns/op	  12.50 MB/s	    1024 B/op	      10 allocs/op
+BenchmarkOperations/resize/small-jpeg-8   	     500	   2600000 ns/op	  11.50 MB/s	    1024 B/op	      10 allocs/op
+PASS
+`
+	results, err := parseResults(strings.NewReader(output))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string][]float64{"BenchmarkOperations/resize/small-jpeg-8": {2400000, 2600000}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Invalid results: %v", results)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := map[string][]float64{"BenchmarkA": {100, 110, 90}, "BenchmarkB": {100}, "BenchmarkC": {100}}
+	current := map[string][]float64{"BenchmarkA": {105, 95, 100}, "BenchmarkB": {150}, "BenchmarkD": {100}}
+
+	var out bytes.Buffer
+	if regressions := compare(&out, baseline, current, 10); regressions != 1 {
+		t.Errorf("Expected 1 regression, got %d: %s", regressions, out.String())
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "REGRESSION") {
+		t.Errorf("Invalid comparison: %s", out.String())
+	}
+}
+
+func TestMedian(t *testing.T) {
+	if m := median([]float64{3, 1, 2}); m != 2 {
+		t.Errorf("Invalid odd median: %f", m)
+	}
+	if m := median([]float64{4, 1, 3, 2}); m != 2.5 {
+		t.Errorf("Invalid even median: %f", m)
+	}
+}
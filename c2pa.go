@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultC2PATool is the C2PA reference implementation command line tool
+// used to sign and validate the content credentials manifests
+const defaultC2PATool = "c2patool"
+
+// c2paExtensions maps the image MIME types to the file extensions supported
+// by the C2PA tool, which detects the asset format by its extension
+var c2paExtensions = map[string]string{
+	"image/jpeg":    "jpg",
+	"image/png":     "png",
+	"image/webp":    "webp",
+	"image/avif":    "avif",
+	"image/heif":    "heif",
+	"image/tiff":    "tiff",
+	"image/gif":     "gif",
+	"image/svg+xml": "svg",
+}
+
+// c2paActions maps the endpoints to the C2PA actions describing the edits
+var c2paActions = map[string]string{
+	"resize":     "c2pa.resized",
+	"enlarge":    "c2pa.resized",
+	"fit":        "c2pa.resized",
+	"thumbnail":  "c2pa.resized",
+	"zoom":       "c2pa.resized",
+	"crop":       "c2pa.cropped",
+	"smartcrop":  "c2pa.cropped",
+	"extract":    "c2pa.cropped",
+	"rotate":     "c2pa.orientation",
+	"autorotate": "c2pa.orientation",
+	"flip":       "c2pa.orientation",
+	"flop":       "c2pa.orientation",
+	"convert":    "c2pa.transcoded",
+}
+
+// C2PA signs the output images with Content Credentials provenance manifests
+// and validates the manifests of the incoming images
+type C2PA struct {
+	Tool         string
+	CertFile     string
+	KeyFile      string
+	Algorithm    string
+	TimestampURL string
+	Validate     bool
+}
+
+type c2paManifest struct {
+	Alg            string          `json:"alg"`
+	PrivateKey     string          `json:"private_key"`
+	SignCert       string          `json:"sign_cert"`
+	TimestampURL   string          `json:"ta_url,omitempty"`
+	ClaimGenerator string          `json:"claim_generator"`
+	Assertions     []c2paAssertion `json:"assertions"`
+}
+
+type c2paAssertion struct {
+	Label string      `json:"label"`
+	Data  interface{} `json:"data"`
+}
+
+type c2paAction struct {
+	Action        string            `json:"action"`
+	SoftwareAgent string            `json:"softwareAgent"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+}
+
+type c2paValidationStatus struct {
+	Code        string `json:"code"`
+	URL         string `json:"url,omitempty"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// newC2PA checks the C2PA tool and signing credentials. The credentials paths
+// are made absolute as the tool resolves them relative to the manifest file.
+func newC2PA(tool, certFile, keyFile, alg, timestampURL string, validate bool) (*C2PA, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both -c2pa-cert and -c2pa-key flags must be defined")
+	}
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the C2PA tool: %s", err)
+	}
+
+	c := &C2PA{Tool: path, Algorithm: alg, TimestampURL: timestampURL, Validate: validate}
+	if certFile != "" {
+		if c.CertFile, err = c2paCredentialPath(certFile); err != nil {
+			return nil, err
+		}
+		if c.KeyFile, err = c2paCredentialPath(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// c2paCredentialPath returns the absolute path of the signing credentials file
+func c2paCredentialPath(file string) (string, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("cannot read C2PA signing credentials: %s", err)
+	}
+	return path, nil
+}
+
+// CanSign reports whether the signing certificate is configured
+func (c *C2PA) CanSign() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Sign embeds a manifest describing the endpoint edits into the output image.
+// The source image, including its own manifest, is recorded as parent
+// ingredient so the provenance chain is preserved. Formats not supported by
+// C2PA are returned unchanged.
+func (c *C2PA) Sign(ctx context.Context, source []byte, image Image, endpoint string) ([]byte, error) {
+	ext, ok := c2paExtensions[image.Mime]
+	if !ok {
+		return image.Body, nil
+	}
+
+	dir, err := ioutil.TempDir("", "imaginary-c2pa")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	action := c2paActions[endpoint]
+	if action == "" {
+		action = "c2pa.edited"
+	}
+	manifest, err := json.Marshal(c2paManifest{
+		Alg:            c.Algorithm,
+		PrivateKey:     c.KeyFile,
+		SignCert:       c.CertFile,
+		TimestampURL:   c.TimestampURL,
+		ClaimGenerator: "imaginary/" + Version,
+		Assertions: []c2paAssertion{{
+			Label: "c2pa.actions",
+			Data: map[string][]c2paAction{"actions": {{
+				Action:        action,
+				SoftwareAgent: "imaginary/" + Version,
+				Parameters:    map[string]string{"endpoint": endpoint},
+			}}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	input := filepath.Join(dir, "input."+ext)
+	output := filepath.Join(dir, "output."+ext)
+	manifestFile := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(input, image.Body, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(manifestFile, manifest, 0600); err != nil {
+		return nil, err
+	}
+
+	args := []string{input, "-m", manifestFile, "-o", output, "-f"}
+	if parentExt, ok := c2paExtensions[detectMimeType(source)]; ok {
+		parent := filepath.Join(dir, "parent."+parentExt)
+		if err := ioutil.WriteFile(parent, source, 0600); err != nil {
+			return nil, err
+		}
+		args = append(args, "-p", parent)
+	}
+
+	if _, err := c.run(ctx, args...); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(output)
+}
+
+// Verify validates the manifest embedded in the image, if any. Images without
+// manifest are considered valid.
+func (c *C2PA) Verify(ctx context.Context, buf []byte) error {
+	ext, ok := c2paExtensions[detectMimeType(buf)]
+	if !ok {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "imaginary-c2pa")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input."+ext)
+	if err := ioutil.WriteFile(input, buf, 0600); err != nil {
+		return err
+	}
+
+	out, err := c.run(ctx, input)
+	if err != nil {
+		if strings.Contains(err.Error(), "No claim found") {
+			return nil
+		}
+		return err
+	}
+
+	var report struct {
+		ValidationStatus []c2paValidationStatus `json:"validation_status"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return fmt.Errorf("cannot read C2PA report: %s", err)
+	}
+	if len(report.ValidationStatus) > 0 {
+		status := report.ValidationStatus[0]
+		return NewError(fmt.Sprintf("Invalid C2PA manifest: %s %s", status.Code, status.Explanation), http.StatusUnprocessableEntity)
+	}
+	return nil
+}
+
+// run executes the C2PA tool, returning its standard output
+func (c *C2PA) run(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Tool, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("c2pa: %s", msg)
+		}
+		return nil, fmt.Errorf("c2pa: %s", err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeC2PATool emulates the C2PA tool: signing appends the manifest to the
+// image, reading reports the manifests found in the image
+const fakeC2PATool = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args"
+input=$1
+shift
+while [ $# -gt 0 ]; do
+	case $1 in
+		-m) manifest=$2; shift;;
+		-o) output=$2; shift;;
+	esac
+	shift
+done
+if [ -n "$output" ]; then
+	cat "$input" "$manifest" > "$output"
+	exit 0
+fi
+if grep -q INVALID "$input"; then
+	echo '{"validation_status":[{"code":"assertion.dataHash.mismatch","explanation":"hash mismatch"}]}'
+	exit 0
+fi
+if grep -q claim_generator "$input"; then
+	echo '{"active_manifest":"urn:uuid:1"}'
+	exit 0
+fi
+echo "Error: No claim found" >&2
+exit 1
+`
+
+func newFakeC2PATool(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires a POSIX shell")
+	}
+	tool := filepath.Join(t.TempDir(), "c2patool")
+	if err := ioutil.WriteFile(tool, []byte(fakeC2PATool), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return tool
+}
+
+func TestNewC2PA(t *testing.T) {
+	tool := newFakeC2PATool(t)
+
+	if _, err := newC2PA(tool, "testdata/server.crt", "", "es256", "", false); err == nil {
+		t.Error("Expected error when the signing key is missing")
+	}
+	if _, err := newC2PA(filepath.Join(t.TempDir(), "missing"), "", "", "es256", "", true); err == nil {
+		t.Error("Expected error when the tool is missing")
+	}
+	if _, err := newC2PA(tool, "testdata/missing.pem", "testdata/missing.pem", "es256", "", false); err == nil {
+		t.Error("Expected error when the signing credentials are missing")
+	}
+
+	c, err := newC2PA(tool, "testdata/server.crt", "testdata/server.key", "es256", "", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !filepath.IsAbs(c.CertFile) || !filepath.IsAbs(c.KeyFile) || !c.CanSign() {
+		t.Errorf("Invalid signing credentials: %s %s", c.CertFile, c.KeyFile)
+	}
+}
+
+func TestC2PASign(t *testing.T) {
+	tool := newFakeC2PATool(t)
+	c := &C2PA{Tool: tool, CertFile: "/certs/cert.pem", KeyFile: "/certs/key.pem", Algorithm: "es256"}
+	source := readTestFile(t, "imaginary.jpg")
+	output := readTestFile(t, "large.jpg")
+
+	signed, err := c.Sign(context.Background(), source, Image{Body: output, Mime: "image/jpeg"}, "resize")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.HasPrefix(signed, output) {
+		t.Fatal("Invalid signed image")
+	}
+	manifest := string(signed[len(output):])
+	for _, expected := range []string{`"alg":"es256"`, `"sign_cert":"/certs/cert.pem"`, `"private_key":"/certs/key.pem"`, `"action":"c2pa.resized"`} {
+		if !strings.Contains(manifest, expected) {
+			t.Errorf("Manifest should contain %s: %s", expected, manifest)
+		}
+	}
+
+	args, _ := ioutil.ReadFile(filepath.Join(filepath.Dir(tool), "args"))
+	if !strings.Contains(string(args), "-p ") || !strings.Contains(string(args), "parent.jpg") {
+		t.Errorf("The source image should be the parent ingredient: %s", args)
+	}
+
+	// Unsupported formats are returned unchanged
+	body := []byte(`{"width":100}`)
+	if signed, err := c.Sign(context.Background(), source, Image{Body: body, Mime: "application/json"}, "info"); err != nil || !bytes.Equal(signed, body) {
+		t.Errorf("Unsupported formats should not be signed: %v %s", err, signed)
+	}
+}
+
+func TestC2PAVerify(t *testing.T) {
+	c := &C2PA{Tool: newFakeC2PATool(t), Validate: true}
+	buf := readTestFile(t, "imaginary.jpg")
+
+	if err := c.Verify(context.Background(), buf); err != nil {
+		t.Errorf("Images without manifest should be valid: %s", err)
+	}
+	if err := c.Verify(context.Background(), append(buf, []byte(`{"claim_generator":"test"}`)...)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	err := c.Verify(context.Background(), append(buf, []byte("INVALID")...))
+	if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusUnprocessableEntity || !strings.Contains(xerr.Message, "assertion.dataHash.mismatch") {
+		t.Errorf("Expected invalid manifest error, got %v", err)
+	}
+
+	c.Tool = filepath.Join(t.TempDir(), "missing")
+	if err := c.Verify(context.Background(), buf); err == nil {
+		t.Error("Expected error when the tool fails")
+	}
+}
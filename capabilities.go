@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// serverCapabilities returns the server capabilities, probing the image
+// formats supported by the libvips build
+func serverCapabilities(o ServerOptions) Capabilities {
+	return Capabilities{
+		Versions:      Versions{Version, bimg.Version, bimg.VipsVersion},
+		Commit:        Commit,
+		BuildDate:     BuildDate,
+		InputFormats:  supportedFormats(o.AllowedInputTypes, false),
+		OutputFormats: supportedFormats(o.AllowedOutputTypes, true),
+		Sources:       enabledSources(o),
+		Endpoints:     enabledEndpoints(o),
+	}
+}
+
+// supportedFormats returns the allowed image formats libvips can load or save
+func supportedFormats(allowed ImageTypes, save bool) []string {
+	formats := []string{}
+	for _, name := range imageFormats {
+		imageType := ImageType(name)
+		support := bimg.IsImageTypeSupportedByVips(imageType)
+		if allowed.Allows(imageType) && ((save && support.Save) || (!save && support.Load)) {
+			formats = append(formats, name)
+		}
+	}
+	return formats
+}
+
+// enabledSources returns the image sources enabled by the server options
+func enabledSources(o ServerOptions) []string {
+	sources := []string{string(ImageSourceTypeBody)}
+	if hasMounts(o) {
+		sources = append(sources, string(ImageSourceTypeFileSystem))
+	}
+	if o.EnableURLSource {
+		sources = append(sources, string(ImageSourceTypeHTTP))
+	}
+	return sources
+}
+
+// enabledEndpoints returns the sorted endpoint names enabled by the server
+// options
+func enabledEndpoints(o ServerOptions) []string {
+	endpoints := []string{}
+	for _, name := range endpointNames() {
+		if (name != "progress" || o.Progress != nil) && (name != "form" || !o.DisableForm) && isEndpointEnabled(name, o) {
+			endpoints = append(endpoints, name)
+		}
+	}
+	return endpoints
+}
+
+// endpointNames returns the sorted names of every endpoint, except the index
+func endpointNames() []string {
+	names := []string{"form", "health", "progress", "qr"}
+	for route := range imageEndpoints {
+		names = append(names, strings.TrimPrefix(route, "/"))
+	}
+	sort.Strings(names)
+	return names
+}
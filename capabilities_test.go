@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestServerCapabilities(t *testing.T) {
+	opts := ServerOptions{
+		PathPrefix:         "/",
+		EnableURLSource:    true,
+		Endpoints:          Endpoints{"form", "crop", "pipeline"},
+		AllowedInputTypes:  ImageTypes{bimg.JPEG, bimg.PNG},
+		AllowedOutputTypes: ImageTypes{bimg.JPEG, bimg.PDF},
+	}
+	ts := testServer(indexController(opts))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var capabilities Capabilities
+	if err := json.NewDecoder(res.Body).Decode(&capabilities); err != nil {
+		t.Fatal(err)
+	}
+
+	if capabilities.ImaginaryVersion != Version || capabilities.VipsVersion != bimg.VipsVersion {
+		t.Errorf("Invalid versions: %+v", capabilities.Versions)
+	}
+	if !reflect.DeepEqual(capabilities.InputFormats, []string{"jpeg", "png"}) {
+		t.Errorf("Invalid input formats: %v", capabilities.InputFormats)
+	}
+	// libvips can't save PDFs
+	if !reflect.DeepEqual(capabilities.OutputFormats, []string{"jpeg"}) {
+		t.Errorf("Invalid output formats: %v", capabilities.OutputFormats)
+	}
+	if !reflect.DeepEqual(capabilities.Sources, []string{"payload", "http"}) {
+		t.Errorf("Invalid sources: %v", capabilities.Sources)
+	}
+
+	endpoints := map[string]bool{}
+	for _, endpoint := range capabilities.Endpoints {
+		endpoints[endpoint] = true
+	}
+	for _, endpoint := range []string{"resize", "health", "qr", "palette"} {
+		if !endpoints[endpoint] {
+			t.Errorf("Endpoint %s should be enabled: %v", endpoint, capabilities.Endpoints)
+		}
+	}
+	for _, endpoint := range []string{"form", "crop", "pipeline", "progress"} {
+		if endpoints[endpoint] {
+			t.Errorf("Endpoint %s should not be enabled: %v", endpoint, capabilities.Endpoints)
+		}
+	}
+}
+
+func TestEnabledSources(t *testing.T) {
+	sources := enabledSources(ServerOptions{Mount: "/images"})
+	if !reflect.DeepEqual(sources, []string{"payload", "fs"}) {
+		t.Errorf("Invalid sources: %v", sources)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is the cgroups v2 unified hierarchy mount point
+const cgroupRoot = "/sys/fs/cgroup"
+
+// workerMemory is the memory budgeted per concurrent image transformation
+// when deriving the workers from the container memory limit
+const workerMemory = 256 * 1024 * 1024
+
+// ResourceLimits represents the CPU and memory available to the process,
+// as limited by the container cgroup, if any
+type ResourceLimits struct {
+	CPUs    float64
+	Memory  uint64
+	Limited bool
+}
+
+// detectResourceLimits reads the cgroups v2 limits of the process, falling
+// back to the host CPUs and unlimited memory
+func detectResourceLimits() ResourceLimits {
+	return readResourceLimits(cgroupRoot)
+}
+
+func readResourceLimits(root string) ResourceLimits {
+	limits := ResourceLimits{CPUs: float64(runtime.NumCPU())}
+	if buf, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		if cpus := parseCgroupCPUMax(string(buf)); cpus > 0 && cpus < limits.CPUs {
+			limits.CPUs, limits.Limited = cpus, true
+		}
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(root, "memory.max")); err == nil {
+		if memory := parseCgroupMemoryMax(string(buf)); memory > 0 {
+			limits.Memory, limits.Limited = memory, true
+		}
+	}
+	return limits
+}
+
+// parseCgroupCPUMax parses the cpu.max quota and period, such as
+// "150000 100000" for 1.5 CPUs, returning 0 if unlimited
+func parseCgroupCPUMax(value string) float64 {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// parseCgroupMemoryMax parses the memory.max bytes, returning 0 if unlimited
+func parseCgroupMemoryMax(value string) uint64 {
+	memory, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return memory
+}
+
+// Procs returns the CPUs used by the Go runtime, rounding up fractional quotas
+func (l ResourceLimits) Procs() int {
+	if procs := int(math.Ceil(l.CPUs)); procs > 1 {
+		return procs
+	}
+	return 1
+}
+
+// Workers returns the concurrent image transformations fitting the limits:
+// one per CPU, and at most one per 256 MB of memory
+func (l ResourceLimits) Workers() int {
+	workers := l.Procs()
+	if l.Memory > 0 {
+		if byMemory := int(l.Memory / workerMemory); byMemory < workers {
+			workers = byMemory
+		}
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+// VipsConcurrency returns the libvips threads per image transformation, so
+// the concurrent transformations share the CPUs. Unlimited workers use one
+// thread each, as by default.
+func (l ResourceLimits) VipsConcurrency(workers int) int {
+	if workers < 1 {
+		return 1
+	}
+	if threads := l.Procs() / workers; threads > 1 {
+		return threads
+	}
+	return 1
+}
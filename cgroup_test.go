@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseCgroupLimits(t *testing.T) {
+	cpus := map[string]float64{"max 100000": 0, "150000 100000\n": 1.5, "200000 100000": 2, "invalid": 0, "100000 0": 0}
+	for value, expected := range cpus {
+		if got := parseCgroupCPUMax(value); got != expected {
+			t.Errorf("cpu.max %q: expected %v, got %v", value, expected, got)
+		}
+	}
+
+	memory := map[string]uint64{"max\n": 0, "1073741824\n": 1073741824, "": 0}
+	for value, expected := range memory {
+		if got := parseCgroupMemoryMax(value); got != expected {
+			t.Errorf("memory.max %q: expected %v, got %v", value, expected, got)
+		}
+	}
+}
+
+func TestReadResourceLimits(t *testing.T) {
+	dir := t.TempDir()
+	if limits := readResourceLimits(dir); limits.Limited || limits.CPUs != float64(runtime.NumCPU()) {
+		t.Errorf("Expected unlimited resources, got: %+v", limits)
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte("50000 100000\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte("536870912\n"), 0644)
+	limits := readResourceLimits(dir)
+	if !limits.Limited || limits.CPUs != 0.5 || limits.Memory != 536870912 || limits.Procs() != 1 {
+		t.Errorf("Invalid resource limits: %+v", limits)
+	}
+}
+
+func TestResourceLimitsWorkers(t *testing.T) {
+	cases := []struct {
+		limits  ResourceLimits
+		workers int
+		threads int
+	}{
+		{ResourceLimits{CPUs: 4}, 4, 1},
+		{ResourceLimits{CPUs: 2.5}, 3, 1},
+		{ResourceLimits{CPUs: 8, Memory: 512 * 1024 * 1024}, 2, 4},
+		{ResourceLimits{CPUs: 1, Memory: 64 * 1024 * 1024}, 1, 1},
+	}
+	for _, c := range cases {
+		workers := c.limits.Workers()
+		if threads := c.limits.VipsConcurrency(workers); workers != c.workers || threads != c.threads {
+			t.Errorf("%+v: expected %d workers of %d threads, got %d of %d", c.limits, c.workers, c.threads, workers, threads)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cliUsage = `Usage:
+  imaginary <operation> [-i <input>] [-o <output>] [param=value...]
+
+Runs an image operation against a local file or stdin without starting the
+HTTP server. The params are the same as the HTTP API query params.
+
+Options:
+  -i <path>    Input image file path, or - to read from stdin [default: -]
+  -o <path>    Output file path, or - to write to stdout [default: -]
+
+Examples:
+  imaginary resize -i photo.jpg -o thumb.webp width=300
+  cat photo.jpg | imaginary convert type=png > photo.png
+  imaginary pipeline -i photo.jpg -o out.jpg operations='[{"operation":"crop","params":{"width":300}}]'
+  imaginary info -i photo.jpg
+`
+
+// cliOperation returns the operation run by the CLI command, if any
+func cliOperation(command string) (Operation, bool) {
+	if command == "" || strings.HasPrefix(command, "-") {
+		return nil, false
+	}
+	operation, ok := imageEndpoints["/"+strings.ToLower(command)]
+	return operation, ok
+}
+
+// runCLI runs the operation command against the input image, writing the
+// output image to the given output, mimicking the HTTP image controller
+func runCLI(command string, args []string, stdin io.Reader, stdout io.Writer) error {
+	operation, ok := cliOperation(command)
+	if !ok {
+		return fmt.Errorf("unknown operation: %s", command)
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	input := flags.String("i", "-", "")
+	output := flags.String("o", "-", "")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return errors.New(strings.TrimSuffix(cliUsage, "\n"))
+		}
+		return err
+	}
+
+	query, err := parseCLIParams(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	opts, err := buildParamsFromQuery(query)
+	if err != nil {
+		return fmt.Errorf("error while processing parameters: %w", err)
+	}
+	if err := resolveCLIType(&opts, *output); err != nil {
+		return err
+	}
+
+	buf, err := readCLIInput(*input, stdin)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return ErrEmptyBody
+	}
+	if !IsImageMimeTypeSupported(detectMimeType(buf)) {
+		return ErrUnsupportedMedia
+	}
+
+	image, err := operation.Run(buf, opts)
+	if err != nil {
+		return fmt.Errorf("error processing image: %w", err)
+	}
+
+	return writeCLIOutput(*output, stdout, image.Body)
+}
+
+// parseCLIParams parses the param=value arguments as URL query params
+func parseCLIParams(args []string) (url.Values, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid param, expected param=value: %s", arg)
+		}
+		query.Set(arg[:i], arg[i+1:])
+	}
+	return query, nil
+}
+
+// resolveCLIType validates the output type, inferring it from the output file
+// extension when missing or set to auto, as there is no Accept header to
+// negotiate it from
+func resolveCLIType(opts *ImageOptions, output string) error {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(output)), ".")
+	if output == "-" || ImageType(ext) == 0 {
+		ext = ""
+	}
+
+	if pipelineHasAutoType(*opts) {
+		if ext == "" {
+			return errors.New("type=auto requires an output file with an image extension")
+		}
+		resolvePipelineAutoType(*opts, ext)
+	}
+
+	switch {
+	case opts.Type == "auto" && ext == "":
+		return errors.New("type=auto requires an output file with an image extension")
+	case opts.Type == "auto", opts.Type == "":
+		opts.Type = ext
+	case ImageType(opts.Type) == 0:
+		return ErrOutputFormat
+	}
+	return nil
+}
+
+func readCLIInput(input string, stdin io.Reader) ([]byte, error) {
+	if input == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(input)
+}
+
+func writeCLIOutput(output string, stdout io.Writer, body []byte) error {
+	if output == "-" {
+		_, err := stdout.Write(body)
+		return err
+	}
+	return os.WriteFile(output, body, 0644)
+}
+
+// runCLICommand runs the CLI command and exits if the first argument is an
+// image operation, otherwise the HTTP server is started as usual
+func runCLICommand() {
+	if len(os.Args) < 2 {
+		return
+	}
+	if _, ok := cliOperation(os.Args[1]); !ok {
+		return
+	}
+
+	if err := runCLI(os.Args[1], os.Args[2:], os.Stdin, os.Stdout); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
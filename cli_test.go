@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCLI(t *testing.T) {
+	var received ImageOptions
+	imageEndpoints["/record"] = func(buf []byte, o ImageOptions) (Image, error) {
+		received = o
+		return Image{Body: []byte("output"), Mime: "image/png"}, nil
+	}
+	defer delete(imageEndpoints, "/record")
+
+	output := filepath.Join(t.TempDir(), "out.png")
+	err := runCLI("record", []string{"-i", "testdata/imaginary.jpg", "-o", output, "width=300", "height=200"}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if received.Width != 300 || received.Height != 200 {
+		t.Errorf("Invalid params: %dx%d", received.Width, received.Height)
+	}
+	if received.Type != "png" {
+		t.Errorf("Type should be inferred from the output extension, got %q", received.Type)
+	}
+	if buf, _ := ioutil.ReadFile(output); string(buf) != "output" {
+		t.Errorf("Invalid output file: %q", buf)
+	}
+
+	// Standard input and output
+	var stdout bytes.Buffer
+	err = runCLI("record", []string{"type=webp"}, bytes.NewReader(readTestFile(t, "imaginary.jpg")), &stdout)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if received.Type != "webp" || stdout.String() != "output" {
+		t.Errorf("Invalid stdout output %q with type %q", stdout.String(), received.Type)
+	}
+}
+
+func TestRunCLIErrors(t *testing.T) {
+	input := readTestFile(t, "imaginary.jpg")
+
+	cases := []struct {
+		name    string
+		command string
+		args    []string
+		stdin   []byte
+	}{
+		{"unknown operation", "unknown", nil, input},
+		{"invalid param", "resize", []string{"width"}, input},
+		{"invalid param value", "resize", []string{"width=foo"}, input},
+		{"invalid type", "resize", []string{"type=foo"}, input},
+		{"auto type to stdout", "resize", []string{"type=auto"}, input},
+		{"empty input", "resize", []string{"width=300"}, nil},
+		{"unsupported input", "resize", []string{"width=300"}, []byte("not an image")},
+		{"missing input file", "resize", []string{"-i", "testdata/missing.jpg"}, nil},
+	}
+
+	for _, tc := range cases {
+		var stdout bytes.Buffer
+		if err := runCLI(tc.command, tc.args, bytes.NewReader(tc.stdin), &stdout); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("%s: unexpected output", tc.name)
+		}
+	}
+}
+
+func TestCLIOperation(t *testing.T) {
+	for _, command := range []string{"resize", "convert", "pipeline", "info", "watermarkImage"} {
+		if _, ok := cliOperation(command); !ok {
+			t.Errorf("Command %q should be supported", command)
+		}
+	}
+	for _, command := range []string{"", "-p", "health", "form"} {
+		if _, ok := cliOperation(command); ok {
+			t.Errorf("Command %q should not be supported", command)
+		}
+	}
+}
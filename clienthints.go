@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxClientHintsDPR caps the device pixel ratio honored from client hints
+	maxClientHintsDPR = 4.0
+
+	// saveDataQuality is the maximum output quality when Save-Data is requested
+	saveDataQuality = 50
+)
+
+// clientHintsHeaders are the request headers advertised via Accept-CH
+var clientHintsHeaders = []string{"Sec-CH-Width", "Sec-CH-DPR"}
+
+// ClientHints holds the responsive image hints sent by the client
+type ClientHints struct {
+	Width    int
+	DPR      float64
+	SaveData bool
+}
+
+// readClientHints parses the client hints headers, ignoring invalid values
+func readClientHints(r *http.Request) ClientHints {
+	var hints ClientHints
+
+	if width, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("Sec-CH-Width"))); err == nil && width > 0 {
+		hints.Width = width
+	}
+
+	if dpr, err := strconv.ParseFloat(strings.TrimSpace(r.Header.Get("Sec-CH-DPR")), 64); err == nil && dpr > 0 {
+		hints.DPR = math.Min(dpr, maxClientHintsDPR)
+	}
+
+	hints.SaveData = strings.EqualFold(strings.TrimSpace(r.Header.Get("Save-Data")), "on")
+	return hints
+}
+
+// Apply scales the requested dimensions and lowers the quality according to
+// the hints, returning the device pixel ratio applied to the output.
+//
+// Sec-CH-Width is expressed in physical pixels, so it's only used when the
+// request doesn't define any dimension. Otherwise the requested dimensions
+// are considered CSS pixels and multiplied by the DPR.
+func (h ClientHints) Apply(o *ImageOptions) float64 {
+	dpr := 1.0
+
+	if o.Width == 0 && o.Height == 0 && h.Width > 0 {
+		o.Width = h.Width
+		if h.DPR > 0 {
+			dpr = h.DPR
+		}
+	} else if h.DPR > 0 && h.DPR != 1 {
+		dpr = h.DPR
+		o.Width = int(math.Round(float64(o.Width) * dpr))
+		o.Height = int(math.Round(float64(o.Height) * dpr))
+	}
+
+	if h.SaveData && !o.AutoQuality && (o.Quality == 0 || o.Quality > saveDataQuality) {
+		o.Quality = saveDataQuality
+	}
+
+	return dpr
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReadClientHints(t *testing.T) {
+	cases := []struct {
+		headers  map[string]string
+		expected ClientHints
+	}{
+		{map[string]string{}, ClientHints{}},
+		{map[string]string{"Sec-CH-Width": "640", "Sec-CH-DPR": "2"}, ClientHints{Width: 640, DPR: 2}},
+		{map[string]string{"Sec-CH-Width": "-10", "Sec-CH-DPR": "foo"}, ClientHints{}},
+		{map[string]string{"Sec-CH-DPR": "10"}, ClientHints{DPR: maxClientHintsDPR}},
+		{map[string]string{"Save-Data": "on"}, ClientHints{SaveData: true}},
+	}
+
+	for _, test := range cases {
+		r, _ := http.NewRequest(http.MethodGet, "http://localhost/resize", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+
+		if hints := readClientHints(r); hints != test.expected {
+			t.Errorf("Invalid client hints for %v: %+v", test.headers, hints)
+		}
+	}
+}
+
+func TestClientHintsApply(t *testing.T) {
+	cases := []struct {
+		hints   ClientHints
+		opts    ImageOptions
+		width   int
+		height  int
+		quality int
+		dpr     float64
+	}{
+		{ClientHints{}, ImageOptions{Width: 300}, 300, 0, 0, 1},
+		{ClientHints{Width: 640, DPR: 2}, ImageOptions{}, 640, 0, 0, 2},
+		{ClientHints{Width: 640, DPR: 2}, ImageOptions{Width: 300, Height: 200}, 600, 400, 0, 2},
+		{ClientHints{DPR: 1.5}, ImageOptions{Height: 100}, 0, 150, 0, 1.5},
+		{ClientHints{SaveData: true}, ImageOptions{Width: 300}, 300, 0, saveDataQuality, 1},
+		{ClientHints{SaveData: true}, ImageOptions{Width: 300, Quality: 30}, 300, 0, 30, 1},
+	}
+
+	for i, test := range cases {
+		opts := test.opts
+		dpr := test.hints.Apply(&opts)
+
+		if opts.Width != test.width || opts.Height != test.height {
+			t.Errorf("Case %d: invalid dimensions %dx%d", i, opts.Width, opts.Height)
+		}
+		if opts.Quality != test.quality {
+			t.Errorf("Case %d: invalid quality %d", i, opts.Quality)
+		}
+		if dpr != test.dpr {
+			t.Errorf("Case %d: invalid DPR %f", i, dpr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notModified sets the Last-Modified and ETag headers of the source image
+// modification time, combined with the request path, params and negotiation
+// headers, and replies 304 Not Modified if the conditional request headers
+// match them, so unchanged images aren't read nor transformed again.
+// If-None-Match takes precedence over If-Modified-Since.
+func notModified(w http.ResponseWriter, r *http.Request, modTime time.Time, o ServerOptions) bool {
+	etag := responseETag(r, modTime, o)
+	modTime = modTime.UTC().Truncate(time.Second)
+
+	header := w.Header()
+	header.Set("Last-Modified", modTime.Format(http.TimeFormat))
+	header.Set("ETag", etag)
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modTime.After(since) {
+		return false
+	}
+
+	setNegotiationHeaders(w, r, o)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// responseETag returns the weak entity tag of the transformed image, hashing
+// the source image modification time, the request path and params, and the
+// request headers the response varies on
+func responseETag(r *http.Request, modTime time.Time, o ServerOptions) string {
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(modTime.UnixNano(), 10)))
+	h.Write([]byte("\n" + r.URL.Path + "\n" + r.URL.Query().Encode()))
+	for _, name := range varyHeaders(r, o) {
+		h.Write([]byte("\n" + name + ": " + r.Header.Get(name)))
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether any of the If-None-Match entity tags matches
+// the given one, using the weak comparison
+func etagMatches(match, etag string) bool {
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 500, time.UTC)
+	r := httptest.NewRequest(http.MethodGet, "/resize?file=image.jpg&width=300", nil)
+	etag := responseETag(r, modTime, ServerOptions{})
+
+	cases := []struct {
+		name     string
+		headers  map[string]string
+		expected bool
+	}{
+		{"unconditional", nil, false},
+		{"not modified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 10:00:00 GMT"}, true},
+		{"modified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 09:59:59 GMT"}, false},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"matching etag", map[string]string{"If-None-Match": `"other", ` + etag}, true},
+		{"strong etag", map[string]string{"If-None-Match": etag[2:]}, true},
+		{"any etag", map[string]string{"If-None-Match": "*"}, true},
+		{"etag precedence", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Wed, 01 May 2024 10:00:00 GMT"}, false},
+	}
+
+	for _, c := range cases {
+		req := r.Clone(r.Context())
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		if notModified(w, req, modTime, ServerOptions{}) != c.expected {
+			t.Errorf("%s: expected not modified %t", c.name, c.expected)
+		}
+		if c.expected && w.Code != http.StatusNotModified {
+			t.Errorf("%s: invalid response status: %d", c.name, w.Code)
+		}
+		if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != "Wed, 01 May 2024 10:00:00 GMT" {
+			t.Errorf("%s: invalid validators: %v", c.name, w.Header())
+		}
+	}
+}
+
+func TestResponseETag(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	etag := func(target, accept string, modTime time.Time) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", accept)
+		return responseETag(r, modTime, ServerOptions{})
+	}
+
+	base := etag("/resize?file=image.jpg&width=300", "image/webp", modTime)
+	if etag("/resize?width=300&file=image.jpg", "image/avif", modTime) != base {
+		t.Error("Entity tag must not depend on the params order, nor unused headers")
+	}
+	if etag("/resize?file=image.jpg&width=400", "image/webp", modTime) == base {
+		t.Error("Entity tag must depend on the params")
+	}
+	if etag("/crop?file=image.jpg&width=300", "image/webp", modTime) == base {
+		t.Error("Entity tag must depend on the endpoint")
+	}
+	if etag("/resize?file=image.jpg&width=300", "image/webp", modTime.Add(time.Millisecond)) == base {
+		t.Error("Entity tag must depend on the modification time")
+	}
+
+	auto := etag("/resize?file=image.jpg&type=auto", "image/webp", modTime)
+	if etag("/resize?file=image.jpg&type=auto", "image/avif", modTime) == auto {
+		t.Error("Entity tag must depend on the negotiated headers")
+	}
+}
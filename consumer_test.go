@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsumerJobTarget(t *testing.T) {
+	o := ServerOptions{PathPrefix: "/"}
+	cases := []struct {
+		job    ConsumerJob
+		path   string
+		params url.Values
+	}{
+		{
+			ConsumerJob{Source: "https://cdn.shop.com/a.jpg", Operation: "resize", Params: map[string]interface{}{"width": float64(300), "force": true}},
+			"/resize", url.Values{"url": {"https://cdn.shop.com/a.jpg"}, "width": {"300"}, "force": {"true"}},
+		},
+		{
+			ConsumerJob{Source: "products/a.jpg", Operations: []byte(`[{"operation":"flip"}]`)},
+			"/pipeline", url.Values{"file": {"products/a.jpg"}, "operations": {`[{"operation":"flip"}]`}},
+		},
+	}
+
+	for _, tc := range cases {
+		target, err := tc.job.target(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(target)
+		if u.Path != tc.path || u.Query().Encode() != tc.params.Encode() {
+			t.Errorf("Invalid job target: %s", target)
+		}
+	}
+
+	for _, job := range []ConsumerJob{{Source: "a.jpg"}, {Source: "a.jpg", Operation: "unknown"}, {Operation: "resize"}} {
+		if _, err := job.target(o); err == nil {
+			t.Errorf("%+v: expected error", job)
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("width") {
+		case "400":
+			ErrorReply(r, w, ErrImageNotFound, ServerOptions{})
+		case "503":
+			ErrorReply(r, w, ErrOverloaded, ServerOptions{})
+		default:
+			w.Header().Set("Content-Type", "image/webp")
+			w.Write([]byte("webp image"))
+		}
+	})
+	dir := t.TempDir()
+	c := ConsumerOptions{Output: dir}
+
+	if err := runJob([]byte(`{"source": "a.jpg", "operation": "resize", "params": {"width": 100}, "destination": "thumbs/a.webp"}`), mux, c, ServerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(filepath.Join(dir, "thumbs", "a.webp")); err != nil || string(buf) != "webp image" {
+		t.Errorf("Invalid job output: %s %v", buf, err)
+	}
+
+	cases := []struct {
+		job       string
+		permanent bool
+	}{
+		{`{`, true},
+		{`{"source": "a.jpg", "operation": "resize"}`, true},
+		{`{"source": "a.jpg", "operation": "resize", "params": {"width": 400}, "destination": "a.webp"}`, true},
+		{`{"source": "a.jpg", "operation": "resize", "params": {"width": 503}, "destination": "a.webp"}`, false},
+	}
+	for _, tc := range cases {
+		err := runJob([]byte(tc.job), mux, c, ServerOptions{})
+		jerr, ok := err.(jobError)
+		if err == nil || (ok && jerr.permanent) != tc.permanent {
+			t.Errorf("%s: expected permanent=%t error, got %v", tc.job, tc.permanent, err)
+		}
+	}
+
+	// Parent directory references stay within the output directory
+	if err := runJob([]byte(`{"source": "a.jpg", "operation": "resize", "destination": "../a.webp"}`), mux, c, ServerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.webp")); err != nil {
+		t.Errorf("Escaped job output: %s", err)
+	}
+
+	// Remote destinations are uploaded via PUT
+	var uploaded []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "image/webp" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploaded, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+	if err := runJob([]byte(`{"source": "a.jpg", "operation": "resize", "destination": "`+ts.URL+`/a.webp"}`), mux, ConsumerOptions{}, ServerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if string(uploaded) != "webp image" {
+		t.Errorf("Invalid uploaded image: %s", uploaded)
+	}
+}
@@ -2,26 +2,45 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/h2non/bimg"
 	"github.com/h2non/filetype"
+	"io"
+	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// Index endpoint modes, defined by the -index-mode flag
+const (
+	IndexModeFull    = "full"
+	IndexModeMinimal = "minimal"
+	IndexModeNone    = "none"
 )
 
 // indexController handles the root endpoint, returning version information
+// and the server capabilities, or only the service name in minimal mode
 func indexController(o ServerOptions) http.HandlerFunc {
+	var index interface{} = serverCapabilities(o)
+	if o.IndexMode == IndexModeMinimal {
+		index = map[string]string{"service": "imaginary"}
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != path.Join(o.PathPrefix, "/") {
+		if r.URL.Path != path.Join(o.PathPrefix, "/") || o.IndexMode == IndexModeNone {
 			ErrorReply(r, w, ErrNotFound, ServerOptions{})
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(Versions{Version, bimg.Version, bimg.VipsVersion})
+		json.NewEncoder(w).Encode(index)
 	}
 }
 
@@ -31,31 +50,219 @@ func healthController(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(GetHealthStats())
 }
 
+// livenessController replies the server is up, without checking its dependencies
+func livenessController(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": HealthOK})
+}
+
+// readinessController replies the readiness checks results, with 503 status
+// if any check failed or is degraded
+func readinessController(o ServerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := CheckReadiness(o)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if readiness.Status != HealthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
+
 // imageController processes image operations based on the source
 func imageController(o ServerOptions, operation Operation) http.HandlerFunc {
+	var fallbackSource ImageSource
+	if o.EnableURLSource {
+		fallbackSource = NewHTTPImageSource(newSourceConfig(o))
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		source := MatchSource(r)
+		o := o
+		if limits, ok := o.APIKeys[authorizedAPIKey(r)]; ok {
+			o = limits.Apply(o)
+		}
+
+		if o.Progress != nil && jobID(r) != "" {
+			pw := &progressWriter{ResponseWriter: w}
+			defer func() { publishProgress(r, o, ProgressEvent{Phase: ProgressDone, Status: pw.status}) }()
+			w = pw
+		}
+
+		source, sourceType := matchSource(r, o)
 		if source == nil {
 			ErrorReply(r, w, ErrMissingImageSource, o)
 			return
 		}
 
-		buf, err := source.GetImage(r)
-		if err != nil {
-			if xerr, ok := err.(Error); ok {
-				ErrorReply(r, w, xerr, o)
-			} else {
-				ErrorReply(r, w, NewError(err.Error(), http.StatusBadRequest), o)
+		if o.Policy != nil {
+			if err := o.Policy.CheckSource(path.Base(r.URL.Path), sourceType); err != nil {
+				o.AuditLog.Log(r, AuditPolicyViolation, "", err)
+				ErrorReply(r, w, err.(Error), o)
+				return
+			}
+		}
+
+		// Raw bodies declaring a larger size are rejected before reading them
+		if xerr, ok := declaredImageTooLarge(r, sourceType, o); ok {
+			o.AuditLog.Log(r, AuditImageTooLarge, "", xerr)
+			ErrorReply(r, w, xerr, o)
+			return
+		}
+		limitImageBody(r, sourceType, o)
+
+		if o.SpoolThreshold > 0 {
+			var release func()
+			r, release = withInputSpool(r)
+			defer release()
+		}
+
+		// Unchanged source images are neither read nor transformed again.
+		// Embedded files have no modification time.
+		if ms, ok := source.(ModTimeSource); ok {
+			if modTime, err := ms.ModTime(r); err == nil && !modTime.IsZero() && notModified(w, r, modTime, o) {
+				return
 			}
+		}
+
+		serve := func(w http.ResponseWriter, r *http.Request) {
+			serveImage(w, r, source, sourceType, fallbackSource, operation, o)
+		}
+
+		// Remote images responses are cached without fetching them again
+		if key, ok := responseCacheKey(r, sourceType, o); ok {
+			serveCachedResponse(w, r, key, serve, o)
 			return
 		}
+		serve(w, r)
+	}
+}
+
+// serveImage reads the source image and replies the transformed image
+func serveImage(w http.ResponseWriter, r *http.Request, source ImageSource, sourceType ImageSourceType, fallbackSource ImageSource, operation Operation, o ServerOptions) {
+	publishProgress(r, o, ProgressEvent{Phase: ProgressFetch})
+	start := time.Now()
+	buf, err := source.GetImage(r)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if isNotFound(err) && r.URL.Query().Get(fallbackParam) != "" {
+		// Keep the original error if the fallback image cannot be read either
+		fallback, ferr := fallbackImage(r, fallbackSource, o.Fallbacks)
+		if ferr == nil {
+			buf, err = fallback, nil
+		}
+		auditSourceError(r, o, fallbackParam, ferr)
+	}
+	addServerTiming(w, o, TimingFetch, time.Since(start))
+	if errors.Is(err, errImageBodyTooLarge) {
+		xerr := NewSizeError(ErrImageTooLarge, 0, int64(o.MaxAllowedSize))
+		o.AuditLog.Log(r, AuditImageTooLarge, "", xerr)
+		ErrorReply(r, w, xerr, o)
+		return
+	}
+	if err != nil {
+		auditSourceError(r, o, URLQueryKey, err)
+		ErrorReply(r, w, concealSourceError(r, sourceError(err)), o)
+		return
+	}
+
+	if len(buf) == 0 {
+		ErrorReply(r, w, ErrEmptyBody, o)
+		return
+	}
+
+	if o.MaxAllowedSize > 0 && len(buf) > o.MaxAllowedSize {
+		xerr := NewSizeError(ErrImageTooLarge, int64(len(buf)), int64(o.MaxAllowedSize))
+		o.AuditLog.Log(r, AuditImageTooLarge, "", xerr)
+		ErrorReply(r, w, xerr, o)
+		return
+	}
 
-		if len(buf) == 0 {
-			ErrorReply(r, w, ErrEmptyBody, o)
+	if o.BodySignatureKey != "" && sourceType == ImageSourceTypeBody {
+		if err := checkBodySignature(r, buf, o); err != nil {
+			ErrorReply(r, w, err.(Error), o)
 			return
 		}
+	}
+
+	imageHandler(w, r, buf, operation, o)
+}
+
+// declaredImageTooLarge checks the Content-Length of the raw request body
+// image against the allowed image size. Multipart bodies also include the
+// form fields, so their images are checked once read, still before decoding.
+func declaredImageTooLarge(r *http.Request, sourceType ImageSourceType, o ServerOptions) (Error, bool) {
+	if sourceType != ImageSourceTypeBody || o.MaxAllowedSize <= 0 || r.ContentLength <= int64(o.MaxAllowedSize) {
+		return Error{}, false
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), multipartPrefix) {
+		return Error{}, false
+	}
+	return NewSizeError(ErrImageTooLarge, r.ContentLength, int64(o.MaxAllowedSize)), true
+}
+
+// limitImageBody limits the raw request body image of unknown size, such as
+// chunked uploads, to the allowed image size while read, since it cannot be
+// checked upfront
+func limitImageBody(r *http.Request, sourceType ImageSourceType, o ServerOptions) {
+	if sourceType != ImageSourceTypeBody || o.MaxAllowedSize <= 0 || r.ContentLength >= 0 || r.Body == nil {
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), multipartPrefix) {
+		return
+	}
+	r.Body = &imageBodyReader{ReadCloser: r.Body, remaining: int64(o.MaxAllowedSize)}
+}
+
+// errImageBodyTooLarge is returned by the limited raw request body images
+// exceeding the allowed image size
+var errImageBodyTooLarge = errors.New("image body too large")
+
+// imageBodyReader fails once more than the remaining bytes are read
+type imageBodyReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *imageBodyReader) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errImageBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining -= int64(n); b.remaining < 0 {
+		return n, errImageBodyTooLarge
+	}
+	return n, err
+}
+
+// matchSource finds the source for the request, within the virtual host image
+// sources, if any, or the registered image sources
+func matchSource(r *http.Request, o ServerOptions) (ImageSource, ImageSourceType) {
+	if o.Sources != nil {
+		return o.Sources.Match(r)
+	}
+	source := MatchSource(r)
+	return source, SourceType(source)
+}
+
+// auditSourceError logs the image source errors caused by forbidden remote
+// origins or oversized images, given the param defining the image URL
+func auditSourceError(r *http.Request, o ServerOptions, param string, err error) {
+	if r.URL.Query().Get(param) == "" {
+		param = ""
+	}
 
-		imageHandler(w, r, buf, operation, o)
+	var xerr Error
+	switch {
+	case errors.Is(err, errForbiddenOrigin):
+		o.AuditLog.Log(r, AuditForbiddenOrigin, param, err)
+		o.Webhooks.Notify(r, WebhookSSRFBlocked, param, err)
+	case errors.As(err, &xerr) && xerr.Code == http.StatusRequestEntityTooLarge:
+		o.AuditLog.Log(r, AuditImageTooLarge, param, err)
 	}
 }
 
@@ -75,6 +282,105 @@ func determineAcceptMimeType(accept string) string {
 	return ""
 }
 
+// Normalized Accept classes used when -normalize-accept is enabled
+const (
+	AcceptAVIF   = "avif"
+	AcceptWebP   = "webp"
+	AcceptLegacy = "legacy"
+)
+
+// normalizeAccept reduces the Accept header to the best modern image format
+// explicitly accepted by the client, so caches store at most three variants.
+func normalizeAccept(accept string) string {
+	var avif, webp bool
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(v)
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+
+		switch mediaType {
+		case "image/avif":
+			avif = true
+		case "image/webp":
+			webp = true
+		}
+	}
+
+	switch {
+	case avif:
+		return AcceptAVIF
+	case webp:
+		return AcceptWebP
+	default:
+		return AcceptLegacy
+	}
+}
+
+// negotiateType returns the output image type preferred by the client.
+// An empty type means the original image type must be kept.
+func negotiateType(w http.ResponseWriter, r *http.Request, o ServerOptions) string {
+	if !o.NormalizeAccept {
+		imageType := determineAcceptMimeType(r.Header.Get("Accept"))
+		if !o.AllowedOutputTypes.Allows(ImageType(imageType)) {
+			return ""
+		}
+		return imageType
+	}
+
+	class := normalizeAccept(r.Header.Get("Accept"))
+	if class != AcceptLegacy && !o.AllowedOutputTypes.Allows(ImageType(class)) {
+		class = AcceptLegacy
+	}
+	w.Header().Set("Normalized-Accept", class)
+	if class == AcceptLegacy {
+		return ""
+	}
+	return class
+}
+
+// queryHasAutoType reports whether the request query uses type=auto,
+// including pipeline operations params
+func queryHasAutoType(query url.Values) bool {
+	if query.Get("type") == "auto" {
+		return true
+	}
+	if query.Get("operations") == "" && query.Get("branches") == "" {
+		return false
+	}
+
+	operations, _ := parseJSONOperations(query.Get("operations"))
+	branches, _ := parseJSONBranches(query.Get("branches"))
+	return pipelineHasAutoType(ImageOptions{Operations: operations, Branches: branches})
+}
+
+// varyHeaders returns the request headers the response varies on
+func varyHeaders(r *http.Request, o ServerOptions) []string {
+	var headers []string
+	if queryHasAutoType(r.URL.Query()) {
+		headers = append(headers, "Accept")
+	}
+	if o.EnableClientHints {
+		headers = append(headers, clientHintsHeaders...)
+		headers = append(headers, "Save-Data")
+	}
+	return headers
+}
+
+// setNegotiationHeaders sets stable Vary and Accept-CH headers, regardless of
+// the response outcome
+func setNegotiationHeaders(w http.ResponseWriter, r *http.Request, o ServerOptions) {
+	if headers := varyHeaders(r, o); len(headers) > 0 {
+		w.Header().Set("Vary", strings.Join(headers, ", "))
+	}
+	if o.EnableClientHints {
+		w.Header().Set("Accept-CH", strings.Join(clientHintsHeaders, ", "))
+	}
+}
+
 // imageHandler processes and responds with the transformed image
 func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation Operation, o ServerOptions) {
 	mimeType := detectMimeType(buf)
@@ -83,42 +389,274 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		return
 	}
 
+	if err := checkInputImage(buf, mimeType, o); err != nil {
+		o.AuditLog.Log(r, AuditInputRejected, "", err)
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
 	opts, err := buildParamsFromQuery(r.URL.Query())
 	if err != nil {
-		ErrorReply(r, w, NewError("Error while processing parameters: "+err.Error(), http.StatusBadRequest), o)
+		ErrorReply(r, w, paramsError(err), o)
 		return
 	}
 
-	vary := ""
-	if opts.Type == "auto" {
-		opts.Type = determineAcceptMimeType(r.Header.Get("Accept"))
-		vary = "Accept"
+	files, err := readFormFiles(r)
+	if err != nil {
+		ErrorReply(r, w, NewError("Cannot read form files: "+err.Error(), http.StatusBadRequest), o)
+		return
+	}
+	opts = opts.WithContext(r.Context()).WithFiles(files).WithInputName(requestInputName(r)).WithLimits(imageLimits(o)).WithWorkers(o.WorkerPool)
+	if r.Method == http.MethodGet {
+		opts = opts.WithImageURL(requestImageURL(r, o))
+	}
+
+	if o.Policy != nil {
+		if err := checkPolicy(o.Policy, path.Base(r.URL.Path), r.URL.Query(), opts); err != nil {
+			o.AuditLog.Log(r, AuditPolicyViolation, "", err)
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+	}
+
+	if opts.Preset != "" {
+		preset, ok := o.PicturePresets[opts.Preset]
+		if !ok {
+			ErrorReply(r, w, ErrUnknownPreset, o)
+			return
+		}
+		opts = preset.Apply(opts)
+	}
+
+	if opts.AutoQuality {
+		opts.QualityTarget = o.AutoQualityTarget
+	}
+	if o.StripMetadata {
+		opts.StripMetadata = true
+	}
+	if o.DisableAutoRotate && !opts.IsDefinedField.NoRotation {
+		opts.NoRotation = true
+	}
+	if o.NoEnlarge && !opts.IsDefinedField.NoEnlarge {
+		opts.NoEnlarge = true
+	}
+
+	setNegotiationHeaders(w, r, o)
+
+	if o.EnableClientHints {
+		if dpr := readClientHints(r).Apply(&opts); dpr != 1 {
+			w.Header().Set("Content-DPR", strconv.FormatFloat(dpr, 'f', -1, 64))
+		}
+	}
+
+	if opts.Type == "auto" || pipelineHasAutoType(opts) {
+		autoType := autoOutputType(negotiateType(w, r, o), r.Header.Get("Accept"), buf, o.AllowedOutputTypes)
+		resolvePipelineAutoType(opts, autoType)
+		if opts.Type == "auto" {
+			opts.Type = autoType
+		}
 	} else if opts.Type != "" && ImageType(opts.Type) == 0 {
 		ErrorReply(r, w, ErrOutputFormat, o)
 		return
 	}
 
-	sizeInfo, err := bimg.Size(buf)
-	if err != nil {
-		ErrorReply(r, w, NewError("Error processing image: "+err.Error(), http.StatusBadRequest), o)
+	if !allowedOutputTypes(o.AllowedOutputTypes, opts) {
+		ErrorReply(r, w, ErrOutputFormatDenied, o)
 		return
 	}
 
-	if (float64(sizeInfo.Width) * float64(sizeInfo.Height) / 1000000) > o.MaxAllowedPixels {
-		ErrorReply(r, w, ErrResolutionTooBig, o)
+	publishProgress(r, o, ProgressEvent{Phase: ProgressDecode})
+	start := time.Now()
+	sizeInfo, err := validateImage(buf, imageLimits(o))
+	if err != nil {
+		switch err {
+		case ErrResolutionTooBig:
+			o.AuditLog.Log(r, AuditResolutionTooBig, "", err)
+		case ErrTooManyFrames:
+			o.AuditLog.Log(r, AuditInputRejected, "", err)
+		}
+		ErrorReply(r, w, err.(Error), o)
 		return
 	}
+	addServerTiming(w, o, TimingDecode, time.Since(start))
+
+	if o.C2PA != nil && o.C2PA.Validate {
+		if err := o.C2PA.Verify(r.Context(), buf); err != nil {
+			if xerr, ok := err.(Error); ok {
+				ErrorReply(r, w, xerr, o)
+			} else {
+				ErrorReply(r, w, NewError("Cannot validate C2PA manifest: "+err.Error(), http.StatusInternalServerError), o)
+			}
+			return
+		}
+	}
 
-	image, err := operation.Run(buf, opts)
+	publishProgress(r, o, ProgressEvent{Phase: ProgressTransform})
+	if o.Progress != nil && jobID(r) != "" {
+		opts = opts.WithProgress(func(step, total int) {
+			publishProgress(r, o, ProgressEvent{Phase: ProgressTransform, Step: step, Total: total})
+		})
+	}
+	var report *PipelineReport
+	if len(pipelineOperations(opts)) > 0 {
+		report = &PipelineReport{}
+		opts = opts.WithReport(report)
+	}
+
+	if hasFrameOptions(opts) {
+		operation = framesOperation(operation)
+	}
+
+	var elapsed time.Duration
+	var image Image
+	var cacheKey string
+	if o.Cache != nil && !opts.Debug {
+		cacheKey = diskCacheKey(r, buf, files, o)
+	}
+	if cached, ok := o.Cache.Get(cacheKey); ok {
+		image = cached
+		w.Header().Set(CacheStatusHeader, "HIT")
+	} else if isPassthrough(path.Base(r.URL.Path), r.URL.Query(), buf, sizeInfo, opts, o) {
+		image = Image{Body: buf, Mime: mimeType, Width: sizeInfo.Width, Height: sizeInfo.Height}
+	} else {
+		image, err = o.WorkerPool.Run(r.Context(), requestPriority(r, o), func(ctx context.Context) (Image, error) {
+			start := time.Now()
+			defer func() { elapsed = time.Since(start) }()
+			return o.TransformBudget.Run(operation, buf, opts.WithContext(ctx))
+		})
+		// Requests shed or cancelled before running aren't operations runs
+		if err != ErrOverloaded && !errors.Is(err, ErrClientClosedRequest) {
+			recordOperation(path.Base(r.URL.Path), elapsed, len(buf), len(image.Body), err)
+		}
+		if err == nil && cacheKey != "" {
+			if err := o.Cache.PutSource(cacheKey, sourceDigest(buf), image); err != nil {
+				log.Printf("cannot write the disk cache: %s", err)
+			}
+			w.Header().Set(CacheStatusHeader, "MISS")
+		}
+	}
+	addServerTiming(w, o, TimingTransform, elapsed)
+	if err == ErrOverloaded {
+		replyOverloaded(r, w, o)
+		return
+	}
+	if errors.Is(err, ErrClientClosedRequest) {
+		ErrorReply(r, w, ErrClientClosedRequest, o)
+		return
+	}
+	if err == ErrTransformTimeout || err == ErrTransformMemory {
+		log.Printf("%s: %s %s", err, r.URL.Path, truncate(r.URL.RawQuery, auditMaxValueSize))
+		o.AuditLog.Log(r, AuditBudgetExceeded, "", err)
+		o.Webhooks.Notify(r, WebhookProcessingFailed, "", err)
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
 	if err != nil {
-		if vary != "" {
-			w.Header().Set("Vary", vary)
+		xerr := operationError(err)
+		// Invalid params aren't processing failures
+		if xerr.Code != http.StatusBadRequest {
+			o.Webhooks.Notify(r, WebhookProcessingFailed, "", xerr)
+		}
+		replyPipelineError(r, w, xerr, report, o)
+		return
+	}
+	recordMegapixels(r, float64(sizeInfo.Width)*float64(sizeInfo.Height)/1000000)
+
+	// The output type defaults to the source image type
+	if imageType := ImageTypeFromMime(image.Mime); imageType != bimg.UNKNOWN && !o.AllowedOutputTypes.Allows(imageType) {
+		ErrorReply(r, w, ErrOutputFormatDenied, o)
+		return
+	}
+
+	if o.StripMetadata && len(o.StripMetadataKeep) > 0 && image.Mime != "application/json" {
+		image.Body = keepMetadata(buf, image.Body, o.StripMetadataKeep, opts.NoRotation)
+	}
+
+	if o.C2PA != nil && o.C2PA.CanSign() {
+		if image.Body, err = o.C2PA.Sign(r.Context(), buf, image, path.Base(r.URL.Path)); err != nil {
+			ErrorReply(r, w, NewError("Cannot sign image with C2PA manifest: "+err.Error(), http.StatusInternalServerError), o)
+			return
 		}
-		ErrorReply(r, w, NewError("Error processing image: "+err.Error(), http.StatusBadRequest), o)
+	}
+
+	if o.ReturnSize {
+		w.Header().Set("X-Operation-Time", strconv.FormatFloat(float64(elapsed)/float64(time.Millisecond), 'f', 3, 64))
+	}
+
+	setPipelineWarnings(w, report)
+	if opts.Debug && report != nil {
+		writePipelineReport(w, image, report, elapsed)
 		return
 	}
 
-	writeImageResponse(w, image, vary, o)
+	if opts.Format == ResponseFormatJSON && image.Mime != "application/json" {
+		writeImageEnvelope(w, image, elapsed)
+		return
+	}
+
+	writeImageResponse(w, image, o)
+}
+
+// requestImageURL returns a function building the URLs of other endpoints for
+// the source image of the GET request, overriding the request params with the
+// given ones, removed if empty. URLs are signed if URL signatures are enabled.
+func requestImageURL(r *http.Request, o ServerOptions) func(endpoint string, params map[string]string) string {
+	return func(endpoint string, params map[string]string) string {
+		query := r.URL.Query()
+		query.Del("sign")
+		for key, value := range params {
+			if value == "" {
+				query.Del(key)
+			} else {
+				query.Set(key, value)
+			}
+		}
+
+		// Encrypted source URLs are kept encrypted
+		if enc, ok := encryptedSourceURL(r); ok {
+			query.Del(URLQueryKey)
+			query.Set(encryptedURLParam, enc)
+		}
+
+		urlPath := path.Join(o.PathPrefix, endpoint)
+		if key, ok := urlSignatureKey(query, o); o.EnableURLSignature && ok {
+			query.Set("sign", base64.RawURLEncoding.EncodeToString(signURL(key, o.URLSignatureAlg, urlPath, query)))
+		}
+		return urlPath + "?" + query.Encode()
+	}
+}
+
+// checkPolicy validates the request params, including the pipeline operations
+// params, against the server policy
+func checkPolicy(policy Policy, endpoint string, query url.Values, opts ImageOptions) error {
+	if err := policy.CheckQuery(endpoint, query); err != nil {
+		return err
+	}
+	for _, operation := range pipelineOperations(opts) {
+		if err := policy.CheckParams(operation.Name, operation.Params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedOutputTypes checks the requested output types, including the picture
+// formats and the pipeline operations ones, against the allowed output types
+func allowedOutputTypes(allowed ImageTypes, opts ImageOptions) bool {
+	if opts.Type != "" && !allowed.Allows(ImageType(opts.Type)) {
+		return false
+	}
+	for _, format := range opts.Formats {
+		if !allowed.Allows(ImageType(format)) {
+			return false
+		}
+	}
+	for _, operation := range pipelineOperations(opts) {
+		if t, ok := operation.Params["type"].(string); ok && t != "" && !allowed.Allows(ImageType(t)) {
+			return false
+		}
+	}
+	return true
 }
 
 // detectMimeType determines the MIME type of the image buffer
@@ -135,24 +673,99 @@ func detectMimeType(buf []byte) string {
 	return mimeType
 }
 
+// operationError returns the error replied for the failed operation, keeping
+// the error code and param of the underlying error, if any
+func operationError(err error) Error {
+	xerr := NewError("Error processing image: "+err.Error(), operationErrorCode(err)).WithKind(KindProcessingError)
+
+	var cause Error
+	var perr ParamError
+	switch {
+	case errors.As(err, &cause):
+		return xerr.WithKind(cause.Kind).WithParam(cause.Param)
+	case errors.As(err, &perr):
+		return xerr.WithKind(KindInvalidParam).WithParam(perr.Param)
+	}
+	return xerr
+}
+
+// paramsError returns the error replied for the params failing to be coerced
+func paramsError(err error) Error {
+	xerr := NewError("Error while processing parameters: "+err.Error(), http.StatusBadRequest)
+
+	var perr ParamError
+	if errors.As(err, &perr) {
+		return xerr.WithKind(KindInvalidParam).WithParam(perr.Param)
+	}
+	return xerr
+}
+
+// sourceError returns the error replied when the image source fails
+func sourceError(err error) Error {
+	if xerr, ok := err.(Error); ok {
+		return xerr
+	}
+
+	xerr := NewError(err.Error(), http.StatusBadRequest)
+	if errors.Is(err, errForbiddenOrigin) {
+		return xerr.WithKind(KindOriginForbidden).WithParam(URLQueryKey)
+	}
+	return xerr
+}
+
+// operationErrorCode returns the status code of the failed operation. Server
+// side failures, such as unreachable remote services, and the images exceeding
+// the limits, such as the pipeline intermediate results, keep their status
+// code, other failures are reported as client errors.
+func operationErrorCode(err error) int {
+	var xerr Error
+	if errors.As(err, &xerr) && (xerr.Code >= http.StatusInternalServerError || xerr.Code == http.StatusUnprocessableEntity) {
+		return xerr.HTTPCode()
+	}
+	return http.StatusBadRequest
+}
+
 // writeImageResponse writes the processed image to the response
-func writeImageResponse(w http.ResponseWriter, image Image, vary string, o ServerOptions) {
+func writeImageResponse(w http.ResponseWriter, image Image, o ServerOptions) {
 	header := w.Header()
 	header.Set("Content-Length", strconv.Itoa(len(image.Body)))
 	header.Set("Content-Type", image.Mime)
 
 	if image.Mime != "application/json" && o.ReturnSize {
-		if meta, err := bimg.Metadata(image.Body); err == nil {
-			header.Set("Image-Width", strconv.Itoa(meta.Size.Width))
-			header.Set("Image-Height", strconv.Itoa(meta.Size.Height))
+		// Read the header only if the operation didn't report the output size
+		width, height, ok := image.Width, image.Height, image.Width > 0 && image.Height > 0
+		if !ok {
+			width, height, ok = imageDimensions(image.Body)
+		}
+		if ok {
+			header.Set("Image-Width", strconv.Itoa(width))
+			header.Set("Image-Height", strconv.Itoa(height))
 		}
+		header.Set("X-Image-Bytes", strconv.Itoa(len(image.Body)))
 	}
 
-	if vary != "" {
-		header.Set("Vary", vary)
+	w.Write(image.Body)
+}
+
+// writeImageEnvelope writes the processed image encoded as base64 within a
+// JSON envelope, along with its metadata
+func writeImageEnvelope(w http.ResponseWriter, image Image, elapsed time.Duration) {
+	width, height := image.Width, image.Height
+	if width == 0 || height == 0 {
+		width, height, _ = imageDimensions(image.Body)
 	}
 
-	w.Write(image.Body)
+	body, _ := json.Marshal(ImageEnvelope{
+		Image:  base64.StdEncoding.EncodeToString(image.Body),
+		Mime:   image.Mime,
+		Width:  width,
+		Height: height,
+		Bytes:  len(image.Body),
+		Timing: float64(elapsed) / float64(time.Millisecond),
+	})
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
 }
 
 // formController generates HTML form for image operations
@@ -177,6 +790,8 @@ func formController(o ServerOptions) http.HandlerFunc {
 		{"Convert format", "convert", "type=png"},
 		{"Image metadata", "info", ""},
 		{"Gaussian blur", "blur", "sigma=15.0&minampl=0.2"},
+		{"Perspective transform", "transform", "points=40,20,500,60,480,700,20,680"},
+		{"Pixelate region", "pixelate", "blocksize=20&regions=%5B%7B%22top%22:100,%22left%22:100,%22width%22:200,%22height%22:150%7D%5D"},
 		{"Pipeline", "pipeline", "operations=%5B%7B%22operation%22:%20%22crop%22,%20%22params%22:%20%7B%22width%22:%20300,%20%22height%22:%20260%7D%7D,%20%7B%22operation%22:%20%22convert%22,%20%22params%22:%20%7B%22type%22:%20%22webp%22%7D%7D%5D"},
 	}
 
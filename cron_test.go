@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/15 8-18 * * 1-5", "0 0 1,15 * 7", "@daily", "@every 90m"} {
+		if _, err := ParseCron(expr); err != nil {
+			t.Errorf("%s: unexpected error: %s", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@yearly", "@every 10s"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Friday
+	now := time.Date(2026, 10, 16, 8, 7, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 16, 8, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 16, 8, 15, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2026, 10, 17, 3, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week matches
+		{"0 0 1 * 0", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", now.Add(90 * time.Minute)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, tc := range cases {
+		s, err := ParseCron(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := s.Next(now); !next.Equal(tc.next) {
+			t.Errorf("%s: expected next run at %s, got %s", tc.expr, tc.next, next)
+		}
+	}
+}
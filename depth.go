@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+// Supported depth param values. 8-bit is the default, converting 16-bit
+// sources to 8-bit sRGB.
+const (
+	depth8  = 8
+	depth10 = 10
+	depth12 = 12
+	depth16 = 16
+)
+
+// isHighDepthType reports whether the image type keeps more than 8 bits per
+// channel: 16-bit PNG and TIFF, 10 and 12-bit AVIF and HEIF
+func isHighDepthType(imageType bimg.ImageType) bool {
+	switch imageType {
+	case bimg.PNG, bimg.TIFF, bimg.AVIF, bimg.HEIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// PreserveDepth runs the operation keeping the bit depth of 16-bit sources,
+// as well as the transfer function and color profile of HDR images (PQ/HLG),
+// instead of converting them to 8-bit sRGB. PNG and TIFF outputs are 16-bit,
+// while AVIF and HEIF outputs are encoded with 10 or 12 bits.
+func PreserveDepth(operation Operation, buf []byte, o ImageOptions) (Image, error) {
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+	if !isHighDepthType(outputType) {
+		return Image{}, NewParamError("The depth param requires PNG, TIFF, AVIF or HEIF output", "depth")
+	}
+
+	depth := o.Depth
+	o.Depth = 0
+	if o.Colorspace == 0 {
+		o.Colorspace = highDepthInterpretation(buf)
+	}
+	if outputType != bimg.AVIF && outputType != bimg.HEIF {
+		return operation(buf, o)
+	}
+
+	// Render the transformation as 16-bit PNG, encoded only once as AVIF or HEIF
+	lossless := o
+	lossless.Type = "png"
+	lossless.Compression = pipelineIntermediateCompression
+	image, err := operation(buf, lossless)
+	if err != nil || image.Mime != "image/png" {
+		return image, err
+	}
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = bimg.Quality
+	}
+	bitdepth := depth12
+	if depth == depth10 {
+		bitdepth = depth10
+	}
+
+	body, err := vipsHeifSaveDepth(image.Body, quality, bitdepth, outputType == bimg.AVIF, o.Lossless, o.StripMetadata)
+	if err != nil {
+		return Image{}, NewError("Cannot encode high bit depth image: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: GetImageMimeType(outputType), Width: image.Width, Height: image.Height}, nil
+}
+
+// highDepthInterpretation returns the 16-bit color space matching the source
+// image channels, grey or RGB
+func highDepthInterpretation(buf []byte) bimg.Interpretation {
+	if meta, err := bimg.Metadata(buf); err == nil && (meta.Space == "b-w" || meta.Space == "grey16") {
+		return bimg.InterpretationGREY16
+	}
+	return bimg.InterpretationRGB16
+}
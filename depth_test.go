@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// png16Image returns a 16-bit PNG image with a color gradient
+func png16Image() []byte {
+	img := image.NewNRGBA64(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{R: uint16(x * 1024), G: uint16(y * 1024), B: 32768, A: 65535})
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func TestPreserveDepth(t *testing.T) {
+	buf := png16Image()
+
+	image, err := Operation(Resize).Run(buf, ImageOptions{Width: 32, Depth: 16})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	// The IHDR chunk bit depth follows the image dimensions
+	if image.Mime != "image/png" || image.Body[24] != 16 {
+		t.Errorf("Expected 16-bit PNG output, got %s of %d bits", image.Mime, image.Body[24])
+	}
+
+	image, err = Operation(Resize).Run(buf, ImageOptions{Width: 32})
+	if err != nil || image.Body[24] != 8 {
+		t.Errorf("Expected 8-bit PNG output by default: %v", err)
+	}
+}
+
+func TestPreserveDepthOutputType(t *testing.T) {
+	_, err := Operation(Resize).Run(png16Image(), ImageOptions{Width: 32, Depth: 16, Type: "jpeg"})
+	if xerr, ok := err.(Error); !ok || xerr.Param != "depth" {
+		t.Errorf("Expected depth param error, got: %v", err)
+	}
+}
+
+func TestCoerceDepth(t *testing.T) {
+	for _, depth := range []string{"8", "10", "12", "16"} {
+		if err := coerceDepth(&ImageOptions{}, depth); err != nil {
+			t.Errorf("Unexpected error for depth %s: %s", depth, err)
+		}
+	}
+	if err := coerceDepth(&ImageOptions{}, "24"); err != ErrUnsupportedValue {
+		t.Errorf("Expected unsupported value error, got: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/h2non/bimg"
+)
+
+// imageDimensions reads the image dimensions from the encoded image header,
+// avoiding to decode the image. Formats which cannot be parsed in pure Go
+// fall back to libvips, which only reads the image header too.
+func imageDimensions(buf []byte) (width, height int, ok bool) {
+	switch {
+	case len(buf) >= 24 && bytes.HasPrefix(buf, pngSignature) && string(buf[12:16]) == "IHDR":
+		return int(binary.BigEndian.Uint32(buf[16:])), int(binary.BigEndian.Uint32(buf[20:])), true
+
+	case len(buf) >= 10 && (bytes.HasPrefix(buf, []byte("GIF87a")) || bytes.HasPrefix(buf, []byte("GIF89a"))):
+		return int(binary.LittleEndian.Uint16(buf[6:])), int(binary.LittleEndian.Uint16(buf[8:])), true
+
+	case len(buf) >= 30 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		return webpDimensions(buf)
+
+	case len(buf) >= 4 && buf[0] == 0xFF && buf[1] == jpegMarkerSOI:
+		for _, segment := range jpegSegments(buf) {
+			if isJPEGFrameMarker(segment.marker) && len(segment.data) >= 5 {
+				return int(binary.BigEndian.Uint16(segment.data[3:])), int(binary.BigEndian.Uint16(segment.data[1:])), true
+			}
+		}
+		return 0, 0, false
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return 0, 0, false
+	}
+	return size.Width, size.Height, true
+}
+
+// sourceDimensions returns the image dimensions once auto rotated
+func sourceDimensions(buf []byte, o ImageOptions) (int, int, error) {
+	metadata, err := bimg.Metadata(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	width, height := metadata.Size.Width, metadata.Size.Height
+	// Width and height will be switched with auto rotation
+	if !o.NoRotation && metadata.Orientation > 4 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+// imageHeaderComplete reports whether the truncated image includes the whole
+// image header, so its metadata can be read without the rest of the image
+func imageHeaderComplete(buf []byte) bool {
+	switch {
+	case bytes.HasPrefix(buf, pngSignature):
+		// The header chunks precede the image data chunks
+		for i := len(pngSignature); i+8 <= len(buf); {
+			if string(buf[i+4:i+8]) == "IDAT" {
+				return true
+			}
+			i += 12 + int(binary.BigEndian.Uint32(buf[i:]))
+		}
+		return false
+
+	case len(buf) >= 4 && buf[0] == 0xFF && buf[1] == jpegMarkerSOI:
+		// The metadata segments precede the frame header
+		for _, segment := range jpegSegments(buf) {
+			if isJPEGFrameMarker(segment.marker) {
+				return true
+			}
+		}
+		return false
+
+	case len(buf) >= 10 && (bytes.HasPrefix(buf, []byte("GIF87a")) || bytes.HasPrefix(buf, []byte("GIF89a"))):
+		return true
+
+	case len(buf) >= 30 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		// Extended WebP images store the EXIF metadata after the image data
+		return string(buf[12:16]) != "VP8X"
+	}
+
+	switch bimg.DetermineImageType(buf) {
+	case bimg.TIFF, bimg.HEIF, bimg.AVIF:
+		_, err := bimg.Metadata(buf)
+		return err == nil
+	}
+	return false
+}
+
+// webpDimensions reads the canvas size of lossy, lossless and extended WebP images
+func webpDimensions(buf []byte) (width, height int, ok bool) {
+	data := buf[20:]
+	switch string(buf[12:16]) {
+	case "VP8 ":
+		// Frame tag followed by the 0x9d012a start code and 14 bits dimensions
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(data[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(data[8:]) & 0x3fff), true
+
+	case "VP8L":
+		// Signature byte followed by 14 bits dimensions minus one
+		if data[0] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(data[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, true
+
+	case "VP8X":
+		// Flags and reserved bytes followed by 24 bits canvas size minus one
+		return int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1,
+			int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1, true
+	}
+	return 0, 0, false
+}
+
+// isJPEGFrameMarker reports whether the marker is a start of frame, which
+// holds the image dimensions
+func isJPEGFrameMarker(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestImageDimensions(t *testing.T) {
+	var gifBuf bytes.Buffer
+	_ = gif.Encode(&gifBuf, image.NewPaletted(image.Rect(0, 0, 30, 20), palette.Plan9), nil)
+
+	// Lossless and extended WebP headers
+	vp8l := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+	vp8l = append(vp8l, 0x1d, 0x40, 0x04, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	vp8x := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+	vp8x = append(vp8x, 0x10, 0, 0, 0, 0x1d, 0x00, 0x00, 0x12, 0x00, 0x00)
+
+	cases := []struct {
+		name          string
+		buf           []byte
+		width, height int
+	}{
+		{"jpeg", readTestFile(t, "imaginary.jpg"), 550, 740},
+		{"png", generatePlaceholderPNG(t, 40, 25), 40, 25},
+		{"webp", readTestFile(t, "test.webp"), 550, 368},
+		{"webp lossless", vp8l, 30, 18},
+		{"webp extended", vp8x, 30, 19},
+		{"gif", gifBuf.Bytes(), 30, 20},
+	}
+
+	for _, tc := range cases {
+		width, height, ok := imageDimensions(tc.buf)
+		if !ok {
+			t.Errorf("%s: cannot read the image dimensions", tc.name)
+			continue
+		}
+		if width != tc.width || height != tc.height {
+			t.Errorf("%s: invalid dimensions %dx%d, expected %dx%d", tc.name, width, height, tc.width, tc.height)
+		}
+	}
+}
+
+func TestImageHeaderComplete(t *testing.T) {
+	jpeg := readTestFile(t, "imaginary.jpg")
+	vp8x := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+	vp8x = append(vp8x, 0x10, 0, 0, 0, 0x1d, 0x00, 0x00, 0x12, 0x00, 0x00)
+
+	cases := []struct {
+		name     string
+		buf      []byte
+		complete bool
+	}{
+		{"jpeg", jpeg[:4096], true},
+		{"jpeg truncated metadata", jpeg[:1024], false},
+		{"png", generatePlaceholderPNG(t, 40, 25), true},
+		{"png truncated metadata", readTestFile(t, "test.png")[:131072], false},
+		{"webp", readTestFile(t, "test.webp")[:64], true},
+		{"webp extended", vp8x, false},
+		{"svg", readTestFile(t, "flyio-button.svg")[:1024], false},
+	}
+
+	for _, tc := range cases {
+		if complete := imageHeaderComplete(tc.buf); complete != tc.complete {
+			t.Errorf("%s: expected complete %t, got %t", tc.name, tc.complete, complete)
+		}
+	}
+}
+
+func TestWriteImageResponseSize(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeImageResponse(w, Image{Body: []byte("body"), Mime: "image/png", Width: 100, Height: 50}, ServerOptions{ReturnSize: true})
+
+	if w.Header().Get("Image-Width") != "100" || w.Header().Get("Image-Height") != "50" {
+		t.Errorf("Invalid image size headers: %v", w.Header())
+	}
+	if w.Header().Get("X-Image-Bytes") != "4" {
+		t.Errorf("Invalid image bytes header: %s", w.Header().Get("X-Image-Bytes"))
+	}
+
+	w = httptest.NewRecorder()
+	writeImageResponse(w, Image{Body: []byte("body"), Mime: "image/png", Width: 100, Height: 50}, ServerOptions{})
+	if w.Header().Get("Image-Width") != "" || w.Header().Get("X-Image-Bytes") != "" {
+		t.Error("Unexpected image size headers")
+	}
+}
+
+func TestWriteImageEnvelope(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeImageEnvelope(w, Image{Body: []byte("body"), Mime: "image/png", Width: 100, Height: 50}, 1500*time.Microsecond)
+
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Invalid content type: %s", w.Header().Get("Content-Type"))
+	}
+
+	var envelope ImageEnvelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	expected := ImageEnvelope{Image: "Ym9keQ==", Mime: "image/png", Width: 100, Height: 50, Bytes: 4, Timing: 1.5}
+	if envelope != expected {
+		t.Errorf("Invalid envelope: %+v", envelope)
+	}
+
+	// Dimensions read from the image header
+	w = httptest.NewRecorder()
+	writeImageEnvelope(w, Image{Body: generatePlaceholderPNG(t, 30, 20), Mime: "image/png"}, 0)
+	_ = json.Unmarshal(w.Body.Bytes(), &envelope)
+	if envelope.Width != 30 || envelope.Height != 20 {
+		t.Errorf("Invalid envelope dimensions: %dx%d", envelope.Width, envelope.Height)
+	}
+}
+
+func generatePlaceholderPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("Cannot generate image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func readTestFile(t testing.TB, file string) []byte {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path.Join("testdata", file))
+	if err != nil {
+		t.Fatalf("Cannot read the test file: %s", err)
+	}
+	return buf
+}
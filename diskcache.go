@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheStatusHeader is the response header reporting whether the image was
+	// served from the disk cache, HIT, or transformed and cached, MISS
+	CacheStatusHeader = "X-Cache"
+
+	// diskCacheIndex is the file name of the disk cache metadata index
+	diskCacheIndex = "index.json"
+
+	// diskCacheSyncInterval is the interval persisting the metadata index
+	diskCacheSyncInterval = time.Minute
+
+	// defaultDiskCacheMaxSize is the default maximum disk cache size, 1 GB
+	defaultDiskCacheMaxSize = 1 << 30
+)
+
+// diskCacheKeyPattern matches the cache entry file names
+var diskCacheKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// DiskCache stores the transformed images as content addressed files under a
+// directory, evicting the least recently used ones above the maximum size.
+// The metadata index, tracking the entries size and access time, is persisted
+// periodically and reconciled with the files on startup, so the cache survives
+// restarts. Read-only caches only serve the entries written by another server,
+// such as replicas sharing a read-only volume. A nil cache caches nothing.
+type DiskCache struct {
+	dir      string
+	maxSize  int64
+	readOnly bool
+
+	mu      sync.Mutex
+	entries map[string]*diskCacheEntry
+	size    int64
+	dirty   bool
+}
+
+// diskCacheEntry is the metadata index entry of a cached image
+type diskCacheEntry struct {
+	Size     int64     `json:"size"`
+	Accessed time.Time `json:"accessed"`
+	Source   string    `json:"source,omitempty"`
+}
+
+// diskCacheMeta is the first line of the cache entry files, followed by the
+// image body, so the entries are readable without the index
+type diskCacheMeta struct {
+	Mime   string    `json:"mime"`
+	Width  int       `json:"width,omitempty"`
+	Height int       `json:"height,omitempty"`
+	Stored time.Time `json:"stored"`
+}
+
+// NewDiskCache opens the disk cache directory, created if missing unless
+// read-only. A zero maximum size disables the eviction.
+func NewDiskCache(dir string, maxSize int64, readOnly bool) (*DiskCache, error) {
+	c := &DiskCache{dir: dir, maxSize: maxSize, readOnly: readOnly, entries: make(map[string]*diskCacheEntry)}
+	if readOnly {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New("not a directory: " + dir)
+		}
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// load indexes the entry files, accessed when last recorded by the metadata
+// index, or else when last modified, so the files cached after the last index
+// sync are still tracked
+func (c *DiskCache) load() error {
+	var index map[string]*diskCacheEntry
+	if buf, err := os.ReadFile(filepath.Join(c.dir, diskCacheIndex)); err == nil {
+		// Invalid indexes are rebuilt from the files
+		_ = json.Unmarshal(buf, &index)
+	}
+
+	return filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !diskCacheKeyPattern.MatchString(d.Name()) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entry := &diskCacheEntry{Size: info.Size(), Accessed: info.ModTime()}
+		if indexed, ok := index[d.Name()]; ok && indexed != nil {
+			entry.Accessed, entry.Source = indexed.Accessed, indexed.Source
+		}
+		c.entries[d.Name()] = entry
+		c.size += entry.Size
+		return nil
+	})
+}
+
+// path returns the entry file path, within a directory per key prefix
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Get returns the cached image of the key, if any
+func (c *DiskCache) Get(key string) (Image, bool) {
+	image, _, ok := c.Entry(key)
+	return image, ok
+}
+
+// Entry returns the cached image of the key, if any, and the time it was
+// stored
+func (c *DiskCache) Entry(key string) (Image, time.Time, bool) {
+	if c == nil || !diskCacheKeyPattern.MatchString(key) {
+		return Image{}, time.Time{}, false
+	}
+
+	buf, err := os.ReadFile(c.path(key))
+	var meta diskCacheMeta
+	i := bytes.IndexByte(buf, '\n')
+	if err == nil && i >= 0 {
+		err = json.Unmarshal(buf[:i], &meta)
+	}
+	if err != nil || i < 0 {
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+		return Image{}, time.Time{}, false
+	}
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.Accessed = time.Now()
+		c.dirty = true
+	}
+	c.mu.Unlock()
+	return Image{Body: buf[i+1:], Mime: meta.Mime, Width: meta.Width, Height: meta.Height}, meta.Stored, true
+}
+
+// Put stores the image under the key, evicting the least recently used images
+// above the maximum size. Images larger than the maximum size aren't cached.
+func (c *DiskCache) Put(key string, image Image) error {
+	return c.PutSource(key, "", image)
+}
+
+// PutSource stores the image transformed from the source image of the digest,
+// so it's purged along with the other variants of the source, see Purge
+func (c *DiskCache) PutSource(key, source string, image Image) error {
+	if c == nil || c.readOnly || !diskCacheKeyPattern.MatchString(key) {
+		return nil
+	}
+
+	meta, _ := json.Marshal(diskCacheMeta{Mime: image.Mime, Width: image.Width, Height: image.Height, Stored: time.Now()})
+	size := int64(len(meta) + 1 + len(image.Body))
+	if c.maxSize > 0 && size > c.maxSize {
+		return nil
+	}
+
+	// Entries are renamed once written, never read partially
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(append(meta, '\n'), image.Body...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.Size
+	}
+	c.entries[key] = &diskCacheEntry{Size: size, Accessed: time.Now(), Source: source}
+	c.size += size
+	c.dirty = true
+	c.evict()
+	return nil
+}
+
+// remove deletes the entry of the key, if indexed. The lock must be held.
+func (c *DiskCache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok || c.readOnly {
+		return
+	}
+	os.Remove(c.path(key))
+	delete(c.entries, key)
+	c.size -= entry.Size
+	c.dirty = true
+}
+
+// evict removes the least recently used entries until the cache fits within
+// the maximum size. The lock must be held.
+func (c *DiskCache) evict() {
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].Accessed.Before(c.entries[keys[j]].Accessed) })
+
+	for _, key := range keys {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.remove(key)
+	}
+}
+
+// Expire removes the entries stored before the given time, returning their
+// number
+func (c *DiskCache) Expire(before time.Time) int {
+	if c == nil || c.readOnly {
+		return 0
+	}
+
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	removed := 0
+	for _, key := range keys {
+		info, err := os.Stat(c.path(key))
+		if err == nil && !info.ModTime().Before(before) {
+			continue
+		}
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+		removed++
+	}
+	return removed
+}
+
+// Purge removes the images transformed from the source image of the digest,
+// returning their number. The entries cached after the last index sync by a
+// previous server process aren't tracked by source.
+func (c *DiskCache) Purge(source string) int {
+	if c == nil || c.readOnly || source == "" {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, entry := range c.entries {
+		if entry.Source == source {
+			c.remove(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// sourceDigest returns the digest of the source image tracking its cached
+// variants
+func sourceDigest(buf []byte) string {
+	digest := sha256.Sum256(buf)
+	return hex.EncodeToString(digest[:])
+}
+
+// Sync persists the metadata index, if changed
+func (c *DiskCache) Sync() error {
+	if c == nil || c.readOnly {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	buf, err := json.Marshal(c.entries)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dir, diskCacheIndex)
+	if err := os.WriteFile(path+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// syncDiskCache persists the disk cache metadata index periodically
+func syncDiskCache(c *DiskCache, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.Sync(); err != nil {
+			log.Printf("cannot write the disk cache index: %s", err)
+		}
+	}
+}
+
+// diskCacheKey returns the content address of the transformed image: the
+// digest of the source image, the additional form files, the request path and
+// params, except the signature, the request headers the response varies on,
+// the virtual host and the server options changing the output image
+func diskCacheKey(r *http.Request, buf []byte, files map[string][]byte, o ServerOptions) string {
+	query := r.URL.Query()
+	query.Del("sign")
+
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path + "\n" + query.Encode()))
+	for _, name := range varyHeaders(r, o) {
+		h.Write([]byte("\n" + name + ": " + r.Header.Get(name)))
+	}
+	h.Write([]byte("\n" + o.VirtualHostname + "\n"))
+	h.Write(outputOptionsFingerprint(o))
+
+	digest := sha256.Sum256(buf)
+	h.Write(digest[:])
+
+	fields := make([]string, 0, len(files))
+	for field := range files {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		digest := sha256.Sum256(files[field])
+		h.Write([]byte("\n" + field + "\n"))
+		h.Write(digest[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// outputOptionsFingerprint returns the server options, possibly overridden by
+// the virtual host, changing the output image of the same request
+func outputOptionsFingerprint(o ServerOptions) []byte {
+	presets, _ := json.Marshal(o.PicturePresets)
+	return []byte(fmt.Sprintf("%s\n%s\n%t %q %t %t %g",
+		presets, o.DefaultParams.Encode(), o.StripMetadata, o.StripMetadataKeep,
+		o.NoEnlarge, o.DisableAutoRotate, o.AutoQualityTarget))
+}
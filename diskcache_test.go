@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCacheKey(name string) string {
+	r := httptest.NewRequest(http.MethodGet, "/resize?width=100", nil)
+	return diskCacheKey(r, []byte(name), nil, ServerOptions{})
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := testCacheKey("image")
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Unexpected cached image")
+	}
+
+	image := Image{Body: []byte("webp image"), Mime: "image/webp", Width: 100, Height: 50}
+	if err := cache.Put(key, image); err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := cache.Get(key)
+	if !ok || !bytes.Equal(cached.Body, image.Body) || cached.Mime != image.Mime || cached.Width != 100 || cached.Height != 50 {
+		t.Fatalf("Invalid cached image: %+v", cached)
+	}
+
+	// Entries are content addressed files, surviving restarts
+	if _, err := os.Stat(filepath.Join(dir, key[:2], key)); err != nil {
+		t.Errorf("Missing entry file: %s", err)
+	}
+	if err := cache.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = NewDiskCache(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(key); !ok || cache.size == 0 {
+		t.Error("Cached image lost on restart")
+	}
+
+	// Read-only caches serve the entries, but don't write them
+	readOnly, err := NewDiskCache(dir, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readOnly.Get(key); !ok {
+		t.Error("Read-only cache must serve the cached images")
+	}
+	other := testCacheKey("other")
+	if err := readOnly.Put(other, image); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(other); ok {
+		t.Error("Read-only cache must not write images")
+	}
+
+	// Nil caches cache nothing
+	var none *DiskCache
+	if err := none.Put(key, image); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := none.Get(key); ok {
+		t.Error("Unexpected cached image")
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	image := Image{Body: bytes.Repeat([]byte("x"), 100), Mime: "image/png"}
+	cache, err := NewDiskCache(dir, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{testCacheKey("first"), testCacheKey("second"), testCacheKey("third"), testCacheKey("fourth")}
+	for _, key := range keys[:3] {
+		if err := cache.Put(key, image); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Fits three images, but not four
+	cache.maxSize = cache.size + cache.size/6
+
+	// The first image is the most recently used, the second one is evicted
+	cache.Get(keys[0])
+	if err := cache.Put(keys[3], image); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []bool{true, false, true, true} {
+		if _, ok := cache.Get(keys[i]); ok != expected {
+			t.Errorf("Image %d: expected cached %t", i+1, expected)
+		}
+	}
+	if cache.size > cache.maxSize {
+		t.Errorf("Cache size exceeds the maximum: %d", cache.size)
+	}
+
+	// Images larger than the cache aren't cached
+	if err := cache.Put(testCacheKey("large"), Image{Body: bytes.Repeat([]byte("x"), 1000000)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(testCacheKey("large")); ok {
+		t.Error("Unexpected cached large image")
+	}
+
+	// Files cached after the last index sync are evicted too
+	cache, err = NewDiskCache(dir, 200, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.entries) != 1 || cache.size > 200 {
+		t.Errorf("Cache exceeds the maximum size on startup: %d entries, %d bytes", len(cache.entries), cache.size)
+	}
+}
+
+func TestDiskCacheKey(t *testing.T) {
+	key := func(target, accept string, buf []byte, files map[string][]byte) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", accept)
+		return diskCacheKey(r, buf, files, ServerOptions{})
+	}
+
+	base := key("/resize?width=100&sign=abc", "image/webp", []byte("image"), nil)
+	if len(base) != 64 || strings.Trim(base, "0123456789abcdef") != "" {
+		t.Fatalf("Invalid key: %s", base)
+	}
+	if key("/resize?width=100&sign=def", "image/avif", []byte("image"), nil) != base {
+		t.Error("Key must not depend on the signature, nor unused headers")
+	}
+	if key("/resize?width=200", "image/webp", []byte("image"), nil) == base {
+		t.Error("Key must depend on the params")
+	}
+	if key("/resize?width=100", "image/webp", []byte("other"), nil) == base {
+		t.Error("Key must depend on the source image")
+	}
+	if key("/resize?width=100", "image/webp", []byte("image"), map[string][]byte{"logo": []byte("logo")}) == base {
+		t.Error("Key must depend on the form files")
+	}
+	if key("/resize?type=auto", "image/webp", []byte("image"), nil) == key("/resize?type=auto", "image/avif", []byte("image"), nil) {
+		t.Error("Key must depend on the negotiated headers")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/resize?width=100", nil)
+	plain := diskCacheKey(r, []byte("image"), nil, ServerOptions{})
+	options := []ServerOptions{
+		{VirtualHostname: "images.brand-a.com"},
+		{PicturePresets: PicturePresets{"hero": {}}},
+		{DefaultParams: url.Values{"quality": {"80"}}},
+		{StripMetadata: true},
+		{StripMetadataKeep: []string{"icc"}},
+		{NoEnlarge: true},
+		{DisableAutoRotate: true},
+		{AutoQualityTarget: 0.02},
+	}
+	for _, o := range options {
+		if diskCacheKey(r, []byte("image"), nil, o) == plain {
+			t.Errorf("Key must depend on the server options: %+v", o)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "math"
+
+// limitEnlargement clamps the requested width and height to the source image
+// dimensions with withoutEnlargement=true, so the image is never upscaled.
+// Both dimensions are scaled down by the same ratio, keeping the requested
+// aspect ratio for the crop and embed operations.
+func limitEnlargement(buf []byte, o ImageOptions) (ImageOptions, error) {
+	if !o.NoEnlarge || (o.Width == 0 && o.Height == 0) {
+		return o, nil
+	}
+
+	width, height, err := sourceDimensions(buf, o)
+	if err != nil {
+		return o, err
+	}
+
+	o.Width, o.Height = clampDimensions(width, height, o.Width, o.Height)
+	return o, nil
+}
+
+// clampDimensions scales down the target dimensions exceeding the source
+// ones. Zero target dimensions are left undefined.
+func clampDimensions(width, height, targetWidth, targetHeight int) (int, int) {
+	if width == 0 || height == 0 {
+		return targetWidth, targetHeight
+	}
+
+	ratio := 1.0
+	if targetWidth > width {
+		ratio = float64(width) / float64(targetWidth)
+	}
+	if targetHeight > height {
+		if r := float64(height) / float64(targetHeight); r < ratio {
+			ratio = r
+		}
+	}
+	if ratio == 1 {
+		return targetWidth, targetHeight
+	}
+
+	return scaleDimension(targetWidth, ratio), scaleDimension(targetHeight, ratio)
+}
+
+func scaleDimension(size int, ratio float64) int {
+	if size == 0 {
+		return 0
+	}
+	if scaled := int(math.Round(float64(size) * ratio)); scaled > 1 {
+		return scaled
+	}
+	return 1
+}
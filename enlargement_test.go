@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestClampDimensions(t *testing.T) {
+	cases := []struct {
+		width, height, targetWidth, targetHeight, expectedWidth, expectedHeight int
+	}{
+		{100, 100, 50, 50, 50, 50},
+		{100, 100, 200, 0, 100, 0},
+		{100, 100, 0, 400, 0, 100},
+		{100, 100, 200, 100, 100, 50},
+		{100, 100, 400, 200, 100, 50},
+		{100, 200, 150, 150, 100, 100},
+		{0, 0, 300, 300, 300, 300},
+	}
+
+	for _, test := range cases {
+		width, height := clampDimensions(test.width, test.height, test.targetWidth, test.targetHeight)
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("Invalid dimensions for %+v: %dx%d", test, width, height)
+		}
+	}
+}
+
+func TestLimitEnlargement(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	opts, err := limitEnlargement(buf, ImageOptions{Width: 1100, NoEnlarge: true})
+	if err != nil {
+		t.Fatalf("Cannot limit the enlargement: %s", err)
+	}
+	// The original image is 550x740
+	if opts.Width != 550 || opts.Height != 0 {
+		t.Errorf("Invalid dimensions: %dx%d", opts.Width, opts.Height)
+	}
+
+	opts, err = limitEnlargement(buf, ImageOptions{Width: 1100})
+	if err != nil {
+		t.Fatalf("Cannot limit the enlargement: %s", err)
+	}
+	if opts.Width != 1100 {
+		t.Errorf("Images must be enlarged without withoutEnlargement: %d", opts.Width)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultInputName is the input name of the images without file name, such
+// as raw request bodies
+const defaultInputName = "image"
+
+// entryNamePlaceholder matches the placeholders of the entry name template
+var entryNamePlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+// unsafeNameChars matches the characters not allowed in entry names
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// entryFilenames returns the file names of the results bundled as ZIP archive
+// or multipart body, rendering the entryname param template, if any, whose
+// placeholders are replaced by the entry values:
+//
+//	{input}  source image file name, without extension
+//	{name}   entry name, such as the branch name or the srcset width
+//	{index}  entry position, starting at 1
+//	{width}  output image width
+//	{height} output image height
+//	{ext}    output image type extension
+//
+// It defaults to {name}.{ext}, or {name} if the output type is unknown.
+func entryFilenames(names []string, results []Image, o ImageOptions) ([]string, error) {
+	filenames := make([]string, len(results))
+	seen := make(map[string]bool, len(results))
+
+	for i, result := range results {
+		if o.EntryName == "" {
+			filenames[i] = branchFilename(names[i], result)
+			continue
+		}
+
+		var err error
+		filename := entryNamePlaceholder.ReplaceAllStringFunc(o.EntryName, func(placeholder string) string {
+			value, ok := entryNameValue(placeholder, i, names[i], result, o)
+			if !ok && err == nil {
+				err = NewParamError(fmt.Sprintf("Unsupported entry name placeholder: %s", placeholder), "entryname")
+			}
+			return value
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if !branchNamePattern.MatchString(filename) || filename == "." || filename == ".." {
+			return nil, NewParamError(fmt.Sprintf("Invalid entry name: %s", filename), "entryname")
+		}
+		if seen[filename] {
+			return nil, NewParamError(fmt.Sprintf("Duplicated entry name: %s", filename), "entryname")
+		}
+		seen[filename] = true
+		filenames[i] = filename
+	}
+	return filenames, nil
+}
+
+// entryNameValue returns the value of the entry name template placeholder
+func entryNameValue(placeholder string, index int, name string, result Image, o ImageOptions) (string, bool) {
+	switch placeholder {
+	case "{input}":
+		return o.InputName(), true
+	case "{name}":
+		return name, true
+	case "{index}":
+		return strconv.Itoa(index + 1), true
+	case "{ext}":
+		return ExtractImageTypeFromMime(result.Mime), true
+	case "{width}", "{height}":
+		width, height := result.Width, result.Height
+		if width == 0 || height == 0 {
+			width, height, _ = imageDimensions(result.Body)
+		}
+		if placeholder == "{width}" {
+			return strconv.Itoa(width), true
+		}
+		return strconv.Itoa(height), true
+	}
+	return "", false
+}
+
+// requestInputName returns the source image file name of the request,
+// without extension and made safe to be used in entry names
+func requestInputName(r *http.Request) string {
+	var name string
+	query := r.URL.Query()
+	switch {
+	case query.Get("file") != "":
+		name = query.Get("file")
+	case query.Get(URLQueryKey) != "":
+		if u, err := url.Parse(query.Get(URLQueryKey)); err == nil {
+			name = u.Path
+		}
+	case r.MultipartForm != nil && len(r.MultipartForm.File[formFieldName]) > 0:
+		name = r.MultipartForm.File[formFieldName][0].Filename
+	}
+
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.TrimSuffix(name, path.Ext(name))
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return defaultInputName
+	}
+	return name
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEntryFilenames(t *testing.T) {
+	names := []string{"small", "large"}
+	results := []Image{
+		{Body: []byte("first"), Mime: "image/jpeg", Width: 320, Height: 200},
+		{Body: []byte("second"), Mime: "image/webp", Width: 1280, Height: 800},
+	}
+
+	cases := []struct {
+		template string
+		expected []string
+	}{
+		{"", []string{"small.jpeg", "large.webp"}},
+		{"{input}-{name}.{ext}", []string{"beach-small.jpeg", "beach-large.webp"}},
+		{"{index}_{width}x{height}.{ext}", []string{"1_320x200.jpeg", "2_1280x800.webp"}},
+	}
+
+	for _, test := range cases {
+		o := ImageOptions{EntryName: test.template}.WithInputName("beach")
+		filenames, err := entryFilenames(names, results, o)
+		if err != nil {
+			t.Fatalf("Cannot render entry names %q: %s", test.template, err)
+		}
+		for i, expected := range test.expected {
+			if filenames[i] != expected {
+				t.Errorf("Invalid entry name for %q: %s != %s", test.template, filenames[i], expected)
+			}
+		}
+	}
+
+	for _, template := range []string{"{input}", "{unknown}", "../{name}", "{name}/{ext}"} {
+		if _, err := entryFilenames(names, results, ImageOptions{EntryName: template}); err == nil {
+			t.Errorf("Expected error for entry name template %q", template)
+		}
+	}
+}
+
+func TestRequestInputName(t *testing.T) {
+	cases := map[string]string{
+		"/srcset?file=photos/beach.jpg":                           "beach",
+		"/srcset?url=https://example.com/a/summer%20trip.png?x=1": "summer_trip",
+		"/srcset?file=..": "image",
+		"/srcset":         "image",
+	}
+
+	for target, expected := range cases {
+		if name := requestInputName(httptest.NewRequest("GET", target, nil)); name != expected {
+			t.Errorf("Invalid input name for %s: %s != %s", target, name, expected)
+		}
+	}
+}
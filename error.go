@@ -11,25 +11,72 @@ import (
 
 var (
 	ErrNotFound             = NewError("Not found", http.StatusNotFound)
-	ErrInvalidAPIKey        = NewError("Invalid or missing API key", http.StatusUnauthorized)
+	ErrInvalidAPIKey        = NewError("Invalid or missing API key", http.StatusUnauthorized).WithKind("invalid_api_key")
+	ErrUnauthorized         = NewError("Invalid or missing credentials", http.StatusUnauthorized)
+	ErrForbidden            = NewError("Forbidden", http.StatusForbidden)
+	ErrAuthUnavailable      = NewError("Authorization service unavailable", http.StatusServiceUnavailable)
 	ErrMethodNotAllowed     = NewError("HTTP method not allowed. Try with a POST or GET method (-enable-url-source flag must be defined)", http.StatusMethodNotAllowed)
 	ErrGetMethodNotAllowed  = NewError("GET method not allowed. Make sure remote URL source is enabled by using the flag: -enable-url-source", http.StatusMethodNotAllowed)
-	ErrUnsupportedMedia     = NewError("Unsupported media type", http.StatusNotAcceptable)
-	ErrOutputFormat         = NewError("Unsupported output image format", http.StatusBadRequest)
-	ErrEmptyBody            = NewError("Empty or unreadable image", http.StatusBadRequest)
-	ErrMissingParamFile     = NewError("Missing required param: file", http.StatusBadRequest)
-	ErrInvalidFilePath      = NewError("Invalid file path", http.StatusBadRequest)
-	ErrInvalidImageURL      = NewError("Invalid image URL", http.StatusBadRequest)
-	ErrMissingImageSource   = NewError("Cannot process the image due to missing or invalid params", http.StatusBadRequest)
+	ErrUnsupportedMedia     = NewError("Unsupported media type", http.StatusNotAcceptable).WithKind("unsupported_media_type")
+	ErrInputFormatDenied    = NewError("Input image format not allowed", http.StatusNotAcceptable).WithKind("input_format_denied")
+	ErrOutputFormat         = NewError("Unsupported output image format", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("type")
+	ErrOutputFormatDenied   = NewError("Output image format not allowed", http.StatusBadRequest).WithKind("output_format_denied")
+	ErrEmptyBody            = NewError("Empty or unreadable image", http.StatusBadRequest).WithKind("empty_image")
+	ErrMissingParamFile     = NewError("Missing required param: file", http.StatusBadRequest).WithKind(KindMissingParam).WithParam("file")
+	ErrInvalidFilePath      = NewError("Invalid file path", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("file")
+	ErrMissingParamMount    = NewError("Missing required param: mount", http.StatusBadRequest).WithKind(KindMissingParam).WithParam("mount")
+	ErrUnknownMount         = NewError("Unknown mount", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("mount")
+	ErrReadOnlyMount        = NewError("Read-only mount: only the directory mounts are writable", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("mount")
+	ErrImageNotFound        = NewError("Image not found", http.StatusNotFound).WithKind("image_not_found")
+	ErrInvalidFallback      = NewError("Invalid fallback image: must be a preset name or an http(s) URL", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("fallback")
+	ErrUnknownPreset        = NewError("Unknown picture preset", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("preset")
+	ErrInvalidImageURL      = NewError("Invalid image URL", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("url")
+	ErrMissingImageSource   = NewError("Cannot process the image due to missing or invalid params", http.StatusBadRequest).WithKind("missing_image_source")
 	ErrNotImplemented       = NewError("Not implemented endpoint", http.StatusNotImplemented)
-	ErrInvalidURLSignature  = NewError("Invalid URL signature", http.StatusBadRequest)
-	ErrURLSignatureMismatch = NewError("URL signature mismatch", http.StatusForbidden)
-	ErrResolutionTooBig     = NewError("Image resolution is too big", http.StatusUnprocessableEntity)
+	ErrInvalidURLSignature  = NewError("Invalid URL signature", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("sign")
+	ErrURLSignatureMismatch = NewError("URL signature mismatch", http.StatusForbidden).WithKind("signature_mismatch")
+	ErrUnknownSignatureKey  = NewError("Unknown URL signature key ID", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("kid")
+	ErrInvalidEncryptedURL  = NewError("Invalid encrypted image URL", http.StatusBadRequest).WithKind(KindInvalidParam).WithParam("enc")
+	ErrInvalidBodySignature = NewError("Missing or invalid X-Signature header", http.StatusBadRequest).WithKind("invalid_signature")
+	ErrBodySignMismatch     = NewError("Image signature mismatch", http.StatusForbidden).WithKind("signature_mismatch")
+	ErrResolutionTooBig     = NewError("Image resolution is too big", http.StatusUnprocessableEntity).WithKind("resolution_too_big")
+	ErrTooManyFrames        = NewError("Image has too many frames or pages", http.StatusUnprocessableEntity).WithKind("too_many_frames")
+	ErrTransformTimeout     = NewError("Image transformation exceeded the time limit", http.StatusUnprocessableEntity).WithKind("transform_timeout")
+	ErrTransformMemory      = NewError("Image transformation exceeded the memory limit", http.StatusUnprocessableEntity).WithKind("transform_memory_exceeded")
+	ErrImageTooLarge        = NewError("Image size exceeds the allowed limit", http.StatusRequestEntityTooLarge).WithKind("image_too_large")
+	ErrEntityTooLarge       = NewError("Request entity too large", http.StatusRequestEntityTooLarge).WithKind("entity_too_large")
+	ErrTooManyRequests      = NewError("Too many requests", http.StatusTooManyRequests)
+	ErrOverloaded           = NewError("Server overloaded, retry later", http.StatusServiceUnavailable).WithKind("overloaded")
+	ErrInternalServer       = NewError("Internal server error", http.StatusInternalServerError)
+	ErrClientClosedRequest  = NewError("Client closed request", StatusClientClosedRequest).WithKind("client_closed_request")
 )
 
+// Machine readable error codes shared by several errors. The other errors
+// codes default to the snake cased HTTP status text, e.g: bad_request
+const (
+	KindInvalidParam      = "invalid_param"
+	KindMissingParam      = "missing_param"
+	KindOriginUnreachable = "origin_unreachable"
+	KindOriginError       = "origin_error"
+	KindOriginForbidden   = "origin_forbidden"
+	KindProcessingError   = "processing_error"
+	KindPolicyViolation   = "policy_violation"
+)
+
+// StatusClientClosedRequest is the non-standard status code used when the
+// client closes the connection before the response is sent
+const StatusClientClosedRequest = 499
+
+// Error represents an HTTP error, replied as JSON. Kind is the machine readable
+// error code, and Param the request param causing the error, if any. Size and
+// Limit report the actual and allowed sizes, in bytes, of the 413 errors.
 type Error struct {
 	Message string `json:"message,omitempty"`
 	Code    int    `json:"status"`
+	Kind    string `json:"code"`
+	Param   string `json:"param,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
 }
 
 func (e Error) JSON() []byte {
@@ -48,15 +95,60 @@ func (e Error) HTTPCode() int {
 	return http.StatusServiceUnavailable
 }
 
+// WithKind returns a copy of the error using the given error code
+func (e Error) WithKind(kind string) Error {
+	e.Kind = kind
+	return e
+}
+
+// WithParam returns a copy of the error caused by the given request param
+func (e Error) WithParam(param string) Error {
+	e.Param = param
+	return e
+}
+
 func NewError(err string, code int) Error {
-	return Error{
+	e := Error{
 		Message: strings.ReplaceAll(err, "\n", ""),
 		Code:    code,
 	}
+	return e.WithKind(statusErrorKind(e.HTTPCode()))
+}
+
+// NewSizeError returns a copy of the 413 error reporting the actual size, if
+// known, and the allowed size, in bytes. Unknown sizes are zero.
+func NewSizeError(e Error, size, limit int64) Error {
+	e.Size, e.Limit = size, limit
+	if size > 0 {
+		e.Message = fmt.Sprintf("%s: %d bytes, %d bytes allowed", e.Message, size, limit)
+	} else {
+		e.Message = fmt.Sprintf("%s: more than %d bytes allowed", e.Message, limit)
+	}
+	return e
+}
+
+// NewParamError returns a bad request error caused by an invalid param value
+func NewParamError(err string, param string) Error {
+	return NewError(err, http.StatusBadRequest).WithKind(KindInvalidParam).WithParam(param)
+}
+
+// NewMissingParamError returns a bad request error caused by a missing
+// required param. The param is empty if any of several params is required.
+func NewMissingParamError(err string, param string) Error {
+	return NewError(err, http.StatusBadRequest).WithKind(KindMissingParam).WithParam(param)
+}
+
+// statusErrorKind returns the default error code for the HTTP status code
+func statusErrorKind(code int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(code)), " ", "_")
 }
 
 func ErrorReply(req *http.Request, w http.ResponseWriter, err Error, o ServerOptions) {
-	if o.EnablePlaceholder || o.Placeholder != "" {
+	// Errors must not be revalidated as the source image response
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+
+	if placeholderEnabled(o) {
 		_ = replyWithPlaceholder(req, w, err, o)
 		return
 	}
@@ -66,30 +158,57 @@ func ErrorReply(req *http.Request, w http.ResponseWriter, err Error, o ServerOpt
 	w.Write(err.JSON())
 }
 
+// placeholderEnabled reports whether the errors are replied with a placeholder
+// image, instead of JSON
+func placeholderEnabled(o ServerOptions) bool {
+	return o.EnablePlaceholder || o.Placeholder != "" || len(o.Placeholders) > 0 || o.PlaceholderColor != nil
+}
+
 func replyWithPlaceholder(req *http.Request, w http.ResponseWriter, errCaller Error, o ServerOptions) error {
+	query := req.URL.Query()
+	imageType := query.Get("type")
+	if imageType == "auto" {
+		imageType = negotiateType(w, req, o)
+	}
+
 	opts := bimg.Options{
 		Force:   true,
 		Crop:    true,
 		Enlarge: true,
-		Type:    ImageType(req.URL.Query().Get("type")),
+		Type:    ImageType(imageType),
 	}
 
-	query := req.URL.Query()
 	width, err := parseInt(query.Get("width"))
 	if err != nil {
-		return sendError(w, http.StatusBadRequest, err)
+		return sendError(w, NewParamError(err.Error(), "width"))
 	}
 	opts.Width = width
 
 	height, err := parseInt(query.Get("height"))
 	if err != nil {
-		return sendError(w, http.StatusBadRequest, err)
+		return sendError(w, NewParamError(err.Error(), "height"))
 	}
 	opts.Height = height
 
-	image, err := bimg.Resize(o.PlaceholderImage, opts)
+	if o.EnableClientHints {
+		size := ImageOptions{Width: opts.Width, Height: opts.Height}
+		readClientHints(req).Apply(&size)
+		opts.Width, opts.Height = size.Width, size.Height
+	}
+
+	buf := placeholderImage(errCaller.HTTPCode(), o)
+	generated := buf == nil
+	if generated {
+		buf, err = generatePlaceholder(o.PlaceholderColor)
+		if err != nil {
+			return sendError(w, NewError(err.Error(), http.StatusInternalServerError))
+		}
+	}
+	opts.Width, opts.Height = placeholderSize(opts.Width, opts.Height, generated, o)
+
+	image, err := bimg.Resize(buf, opts)
 	if err != nil {
-		return sendError(w, http.StatusBadRequest, err)
+		return sendError(w, NewError(err.Error(), http.StatusBadRequest))
 	}
 
 	header := w.Header()
@@ -106,9 +225,9 @@ func replyWithPlaceholder(req *http.Request, w http.ResponseWriter, errCaller Er
 	return errCaller
 }
 
-func sendError(w http.ResponseWriter, code int, err error) error {
+func sendError(w http.ResponseWriter, err Error) error {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write([]byte(fmt.Sprintf(`{"error":"%s", "status":%d}`, err.Error(), code)))
+	w.WriteHeader(err.HTTPCode())
+	w.Write(err.JSON())
 	return err
 }
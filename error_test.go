@@ -18,7 +18,28 @@ func TestDefaultError(t *testing.T) {
 	}
 
 	json := string(err.JSON())
-	if json != "{\"message\":\"oops!\",\"status\":503}" {
+	if json != "{\"message\":\"oops!\",\"status\":503,\"code\":\"service_unavailable\"}" {
 		t.Fatalf("Invalid JSON output: %s", json)
 	}
 }
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		err      Error
+		expected string
+	}{
+		{NewError("Too many requests", 429), `{"message":"Too many requests","status":429,"code":"too_many_requests"}`},
+		{ErrClientClosedRequest, `{"message":"Client closed request","status":499,"code":"client_closed_request"}`},
+		{ErrResolutionTooBig, `{"message":"Image resolution is too big","status":422,"code":"resolution_too_big"}`},
+		{NewParamError("Invalid param: foo", "foo"), `{"message":"Invalid param: foo","status":400,"code":"invalid_param","param":"foo"}`},
+		{NewMissingParamError("Missing required param: width or height", ""), `{"message":"Missing required param: width or height","status":400,"code":"missing_param"}`},
+		{NewSizeError(ErrImageTooLarge, 2048, 1024), `{"message":"Image size exceeds the allowed limit: 2048 bytes, 1024 bytes allowed","status":413,"code":"image_too_large","size":2048,"limit":1024}`},
+		{NewSizeError(ErrImageTooLarge, 0, 1024), `{"message":"Image size exceeds the allowed limit: more than 1024 bytes allowed","status":413,"code":"image_too_large","limit":1024}`},
+	}
+
+	for _, tc := range cases {
+		if json := string(tc.err.JSON()); json != tc.expected {
+			t.Errorf("Invalid JSON output: %s", json)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// fallbackParam is the query param defining the image served when the
+// source image is not found, either as a preset name or a remote URL
+const fallbackParam = "fallback"
+
+// fallbackImage returns the fallback image defined by the request.
+// Preset names take precedence over URLs, which are only fetched when the
+// remote URL source is enabled and are subject to the allowed origins.
+func fallbackImage(r *http.Request, source ImageSource, presets map[string][]byte) ([]byte, error) {
+	fallback := r.URL.Query().Get(fallbackParam)
+	if buf, ok := presets[fallback]; ok {
+		return buf, nil
+	}
+
+	u, err := url.Parse(fallback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidFallback
+	}
+	if source == nil {
+		return nil, ErrGetMethodNotAllowed
+	}
+
+	query := url.Values{URLQueryKey: {fallback}}
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL.RawQuery = query.Encode()
+	return source.GetImage(req)
+}
+
+// isNotFound reports whether the image source error means the image doesn't exist
+func isNotFound(err error) bool {
+	xerr, ok := err.(Error)
+	return ok && xerr.Code == http.StatusNotFound
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFallbackImagePreset(t *testing.T) {
+	preset := []byte("preset")
+	r := httptest.NewRequest(http.MethodGet, "/resize?file=missing.jpg&fallback=shoes", nil)
+
+	buf, err := fallbackImage(r, nil, map[string][]byte{"shoes": preset})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(buf, preset) {
+		t.Error("Invalid fallback preset image")
+	}
+}
+
+func TestFallbackImageURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("remote"))
+	}))
+	defer ts.Close()
+
+	origin, _ := url.Parse(ts.URL)
+	query := url.Values{"file": {"missing.jpg"}, fallbackParam: {ts.URL + "/default.jpg"}}
+	r := httptest.NewRequest(http.MethodGet, "/resize?"+query.Encode(), nil)
+
+	source := NewHTTPImageSource(&SourceConfig{AllowedOrigins: []*url.URL{origin}, MaxAllowedSize: 1024})
+	buf, err := fallbackImage(r, source, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(buf) != "remote" {
+		t.Errorf("Invalid fallback image: %s", buf)
+	}
+
+	other, _ := url.Parse("http://example.org")
+	source = NewHTTPImageSource(&SourceConfig{AllowedOrigins: []*url.URL{other}})
+	if _, err := fallbackImage(r, source, nil); err == nil {
+		t.Error("Expected fallback URL origin to be restricted")
+	}
+
+	if _, err := fallbackImage(r, nil, nil); err != ErrGetMethodNotAllowed {
+		t.Errorf("Expected URL fallback to require the URL source, got: %v", err)
+	}
+}
+
+func TestFallbackImageInvalid(t *testing.T) {
+	for _, fallback := range []string{"unknown", "file:///etc/passwd", "http://"} {
+		query := url.Values{fallbackParam: {fallback}}
+		r := httptest.NewRequest(http.MethodGet, "/resize?"+query.Encode(), nil)
+		if _, err := fallbackImage(r, NewHTTPImageSource(&SourceConfig{}), nil); err != ErrInvalidFallback {
+			t.Errorf("Expected invalid fallback error for %q, got: %v", fallback, err)
+		}
+	}
+}
+
+func TestFallbackMissingFile(t *testing.T) {
+	o := ServerOptions{
+		Mount:     "testdata",
+		Fallbacks: map[string][]byte{"default": []byte("fallback")},
+	}
+	LoadSources(o)
+
+	r := httptest.NewRequest(http.MethodGet, "/info?file=missing.jpg&fallback=default", nil)
+	if _, err := MatchSource(r).GetImage(r); !isNotFound(err) {
+		t.Fatalf("Expected not found error, got: %v", err)
+	}
+
+	// The fallback image is read, failing later as it isn't a valid image
+	w := httptest.NewRecorder()
+	imageController(o, Info)(w, r)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected the fallback image to be processed, got status %d", w.Code)
+	}
+}
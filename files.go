@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// maxListedFiles limits the files listed by the /files endpoint
+const maxListedFiles = 1000
+
+// errListingTruncated stops walking the mount directory
+var errListingTruncated = errors.New("file listing truncated")
+
+// FileListing represents the images available under the mount directory
+type FileListing struct {
+	Files     []ListedFile `json:"files"`
+	Truncated bool         `json:"truncated"`
+}
+
+// ListedFile represents an image file, by its path relative to the mount
+type ListedFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// filesController lists the images under the mount directory whose path
+// starts with the prefix param, sorted by path. If the mount writes are
+// enabled, it also stores and deletes the images, see putMountFile.
+func filesController(o ServerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		// The listing isn't enabled along with the mount writes only
+		case r.Method == http.MethodGet && (o.EnableFileListing || !o.EnableMountWrites):
+		case isMountWrite(r, o) && r.Method == http.MethodPut:
+			putMountFile(w, r, o)
+			return
+		case isMountWrite(r, o):
+			deleteMountFile(w, r, o)
+			return
+		default:
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+			return
+		}
+
+		var listing FileListing
+		mount, err := selectMount(r, o.Mount, o.Mounts)
+		if err == nil {
+			listing, err = listMountFiles(mount, r.URL.Query().Get("prefix"))
+		}
+		if err != nil {
+			if xerr, ok := err.(Error); ok {
+				ErrorReply(r, w, xerr, o)
+			} else {
+				ErrorReply(r, w, NewError("Cannot list files: "+err.Error(), http.StatusInternalServerError), o)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(listing)
+	}
+}
+
+// listMountFiles walks the directory of the prefix, such as kiosk/screen-,
+// skipping the hidden files and directories and the non image files
+func listMountFiles(mount, prefix string) (FileListing, error) {
+	listing := FileListing{Files: []ListedFile{}}
+
+	// Directory prefixes, such as kiosk/, list the whole directory
+	dirPrefix := strings.HasSuffix(prefix, "/")
+	prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+	dirName := path.Dir(prefix)
+	if dirPrefix && prefix != "" {
+		dirName = prefix
+		prefix += "/"
+	}
+
+	fsys, err := openMount(mount)
+	if err != nil {
+		return listing, err
+	}
+
+	err = fs.WalkDir(fsys, dirName, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if name != dirName && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			// Skip the directories not sharing the prefix
+			if name != dirName && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !isImageFile(name) {
+			return nil
+		}
+
+		if len(listing.Files) == maxListedFiles {
+			listing.Truncated = true
+			return errListingTruncated
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		listing.Files = append(listing.Files, ListedFile{Path: name, Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+
+	if err == errListingTruncated {
+		err = nil
+	}
+
+	sort.Slice(listing.Files, func(i, j int) bool { return listing.Files[i].Path < listing.Files[j].Path })
+	return listing, err
+}
+
+// isImageFile reports whether the file extension is a supported image format
+func isImageFile(name string) bool {
+	switch ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), ".")); ext {
+	case "tif", "heic":
+		return true
+	default:
+		return ImageType(ext) != bimg.UNKNOWN
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newFilesMount(t *testing.T) string {
+	mount := t.TempDir()
+	for _, name := range []string{
+		"logo.png",
+		"notes.txt",
+		".hidden.jpg",
+		".cache/thumb.jpg",
+		"kiosk/screen-1.jpg",
+		"kiosk/screen-2.webp",
+		"kiosk/menu.jpg",
+		"kiosk/old/screen-0.jpg",
+		"kiosk-archive/screen-9.jpg",
+	} {
+		file := filepath.Join(mount, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(file), 0755)
+		_ = ioutil.WriteFile(file, []byte(name), 0644)
+	}
+	return mount
+}
+
+func TestListMountFiles(t *testing.T) {
+	mount := newFilesMount(t)
+	cases := []struct {
+		prefix string
+		files  []string
+	}{
+		{"", []string{"kiosk-archive/screen-9.jpg", "kiosk/menu.jpg", "kiosk/old/screen-0.jpg", "kiosk/screen-1.jpg", "kiosk/screen-2.webp", "logo.png"}},
+		{"kiosk/", []string{"kiosk/menu.jpg", "kiosk/old/screen-0.jpg", "kiosk/screen-1.jpg", "kiosk/screen-2.webp"}},
+		{"kiosk/screen-", []string{"kiosk/screen-1.jpg", "kiosk/screen-2.webp"}},
+		{"/kiosk/o", []string{"kiosk/old/screen-0.jpg"}},
+		{"kiosk", []string{"kiosk-archive/screen-9.jpg", "kiosk/menu.jpg", "kiosk/old/screen-0.jpg", "kiosk/screen-1.jpg", "kiosk/screen-2.webp"}},
+		{"missing/", []string{}},
+		{"../", []string{"kiosk-archive/screen-9.jpg", "kiosk/menu.jpg", "kiosk/old/screen-0.jpg", "kiosk/screen-1.jpg", "kiosk/screen-2.webp", "logo.png"}},
+	}
+
+	for _, c := range cases {
+		listing, err := listMountFiles(mount, c.prefix)
+		if err != nil {
+			t.Fatalf("%q: cannot list files: %s", c.prefix, err)
+		}
+		files := []string{}
+		for _, file := range listing.Files {
+			files = append(files, file.Path)
+		}
+		if !reflect.DeepEqual(files, c.files) || listing.Truncated {
+			t.Errorf("%q: expected files %v, got %v", c.prefix, c.files, files)
+		}
+	}
+}
+
+func TestFilesController(t *testing.T) {
+	mount := newFilesMount(t)
+	handler := Middleware(filesController(ServerOptions{Mount: mount, APIKey: "secret"}), ServerOptions{Mount: mount, APIKey: "secret"})
+
+	r := httptest.NewRequest(http.MethodGet, "/files?prefix=kiosk/screen-", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized status, got: %d", w.Code)
+	}
+
+	r.Header.Set("API-Key", "secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var listing FileListing
+	if err := json.NewDecoder(w.Body).Decode(&listing); err != nil {
+		t.Fatalf("Invalid JSON response: %s", err)
+	}
+	if len(listing.Files) != 2 || listing.Files[0].Path != "kiosk/screen-1.jpg" || listing.Files[0].Size != int64(len("kiosk/screen-1.jpg")) {
+		t.Errorf("Invalid listing: %+v", listing)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/files", nil)
+	r.Header.Set("API-Key", "secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed status, got: %d", w.Code)
+	}
+
+	// Writes require the -enable-mount-writes flag
+	r = httptest.NewRequest(http.MethodDelete, "/files?file=logo.png", nil)
+	r.Header.Set("API-Key", "secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if _, err := os.Stat(filepath.Join(mount, "logo.png")); w.Code != http.StatusMethodNotAllowed || err != nil {
+		t.Errorf("Expected method not allowed status, got: %d", w.Code)
+	}
+}
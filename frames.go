@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+const (
+	// maxAnimatedFrames bounds the frames of the animated GIF images decoded
+	// by the frame params, along with -max-gif-frames
+	maxAnimatedFrames = 1000
+
+	// maxFrameDelay is the maximum frame delay in milliseconds, stored by GIF
+	// images as 16 bits hundredths of a second
+	maxFrameDelay = 655350
+)
+
+// hasFrameOptions reports whether the animated image frames are selected or
+// re-timed, see framesOperation
+func hasFrameOptions(o ImageOptions) bool {
+	return o.Frame > 0 || o.FrameStep > 0 || o.MaxFrames > 0 || o.Delay > 0 || o.IsDefinedField.Loop
+}
+
+// framesOperation wraps the operation to apply the frame params to the
+// animated GIF images, since libvips only processes their first frame: either
+// the selected frame is processed as a still image, or every kept frame is
+// processed one at a time, and re-encoded as GIF animation with the requested
+// loop count and delay. Other images are processed as usual.
+func framesOperation(operation Operation) Operation {
+	return func(buf []byte, opts ImageOptions) (Image, error) {
+		if !hasFrameOptions(opts) || bimg.DetermineImageType(buf) != bimg.GIF {
+			return operation(buf, opts)
+		}
+		if gifFrameCount(buf, maxAnimatedFrames) > maxAnimatedFrames {
+			return Image{}, ErrTooManyFrames
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(buf))
+		if err != nil {
+			return Image{}, NewError("Cannot decode the GIF frames: "+err.Error(), http.StatusBadRequest)
+		}
+		frames := composeGIFFrames(anim)
+
+		if opts.Frame > 0 {
+			if opts.Frame > len(frames) {
+				return Image{}, NewParamError(fmt.Sprintf("Invalid frame: the image has %d frames", len(frames)), "frame")
+			}
+			var still bytes.Buffer
+			if err := gif.Encode(&still, frames[opts.Frame-1], nil); err != nil {
+				return Image{}, err
+			}
+			return operation(still.Bytes(), opts)
+		}
+		return animateGIFFrames(anim, frames, operation, opts)
+	}
+}
+
+// composeGIFFrames returns the full frames of the GIF animation, as displayed:
+// each frame drawn over the previous ones, as left by their disposal method.
+// The frames are quantized to their own palette.
+func composeGIFFrames(anim *gif.GIF) []*image.Paletted {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.Paletted, 0, len(anim.Image))
+
+	for i, frame := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		composed := image.NewPaletted(bounds, framePalette(frame.Palette))
+		draw.Draw(composed, bounds, canvas, image.Point{}, draw.Src)
+		frames = append(frames, composed)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// framePalette returns the palette with a transparent color, if missing and
+// not full, so the transparent areas of the full frames are kept
+func framePalette(palette color.Palette) color.Palette {
+	if len(palette) >= 256 {
+		return palette
+	}
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return palette
+		}
+	}
+	return append(append(color.Palette{}, palette...), color.Transparent)
+}
+
+// animateGIFFrames processes every framestep frame, up to maxframes, with the
+// operation, and encodes them as GIF animation. Skipped frames extend the
+// delay of the previous kept frame, so the animation duration is unchanged,
+// unless the delay param overrides it.
+func animateGIFFrames(anim *gif.GIF, frames []*image.Paletted, operation Operation, opts ImageOptions) (Image, error) {
+	if opts.Type != "" && ImageType(opts.Type) != bimg.GIF {
+		return Image{}, NewParamError("Animated images are only encoded as GIF: use type=gif, or the frame param to select a still frame", "type")
+	}
+	step := opts.FrameStep
+	if step < 1 {
+		step = 1
+	}
+
+	out := &gif.GIF{LoopCount: anim.LoopCount}
+	if opts.IsDefinedField.Loop {
+		// GIF images store the repetitions after the first run, 0 looping forever
+		switch opts.Loop {
+		case 0:
+			out.LoopCount = 0
+		case 1:
+			out.LoopCount = -1
+		default:
+			out.LoopCount = opts.Loop - 1
+		}
+	}
+
+	frameOpts := opts
+	frameOpts.Type = "png"
+	for i := 0; i < len(frames); i += step {
+		if opts.MaxFrames > 0 && len(out.Image) == opts.MaxFrames {
+			break
+		}
+		if err := opts.Context().Err(); err != nil {
+			return Image{}, ErrClientClosedRequest
+		}
+
+		var still bytes.Buffer
+		if err := png.Encode(&still, frames[i]); err != nil {
+			return Image{}, err
+		}
+		result, err := operation(still.Bytes(), frameOpts)
+		if err != nil {
+			return Image{}, err
+		}
+		processed, err := png.Decode(bytes.NewReader(result.Body))
+		if err != nil {
+			return Image{}, NewError("Frame params are only supported by the operations replying an image", http.StatusBadRequest).WithKind(KindInvalidParam)
+		}
+		if len(out.Image) > 0 && processed.Bounds() != out.Image[0].Bounds() {
+			return Image{}, NewError("Animated frames processed to different sizes", http.StatusUnprocessableEntity)
+		}
+
+		paletted := imageNewPaletted(processed, frames[i].Palette)
+		delay := 0
+		for j := i; j < i+step && j < len(anim.Delay); j++ {
+			delay += anim.Delay[j]
+		}
+		if opts.Delay > 0 {
+			delay = opts.Delay / 10
+		}
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return Image{}, err
+	}
+	bounds := out.Image[0].Bounds()
+	return Image{Body: buf.Bytes(), Mime: "image/gif", Width: bounds.Dx(), Height: bounds.Dy()}, nil
+}
+
+// imageNewPaletted quantizes the processed frame to its source palette, with
+// Floyd-Steinberg error diffusion
+func imageNewPaletted(img image.Image, palette color.Palette) *image.Paletted {
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, bounds.Min)
+	return paletted
+}
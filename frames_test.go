@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+// pngOperation decodes the frame and encodes it as PNG, recording the decoded
+// frames, as a libvips operation would
+func pngOperation(frames *[]image.Image) Operation {
+	return func(buf []byte, opts ImageOptions) (Image, error) {
+		img, _, err := image.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return Image{}, err
+		}
+		*frames = append(*frames, img)
+		var out bytes.Buffer
+		if err := png.Encode(&out, img); err != nil {
+			return Image{}, err
+		}
+		return Image{Body: out.Bytes(), Mime: "image/png"}, nil
+	}
+}
+
+func TestFramesOperationFrame(t *testing.T) {
+	var frames []image.Image
+	operation := framesOperation(pngOperation(&frames))
+
+	if _, err := operation(newTestGIF(t, 5), ImageOptions{Frame: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("Invalid processed frames: %d", len(frames))
+	}
+	// The third frame sets the pixel 2,2 over the previous ones
+	if r, _, _, _ := frames[0].At(2, 2).RGBA(); r == 0 {
+		t.Error("Expected the third frame")
+	}
+	if r, _, _, _ := frames[0].At(3, 3).RGBA(); r != 0 {
+		t.Error("Unexpected fourth frame pixel")
+	}
+
+	if _, err := operation(newTestGIF(t, 5), ImageOptions{Frame: 6}); err == nil || err.(Error).Param != "frame" {
+		t.Errorf("Expected frame error, got %v", err)
+	}
+}
+
+func TestFramesOperationAnimation(t *testing.T) {
+	cases := []struct {
+		opts   ImageOptions
+		frames int
+		delay  int
+		loop   int
+	}{
+		{ImageOptions{FrameStep: 2}, 5, 20, 0},
+		{ImageOptions{FrameStep: 3, MaxFrames: 1}, 1, 30, -1},
+		{ImageOptions{MaxFrames: 4, Delay: 250}, 4, 25, 0},
+		{ImageOptions{Loop: 1, IsDefinedField: IsDefinedField{Loop: true}}, 10, 10, -1},
+		{ImageOptions{Loop: 3, IsDefinedField: IsDefinedField{Loop: true}}, 10, 10, 2},
+	}
+
+	for _, tc := range cases {
+		var frames []image.Image
+		result, err := framesOperation(pngOperation(&frames))(newTestGIF(t, 10), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(result.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Mime != "image/gif" || len(anim.Image) != tc.frames || len(frames) != tc.frames {
+			t.Errorf("%+v: invalid frames: %d", tc.opts, len(anim.Image))
+			continue
+		}
+		if anim.Delay[0] != tc.delay || anim.LoopCount != tc.loop {
+			t.Errorf("%+v: invalid delay %d or loop count %d", tc.opts, anim.Delay[0], anim.LoopCount)
+		}
+	}
+}
+
+func TestFramesOperationErrors(t *testing.T) {
+	var frames []image.Image
+	operation := framesOperation(pngOperation(&frames))
+
+	if _, err := operation(newTestGIF(t, 3), ImageOptions{FrameStep: 2, Type: "webp"}); err == nil || err.(Error).Param != "type" {
+		t.Errorf("Expected type error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := operation(newTestGIF(t, 3), ImageOptions{FrameStep: 2}.WithContext(ctx)); err != ErrClientClosedRequest {
+		t.Errorf("Expected client closed request error, got %v", err)
+	}
+
+	// Still images are processed as usual
+	if _, err := operation([]byte("not an image"), ImageOptions{FrameStep: 2}); err == nil {
+		t.Error("Expected the operation error")
+	}
+	if len(frames) != 0 {
+		t.Errorf("Unexpected processed frames: %d", len(frames))
+	}
+}
+
+func TestReadFrameParams(t *testing.T) {
+	opts, err := buildParamsFromQuery(url.Values{"frame": {"2"}, "framestep": {"3"}, "maxframes": {"10"}, "loop": {"0"}, "delay": {"80"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Frame != 2 || opts.FrameStep != 3 || opts.MaxFrames != 10 || opts.Loop != 0 || !opts.IsDefinedField.Loop || opts.Delay != 80 {
+		t.Errorf("Invalid frame params: %+v", opts)
+	}
+
+	for _, q := range []url.Values{{"frame": {"0"}}, {"framestep": {"0"}}, {"maxframes": {"0"}}, {"delay": {"5"}}, {"delay": {"700000"}}} {
+		if _, err := buildParamsFromQuery(q); err == nil {
+			t.Errorf("%v: expected error", q)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build go1.18
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+// The fuzz targets run their seeds, and the failing inputs saved under
+// testdata/fuzz, as regular tests. Fuzz them via: make fuzz
+
+func FuzzBuildParamsFromQuery(f *testing.F) {
+	for _, seed := range []string{
+		"width=300&height=200&type=webp&quality=80",
+		"width=300&aspectratio=16:9",
+		"height=300&aspectratio=4:3",
+		"extend=background&background=255,200,150",
+		"gravity=smart&crop=true&nocrop=false",
+		"quality=auto&type=auto",
+		"widths=320,640,1280&sizes=100vw&formats=avif,webp",
+		"matrix=1,0,0,1&points=0,0,10,10",
+		`operations=[{"operation":"crop","params":{"width":100}}]`,
+		"width=-1&height=1e400&sigma=NaN",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		query, err := url.ParseQuery(raw)
+		if err != nil {
+			return
+		}
+		opts, err := buildParamsFromQuery(query)
+		if err != nil {
+			var perr ParamError
+			if !errors.As(err, &perr) {
+				t.Errorf("Expected param error, got %T: %s", err, err)
+			}
+			return
+		}
+		BimgOptions(opts)
+	})
+}
+
+func FuzzPipelineJSON(f *testing.F) {
+	for _, seed := range []string{
+		`[{"operation":"crop","params":{"width":300,"height":260}},{"operation":"convert","params":{"type":"webp"}}]`,
+		`[{"operation":"resize","params":{"width":300,"aspectratio":"16:9","type":"auto"}}]`,
+		`[{"operation":"blur","ignore_failure":true,"params":{"sigma":"5"}}]`,
+		`[{"operation":"watermark","params":{"text":"foo","background":[255,0,0]}}]`,
+		`[{"operation":"crop","params":null},{"operation":"convert","params":{"type":null}}]`,
+		`[{"operation":"resize","params":{"width":{"nested":true},"height":[1,2]}}]`,
+		`[{"name":"small","operations":[{"operation":"resize","params":{"width":100}}]}]`,
+		`[]`,
+		`{}`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data string) {
+		if operations, err := parseJSONOperations(data); err == nil {
+			checkPipelineOperations(t, operations)
+		}
+		if branches, err := parseJSONBranches(data); err == nil {
+			opts := ImageOptions{Branches: branches}
+			if pipelineHasAutoType(opts) {
+				resolvePipelineAutoType(opts, "webp")
+			}
+			for _, branch := range branches {
+				checkPipelineOperations(t, branch.Operations)
+			}
+		}
+	})
+}
+
+// checkPipelineOperations builds the options of the operations as runPipeline
+func checkPipelineOperations(t *testing.T, operations PipelineOperations) {
+	t.Helper()
+	for _, operation := range operations {
+		opts, err := buildParamsFromOperation(operation)
+		if err != nil {
+			var perr ParamError
+			if !errors.As(err, &perr) {
+				t.Errorf("Expected param error, got %T: %s", err, err)
+			}
+			continue
+		}
+		BimgOptions(opts)
+	}
+}
+
+func FuzzDetectMimeType(f *testing.F) {
+	for _, name := range []string{"imaginary.jpg", "test.png", "test.webp", "flyio-button.svg"} {
+		f.Add(readTestFile(f, name))
+	}
+	f.Add([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+	f.Add([]byte("GIF89a"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if mimeType := detectMimeType(buf); mimeType == "" {
+			t.Errorf("Empty MIME type for %q", buf)
+		}
+	})
+}
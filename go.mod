@@ -6,6 +6,9 @@ require (
 	github.com/h2non/bimg v1.1.9
 	github.com/h2non/filetype v1.1.3
 	github.com/hashicorp/golang-lru v1.0.2 // indirect
+	github.com/makiuchi-d/gozxing v0.1.1
+	github.com/nats-io/nats.go v1.16.0
 	github.com/rs/cors v1.11.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/throttled/throttled/v2 v2.12.0
 )
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// Anchor represents the position of the gravity on each axis: -1 for the
+// west and north edges, 0 for the centre and 1 for the east and south edges
+type Anchor struct {
+	X int
+	Y int
+}
+
+// Corner reports whether the anchor is a corner, such as north_west, not
+// supported by the libvips crop gravity
+func (a Anchor) Corner() bool {
+	return a.X != 0 && a.Y != 0
+}
+
+var anchorsMap = map[string]Anchor{
+	"north":      {0, -1},
+	"south":      {0, 1},
+	"east":       {1, 0},
+	"west":       {-1, 0},
+	"centre":     {0, 0},
+	"center":     {0, 0},
+	"north_west": {-1, -1},
+	"north_east": {1, -1},
+	"south_west": {-1, 1},
+	"south_east": {1, 1},
+}
+
+// parseAnchor parses the gravity position, defaulting to the centre
+func parseAnchor(val string) Anchor {
+	val = strings.Replace(strings.TrimSpace(strings.ToLower(val)), "-", "_", -1)
+	return anchorsMap[val]
+}
+
+// anchored reports whether the crop area must be positioned by imaginary,
+// given a corner gravity or edge offsets
+func anchored(o ImageOptions) bool {
+	return o.Gravity != bimg.GravitySmart && (o.Anchor.Corner() || o.XOffset != 0 || o.YOffset != 0)
+}
+
+// anchorPosition returns the offset of the area within the given size,
+// aligned to the anchor edge and moved inwards by the offset. Offsets move
+// the area right and down with the centre gravity.
+func anchorPosition(size, area, anchor, offset int) int {
+	var pos int
+	switch anchor {
+	case -1:
+		pos = offset
+	case 1:
+		pos = size - area - offset
+	default:
+		pos = (size-area)/2 + offset
+	}
+
+	if pos > size-area {
+		pos = size - area
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	return pos
+}
+
+// AnchoredCrop resizes the image to cover the requested dimensions, then
+// extracts the area at the gravity position, in a single libvips pipeline
+func AnchoredCrop(buf []byte, o ImageOptions) (Image, error) {
+	width, height, err := sourceDimensions(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+	if width == 0 || height == 0 {
+		return Image{}, NewError("Width or height of requested image is zero", http.StatusNotAcceptable)
+	}
+
+	areaWidth, areaHeight := o.Width, o.Height
+	if areaWidth == 0 {
+		areaWidth = width
+	}
+	if areaHeight == 0 {
+		areaHeight = height
+	}
+
+	// Images smaller than the area are cropped, not enlarged, as libvips does
+	scale := math.Max(float64(areaWidth)/float64(width), float64(areaHeight)/float64(height))
+	if areaWidth > width && areaHeight > height {
+		scale = 1
+	}
+
+	resizedWidth := int(math.Round(float64(width) * scale))
+	resizedHeight := int(math.Round(float64(height) * scale))
+	if areaWidth > resizedWidth {
+		areaWidth = resizedWidth
+	}
+	if areaHeight > resizedHeight {
+		areaHeight = resizedHeight
+	}
+
+	opts := BimgOptions(o)
+	opts.Width = resizedWidth
+	opts.Height = resizedHeight
+	opts.Force = true
+	opts.Crop = false
+	opts.Embed = false
+	opts.Left = anchorPosition(resizedWidth, areaWidth, o.Anchor.X, o.XOffset)
+	opts.Top = anchorPosition(resizedHeight, areaHeight, o.Anchor.Y, o.YOffset)
+	opts.AreaWidth = areaWidth
+	opts.AreaHeight = areaHeight
+	return Process(buf, opts)
+}
+
+// anchorExtractArea positions the extract area at the gravity position of
+// the image, resized with the width and height params, if any
+func anchorExtractArea(buf []byte, o ImageOptions) (int, int, error) {
+	width, height, err := sourceDimensions(buf, o)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		width, height = o.Width, o.Height
+	case o.Width > 0 && width > 0:
+		width, height = o.Width, int(math.Round(float64(height)*float64(o.Width)/float64(width)))
+	case o.Height > 0 && height > 0:
+		width, height = int(math.Round(float64(width)*float64(o.Height)/float64(height))), o.Height
+	}
+
+	left := anchorPosition(width, o.AreaWidth, o.Anchor.X, o.XOffset)
+	top := anchorPosition(height, o.AreaHeight, o.Anchor.Y, o.YOffset)
+	return left, top, nil
+}
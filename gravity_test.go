@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseAnchor(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected Anchor
+	}{
+		{"north_west", Anchor{-1, -1}},
+		{"South-East", Anchor{1, 1}},
+		{"east", Anchor{1, 0}},
+		{"centre", Anchor{0, 0}},
+		{"smart", Anchor{0, 0}},
+		{"foo", Anchor{0, 0}},
+	}
+
+	for _, test := range cases {
+		if anchor := parseAnchor(test.value); anchor != test.expected {
+			t.Errorf("Invalid anchor for %q: %+v", test.value, anchor)
+		}
+	}
+}
+
+func TestAnchorPosition(t *testing.T) {
+	cases := []struct {
+		size, area, anchor, offset, expected int
+	}{
+		{100, 40, -1, 0, 0},
+		{100, 40, -1, 10, 10},
+		{100, 40, 1, 0, 60},
+		{100, 40, 1, 10, 50},
+		{100, 40, 0, 0, 30},
+		{100, 40, 0, -10, 20},
+		{100, 40, -1, 80, 60},
+		{100, 40, 1, 80, 0},
+	}
+
+	for _, test := range cases {
+		if pos := anchorPosition(test.size, test.area, test.anchor, test.offset); pos != test.expected {
+			t.Errorf("Invalid position for %+v: %d", test, pos)
+		}
+	}
+}
+
+func TestAnchoredCrop(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	opts := ImageOptions{Width: 300, Height: 100, Anchor: Anchor{1, 1}, YOffset: 20}
+	if !anchored(opts) {
+		t.Fatal("Corner gravities must be anchored")
+	}
+
+	img, err := Crop(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot crop image: %s", err)
+	}
+	if err := assertSize(img.Body, 300, 100); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,9 +2,15 @@
 package main
 
 import (
+	"fmt"
+	"io/fs"
 	"math"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/h2non/bimg"
 )
 
 // Track server start time
@@ -25,6 +31,16 @@ type HealthStats struct {
 	HeapAllocated        float64 `json:"heapInUse"`
 	ObjectsInUse         uint64  `json:"objectsInUse"`
 	OSMemoryObtained     float64 `json:"OSMemoryObtained"`
+	TransformTimeouts    uint64  `json:"transformTimeouts"`
+	TransformMemoryLimit uint64  `json:"transformMemoryLimitExceeded"`
+	TransformsRunning    int64   `json:"transformsRunning"`
+	WorkersBusy          int64   `json:"workersBusy"`
+	QueueDepth           int64   `json:"queueDepth"`
+	RequestsShed         uint64  `json:"requestsShed"`
+	MemoryReleases       uint64  `json:"memoryReleases"`
+
+	// Operations holds the image operations metrics, by endpoint name
+	Operations map[string]OperationStats `json:"operations"`
 }
 
 // GetHealthStats returns current server health metrics
@@ -43,6 +59,15 @@ func GetHealthStats() *HealthStats {
 		HeapAllocated:        toMegaBytes(mem.HeapAlloc),
 		ObjectsInUse:         mem.Mallocs - mem.Frees,
 		OSMemoryObtained:     toMegaBytes(mem.Sys),
+		TransformTimeouts:    atomic.LoadUint64(&watchdogTimeouts),
+		TransformMemoryLimit: atomic.LoadUint64(&watchdogMemory),
+		TransformsRunning:    atomic.LoadInt64(&watchdogRunning),
+		WorkersBusy:          atomic.LoadInt64(&workersBusy),
+		QueueDepth:           atomic.LoadInt64(&queueDepth),
+		RequestsShed:         atomic.LoadUint64(&requestsShed),
+		MemoryReleases:       atomic.LoadUint64(&watchdogReleases),
+
+		Operations: operationStats(),
 	}
 }
 
@@ -61,3 +86,101 @@ func toFixed(num float64, precision int) float64 {
 	output := math.Pow(10, float64(precision))
 	return float64(round(num*output)) / output
 }
+
+// Readiness check statuses. Degraded checks succeeded, but slower than the
+// -health-degraded-latency threshold.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFail     = "fail"
+)
+
+// healthChecks maps the readiness check names, enabled via -health-checks,
+// to their implementation
+var healthChecks = map[string]func(o ServerOptions) error{
+	"mount": checkMountsHealth,
+	"vips":  checkVipsHealth,
+}
+
+// HealthCheck holds the result of a readiness check
+type HealthCheck struct {
+	Status   string  `json:"status"`
+	Duration float64 `json:"durationMs"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Readiness holds the readiness checks results, the overall status being
+// the worst check status
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// CheckReadiness runs the enabled readiness checks concurrently
+func CheckReadiness(o ServerOptions) *Readiness {
+	readiness := &Readiness{Status: HealthOK, Checks: make(map[string]HealthCheck, len(o.HealthChecks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range o.HealthChecks {
+		check, ok := healthChecks[name]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, check func(ServerOptions) error) {
+			defer wg.Done()
+			started := time.Now()
+			err := check(o)
+			elapsed := time.Since(started)
+
+			result := HealthCheck{Status: HealthOK, Duration: toFixed(float64(elapsed)/float64(time.Millisecond), 2)}
+			if err != nil {
+				result.Status, result.Error = HealthFail, err.Error()
+			} else if o.DegradedLatency > 0 && elapsed > o.DegradedLatency {
+				result.Status = HealthDegraded
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Checks[name] = result
+			if result.Status == HealthFail || (result.Status == HealthDegraded && readiness.Status == HealthOK) {
+				readiness.Status = result.Status
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return readiness
+}
+
+// checkMountsHealth checks the mount directories, or archives, are readable
+func checkMountsHealth(o ServerOptions) error {
+	mounts := map[string]string{"default": o.Mount}
+	for name, dir := range o.Mounts {
+		mounts[name] = dir
+	}
+	for name, dir := range mounts {
+		if dir == "" {
+			continue
+		}
+		fsys, err := openMount(dir)
+		if err == nil {
+			_, err = fs.ReadDir(fsys, ".")
+		}
+		if err != nil {
+			return fmt.Errorf("mount %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// checkVipsHealth checks libvips by resizing a tiny image
+func checkVipsHealth(o ServerOptions) error {
+	buf, err := bimg.Resize(selfTestImage(), bimg.Options{Width: 4, Height: 4, Type: bimg.JPEG})
+	if err != nil {
+		return err
+	}
+	if bimg.DetermineImageType(buf) != bimg.JPEG {
+		return fmt.Errorf("unexpected output format %s", bimg.DetermineImageTypeName(buf))
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
 
 func TestToMegaBytes(t *testing.T) {
 	tests := []struct {
@@ -64,3 +69,32 @@ func TestToFixed(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckReadiness(t *testing.T) {
+	readiness := CheckReadiness(ServerOptions{HealthChecks: []string{"mount"}, Mount: "testdata", Mounts: Mounts{"missing": "_invalid_"}})
+	if readiness.Status != HealthFail || readiness.Checks["mount"].Status != HealthFail || readiness.Checks["mount"].Error == "" {
+		t.Errorf("Expected failed mount check, got: %+v", readiness)
+	}
+
+	readiness = CheckReadiness(ServerOptions{HealthChecks: []string{"mount"}, Mount: "testdata"})
+	if readiness.Status != HealthOK || readiness.Checks["mount"].Status != HealthOK {
+		t.Errorf("Expected ok mount check, got: %+v", readiness)
+	}
+
+	healthChecks["slow"] = func(ServerOptions) error { time.Sleep(5 * time.Millisecond); return nil }
+	defer delete(healthChecks, "slow")
+	readiness = CheckReadiness(ServerOptions{HealthChecks: []string{"mount", "slow"}, Mount: "testdata", DegradedLatency: time.Millisecond})
+	if readiness.Status != HealthDegraded || readiness.Checks["slow"].Status != HealthDegraded {
+		t.Errorf("Expected degraded check, got: %+v", readiness)
+	}
+}
+
+func TestReadinessController(t *testing.T) {
+	for mount, status := range map[string]int{"testdata": http.StatusOK, "_invalid_": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		readinessController(ServerOptions{HealthChecks: []string{"mount"}, Mount: mount})(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", mount, status, w.Code)
+		}
+	}
+}
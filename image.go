@@ -5,10 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/h2non/bimg"
+	"image/color"
 	"io"
 	"math"
 	"net/http"
 	"strings"
+	"time"
+)
+
+// defaultBlockSize defines the default pixelation block size in pixels
+const defaultBlockSize = 16
+
+// Enhance operation methods
+const (
+	EnhanceContrast = "contrast"
+	EnhanceEqualize = "equalize"
+	EnhanceNone     = "none"
 )
 
 // OperationsMap defines the allowed image transformation operations
@@ -29,15 +41,37 @@ var OperationsMap = map[string]Operation{
 	"blur":           GaussianBlur,
 	"smartcrop":      SmartCrop,
 	"fit":            Fit,
+	"transform":      Transform,
+	"pixelate":       Pixelate,
+	"enhance":        Enhance,
+	"colorspace":     Colorspace,
 }
 
 type Image struct {
 	Body []byte
 	Mime string
+	// Width and height of the output image, if known
+	Width  int
+	Height int
 }
 
 type Operation func([]byte, ImageOptions) (Image, error)
 
+// ResponseFormatJSON is the format param value replying the image within a
+// JSON envelope
+const ResponseFormatJSON = "json"
+
+// ImageEnvelope represents the JSON envelope of the processed image, for
+// clients reading the image metadata without parsing the response headers
+type ImageEnvelope struct {
+	Image  string  `json:"image"`
+	Mime   string  `json:"mime"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Bytes  int     `json:"bytes"`
+	Timing float64 `json:"timing"`
+}
+
 type ImageInfo struct {
 	Width       int    `json:"width"`
 	Height      int    `json:"height"`
@@ -50,6 +84,24 @@ type ImageInfo struct {
 }
 
 func (o Operation) Run(buf []byte, opts ImageOptions) (Image, error) {
+	// Don't start processing images nobody will receive
+	if opts.Context().Err() != nil {
+		return Image{}, ErrClientClosedRequest
+	}
+	opts, err := limitEnlargement(buf, opts)
+	if err != nil {
+		return Image{}, err
+	}
+	if opts.Depth > depth8 {
+		return PreserveDepth(o, buf, opts)
+	}
+	// Lossless encoding doesn't depend on the quality
+	if opts.AutoQuality && !opts.Lossless {
+		return AutoQuality(o, buf, opts)
+	}
+	if opts.Optimize {
+		return OptimizeJPEG(o, buf, opts)
+	}
 	return o(buf, opts)
 }
 
@@ -106,16 +158,24 @@ func Process(buf []byte, opts bimg.Options) (out Image, err error) {
 		}
 	}
 
+	width, height, _ := imageDimensions(ibuf)
 	return Image{
-		Body: ibuf,
-		Mime: GetImageMimeType(bimg.DetermineImageType(ibuf)),
+		Body:   ibuf,
+		Mime:   GetImageMimeType(bimg.DetermineImageType(ibuf)),
+		Width:  width,
+		Height: height,
 	}, nil
 }
 
 func Resize(buf []byte, o ImageOptions) (Image, error) {
 	// Validate dimensions
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: height or width", "")
+	}
+
+	buf, err := upscale(buf, o)
+	if err != nil {
+		return Image{}, err
 	}
 
 	// Create options with optimal defaults
@@ -138,7 +198,7 @@ func Resize(buf []byte, o ImageOptions) (Image, error) {
 
 func Fit(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 || o.Height == 0 {
-		return Image{}, NewError("Missing required params: height, width", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required params: height, width", "")
 	}
 
 	metadata, err := bimg.Metadata(buf)
@@ -201,7 +261,12 @@ func calculateDestinationFitDimension(imageWidth, imageHeight, fitWidth, fitHeig
 
 func Enlarge(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 || o.Height == 0 {
-		return Image{}, NewError("Missing required params: height, width", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required params: height, width", "")
+	}
+
+	buf, err := upscale(buf, o)
+	if err != nil {
+		return Image{}, err
 	}
 
 	opts := BimgOptions(o)
@@ -211,13 +276,23 @@ func Enlarge(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func Extract(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Regions) > 0 {
+		return ExtractRegions(buf, o)
+	}
 	if o.AreaWidth == 0 || o.AreaHeight == 0 {
-		return Image{}, NewError("Missing required params: areawidth or areaheight", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required params: areawidth or areaheight", "")
 	}
 
 	opts := BimgOptions(o)
 	opts.Top = o.Top
 	opts.Left = o.Left
+	if o.IsDefinedField.Gravity || o.XOffset != 0 || o.YOffset != 0 {
+		left, top, err := anchorExtractArea(buf, o)
+		if err != nil {
+			return Image{}, err
+		}
+		opts.Left, opts.Top = left, top
+	}
 	opts.AreaWidth = o.AreaWidth
 	opts.AreaHeight = o.AreaHeight
 	return Process(buf, opts)
@@ -225,7 +300,10 @@ func Extract(buf []byte, o ImageOptions) (Image, error) {
 
 func Crop(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: height or width", "")
+	}
+	if anchored(o) {
+		return AnchoredCrop(buf, o)
 	}
 
 	opts := BimgOptions(o)
@@ -235,7 +313,7 @@ func Crop(buf []byte, o ImageOptions) (Image, error) {
 
 func SmartCrop(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required param: height or width", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: height or width", "")
 	}
 
 	opts := BimgOptions(o)
@@ -246,7 +324,7 @@ func SmartCrop(buf []byte, o ImageOptions) (Image, error) {
 
 func Rotate(buf []byte, o ImageOptions) (Image, error) {
 	if o.Rotate == 0 {
-		return Image{}, NewError("Missing required param: rotate", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: rotate", "rotate")
 	}
 
 	return Process(buf, BimgOptions(o))
@@ -258,6 +336,16 @@ func AutoRotate(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, err
 	}
 
+	if o.StripMetadata {
+		// AutoRotate keeps the original metadata, strip it in a second pass
+		opts := BimgOptions(o)
+		opts.NoAutoRotate = true
+		if opts.Type == bimg.UNKNOWN {
+			opts.Type = bimg.DetermineImageType(ibuf)
+		}
+		return Process(ibuf, opts)
+	}
+
 	return Image{
 		Body: ibuf,
 		Mime: GetImageMimeType(bimg.DetermineImageType(ibuf)),
@@ -276,23 +364,74 @@ func Flop(buf []byte, o ImageOptions) (Image, error) {
 	return Process(buf, opts)
 }
 
+// thumbnailCrop defines the region of the image kept by the thumbnails
+type thumbnailCrop int
+
+const (
+	thumbnailCropNone thumbnailCrop = iota
+	thumbnailCropCentre
+	thumbnailCropAttention
+)
+
+// Thumbnail shrinks the image to the width and height using the libvips
+// thumbnail operation, which shrinks JPEG, WebP and HEIF images while loading
+// them. Given both width and height, the image is cropped to fill them around
+// its center, or its most interesting region with gravity=smart, unless the
+// nocrop or embed params are defined. Images are never enlarged, unless forced.
+// The thumbnail is then encoded, applying the other options, by bimg.
 func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 && o.Height == 0 {
-		return Image{}, NewError("Missing required params: width or height", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required params: width or height", "")
 	}
-	return Process(buf, BimgOptions(o))
+
+	opts := BimgOptions(o)
+	crop := thumbnailCropNone
+	if opts.Width > 0 && opts.Height > 0 && !o.NoCrop && !o.Embed {
+		crop = thumbnailCropCentre
+		if o.Gravity == bimg.GravitySmart {
+			crop = thumbnailCropAttention
+		}
+	}
+
+	thumbnail, err := vipsThumbnail(buf, opts.Width, opts.Height, crop, o.Force, o.NoRotation)
+	if err != nil {
+		return Image{}, fmt.Errorf("image processing error: %w", err)
+	}
+
+	// The thumbnail is only resized again to be embedded
+	if !o.Embed {
+		opts.Width, opts.Height = 0, 0
+	}
+	opts.Force = false
+	opts.Gravity = bimg.GravityCentre
+	opts.NoAutoRotate = true
+	opts.Type = outputImageType(buf, o)
+	return Process(thumbnail, opts)
+}
+
+// outputImageType returns the image type defined by the options, or else the
+// source image type, or JPEG if libvips can't save it
+func outputImageType(buf []byte, o ImageOptions) bimg.ImageType {
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+		if !bimg.IsImageTypeSupportedByVips(outputType).Save {
+			outputType = bimg.JPEG
+		}
+	}
+	return outputType
 }
 
 func Zoom(buf []byte, o ImageOptions) (Image, error) {
 	if o.Factor == 0 {
-		return Image{}, NewError("Missing required param: factor", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: factor", "factor")
 	}
 
 	opts := BimgOptions(o)
 
 	if o.Top > 0 || o.Left > 0 {
 		if o.AreaWidth == 0 && o.AreaHeight == 0 {
-			return Image{}, NewError("Missing required params: areawidth, areaheight", http.StatusBadRequest)
+			return Image{}, NewMissingParamError("Missing required params: areawidth, areaheight", "")
 		}
 
 		opts.Top = o.Top
@@ -311,17 +450,48 @@ func Zoom(buf []byte, o ImageOptions) (Image, error) {
 
 func Convert(buf []byte, o ImageOptions) (Image, error) {
 	if o.Type == "" {
-		return Image{}, NewError("Missing required param: type", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: type", "type")
 	}
 	if ImageType(o.Type) == bimg.UNKNOWN {
-		return Image{}, NewError("Invalid image type: "+o.Type, http.StatusBadRequest)
+		return Image{}, NewParamError("Invalid image type: "+o.Type, "type")
 	}
 	return Process(buf, BimgOptions(o))
 }
 
+// Colorspace converts the image to sRGB, which also converts CMYK and 16-bit
+// images to 8-bit sRGB, to black and white or to sepia tones
+func Colorspace(buf []byte, o ImageOptions) (Image, error) {
+	if !o.Sepia {
+		opts := BimgOptions(o)
+		if opts.Interpretation == 0 {
+			opts.Interpretation = bimg.InterpretationSRGB
+		}
+		return Process(buf, opts)
+	}
+
+	img, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+	sepiaRaster(img)
+
+	if o.Width > 0 || o.Height > 0 {
+		toned, err := encodeRaster(img, buf, ImageOptions{Type: "png"})
+		if err != nil {
+			return Image{}, err
+		}
+		opts := BimgOptions(o)
+		if opts.Type == bimg.UNKNOWN {
+			opts.Type = bimg.DetermineImageType(buf)
+		}
+		return Process(toned.Body, opts)
+	}
+	return encodeRaster(img, buf, o)
+}
+
 func Watermark(buf []byte, o ImageOptions) (Image, error) {
 	if o.Text == "" {
-		return Image{}, NewError("Missing required param: text", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: text", "text")
 	}
 
 	opts := BimgOptions(o)
@@ -342,12 +512,36 @@ func Watermark(buf []byte, o ImageOptions) (Image, error) {
 
 func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 	if o.Image == "" {
-		return Image{}, NewError("Missing required param: image", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: image", "image")
+	}
+
+	imageBuf, err := watermarkImage(o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts := BimgOptions(o)
+	opts.WatermarkImage.Left = o.Left
+	opts.WatermarkImage.Top = o.Top
+	opts.WatermarkImage.Buf = imageBuf
+	opts.WatermarkImage.Opacity = o.Opacity
+
+	return Process(buf, opts)
+}
+
+// watermarkImage returns the watermark image, either uploaded in the
+// multipart form field named by the image param or fetched from its URL
+func watermarkImage(o ImageOptions) ([]byte, error) {
+	if buf, ok := o.File(o.Image); ok {
+		if len(buf) == 0 {
+			return nil, NewParamError("Unable to read watermark image: empty form file", "image")
+		}
+		return buf, nil
 	}
 
 	response, err := http.Get(o.Image)
 	if err != nil {
-		return Image{}, NewError(fmt.Sprintf("Unable to retrieve watermark image: %s", o.Image), http.StatusBadRequest)
+		return nil, NewParamError(fmt.Sprintf("Unable to retrieve watermark image: %s", o.Image), "image")
 	}
 	defer response.Body.Close()
 
@@ -357,54 +551,302 @@ func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 		if err != nil {
 			errMsg = fmt.Sprintf("%s: %s", errMsg, err.Error())
 		}
-		return Image{}, NewError(errMsg, http.StatusBadRequest)
+		return nil, NewParamError(errMsg, "image")
 	}
-
-	opts := BimgOptions(o)
-	opts.WatermarkImage.Left = o.Left
-	opts.WatermarkImage.Top = o.Top
-	opts.WatermarkImage.Buf = imageBuf
-	opts.WatermarkImage.Opacity = o.Opacity
-
-	return Process(buf, opts)
+	return imageBuf, nil
 }
 
 func GaussianBlur(buf []byte, o ImageOptions) (Image, error) {
 	if o.Sigma == 0 && o.MinAmpl == 0 {
-		return Image{}, NewError("Missing required param: sigma or minampl", http.StatusBadRequest)
+		return Image{}, NewMissingParamError("Missing required param: sigma or minampl", "")
 	}
 	return Process(buf, BimgOptions(o))
 }
 
+func Transform(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Matrix) == 0 && len(o.Points) == 0 {
+		return Image{}, NewMissingParamError("Missing required param: matrix or points", "")
+	}
+	if len(o.Points) != 0 && len(o.Points) != 8 {
+		return Image{}, NewParamError("Invalid param: points must define 4 x,y corner coordinates", "points")
+	}
+	if len(o.Points) == 0 && len(o.Matrix) != 6 {
+		return Image{}, NewParamError("Invalid param: matrix must define 6 affine coefficients", "matrix")
+	}
+
+	src, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var mapping func(x, y float64) (float64, float64)
+	width, height := o.Width, o.Height
+
+	if len(o.Points) == 8 {
+		// Perspective correction: map the source quadrilateral onto the output rectangle
+		var quad [4][2]float64
+		for i := range quad {
+			quad[i] = [2]float64{o.Points[i*2], o.Points[i*2+1]}
+		}
+		if width == 0 || height == 0 {
+			width, height = quadDimensions(quad)
+		}
+
+		w, h := float64(width), float64(height)
+		hom, err := newHomography([4][2]float64{{0, 0}, {w, 0}, {w, h}, {0, h}}, quad)
+		if err != nil {
+			return Image{}, NewParamError("Invalid param: "+err.Error(), "points")
+		}
+		mapping = hom.apply
+	} else {
+		var matrix affineMatrix
+		copy(matrix[:], o.Matrix)
+		inverse, err := matrix.invert()
+		if err != nil {
+			return Image{}, NewParamError("Invalid param: "+err.Error(), "matrix")
+		}
+		if width == 0 || height == 0 {
+			width, height = src.Bounds().Dx(), src.Bounds().Dy()
+		}
+		mapping = inverse.apply
+	}
+
+	if width <= 0 || height <= 0 || width > maxRasterPixels/height {
+		return Image{}, NewError("Invalid output dimensions", http.StatusBadRequest)
+	}
+
+	var bg color.NRGBA
+	if len(o.Background) > 2 {
+		bg = color.NRGBA{R: o.Background[0], G: o.Background[1], B: o.Background[2], A: 255}
+	}
+
+	return encodeRaster(warpRaster(src, width, height, bg, mapping), buf, o)
+}
+
+func Pixelate(buf []byte, o ImageOptions) (Image, error) {
+	size := o.BlockSize
+	if size <= 0 {
+		size = defaultBlockSize
+	}
+
+	img, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+	// Larger blocks would average the whole image as well
+	if bounds := img.Bounds(); size > bounds.Dx() && size > bounds.Dy() {
+		size = bounds.Dx()
+		if bounds.Dy() > size {
+			size = bounds.Dy()
+		}
+	}
+
+	if len(o.Regions) == 0 {
+		pixelateRaster(img, img.Bounds(), size)
+	}
+	for _, region := range o.Regions {
+		if region.Width <= 0 || region.Height <= 0 {
+			return Image{}, NewParamError("Invalid region: width and height are required", "regions")
+		}
+		pixelateRaster(img, region.Rect(), size)
+	}
+
+	if o.Width > 0 || o.Height > 0 {
+		// Redact before resizing, so the pixelation survives the downscale
+		pixelated, err := encodeRaster(img, buf, ImageOptions{Type: "png"})
+		if err != nil {
+			return Image{}, err
+		}
+		opts := BimgOptions(o)
+		if opts.Type == bimg.UNKNOWN {
+			opts.Type = bimg.DetermineImageType(buf)
+		}
+		return Process(pixelated.Body, opts)
+	}
+
+	return encodeRaster(img, buf, o)
+}
+
+// Enhance corrects the exposure of the image, stretching its contrast (auto
+// levels) or equalizing its histogram, optionally correcting the white balance
+// first, e.g. for scanned documents or underexposed photos.
+func Enhance(buf []byte, o ImageOptions) (Image, error) {
+	method := o.Method
+	if method == "" {
+		method = EnhanceContrast
+	}
+	if method != EnhanceContrast && method != EnhanceEqualize && method != EnhanceNone {
+		return Image{}, NewParamError("Invalid param: method must be contrast, equalize or none", "method")
+	}
+
+	img, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if o.WhiteBalance {
+		whiteBalanceRaster(img)
+	}
+	switch method {
+	case EnhanceContrast:
+		stretchContrastRaster(img)
+	case EnhanceEqualize:
+		equalizeRaster(img)
+	}
+
+	return encodeRaster(img, buf, o)
+}
+
 func Pipeline(buf []byte, o ImageOptions) (Image, error) {
-	if len(o.Operations) == 0 {
-		return Image{}, NewError("Missing pipeline operations", http.StatusBadRequest)
+	outputType := bimg.DetermineImageTypeName(buf)
+	if len(o.Branches) == 0 {
+		image, _, err := runPipeline(buf, o.Operations, outputType, false, o)
+		return image, err
 	}
-	if len(o.Operations) > 10 {
-		return Image{}, NewError("Maximum pipeline operations (10) exceeded", http.StatusBadRequest)
+
+	// Operations are applied once before the branches, if present
+	if len(o.Operations) > 0 {
+		image, imageType, err := runPipeline(buf, o.Operations, outputType, true, o)
+		if err != nil {
+			return Image{}, err
+		}
+		buf, outputType = image.Body, imageType
+	}
+
+	return pipelineBranches(buf, outputType, o)
+}
+
+// pipelineResolutionError returns the error of the pipeline operation whose
+// output image exceeds the resolution limit
+func pipelineResolutionError(i int, name string) Error {
+	xerr := ErrResolutionTooBig
+	xerr.Message = fmt.Sprintf("%s: pipeline operation %d (%s) exceeds the allowed resolution", xerr.Message, i+1, name)
+	return xerr
+}
+
+// runPipeline sequentially applies the operations, passing the output image
+// of each operation to the next one.
+//
+// Lossy images are passed between operations as lossless PNG to avoid
+// generation loss, only the last operation encodes the image into the output
+// type, which defaults to the source image type unless an operation defines
+// its own type. The last result is kept lossless too when intermediate is true.
+// The output type is returned along with the resulting image.
+func runPipeline(buf []byte, operations PipelineOperations, outputType string, intermediate bool, o ImageOptions) (Image, string, error) {
+	if len(operations) == 0 {
+		return Image{}, "", NewMissingParamError("Missing pipeline operations", "operations")
+	}
+	if len(operations) > 10 {
+		return Image{}, "", NewParamError("Maximum pipeline operations (10) exceeded", "operations")
+	}
+
+	// The operations output size is checked against the limits, if any
+	var size bimg.ImageSize
+	checkLimits := o.limits != (ImageLimits{})
+	if checkLimits {
+		var err error
+		if size, err = validateImage(buf, o.limits); err != nil {
+			return Image{}, "", err
+		}
 	}
 
 	image := Image{Body: buf}
-	for i, operation := range o.Operations {
+	lossless := false
+	for i, operation := range operations {
+		start := time.Now()
 		if op, exists := OperationsMap[operation.Name]; !exists {
-			return Image{}, NewError(fmt.Sprintf("Unsupported operation: %s", operation.Name), http.StatusBadRequest)
+			err := NewParamError(fmt.Sprintf("Unsupported operation: %s", operation.Name), "operations")
+			o.report.record(i, operation, start, Image{}, err)
+			return Image{}, "", err
 		} else {
 			operation.Operation = op
 		}
 
 		opts, err := buildParamsFromOperation(operation)
 		if err != nil {
-			return Image{}, fmt.Errorf("pipeline operation %d failed: %w", i+1, err)
+			err = fmt.Errorf("pipeline operation %d failed: %w", i+1, err)
+			o.report.record(i, operation, start, Image{}, err)
+			return Image{}, "", err
+		}
+		if o.StripMetadata {
+			opts.StripMetadata = true
+		}
+		// Operations inherit the pipeline auto rotation, unless defined
+		if !opts.IsDefinedField.NoRotation {
+			opts.NoRotation = o.NoRotation
+		}
+		if !opts.IsDefinedField.NoEnlarge {
+			opts.NoEnlarge = o.NoEnlarge
+		}
+		opts.ctx = o.ctx
+		opts.files = o.files
+		if o.progress != nil {
+			o.progress(i+1, len(operations))
 		}
 
-		result, err := operation.Operation(image.Body, opts)
+		last := i == len(operations)-1 && !intermediate
+		keepLossless := false
+		if opts.Type != "" {
+			outputType = opts.Type
+		} else if isLossyImageType(ImageType(outputType)) {
+			if last {
+				opts.Type = outputType
+			} else {
+				opts.Type = "png"
+				opts.Compression = pipelineIntermediateCompression
+				keepLossless = true
+			}
+		}
+
+		if opts.Context().Err() != nil {
+			return Image{}, "", ErrClientClosedRequest
+		}
+		if checkLimits && o.limits.exceeded(expectedImageSize(size, operation.Name, opts)) {
+			err := pipelineResolutionError(i, operation.Name)
+			o.report.record(i, operation, start, Image{}, err)
+			return Image{}, "", err
+		}
+
+		var result Image
+		if opts.Depth > depth8 {
+			result, err = PreserveDepth(operation.Operation, image.Body, opts)
+		} else if last && opts.Optimize {
+			result, err = OptimizeJPEG(operation.Operation, image.Body, opts)
+		} else {
+			result, err = operation.Operation(image.Body, opts)
+		}
 		if err != nil && !operation.IgnoreFailure {
-			return Image{}, err
+			o.report.record(i, operation, start, result, err)
+			return Image{}, "", err
 		}
 		if err == nil {
 			image = result
+			lossless = keepLossless
+		}
+
+		// Intermediate results are decoded by the next operations, or branches
+		if !last && checkLimits {
+			var verr error
+			if size, verr = validateImage(image.Body, o.limits); verr == ErrResolutionTooBig {
+				verr = pipelineResolutionError(i, operation.Name)
+			}
+			if verr != nil {
+				o.report.record(i, operation, start, result, verr)
+				return Image{}, "", verr
+			}
 		}
+		o.report.record(i, operation, start, result, err)
+	}
+
+	// The last operation failed, encode the lossless intermediate result
+	if lossless && !intermediate {
+		image, err := Process(image.Body, bimg.Options{
+			Type:          ImageType(outputType),
+			NoAutoRotate:  true,
+			StripMetadata: o.StripMetadata,
+		})
+		return image, outputType, err
 	}
 
-	return image, nil
+	return image, outputType, nil
 }
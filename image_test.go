@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"testing"
+
+	"github.com/h2non/bimg"
 )
 
 func TestImageResize(t *testing.T) {
@@ -76,6 +79,37 @@ func TestImageResize(t *testing.T) {
 
 }
 
+func TestImageThumbnail(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	cases := []struct {
+		name          string
+		opts          ImageOptions
+		width, height int
+	}{
+		{"Width and Height cropped", ImageOptions{Width: 200, Height: 200}, 200, 200},
+		{"Width and Height smart cropped", ImageOptions{Width: 200, Height: 100, Gravity: bimg.GravitySmart}, 200, 100},
+		{"Width and Height with NoCrop", ImageOptions{Width: 200, Height: 200, NoCrop: true}, 200, 149},
+		{"Width defined", ImageOptions{Width: 370}, 370, 275},
+		{"Not enlarged", ImageOptions{Width: 1480}, 740, 550},
+		{"Enlarged by force", ImageOptions{Width: 1000, Height: 1000, NoCrop: true, Force: true}, 1000, 1000},
+	}
+
+	for _, tc := range cases {
+		img, err := Thumbnail(buf, tc.opts)
+		if err != nil {
+			t.Errorf("%s: cannot process image: %s", tc.name, err)
+			continue
+		}
+		if img.Mime != "image/jpeg" {
+			t.Errorf("%s: invalid image MIME type: %s", tc.name, img.Mime)
+		}
+		if err := assertSize(img.Body, tc.width, tc.height); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+	}
+}
+
 func TestImageFit(t *testing.T) {
 	opts := ImageOptions{Width: 300, Height: 300}
 	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
@@ -141,6 +175,30 @@ func TestImagePipelineOperations(t *testing.T) {
 	}
 }
 
+func TestImageCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	operation := Operation(func(buf []byte, o ImageOptions) (Image, error) {
+		called = true
+		return Image{Body: buf}, nil
+	})
+
+	opts := ImageOptions{}.WithContext(ctx)
+	if _, err := operation.Run([]byte("image"), opts); err != ErrClientClosedRequest {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if called {
+		t.Error("Operation must not run when the request is canceled")
+	}
+
+	opts.Operations = PipelineOperations{{Name: "flip"}}
+	if _, err := Pipeline([]byte("image"), opts); err != ErrClientClosedRequest {
+		t.Errorf("Invalid pipeline error: %v", err)
+	}
+}
+
 func TestCalculateDestinationFitDimension(t *testing.T) {
 	cases := []struct {
 		// Image
@@ -178,3 +236,34 @@ func TestCalculateDestinationFitDimension(t *testing.T) {
 	}
 
 }
+
+func TestWatermarkImageFormFile(t *testing.T) {
+	o := ImageOptions{Image: "logo"}.WithFiles(map[string][]byte{"logo": []byte("watermark")})
+	buf, err := watermarkImage(o)
+	if err != nil || string(buf) != "watermark" {
+		t.Errorf("Invalid watermark image: %s (%v)", buf, err)
+	}
+
+	o = ImageOptions{Image: "logo"}.WithFiles(map[string][]byte{"logo": {}})
+	if _, err := watermarkImage(o); err == nil {
+		t.Error("Expected empty form file error")
+	}
+}
+
+func TestImageColorspace(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	for _, colorspace := range []string{"srgb", "bw", "sepia"} {
+		opts, _ := buildParamsFromQuery(map[string][]string{"colorspace": {colorspace}, "width": {"300"}})
+		img, err := Colorspace(buf, opts)
+		if err != nil {
+			t.Fatalf("Cannot process image with %s colorspace: %s", colorspace, err)
+		}
+		if img.Mime != "image/jpeg" {
+			t.Error("Invalid image MIME type")
+		}
+		if err := assertSize(img.Body, 300, 404); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -31,27 +32,116 @@ var (
 	aEnablePlaceholder  = flag.Bool("enable-placeholder", false, "Enable image response placeholder to be used in case of error")
 	aEnableURLSignature = flag.Bool("enable-url-signature", false, "Enable URL signature (URL-safe Base64-encoded HMAC digest)")
 	aURLSignatureKey    = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum)")
-	aAllowedOrigins     = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas). Note: Origins are validated against host *AND* path.")
+	aURLSignatureKeys   = flag.String("url-signature-keys", "", "Comma separated key IDs and URL signature keys, selected by the kid param, e.g: 2024:4f46feebafc4b5e988f131c4ff8b5997")
+	aURLSignatureAlg    = flag.String("url-signature-alg", SignatureAlgSHA256, "URL and body signatures HMAC algorithm: sha256 or sha512")
+	aURLEncryptionKey   = flag.String("url-encryption-key", "", "Hex encoded AES key (16, 24 or 32 bytes) decrypting the AES-GCM encrypted source image URL of the enc param")
+	aBodySignatureKey   = flag.String("body-signature-key", "", "Require the uploaded images to be signed by the X-Signature header (URL-safe Base64-encoded HMAC digest) with the key (32 characters minimum)")
+	aTrustedProxies     = flag.String("trusted-proxies", "", "Comma separated proxy IPs or CIDRs allowed to define the client IP via X-Forwarded-For or X-Real-IP headers")
+	aAllowedOrigins     = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas). Note: Origins are validated against scheme, host, port *AND* path.")
 	aMaxAllowedSize     = flag.Int("max-allowed-size", 0, "Restrict maximum size of http image source (in bytes)")
+	aMetadataRangeSize  = flag.Int("metadata-range-size", 131072, "Bytes of the http image source fetched via Range requests by the /info endpoint, falling back to the whole image if the image header exceeds them. 0 disables the Range requests")
+	aMaxBodySize        = flag.Int64("max-body-size", maxMemory, "Restrict maximum size of the request body (in bytes)")
+	aSpoolThreshold     = flag.Int64("spool-threshold", 0, "Request bodies exceeding the size (in bytes) are buffered to temporary files, memory mapped instead of read into memory [default: disabled]")
+	aMaxBodySizes       = flag.String("max-body-sizes", "", "Comma separated maximum request body sizes (in bytes) per endpoint, e.g: resize=1048576,pipeline=10485760")
 	aMaxAllowedPixels   = flag.Float64("max-allowed-resolution", 18.0, "Restrict maximum resolution of the image (in megapixels)")
 	aKey                = flag.String("key", "", "Define API key for authorization")
-	aMount              = flag.String("mount", "", "Mount server local directory")
+	aAuth               = flag.String("auth", "", "Authorization provider: apikey, jwt, mtls or external [default: apikey if -key or -api-keys are defined]")
+	aJWTSecret          = flag.String("jwt-secret", "", "HMAC secret verifying the HS256, HS384 and HS512 JWT bearer tokens of the jwt authorization provider")
+	aJWTPublicKey       = flag.String("jwt-public-key", "", "RSA or ECDSA public key PEM file path verifying the RS* and ES* JWT bearer tokens of the jwt authorization provider")
+	aJWTAudience        = flag.String("jwt-audience", "", "JWT aud claim required by the jwt authorization provider")
+	aAuthURL            = flag.String("auth-url", "", "Authorization service URL of the external authorization provider, queried with the request credentials on every request")
+	aTLSClientCA        = flag.String("tls-client-ca", "", "CA certificates PEM file path verifying the TLS client certificates of the mtls authorization provider")
+	aMount              = newMountFlags("mount", "Mount server local directory or ZIP archive, optionally named as name=path to be selected via the mount param. Repeat the flag to define several mounts")
+	aEnableFileListing  = flag.Bool("enable-file-listing", false, "Enable the /files endpoint listing the images under the mount directory. -mount and -key or -api-keys flags must be defined")
+	aEnableMountWrites  = flag.Bool("enable-mount-writes", false, "Enable storing and deleting the images of the mount directories via PUT and DELETE /files requests. -mount and -key or -api-keys flags must be defined")
+	aDisableForm        = flag.Bool("disable-form", false, "Disable the /form playground endpoint, replied with 404")
+	aIndexMode          = flag.String("index-mode", IndexModeFull, "Index endpoint mode: full (versions and capabilities), minimal (service name only, hiding the versions from the Server header) or none (404)")
 	aCertFile           = flag.String("certfile", "", "TLS certificate file path")
 	aKeyFile            = flag.String("keyfile", "", "TLS private key file path")
 	aAuthorization      = flag.String("authorization", "", "Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization")
 	aForwardHeaders     = flag.String("forward-headers", "", "Forwards custom headers to the image source server. -enable-url-source flag must be defined.")
+	aOriginUserAgent    = flag.String("origin-user-agent", "imaginary/"+Version, "User-Agent header sent to the image source servers")
+	aForwardQuery       = flag.String("forward-query", "", "Comma separated query params forwarded to the image source URL, e.g: token,expires")
+	aOriginQuery        = flag.String("origin-query", "", "Static query params appended to the image source URL, defined as URL query, e.g: token=s3cr3t")
+	aOriginHeaders      = flag.String("origin-headers", "", "Comma separated static headers sent to the allowed image source servers, e.g: X-Origin-Secret:s3cr3t,Accept:image/*")
 	aPlaceholder        = flag.String("placeholder", "", "Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200")
+	aPlaceholders       = flag.String("placeholders", "", "Comma separated placeholder image paths per HTTP status code or class, e.g: 404=./notfound.jpg,5xx=./error.jpg")
+	aPlaceholderColor   = flag.String("placeholder-color", "", "Generate solid color placeholders (RGB) when no placeholder image is defined, e.g: 238,238,238")
+	aDefaultParams      = flag.String("default-params", "", "Default params applied when the request omits them, defined as URL query, e.g: quality=80&type=auto&stripmeta=true")
+	aFallbacks          = flag.String("fallbacks", "", "Comma separated fallback image paths per preset name, served via the fallback param when the source image is not found, e.g: shoes=./shoes.jpg")
 	aPlaceholderStatus  = flag.Int("placeholder-status", 0, "HTTP status returned when use -placeholder flag")
+	aAllowedOutputTypes = flag.String("allowed-output-types", "", "Comma separated image formats allowed as output, e.g: jpeg,png,webp,avif")
+	aAllowedInputTypes  = flag.String("allowed-input-types", "", "Comma separated image formats allowed as input, e.g: jpeg,png,webp,gif")
+	aMaxGIFFrames       = flag.Int("max-gif-frames", 0, "Restrict maximum number of frames of the GIF input images")
+	aMaxTIFFPages       = flag.Int("max-tiff-pages", 0, "Restrict maximum number of pages (IFDs) of the TIFF input images")
+	aTransformTimeout   = flag.Int("transform-timeout", 0, "Maximum image transformation time in seconds, exceeding transformations are replied with 422")
+	aTransformMaxMemory = flag.Int("transform-max-memory", 0, "Maximum process resident memory in megabytes during image transformations, exceeding transformations are replied with 422")
+	aFailOnMissing      = flag.String("fail-on-missing", "", "Comma separated image formats required on startup, e.g: webp,avif")
 	aDisableEndpoints   = flag.String("disable-endpoints", "", "Comma separated endpoints to disable. E.g: form,crop,rotate,health")
+	aEnableEndpoints    = flag.String("enable-endpoints", "", "Comma separated endpoints to enable, disabling the rest. E.g: resize,info,health")
 	aHTTPCacheTTL       = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
+	aCacheDir           = flag.String("cache-dir", "", "Cache the transformed images as files under the directory, surviving restarts")
+	aCacheMaxSize       = flag.Int64("cache-max-size", defaultDiskCacheMaxSize, "Maximum disk cache size (in bytes), evicting the least recently used images. 0 disables the eviction")
+	aCacheReadOnly      = flag.Bool("cache-read-only", false, "Only serve the disk cache images written by another server, e.g. replicas sharing a read-only volume")
+	aCacheTTL           = flag.Int("cache-ttl", 0, "Serve the disk cached responses of the remote images without fetching them again during the TTL in seconds")
+	aCacheStaleTTL      = flag.Int("cache-stale-ttl", 0, "Serve the expired disk cached responses for up to the given seconds while refreshing them in background, also defining stale-while-revalidate in Cache-Control")
+	aPrefetchKey        = flag.String("prefetch-key", "", "Enable the /prefetch endpoint warming the disk cache, authorized by this bearer token. Requires -cache-dir")
 	aReadTimeout        = flag.Int("http-read-timeout", 60, "HTTP read timeout in seconds")
 	aWriteTimeout       = flag.Int("http-write-timeout", 60, "HTTP write timeout in seconds")
-	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
+	aPIDFile            = flag.String("pid-file", "", "Write the process ID to the given file path, updated by the new process on upgrade")
+	aShutdownTimeout    = flag.Int("shutdown-timeout", defaultShutdownTimeout, "Time in seconds given to the in-flight requests to complete on shutdown")
+	aHealthChecks       = flag.String("health-checks", "", "Comma separated readiness checks run by the /health/ready endpoint: mount,vips")
+	aDegradedLatency    = flag.Int("health-degraded-latency", 0, "Readiness checks slower than the time in milliseconds report a degraded status, replied with 503 [default: disabled]")
+	aMaxWorkers         = flag.Int("max-workers", 0, "Maximum concurrent image transformations, exceeding requests are queued by priority [default: unlimited]")
+	aMaxQueue           = flag.Int("max-queue", 100, "Maximum requests queued waiting for a worker, exceeding lower priority requests are replied with 503")
+	aQueueTimeout       = flag.Int("queue-timeout", 0, "Maximum seconds queued waiting for a worker, exceeding requests are replied with 503 [default: unlimited]")
+	aPriorityHeader     = flag.String("priority-header", "", "Request header defining the integer priority of the queued requests, unless defined by the API key")
+	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second and client IP")
 	aBurst              = flag.Int("burst", 100, "Throttle burst max cache size")
 	aMRelease           = flag.Int("mrelease", 30, "OS memory release interval in seconds")
+	aMemoryThreshold    = flag.Int("memory-release-threshold", 0, "Process resident memory in megabytes above which the libvips cache and the unused memory are released, checked every second")
 	aCpus               = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
+	aVipsConcurrency    = flag.Int("vips-concurrency", 0, "Number of libvips threads per image transformation")
 	aLogLevel           = flag.String("log-level", "info", "Define log level for http-server. E.g: info,warning,error")
+	aLogFile            = flag.String("log-file", "", "Write the access log to the given file path instead of the standard output. Reopened on SIGUSR1")
+	aLogMaxSize         = flag.Int("log-max-size", 0, "Rotate the log files when exceeding the given size in megabytes")
+	aLogSample          = flag.Float64("log-sample", 1, "Ratio of the info level access logs written, from 0 to 1. Errors and slow requests are always logged")
+	aLogSlow            = flag.Int("log-slow", 0, "Always log the requests slower than the given time in milliseconds, flagged as slow")
+	aAuditLogFile       = flag.String("audit-log-file", "", "Write the requests rejected for security reasons as JSON lines to the given file path. Reopened on SIGUSR1")
+	aErrorLogFile       = flag.String("error-log-file", "", "Write the server errors and 5xx responses to the given file path. Reopened on SIGUSR1")
 	aReturnSize         = flag.Bool("return-size", false, "Return the image size in the HTTP headers")
+	aEnableProgress     = flag.Bool("enable-progress", false, "Enable the /progress Server-Sent Events endpoint reporting the progress of the requests sending the X-Job-ID header")
+	aServerTiming       = flag.Bool("server-timing", false, "Return the fetch, decode and transform durations in the Server-Timing HTTP header")
+	aDisableAutoRotate  = flag.Bool("disable-autorotate", false, "Disable the auto rotation based on EXIF orientation by default, unless requested via the autorotate param")
+	aNoEnlarge          = flag.Bool("without-enlargement", false, "Never upscale the images beyond their source dimensions by default, unless disabled via the withoutEnlargement param")
+	aStripMetadata      = flag.Bool("strip-metadata", false, "Force metadata stripping (EXIF, GPS, XMP...) on every output image regardless of the request params")
+	aStripMetadataKeep  = flag.String("strip-metadata-keep", "", "Comma separated metadata fields kept when -strip-metadata is enabled. Allowed values: icc,orientation")
+	aUpscalerURL        = flag.String("upscaler-url", "", "Remote HTTP super-resolution service URL used by the upscaler=remote param")
+	aClassifierURL      = flag.String("classifier-url", "", "Remote HTTP content moderation service URL used by the /moderate endpoint")
+	aC2PACert           = flag.String("c2pa-cert", "", "Signing certificate chain PEM file path used to add C2PA content credentials to the output images")
+	aC2PAKey            = flag.String("c2pa-key", "", "Signing private key PEM file path used to add C2PA content credentials to the output images")
+	aC2PAAlg            = flag.String("c2pa-alg", "es256", "C2PA signing algorithm matching the signing key. E.g: es256,es384,ps256,ed25519")
+	aC2PATimestampURL   = flag.String("c2pa-tsa-url", "", "RFC 3161 time stamp authority URL used to timestamp the C2PA signatures")
+	aC2PAValidate       = flag.Bool("c2pa-validate", false, "Reject the incoming images embedding an invalid C2PA manifest")
+	aC2PATool           = flag.String("c2pa-tool", defaultC2PATool, "C2PA command line tool path used to sign and validate the manifests")
+	aRemoteOperations   = flag.String("remote-operations", "", "Comma separated remote HTTP services usable as pipeline operations by name, e.g: removebg=http://localhost:9000/removebg")
+	aRemoteOpTimeout    = flag.Int("remote-operation-timeout", int(defaultRemoteOperationTimeout/time.Second), "Remote operations HTTP request timeout in seconds")
+	aNormalizeAccept    = flag.Bool("normalize-accept", false, "Normalize the Accept header into avif, webp or legacy variants when using type=auto")
+	aEnableClientHints  = flag.Bool("enable-client-hints", false, "Honor Sec-CH-Width, Sec-CH-DPR and Save-Data client hints request headers")
+	aPolicy             = flag.String("policy", "", "JSON file path defining the allowed params, values and image sources per endpoint")
+	aAPIKeys            = flag.String("api-keys", "", "JSON file path defining the accepted API keys and their size, resolution and concurrency limits")
+	aPicturePresets     = flag.String("picture-presets", "", "JSON file path defining the picture endpoint presets widths, sizes and formats")
+	aUsageKey           = flag.String("usage-key", "", "Enable the per API key and virtual host usage accounting, exposed by the /usage endpoint authorized by this bearer token")
+	aVirtualHosts       = flag.String("vhosts", "", "JSON file path defining the mount, allowed origins, URL signature key, default params and picture presets per Host header")
+	aRoutes             = flag.String("routes", "", "JSON file path enabling or disabling the auth, signature, throttle, cors and cache middleware per route")
+	aWebhooks           = flag.String("webhooks", "", "JSON file path defining the webhooks notified of the processing failures, blocked origins and prefetch jobs completion")
+	aConsume            = flag.String("consume", "", "NATS server URL to consume the processing jobs from instead of serving HTTP, e.g: nats://localhost:4222")
+	aConsumeSubject     = flag.String("consume-subject", defaultConsumeSubject, "NATS JetStream subject of the processing jobs")
+	aConsumeQueue       = flag.String("consume-queue", "", "NATS queue group sharing the processing jobs between the consumers")
+	aConsumeOutput      = flag.String("consume-output", "", "Directory the processing jobs file destinations are written to")
+	aConsumeWorkers     = flag.Int("consume-workers", 0, "Number of processing jobs processed at the same time. 0 defaults to the number of CPUs")
+	aSchedules          = flag.String("schedules", "", "JSON file path defining the cron scheduled prefetch of the changed sources and cleanup of the expired cache entries and files")
+	aAutoQualityTarget  = flag.Float64("auto-quality-target", defaultAutoQualityTarget, "Maximum DSSIM distortion allowed when using quality=auto")
 )
 
 const usage = `imaginary %s
@@ -63,6 +153,7 @@ Usage:
   imaginary -path-prefix /api/v1
   imaginary -enable-url-source
   imaginary -disable-endpoints form,health,crop,rotate
+  imaginary -enable-endpoints resize,info,health
   imaginary -enable-url-source -allowed-origins http://localhost,http://server.com
   imaginary -enable-url-source -enable-auth-forwarding
   imaginary -enable-url-source -authorization "Basic AwDJdL2DbwrD=="
@@ -70,6 +161,7 @@ Usage:
   imaginary -enable-url-source -placeholder ./placeholder.jpg
   imaginary -enable-url-signature -url-signature-key 4f46feebafc4b5e988f131c4ff8b5997
   imaginary -enable-url-source -forward-headers X-Custom,X-Token
+  imaginary resize -i photo.jpg -o thumb.webp width=300
   imaginary -h | -help
   imaginary -v | -version
 
@@ -83,33 +175,122 @@ Options:
   -cors                      Enable CORS support [default: false]
   -gzip                      Enable gzip compression (deprecated) [default: false]
   -disable-endpoints         Comma separated endpoints to disable. E.g: form,crop,rotate,health [default: ""]
+  -enable-endpoints          Comma separated endpoints to enable, disabling the rest. E.g: resize,info,health [default: ""]
+  -allowed-output-types <list> Comma separated image formats allowed as output, e.g: jpeg,png,webp,avif [default: all]
+  -allowed-input-types <list> Comma separated image formats allowed as input, e.g: jpeg,png,webp,gif [default: all]
+  -fail-on-missing <list>    Comma separated image formats required on startup, e.g: webp,avif [default: ""]
   -key <key>                 Define API key for authorization
-  -mount <path>              Mount server local directory
+  -auth <provider>           Authorization provider: apikey, jwt, mtls or external [default: apikey if -key or -api-keys are defined]
+  -jwt-secret <secret>       HMAC secret verifying the HS256, HS384 and HS512 JWT bearer tokens of the jwt authorization provider
+  -jwt-public-key <path>     RSA or ECDSA public key PEM file path verifying the RS* and ES* JWT bearer tokens of the jwt authorization provider
+  -jwt-audience <aud>        JWT aud claim required by the jwt authorization provider
+  -auth-url <url>            Authorization service URL of the external authorization provider, queried with the request credentials on every request
+  -tls-client-ca <path>      CA certificates PEM file path verifying the TLS client certificates of the mtls authorization provider
+  -mount <path>              Mount server local directory or ZIP archive, optionally named as name=path to be selected via the mount param. Repeat the flag to define several mounts
+  -enable-file-listing       Enable the /files endpoint listing the images under the mount directory. -mount and -key or -api-keys flags must be defined [default: false]
+  -enable-mount-writes       Enable storing and deleting the images of the mount directories via PUT and DELETE /files requests. -mount and -key or -api-keys flags must be defined [default: false]
+  -disable-form              Disable the /form playground endpoint, replied with 404 [default: false]
+  -index-mode <mode>         Index endpoint mode: full (versions and capabilities), minimal (service name only, hiding the versions from the Server header) or none (404) [default: full]
   -http-cache-ttl <num>      The TTL in seconds. Adds caching headers to locally served files.
+  -cache-dir <path>          Cache the transformed images as files under the directory, surviving restarts
+  -cache-max-size <bytes>    Maximum disk cache size (in bytes), evicting the least recently used images. 0 disables the eviction [default: 1073741824]
+  -cache-read-only           Only serve the disk cache images written by another server, e.g. replicas sharing a read-only volume [default: false]
+  -cache-ttl <num>           Serve the disk cached responses of the remote images without fetching them again during the TTL in seconds [default: disabled]
+  -cache-stale-ttl <num>     Serve the expired disk cached responses for up to the given seconds while refreshing them in background, also defining stale-while-revalidate in Cache-Control [default: disabled]
+  -prefetch-key <key>        Enable the /prefetch endpoint warming the disk cache, authorized by this bearer token. Requires -cache-dir
   -http-read-timeout <num>   HTTP read timeout in seconds [default: 30]
   -http-write-timeout <num>  HTTP write timeout in seconds [default: 30]
+  -shutdown-timeout <num>    Time in seconds given to the in-flight requests to complete on shutdown [default: 5]
+  -health-checks <list>      Comma separated readiness checks run by the /health/ready endpoint: mount,vips [default: ""]
+  -health-degraded-latency <ms> Readiness checks slower than the time in milliseconds report a degraded status, replied with 503 [default: disabled]
+  -pid-file <path>           Write the process ID to the given file path, updated by the new process on upgrade
   -enable-url-source         Enable remote HTTP URL image source processing
   -enable-placeholder        Enable image response placeholder to be used in case of error [default: false]
   -enable-auth-forwarding    Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors
   -forward-headers           Forwards custom headers to the image source server. -enable-url-source flag must be defined.
+  -origin-user-agent <value> User-Agent header sent to the image source servers [default: imaginary/<version>]
+  -origin-headers <list>     Comma separated static headers sent to the allowed image source servers, e.g: X-Origin-Secret:s3cr3t,Accept:image/*
+  -forward-query <names>     Comma separated query params forwarded to the image source URL, e.g: token,expires
+  -origin-query <query>      Static query params appended to the image source URL, defined as URL query, e.g: token=s3cr3t
   -enable-url-signature      Enable URL signature (URL-safe Base64-encoded HMAC digest) [default: false]
   -url-signature-key         The URL signature key (32 characters minimum)
+  -url-signature-keys <list> Comma separated key IDs and URL signature keys, selected by the kid param, e.g: 2024:4f46feebafc4b5e988f131c4ff8b5997
+  -url-signature-alg <alg>   URL and body signatures HMAC algorithm: sha256 or sha512 [default: sha256]
+  -url-encryption-key <hex>  Hex encoded AES key (16, 24 or 32 bytes) decrypting the AES-GCM encrypted source image URL of the enc param
+  -body-signature-key <key>  Require the uploaded images to be signed by the X-Signature header (URL-safe Base64-encoded HMAC digest) with the key (32 characters minimum)
   -allowed-origins <urls>    Restrict remote image source processing to certain origins (separated by commas)
+  -trusted-proxies <cidrs>   Comma separated proxy IPs or CIDRs allowed to define the client IP via X-Forwarded-For or X-Real-IP headers
   -max-allowed-size <bytes>  Restrict maximum size of http image source (in bytes)
+  -metadata-range-size <bytes> Bytes of the http image source fetched via Range requests by the /info endpoint, falling back to the whole image if the image header exceeds them. 0 disables the Range requests [default: 131072]
+  -max-body-size <bytes>     Restrict maximum size of the request body (in bytes) [default: 67108864]
+  -max-body-sizes <list>     Comma separated maximum request body sizes (in bytes) per endpoint, e.g: resize=1048576,pipeline=10485760
+  -spool-threshold <bytes>   Request bodies exceeding the size (in bytes) are buffered to temporary files, memory mapped instead of read into memory [default: disabled]
   -max-allowed-resolution <megapixels> Restrict maximum resolution of the image [default: 18.0]
+  -max-gif-frames <num>      Restrict maximum number of frames of the GIF input images [default: unlimited]
+  -max-tiff-pages <num>      Restrict maximum number of pages (IFDs) of the TIFF input images [default: unlimited]
+  -transform-timeout <num>   Maximum image transformation time in seconds, exceeding transformations are replied with 422 [default: unlimited]
+  -transform-max-memory <megabytes> Maximum process resident memory during image transformations, exceeding transformations are replied with 422 [default: unlimited]
   -certfile <path>           TLS certificate file path
   -keyfile <path>            TLS private key file path
   -authorization <value>     Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization
   -placeholder <path>        Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200
+  -placeholders <list>       Comma separated placeholder image paths per HTTP status code or class, e.g: 404=./notfound.jpg,5xx=./error.jpg
+  -placeholder-color <rgb>   Generate solid color placeholders (RGB) when no placeholder image is defined, e.g: 238,238,238
+  -fallbacks <list>          Comma separated fallback image paths per preset name, served via the fallback param when the source image is not found, e.g: shoes=./shoes.jpg
+  -default-params <query>   Default params applied when the request omits them, defined as URL query, e.g: quality=80&type=auto&stripmeta=true
   -placeholder-status <code> HTTP status returned when use -placeholder flag
-  -concurrency <num>         Throttle concurrency limit per second [default: disabled]
+  -concurrency <num>         Throttle concurrency limit per second and client IP [default: disabled]
   -burst <num>               Throttle burst max cache size [default: 100]
+  -max-workers <num>         Maximum concurrent image transformations, exceeding requests are queued by priority [default: unlimited, or derived from the container limits]
+  -max-queue <num>           Maximum requests queued waiting for a worker, exceeding lower priority requests are replied with 503 [default: 100]
+  -queue-timeout <seconds>   Maximum seconds queued waiting for a worker, exceeding requests are replied with 503 [default: unlimited]
+  -priority-header <name>    Request header defining the integer priority of the queued requests, unless defined by the API key
   -mrelease <num>            OS memory release interval in seconds [default: 30]
+  -memory-release-threshold <megabytes> Process resident memory above which the libvips cache and the unused memory are released, checked every second [default: disabled]
   -cpus <num>                Number of used cpu cores.
-                             (default for current machine is %d cores)
+                             (default for current machine is %d cores, or the container CPU limit)
+  -vips-concurrency <num>    Number of libvips threads per image transformation [default: 1, or the container CPUs per worker]
   -log-level                 Set log level for http-server. E.g: info,warning,error [default: info].
                              Or can use the environment variable GOLANG_LOG=info.
-  -return-size               Return the image size with X-Width and X-Height HTTP header. [default: disabled].
+  -log-file <path>           Write the access log to the given file path instead of the standard output. Reopened on SIGUSR1
+  -log-max-size <MB>         Rotate the log files when exceeding the given size in megabytes [default: disabled]
+  -log-sample <ratio>        Ratio of the info level access logs written, from 0 to 1. Errors and slow requests are always logged [default: 1]
+  -log-slow <ms>             Always log the requests slower than the given time in milliseconds, flagged as slow [default: disabled]
+  -error-log-file <path>     Write the server errors and 5xx responses to the given file path. Reopened on SIGUSR1
+  -audit-log-file <path>     Write the requests rejected for security reasons as JSON lines to the given file path. Reopened on SIGUSR1
+  -return-size               Return the output image size with Image-Width, Image-Height and X-Image-Bytes HTTP headers, plus the processing time in milliseconds with X-Operation-Time. [default: disabled].
+  -server-timing             Return the fetch, decode and transform durations in the Server-Timing HTTP header. [default: disabled].
+  -enable-progress           Enable the /progress Server-Sent Events endpoint reporting the progress of the requests sending the X-Job-ID header [default: false]
+  -disable-autorotate        Disable the auto rotation based on EXIF orientation by default, unless requested via the autorotate param [default: false]
+  -without-enlargement       Never upscale the images beyond their source dimensions by default, unless disabled via the withoutEnlargement param [default: false]
+  -strip-metadata            Force metadata stripping (EXIF, GPS, XMP...) on every output image regardless of the request params [default: false]
+  -strip-metadata-keep <fields> Comma separated metadata fields kept when -strip-metadata is enabled. Allowed values: icc,orientation
+  -upscaler-url <url>        Remote HTTP super-resolution service URL used by the upscaler=remote param
+  -classifier-url <url>      Remote HTTP content moderation service URL used by the /moderate endpoint
+  -c2pa-cert <path>          Signing certificate chain PEM file path used to add C2PA content credentials to the output images
+  -c2pa-key <path>           Signing private key PEM file path used to add C2PA content credentials to the output images
+  -c2pa-alg <alg>            C2PA signing algorithm matching the signing key. E.g: es256,es384,ps256,ed25519 [default: es256]
+  -c2pa-tsa-url <url>        RFC 3161 time stamp authority URL used to timestamp the C2PA signatures
+  -c2pa-validate             Reject the incoming images embedding an invalid C2PA manifest [default: false]
+  -c2pa-tool <path>          C2PA command line tool path used to sign and validate the manifests [default: c2patool]
+  -remote-operations <list>  Comma separated remote HTTP services usable as pipeline operations by name, e.g: removebg=http://localhost:9000/removebg
+  -remote-operation-timeout <num> Remote operations HTTP request timeout in seconds [default: 30]
+  -normalize-accept          Normalize the Accept header into avif, webp or legacy variants when using type=auto [default: false]
+  -enable-client-hints       Honor Sec-CH-Width, Sec-CH-DPR and Save-Data client hints request headers [default: false]
+  -policy <path>             JSON file path defining the allowed params, values and image sources per endpoint
+  -api-keys <path>           JSON file path defining the accepted API keys and their size, resolution and concurrency limits
+  -picture-presets <path>    JSON file path defining the picture endpoint presets widths, sizes and formats
+  -usage-key <key>           Enable the per API key and virtual host usage accounting, exposed by the /usage endpoint authorized by this bearer token
+  -vhosts <path>             JSON file path defining the mount, allowed origins, URL signature key, default params and picture presets per Host header
+  -routes <path>             JSON file path enabling or disabling the auth, signature, throttle, cors and cache middleware per route
+  -webhooks <path>           JSON file path defining the webhooks notified of the processing failures, blocked origins and prefetch jobs completion
+  -consume <url>             NATS server URL to consume the processing jobs from instead of serving HTTP, e.g: nats://localhost:4222
+  -consume-subject <name>    NATS JetStream subject of the processing jobs [default: imaginary.jobs]
+  -consume-queue <name>      NATS queue group sharing the processing jobs between the consumers
+  -consume-output <path>     Directory the processing jobs file destinations are written to
+  -consume-workers <num>     Number of processing jobs processed at the same time [default: number of CPUs]
+  -schedules <path>          JSON file path defining the cron scheduled prefetch of the changed sources and cleanup of the expired cache entries and files
+  -auto-quality-target <dssim> Maximum DSSIM distortion allowed when using quality=auto [default: 0.01]
 `
 
 type URLSignature struct {
@@ -117,6 +298,9 @@ type URLSignature struct {
 }
 
 func main() {
+	// Run the image operation subcommands without starting the server
+	runCLICommand()
+
 	flag.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr, usage, Version, runtime.NumCPU())
 	}
@@ -129,6 +313,27 @@ func main() {
 		showVersion()
 	}
 
+	// Default to the container limits, which runtime.NumCPU() over-counts
+	limits := detectResourceLimits()
+	if limits.Limited {
+		debug("container limits: %.2f CPUs, %d MB memory", limits.CPUs, limits.Memory/1024/1024)
+		if !isFlagSet("cpus") {
+			*aCpus = limits.Procs()
+		}
+		if !isFlagSet("max-workers") {
+			*aMaxWorkers = limits.Workers()
+		}
+		if *aVipsConcurrency == 0 && os.Getenv("VIPS_CONCURRENCY") == "" {
+			*aVipsConcurrency = limits.VipsConcurrency(*aMaxWorkers)
+		}
+	}
+	if *aVipsConcurrency < 0 {
+		exitWithError("The -vips-concurrency flag must be a positive number")
+	}
+	if *aVipsConcurrency > 0 {
+		vipsSetConcurrency(*aVipsConcurrency)
+	}
+
 	// Only required in Go < 1.5
 	runtime.GOMAXPROCS(*aCpus)
 
@@ -144,11 +349,16 @@ func main() {
 		EnablePlaceholder:  *aEnablePlaceholder,
 		EnableURLSignature: *aEnableURLSignature,
 		URLSignatureKey:    urlSignature.Key,
+		URLSignatureAlg:    strings.ToLower(*aURLSignatureAlg),
+		BodySignatureKey:   getBodySignatureKey(*aBodySignatureKey),
 		PathPrefix:         *aPathPrefix,
 		APIKey:             *aKey,
 		Concurrency:        *aConcurrency,
 		Burst:              *aBurst,
-		Mount:              *aMount,
+		EnableFileListing:  *aEnableFileListing,
+		EnableMountWrites:  *aEnableMountWrites,
+		DisableForm:        *aDisableForm,
+		IndexMode:          *aIndexMode,
 		CertFile:           *aCertFile,
 		KeyFile:            *aKeyFile,
 		Placeholder:        *aPlaceholder,
@@ -156,13 +366,38 @@ func main() {
 		HTTPCacheTTL:       *aHTTPCacheTTL,
 		HTTPReadTimeout:    *aReadTimeout,
 		HTTPWriteTimeout:   *aWriteTimeout,
+		ShutdownTimeout:    *aShutdownTimeout,
+		HealthChecks:       parseEndpoints(*aHealthChecks),
+		DegradedLatency:    time.Duration(*aDegradedLatency) * time.Millisecond,
+		PIDFile:            *aPIDFile,
 		Authorization:      *aAuthorization,
 		ForwardHeaders:     parseForwardHeaders(*aForwardHeaders),
+		OriginUserAgent:    *aOriginUserAgent,
+		ForwardQuery:       parseForwardHeaders(*aForwardQuery),
 		AllowedOrigins:     parseOrigins(*aAllowedOrigins),
 		MaxAllowedSize:     *aMaxAllowedSize,
+		MetadataRangeSize:  *aMetadataRangeSize,
+		MaxBodySize:        *aMaxBodySize,
+		MaxBodySizes:       parseBodySizes(*aMaxBodySizes),
+		SpoolThreshold:     *aSpoolThreshold,
 		MaxAllowedPixels:   *aMaxAllowedPixels,
+		MaxGIFFrames:       *aMaxGIFFrames,
+		MaxTIFFPages:       *aMaxTIFFPages,
 		LogLevel:           getLogLevel(*aLogLevel),
+		LogFile:            *aLogFile,
+		LogMaxSize:         int64(*aLogMaxSize) * 1024 * 1024,
+		LogSampling:        LogSampling{Rate: *aLogSample, Slow: time.Duration(*aLogSlow) * time.Millisecond},
+		ErrorLogFile:       *aErrorLogFile,
+		AuditLogFile:       *aAuditLogFile,
 		ReturnSize:         *aReturnSize,
+		ServerTiming:       *aServerTiming,
+		NormalizeAccept:    *aNormalizeAccept,
+		EnableClientHints:  *aEnableClientHints,
+		AutoQualityTarget:  *aAutoQualityTarget,
+		StripMetadata:      *aStripMetadata,
+		DisableAutoRotate:  *aDisableAutoRotate,
+		NoEnlarge:          *aNoEnlarge,
+		StripMetadataKeep:  parseMetadataFields(*aStripMetadataKeep),
 	}
 
 	// Show warning if gzip flag is passed
@@ -175,9 +410,63 @@ func main() {
 		memoryRelease(*aMRelease)
 	}
 
-	// Check if the mount directory exists, if present
-	if *aMount != "" {
-		checkMountDirectory(*aMount)
+	// Create the memory watchdog goroutine, if required
+	if *aMemoryThreshold < 0 {
+		exitWithError("The -memory-release-threshold flag must be a positive number")
+	}
+	if *aMemoryThreshold > 0 {
+		watchMemory(uint64(*aMemoryThreshold) * 1024 * 1024)
+	}
+
+	// Check if the mount directories exist, if present
+	mount, mounts, err := parseMounts(*aMount)
+	if err != nil {
+		exitWithError("invalid -mount value: %s", err)
+	}
+	if mount != "" {
+		checkMountDirectory(mount)
+	}
+	for _, dir := range mounts {
+		checkMountDirectory(dir)
+	}
+	opts.Mount = mount
+	opts.Mounts = mounts
+
+	// Validate index mode
+	switch *aIndexMode {
+	case IndexModeFull, IndexModeMinimal, IndexModeNone:
+	default:
+		exitWithError("The -index-mode flag must be one of: full, minimal, none")
+	}
+
+	// The file listing exposes the mount directory, so it requires authorization
+	if *aEnableFileListing {
+		if !hasMounts(opts) {
+			exitWithError("The -enable-file-listing flag requires the -mount flag")
+		}
+		if *aKey == "" && *aAPIKeys == "" && (*aAuth == "" || *aAuth == AuthAPIKey) {
+			exitWithError("The -enable-file-listing flag requires the -key, -api-keys or -auth flag")
+		}
+	}
+
+	// Mount writes replace the served images, so they require authorization too
+	if *aEnableMountWrites {
+		if !hasMounts(opts) {
+			exitWithError("The -enable-mount-writes flag requires the -mount flag")
+		}
+		if *aKey == "" && *aAPIKeys == "" && (*aAuth == "" || *aAuth == AuthAPIKey) {
+			exitWithError("The -enable-mount-writes flag requires the -key, -api-keys or -auth flag")
+		}
+	}
+
+	// Validate the readiness checks
+	for _, name := range opts.HealthChecks {
+		if _, ok := healthChecks[name]; !ok {
+			exitWithError("unknown -health-checks check: %s", name)
+		}
+	}
+	if *aDegradedLatency < 0 {
+		exitWithError("The -health-degraded-latency flag must be a positive number")
 	}
 
 	// Validate HTTP cache param, if present
@@ -190,6 +479,28 @@ func main() {
 		opts.Endpoints = parseEndpoints(*aDisableEndpoints)
 	}
 
+	// Parse endpoint names to enable, if present. Unknown names are rejected,
+	// as a typo would otherwise disable the endpoint.
+	if *aEnableEndpoints != "" {
+		opts.EnabledEndpoints = parseEndpoints(*aEnableEndpoints)
+		names := Endpoints(endpointNames())
+		for _, endpoint := range opts.EnabledEndpoints {
+			if !names.Has(endpoint) {
+				exitWithError("unknown -enable-endpoints endpoint: %s", endpoint)
+			}
+		}
+	}
+
+	// Parse the allowed output image formats, if present
+	if *aAllowedOutputTypes != "" {
+		opts.AllowedOutputTypes = parseImageTypes("allowed-output-types", *aAllowedOutputTypes)
+	}
+
+	// Parse the allowed input image formats, if present
+	if *aAllowedInputTypes != "" {
+		opts.AllowedInputTypes = parseImageTypes("allowed-input-types", *aAllowedInputTypes)
+	}
+
 	// Read placeholder image, if required
 	if *aPlaceholder != "" {
 		buf, err := ioutil.ReadFile(*aPlaceholder)
@@ -208,22 +519,372 @@ func main() {
 		opts.PlaceholderImage = placeholder
 	}
 
+	// Read the API keys limits, if present
+	if *aAPIKeys != "" {
+		keys, err := ReadAPIKeys(*aAPIKeys)
+		if err != nil {
+			exitWithError("cannot read the API keys: %s", err)
+		}
+		opts.APIKeys = keys
+	}
+
+	// Set up the authorization provider, if other than the API keys
+	switch *aAuth {
+	case "", AuthAPIKey:
+		if *aAuth == AuthAPIKey && opts.APIKey == "" && len(opts.APIKeys) == 0 {
+			exitWithError("The apikey authorization provider requires the -key or -api-keys flag")
+		}
+	case AuthJWT:
+		auth, err := NewJWTAuth(getJWTSecret(*aJWTSecret), *aJWTPublicKey, *aJWTAudience)
+		if err != nil {
+			exitWithError("invalid jwt authorization provider: %s", err)
+		}
+		opts.Auth = auth
+	case AuthMTLS:
+		if opts.CertFile == "" || opts.KeyFile == "" || *aTLSClientCA == "" {
+			exitWithError("The mtls authorization provider requires the -certfile, -keyfile and -tls-client-ca flags")
+		}
+		opts.Auth = mtlsAuth{}
+	case AuthExternal:
+		auth, err := NewExternalAuth(*aAuthURL)
+		if err != nil {
+			exitWithError("invalid external authorization provider: %s", err)
+		}
+		opts.Auth = auth
+	default:
+		exitWithError("invalid -auth value: %s", *aAuth)
+	}
+
+	// Read the TLS client certificates authorities, if present
+	if *aTLSClientCA != "" {
+		buf, err := os.ReadFile(*aTLSClientCA)
+		if err != nil {
+			exitWithError("cannot read the TLS client CA certificates: %s", err)
+		}
+		opts.ClientCAs = x509.NewCertPool()
+		if !opts.ClientCAs.AppendCertsFromPEM(buf) {
+			exitWithError("invalid -tls-client-ca value: no PEM certificates found")
+		}
+	}
+
+	// Read the picture presets, if present
+	if *aPicturePresets != "" {
+		presets, err := ReadPicturePresets(*aPicturePresets)
+		if err != nil {
+			exitWithError("cannot read the picture presets: %s", err)
+		}
+		opts.PicturePresets = presets
+	}
+
+	// Read the params policy, if present
+	if *aPolicy != "" {
+		policy, err := ReadPolicy(*aPolicy)
+		if err != nil {
+			exitWithError("cannot read the policy: %s", err)
+		}
+		opts.Policy = policy
+	}
+
+	// Track the jobs progress, if required
+	if *aEnableProgress {
+		opts.Progress = NewProgressHub()
+	}
+
+	// Parse trusted proxies, if present
+	if *aTrustedProxies != "" {
+		proxies, err := ParseTrustedProxies(*aTrustedProxies)
+		if err != nil {
+			exitWithError("invalid -trusted-proxies value: %s", err)
+		}
+		opts.TrustedProxies = proxies
+	}
+
+	// Parse the static origin headers, if present
+	if *aOriginHeaders != "" {
+		// The static headers usually hold secrets, only sent to the allowed origins
+		if *aAllowedOrigins == "" {
+			exitWithError("The -origin-headers flag requires the -allowed-origins flag")
+		}
+		headers, err := parseOriginHeaders(*aOriginHeaders)
+		if err != nil {
+			exitWithError("invalid -origin-headers value: %s", err)
+		}
+		opts.OriginHeaders = headers
+	}
+
+	// Parse the static origin query params, if present
+	if *aOriginQuery != "" {
+		query, err := url.ParseQuery(*aOriginQuery)
+		if err != nil {
+			exitWithError("invalid -origin-query value: %s", err)
+		}
+		opts.OriginQuery = query
+	}
+
+	// Read placeholder images per status, if present
+	if *aPlaceholders != "" {
+		opts.Placeholders = readPlaceholders(*aPlaceholders)
+	}
+
+	// Parse the default params, if present
+	if *aDefaultParams != "" {
+		params, err := parseDefaultParams(*aDefaultParams)
+		if err != nil {
+			exitWithError("invalid -default-params value: %s", err)
+		}
+		opts.DefaultParams = params
+	}
+
+	// Account the usage per tenant, if required
+	if *aUsageKey != "" {
+		opts.Usage = NewUsage()
+		opts.UsageKey = *aUsageKey
+	}
+
+	// Read the virtual hosts, if present
+	if *aVirtualHosts != "" {
+		hosts, err := ReadVirtualHosts(*aVirtualHosts)
+		if err != nil {
+			exitWithError("cannot read the virtual hosts: %s", err)
+		}
+		opts.VirtualHosts = hosts
+	}
+
+	// Read the middleware per route, if present
+	if *aRoutes != "" {
+		routes, err := ReadRouteMiddlewares(*aRoutes, opts)
+		if err != nil {
+			exitWithError("cannot read the routes: %s", err)
+		}
+		opts.Routes = routes
+	}
+
+	// Read the webhooks, if present
+	if *aWebhooks != "" {
+		hooks, err := ReadWebhooks(*aWebhooks)
+		if err != nil {
+			exitWithError("cannot read the webhooks: %s", err)
+		}
+		opts.Webhooks = hooks
+	}
+
+	// Read fallback images per preset name, if present
+	if *aFallbacks != "" {
+		opts.Fallbacks = readFallbacks(*aFallbacks)
+	}
+
+	// Parse generated placeholder color, if present
+	if *aPlaceholderColor != "" {
+		if opts.PlaceholderColor = parseColor(*aPlaceholderColor); len(opts.PlaceholderColor) != 3 {
+			exitWithError("invalid -placeholder-color value: %s", *aPlaceholderColor)
+		}
+	}
+
+	// Validate request body size
+	if *aMaxBodySize <= 0 {
+		exitWithError("The -max-body-size flag must be greater than 0")
+	}
+
+	// Validate metadata range size
+	if *aMetadataRangeSize < 0 {
+		exitWithError("The -metadata-range-size flag must be a positive number")
+	}
+
+	// Open the disk cache, if required
+	if *aCacheDir != "" {
+		if *aCacheMaxSize < 0 {
+			exitWithError("The -cache-max-size flag must be a positive number")
+		}
+		cache, err := NewDiskCache(*aCacheDir, *aCacheMaxSize, *aCacheReadOnly)
+		if err != nil {
+			exitWithError("cannot open the disk cache: %s", err)
+		}
+		opts.Cache = cache
+	}
+	if *aCacheTTL < 0 || *aCacheStaleTTL < 0 {
+		exitWithError("The -cache-ttl and -cache-stale-ttl flags must be a positive number")
+	}
+	if *aCacheTTL > 0 && opts.Cache == nil {
+		exitWithError("The -cache-ttl flag requires the -cache-dir flag")
+	}
+	opts.CacheTTL = *aCacheTTL
+	opts.CacheStaleTTL = *aCacheStaleTTL
+	if *aPrefetchKey != "" && opts.Cache == nil {
+		exitWithError("The -prefetch-key flag requires the -cache-dir flag")
+	}
+	opts.PrefetchKey = *aPrefetchKey
+
+	// Validate body spooling threshold
+	if *aSpoolThreshold < 0 {
+		exitWithError("The -spool-threshold flag must be a positive number")
+	}
+
+	// Validate log rotation size
+	if *aLogMaxSize < 0 {
+		exitWithError("The -log-max-size flag must be a positive number")
+	}
+
+	// Validate access log sampling
+	if *aLogSample <= 0 || *aLogSample > 1 {
+		exitWithError("The -log-sample flag must be greater than 0 and up to 1")
+	}
+	if *aLogSlow < 0 {
+		exitWithError("The -log-slow flag must be a positive number")
+	}
+
+	// Validate input frames limits
+	if *aMaxGIFFrames < 0 || *aMaxTIFFPages < 0 {
+		exitWithError("The -max-gif-frames and -max-tiff-pages flags must be a positive number")
+	}
+
+	// Validate the transformations budget
+	if *aTransformTimeout < 0 || *aTransformMaxMemory < 0 {
+		exitWithError("The -transform-timeout and -transform-max-memory flags must be a positive number")
+	}
+	opts.TransformBudget = TransformBudget{
+		Timeout:   time.Duration(*aTransformTimeout) * time.Second,
+		MaxMemory: uint64(*aTransformMaxMemory) * 1024 * 1024,
+	}
+
+	// Limit the concurrent transformations, if required
+	if *aMaxWorkers < 0 || *aMaxQueue < 0 || *aQueueTimeout < 0 {
+		exitWithError("The -max-workers, -max-queue and -queue-timeout flags must be a positive number")
+	}
+	if *aMaxWorkers > 0 {
+		opts.WorkerPool = NewWorkerPool(*aMaxWorkers, *aMaxQueue, time.Duration(*aQueueTimeout)*time.Second)
+	}
+	opts.PriorityHeader = *aPriorityHeader
+
+	// Validate quality=auto target, if present
+	if *aAutoQualityTarget <= 0 {
+		exitWithError("The -auto-quality-target flag must be greater than 0")
+	}
+
+	// Register the remote upscaler, if required
+	if *aUpscalerURL != "" {
+		u, err := url.Parse(*aUpscalerURL)
+		if err != nil || u.Host == "" {
+			exitWithError("invalid upscaler URL: %s", *aUpscalerURL)
+		}
+		RegisterUpscaler(ImageUpscalerRemote, NewHTTPUpscaler(u))
+	}
+
+	// Register the remote content moderation classifier, if required
+	if *aClassifierURL != "" {
+		u, err := url.Parse(*aClassifierURL)
+		if err != nil || u.Host == "" {
+			exitWithError("invalid classifier URL: %s", *aClassifierURL)
+		}
+		RegisterClassifier(ImageClassifierRemote, NewHTTPClassifier(u))
+	}
+
+	// Configure the C2PA content credentials, if required
+	if *aC2PACert != "" || *aC2PAKey != "" || *aC2PAValidate {
+		c2pa, err := newC2PA(*aC2PATool, *aC2PACert, *aC2PAKey, *aC2PAAlg, *aC2PATimestampURL, *aC2PAValidate)
+		if err != nil {
+			exitWithError("%s", err)
+		}
+		opts.C2PA = c2pa
+	}
+
+	// Register the remote pipeline operations, if required
+	if *aRemoteOperations != "" {
+		if *aRemoteOpTimeout <= 0 {
+			exitWithError("The -remote-operation-timeout flag must be greater than 0")
+		}
+		operations, err := parseRemoteOperations(*aRemoteOperations, time.Duration(*aRemoteOpTimeout)*time.Second)
+		if err != nil {
+			exitWithError("%s", err)
+		}
+		for _, op := range operations {
+			if err := RegisterRemoteOperation(op); err != nil {
+				exitWithError("%s", err)
+			}
+		}
+	}
+
+	// Parse the URL signature keys selected by key ID, if present
+	if *aURLSignatureKeys != "" {
+		keys, err := parseSignatureKeys(*aURLSignatureKeys)
+		if err != nil {
+			exitWithError("invalid -url-signature-keys value: %s", err)
+		}
+		opts.URLSignatureKeys = keys
+	}
+
 	// Check URL signature key, if required
 	if *aEnableURLSignature {
-		if urlSignature.Key == "" {
+		if urlSignature.Key == "" && len(opts.URLSignatureKeys) == 0 {
 			exitWithError("URL signature key is required")
 		}
 
-		if len(urlSignature.Key) < 32 {
+		if urlSignature.Key != "" && len(urlSignature.Key) < 32 {
 			exitWithError("URL signature key must be a minimum of 32 characters")
 		}
 	}
 
-	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
+	switch opts.URLSignatureAlg {
+	case SignatureAlgSHA256, SignatureAlgSHA512:
+	default:
+		exitWithError("invalid -url-signature-alg value: %s", *aURLSignatureAlg)
+	}
+
+	// Parse the source URL encryption key, if present
+	if key := getURLEncryptionKey(*aURLEncryptionKey); key != "" {
+		encryptionKey, err := parseEncryptionKey(key)
+		if err != nil {
+			exitWithError("invalid -url-encryption-key value: %s", err)
+		}
+		opts.URLEncryptionKey = encryptionKey
+	}
+
+	// Check the body signature key, if any
+	if opts.BodySignatureKey != "" && len(opts.BodySignatureKey) < 32 {
+		exitWithError("body signature key must be a minimum of 32 characters")
+	}
+
+	// Check the image formats support, warming up libvips
+	missing := selfTest(imageFormats)
+	if *aFailOnMissing != "" {
+		for _, imageType := range parseImageTypes("fail-on-missing", *aFailOnMissing) {
+			if err, ok := missing[imageType]; ok {
+				exitWithError("missing required %s image format support: %s", bimg.ImageTypeName(imageType), err)
+			}
+		}
+	}
 
 	// Load image source providers
 	LoadSources(opts)
 
+	// Consume the processing jobs instead of serving HTTP, if required
+	if *aConsume != "" {
+		if *aConsumeWorkers < 0 {
+			exitWithError("The -consume-workers flag must be a positive number")
+		}
+		consumer := ConsumerOptions{
+			URL:     *aConsume,
+			Subject: *aConsumeSubject,
+			Queue:   *aConsumeQueue,
+			Output:  *aConsumeOutput,
+			Workers: *aConsumeWorkers,
+		}
+		if err := Consume(opts, consumer); err != nil {
+			exitWithError("cannot consume the processing jobs: %s", err)
+		}
+		return
+	}
+
+	// Read the scheduled jobs, if present
+	if *aSchedules != "" {
+		jobs, err := ReadSchedules(*aSchedules, opts)
+		if err != nil {
+			exitWithError("cannot read the schedules: %s", err)
+		}
+		opts.Schedules = jobs
+	}
+
+	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
+
 	// Start the server
 	Server(opts)
 }
@@ -246,6 +907,27 @@ func getURLSignature(key string) URLSignature {
 	return URLSignature{key}
 }
 
+func getJWTSecret(secret string) string {
+	if secretEnv := os.Getenv("JWT_SECRET"); secretEnv != "" {
+		secret = secretEnv
+	}
+	return secret
+}
+
+func getURLEncryptionKey(key string) string {
+	if keyEnv := os.Getenv("URL_ENCRYPTION_KEY"); keyEnv != "" {
+		key = keyEnv
+	}
+	return key
+}
+
+func getBodySignatureKey(key string) string {
+	if keyEnv := os.Getenv("BODY_SIGNATURE_KEY"); keyEnv != "" {
+		key = keyEnv
+	}
+	return key
+}
+
 func getLogLevel(logLevel string) string {
 	if logLevelEnv := os.Getenv("GOLANG_LOG"); logLevelEnv != "" {
 		logLevel = logLevelEnv
@@ -264,16 +946,30 @@ func showVersion() {
 }
 
 func checkMountDirectory(path string) {
+	if err := validateMountDirectory(path); err != nil {
+		exitWithError("%s", err)
+	}
+}
+
+func validateMountDirectory(path string) error {
+	if strings.HasPrefix(path, embedMountPrefix) || isArchiveMount(path) {
+		if _, err := openMount(path); err != nil {
+			return fmt.Errorf("error while mounting %s: %s", path, err)
+		}
+		return nil
+	}
+
 	src, err := os.Stat(path)
 	if err != nil {
-		exitWithError("error while mounting directory: %s", err)
+		return fmt.Errorf("error while mounting directory: %s", err)
 	}
 	if !src.IsDir() {
-		exitWithError("mount path is not a directory: %s", path)
+		return fmt.Errorf("mount path is not a directory: %s", path)
 	}
 	if path == "/" {
-		exitWithError("cannot mount root directory for security reasons")
+		return fmt.Errorf("cannot mount root directory for security reasons")
 	}
+	return nil
 }
 
 func checkHTTPCacheTTL(ttl int) {
@@ -300,12 +996,109 @@ func parseForwardHeaders(forwardHeaders string) []string {
 	return headers
 }
 
+func readPlaceholders(input string) map[string][]byte {
+	placeholders := make(map[string][]byte)
+	for _, entry := range strings.Split(input, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || !isPlaceholderStatus(parts[0]) {
+			exitWithError("invalid -placeholders entry: %s", entry)
+		}
+
+		buf, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			exitWithError("cannot read placeholder image: %s", err)
+		}
+		if !bimg.IsImageTypeSupportedByVips(bimg.DetermineImageType(buf)).Load {
+			exitWithError("placeholder image type is not supported: %s", parts[1])
+		}
+
+		placeholders[strings.ToLower(parts[0])] = buf
+	}
+	return placeholders
+}
+
+func parseBodySizes(input string) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, entry := range strings.Split(input, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			exitWithError("invalid -max-body-sizes entry: %s", entry)
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || size <= 0 {
+			exitWithError("invalid -max-body-sizes size: %s", entry)
+		}
+		sizes[parts[0]] = size
+	}
+	return sizes
+}
+
+func readFallbacks(input string) map[string][]byte {
+	fallbacks := make(map[string][]byte)
+	for _, entry := range strings.Split(input, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			exitWithError("invalid -fallbacks entry: %s", entry)
+		}
+
+		buf, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			exitWithError("cannot read fallback image: %s", err)
+		}
+		if !bimg.IsImageTypeSupportedByVips(bimg.DetermineImageType(buf)).Load {
+			exitWithError("fallback image type is not supported: %s", parts[1])
+		}
+
+		fallbacks[parts[0]] = buf
+	}
+	return fallbacks
+}
+
+// isPlaceholderStatus checks the status code (e.g. 404) or class (e.g. 5xx)
+func isPlaceholderStatus(status string) bool {
+	status = strings.ToLower(status)
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+func parseMetadataFields(input string) []string {
+	var fields []string
+	for _, field := range strings.Split(input, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "":
+			continue
+		case MetadataICC, MetadataOrientation:
+			fields = append(fields, field)
+		default:
+			exitWithError("unsupported -strip-metadata-keep field: %s", field)
+		}
+	}
+	return fields
+}
+
 func parseOrigins(origins string) []*url.URL {
 	var urls []*url.URL
 	if origins == "" {
 		return urls
 	}
 	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if !strings.Contains(origin, "://") {
+			// Origins without scheme allow both http and https
+			origin = "//" + origin
+		}
 		u, err := url.Parse(origin)
 		if err != nil {
 			continue
@@ -336,6 +1129,22 @@ func parseEndpoints(input string) Endpoints {
 	return endpoints
 }
 
+func parseImageTypes(flagName, input string) ImageTypes {
+	var types ImageTypes
+	for _, name := range strings.Split(input, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		imageType := ImageType(name)
+		if imageType == bimg.UNKNOWN {
+			exitWithError("unsupported -%s format: %s", flagName, name)
+		}
+		types = append(types, imageType)
+	}
+	return types
+}
+
 func memoryRelease(interval int) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	go func() {
@@ -346,8 +1155,19 @@ func memoryRelease(interval int) {
 	}()
 }
 
+// isFlagSet reports whether the flag is defined in the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func exitWithError(format string, args ...interface{}) {
-	_, _ = fmt.Fprintf(os.Stderr, format+"\n", args)
+	_, _ = fmt.Fprintf(os.Stderr, format+"\n", args...)
 	os.Exit(1)
 }
 
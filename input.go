@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+// ImageLimits defines the limits of the images to decode, checked against the
+// source images and the pipeline intermediate results, which may exceed them
+// after enlarging the image. Zero values disable the limits.
+type ImageLimits struct {
+	MaxPixels    float64
+	MaxGIFFrames int
+	MaxTIFFPages int
+}
+
+// imageLimits returns the image limits of the server options
+func imageLimits(o ServerOptions) ImageLimits {
+	return ImageLimits{MaxPixels: o.MaxAllowedPixels, MaxGIFFrames: o.MaxGIFFrames, MaxTIFFPages: o.MaxTIFFPages}
+}
+
+// checkInputImage enforces the per-format input restrictions, rejecting the
+// not allowed image formats and the GIF and TIFF images with more frames or
+// pages than allowed, which could exhaust the server resources when decoded.
+// The frames are counted walking the image structure, without decoding it.
+func checkInputImage(buf []byte, mimeType string, o ServerOptions) error {
+	imageType := ImageTypeFromMime(mimeType)
+	if !o.AllowedInputTypes.Allows(imageType) {
+		return ErrInputFormatDenied
+	}
+	return checkImageFrames(buf, imageType, imageLimits(o))
+}
+
+// validateImage checks the image frames, or pages, and resolution against the
+// limits, reading the image header only, before decoding the image. It
+// returns the image size.
+func validateImage(buf []byte, limits ImageLimits) (bimg.ImageSize, error) {
+	if err := checkImageFrames(buf, ImageTypeFromMime(detectMimeType(buf)), limits); err != nil {
+		return bimg.ImageSize{}, err
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return size, NewError("Error processing image: "+err.Error(), http.StatusBadRequest)
+	}
+
+	if limits.exceeded(size) {
+		return size, ErrResolutionTooBig
+	}
+	return size, nil
+}
+
+// exceeded checks if the image size exceeds the resolution limit
+func (l ImageLimits) exceeded(size bimg.ImageSize) bool {
+	megapixels := float64(size.Width) * float64(size.Height) / 1000000
+	return l.MaxPixels > 0 && megapixels > l.MaxPixels
+}
+
+// expectedImageSize returns the output image size expected from the image
+// operation params, to reject the operations exceeding the resolution limit
+// before running them. The width and height, or the zoom factor, define the
+// output size, keeping the aspect ratio if only one is defined.
+func expectedImageSize(size bimg.ImageSize, operation string, o ImageOptions) bimg.ImageSize {
+	width, height := o.Width, o.Height
+	switch {
+	case width > 0 && height > 0:
+	case width > 0 && size.Width > 0:
+		height = size.Height * width / size.Width
+	case height > 0 && size.Height > 0:
+		width = size.Width * height / size.Height
+	default:
+		width, height = size.Width, size.Height
+	}
+
+	if o.NoEnlarge {
+		width, height = clampDimensions(size.Width, size.Height, width, height)
+	}
+	if operation == "zoom" && o.Factor > 0 {
+		width, height = width*o.Factor, height*o.Factor
+	}
+	return bimg.ImageSize{Width: width, Height: height}
+}
+
+// checkImageFrames rejects the GIF and TIFF images with more frames or pages
+// than allowed
+func checkImageFrames(buf []byte, imageType bimg.ImageType, limits ImageLimits) error {
+	switch {
+	case imageType == bimg.GIF && limits.MaxGIFFrames > 0:
+		if gifFrameCount(buf, limits.MaxGIFFrames) > limits.MaxGIFFrames {
+			return ErrTooManyFrames
+		}
+	case imageType == bimg.TIFF && limits.MaxTIFFPages > 0:
+		pages, ok := tiffPageCount(buf, limits.MaxTIFFPages)
+		if !ok {
+			return NewError("Invalid TIFF image: circular page references", http.StatusUnprocessableEntity)
+		}
+		if pages > limits.MaxTIFFPages {
+			return ErrTooManyFrames
+		}
+	}
+	return nil
+}
+
+// gifFrameCount counts the image descriptors of the GIF image, stopping once
+// the limit is exceeded. Truncated images return the frames found so far.
+func gifFrameCount(buf []byte, limit int) int {
+	// Header and logical screen descriptor
+	if len(buf) < 13 {
+		return 0
+	}
+	pos := 13
+	if flags := buf[10]; flags&0x80 != 0 {
+		pos += 3 << (uint(flags&0x07) + 1)
+	}
+
+	frames := 0
+	for pos < len(buf) && frames <= limit {
+		switch buf[pos] {
+		case 0x21: // Extension: label and data sub-blocks
+			pos = skipGIFSubBlocks(buf, pos+2)
+		case 0x2C: // Image descriptor, optional local color table and image data
+			frames++
+			if pos+10 > len(buf) {
+				return frames
+			}
+			flags := buf[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&0x07) + 1)
+			}
+			pos = skipGIFSubBlocks(buf, pos+1)
+		default: // Trailer or invalid block
+			return frames
+		}
+	}
+	return frames
+}
+
+// skipGIFSubBlocks returns the position following the data sub-blocks
+func skipGIFSubBlocks(buf []byte, pos int) int {
+	for pos < len(buf) {
+		size := int(buf[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+// tiffPageCount counts the image file directories (IFD) of the TIFF or
+// BigTIFF image, stopping once the limit is exceeded. Circular directory
+// chains, which never end, are reported as invalid.
+func tiffPageCount(buf []byte, limit int) (int, bool) {
+	if len(buf) < 8 {
+		return 0, true
+	}
+
+	var order binary.ByteOrder
+	switch string(buf[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, true
+	}
+
+	// Classic TIFF uses 32 bits offsets and 12 bytes entries, BigTIFF uses
+	// 64 bits offsets and 20 bytes entries
+	bigTIFF := order.Uint16(buf[2:]) == 43
+	readOffset := func(pos uint64) uint64 {
+		if bigTIFF {
+			if pos+8 > uint64(len(buf)) {
+				return 0
+			}
+			return order.Uint64(buf[pos:])
+		}
+		if pos+4 > uint64(len(buf)) {
+			return 0
+		}
+		return uint64(order.Uint32(buf[pos:]))
+	}
+
+	offset := readOffset(4)
+	if bigTIFF {
+		offset = readOffset(8)
+	}
+
+	pages := 0
+	visited := map[uint64]bool{}
+	for offset != 0 && offset < uint64(len(buf)) && pages <= limit {
+		if visited[offset] {
+			return pages, false
+		}
+		visited[offset] = true
+		pages++
+
+		var entries, next uint64
+		if bigTIFF {
+			if offset+8 > uint64(len(buf)) {
+				break
+			}
+			entries = order.Uint64(buf[offset:])
+			next = offset + 8 + entries*20
+		} else {
+			if offset+2 > uint64(len(buf)) {
+				break
+			}
+			entries = uint64(order.Uint16(buf[offset:]))
+			next = offset + 2 + entries*12
+		}
+		if entries > uint64(len(buf)) {
+			break
+		}
+		offset = readOffset(next)
+	}
+	return pages, true
+}
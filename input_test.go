@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func newTestGIF(t *testing.T, frames int) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		palette := color.Palette{color.Black, color.White}
+		img := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+		img.SetColorIndex(i%10, i%10, 1)
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestTIFF returns a TIFF image structure with the given chain of IFD
+// offsets, each IFD pointing to the next one
+func newTestTIFF(order binary.ByteOrder, offsets ...uint32) []byte {
+	buf := make([]byte, 1024)
+	copy(buf, "II")
+	if order == binary.BigEndian {
+		copy(buf, "MM")
+	}
+	order.PutUint16(buf[2:], 42)
+	order.PutUint32(buf[4:], offsets[0])
+	for i, offset := range offsets {
+		// One entry per IFD
+		order.PutUint16(buf[offset:], 1)
+		var next uint32
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		order.PutUint32(buf[offset+2+12:], next)
+	}
+	return buf
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for _, frames := range []int{1, 3, 12} {
+		if count := gifFrameCount(newTestGIF(t, frames), 100); count != frames {
+			t.Errorf("Invalid frame count: %d != %d", count, frames)
+		}
+	}
+
+	// Counting stops once the limit is exceeded
+	if count := gifFrameCount(newTestGIF(t, 12), 5); count != 6 {
+		t.Errorf("Invalid limited frame count: %d", count)
+	}
+
+	// Truncated images
+	buf := newTestGIF(t, 3)
+	if count := gifFrameCount(buf[:len(buf)/2], 100); count < 1 || count > 3 {
+		t.Errorf("Invalid truncated frame count: %d", count)
+	}
+	if count := gifFrameCount(buf[:10], 100); count != 0 {
+		t.Errorf("Invalid truncated frame count: %d", count)
+	}
+}
+
+func TestTIFFPageCount(t *testing.T) {
+	invalid := newTestTIFF(binary.LittleEndian, 8)
+	binary.LittleEndian.PutUint32(invalid[4:], 2000)
+
+	circular := newTestTIFF(binary.LittleEndian, 8, 100)
+	binary.LittleEndian.PutUint32(circular[100+2+12:], 8)
+
+	cases := []struct {
+		name  string
+		buf   []byte
+		pages int
+		valid bool
+	}{
+		{"single page", newTestTIFF(binary.LittleEndian, 8), 1, true},
+		{"multiple pages", newTestTIFF(binary.BigEndian, 8, 100, 200, 300), 4, true},
+		{"circular pages", circular, 2, false},
+		{"limited pages", newTestTIFF(binary.LittleEndian, 8, 100, 200, 300, 400, 500, 600), 4, true},
+		{"invalid offset", invalid, 0, true},
+		{"not a TIFF", []byte("GIF89a.........."), 0, true},
+	}
+
+	for _, tc := range cases {
+		pages, valid := tiffPageCount(tc.buf, 3)
+		if pages != tc.pages || valid != tc.valid {
+			t.Errorf("%s: invalid page count: %d %v", tc.name, pages, valid)
+		}
+	}
+}
+
+func TestCheckInputImage(t *testing.T) {
+	svg := readTestFile(t, "flyio-button.svg")
+	animated := newTestGIF(t, 5)
+	pages := newTestTIFF(binary.LittleEndian, 8, 100)
+
+	cases := []struct {
+		name string
+		buf  []byte
+		mime string
+		opts ServerOptions
+		err  error
+	}{
+		{"no restrictions", animated, "image/gif", ServerOptions{}, nil},
+		{"allowed format", svg, "image/svg+xml", ServerOptions{AllowedInputTypes: ImageTypes{bimg.SVG}}, nil},
+		{"not allowed format", svg, "image/svg+xml", ServerOptions{AllowedInputTypes: ImageTypes{bimg.JPEG, bimg.GIF}}, ErrInputFormatDenied},
+		{"not allowed PDF", []byte("%PDF-1.4"), "application/pdf", ServerOptions{AllowedInputTypes: ImageTypes{bimg.JPEG}}, ErrInputFormatDenied},
+		{"frames within limit", animated, "image/gif", ServerOptions{MaxGIFFrames: 5}, nil},
+		{"too many frames", animated, "image/gif", ServerOptions{MaxGIFFrames: 4}, ErrTooManyFrames},
+		{"pages within limit", pages, "image/tiff", ServerOptions{MaxTIFFPages: 2}, nil},
+		{"too many pages", pages, "image/tiff", ServerOptions{MaxTIFFPages: 1}, ErrTooManyFrames},
+	}
+
+	for _, tc := range cases {
+		if err := checkInputImage(tc.buf, tc.mime, tc.opts); err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(pages[100+2+12:], 8)
+	err := checkInputImage(pages, "image/tiff", ServerOptions{MaxTIFFPages: 10})
+	if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusUnprocessableEntity {
+		t.Errorf("Expected invalid TIFF error, got %v", err)
+	}
+}
+
+func TestInputRestrictionsHandler(t *testing.T) {
+	o := ServerOptions{MaxAllowedPixels: 18.0, AllowedInputTypes: ImageTypes{bimg.JPEG, bimg.GIF}, MaxGIFFrames: 2}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		imageHandler(w, r, buf, Resize, o)
+	}
+	ts := testServer(fn)
+	defer ts.Close()
+
+	cases := []struct {
+		buf    []byte
+		status int
+		err    Error
+	}{
+		{readTestFile(t, "test.png"), http.StatusNotAcceptable, ErrInputFormatDenied},
+		{newTestGIF(t, 3), http.StatusUnprocessableEntity, ErrTooManyFrames},
+	}
+
+	for _, tc := range cases {
+		res, err := http.Post(ts.URL+"?width=100", "", bytes.NewReader(tc.buf))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tc.status || !strings.Contains(string(body), tc.err.Message) {
+			t.Errorf("Invalid response: %d %s", res.StatusCode, body)
+		}
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+
+	cases := []struct {
+		name   string
+		buf    []byte
+		limits ImageLimits
+		err    error
+	}{
+		{"no limits", buf, ImageLimits{}, nil},
+		{"within resolution", buf, ImageLimits{MaxPixels: 0.0001}, nil},
+		{"resolution too big", buf, ImageLimits{MaxPixels: 0.00001}, ErrResolutionTooBig},
+		{"too many frames", newTestGIF(t, 3), ImageLimits{MaxGIFFrames: 2}, ErrTooManyFrames},
+	}
+
+	for _, tc := range cases {
+		size, err := validateImage(tc.buf, tc.limits)
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if err == nil && (size.Width != 8 || size.Height != 8) {
+			t.Errorf("%s: invalid size: %+v", tc.name, size)
+		}
+	}
+}
+
+func TestPipelineIntermediateLimits(t *testing.T) {
+	// Enlarges the image beyond the resolution limit
+	OperationsMap["grow"] = func(buf []byte, o ImageOptions) (Image, error) {
+		var out bytes.Buffer
+		if err := png.Encode(&out, image.NewNRGBA(image.Rect(0, 0, 200, 200))); err != nil {
+			return Image{}, err
+		}
+		return Image{Body: out.Bytes(), Mime: "image/png"}, nil
+	}
+	defer delete(OperationsMap, "grow")
+
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	opts := ImageOptions{Operations: PipelineOperations{{Name: "grow"}, {Name: "grow"}}}.WithLimits(ImageLimits{MaxPixels: 0.01})
+
+	if _, err := Pipeline(buf, opts); err == nil || err.(Error).Kind != ErrResolutionTooBig.Kind {
+		t.Errorf("Expected resolution too big error, got %v", err)
+	}
+
+	// The last operation result is not decoded again
+	opts.Operations = PipelineOperations{{Name: "grow"}}
+	if _, err := Pipeline(buf, opts); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Operations are rejected before running them, if the params exceed the limits
+	opts.Operations = PipelineOperations{{Name: "enlarge", Params: map[string]interface{}{"width": 2000, "height": 2000}}}
+	_, err := Pipeline(buf, opts)
+	if xerr, ok := err.(Error); !ok || xerr.Kind != ErrResolutionTooBig.Kind || operationError(err).HTTPCode() != http.StatusUnprocessableEntity {
+		t.Errorf("Expected resolution too big error, got %v", err)
+	}
+}
+
+func TestExpectedImageSize(t *testing.T) {
+	size := bimg.ImageSize{Width: 400, Height: 200}
+
+	cases := []struct {
+		operation string
+		opts      ImageOptions
+		width     int
+		height    int
+	}{
+		{"blur", ImageOptions{}, 400, 200},
+		{"resize", ImageOptions{Width: 800}, 800, 400},
+		{"resize", ImageOptions{Height: 100}, 200, 100},
+		{"crop", ImageOptions{Width: 300, Height: 300}, 300, 300},
+		{"enlarge", ImageOptions{Width: 800, Height: 800, NoEnlarge: true}, 200, 200},
+		{"zoom", ImageOptions{Factor: 3}, 1200, 600},
+	}
+
+	for _, tc := range cases {
+		expected := expectedImageSize(size, tc.operation, tc.opts)
+		if expected.Width != tc.width || expected.Height != tc.height {
+			t.Errorf("%s %+v: invalid expected size: %+v", tc.operation, tc.opts, expected)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// loadShedRetryAfter is the Retry-After seconds replied to the shed requests
+	loadShedRetryAfter = 1
+
+	// prefetchPriority is the priority of the prefetch requests, served after
+	// any other queued request
+	prefetchPriority = math.MinInt32
+)
+
+// priorityContextKey is the request context key of the internal requests
+// priority, taking precedence over the client defined priority
+type priorityContextKey struct{}
+
+// workerContextKey is the transformation context key of its worker lease, see
+// retainWorker
+type workerContextKey struct{}
+
+// Worker pool gauges and counters exposed by the health endpoint
+var (
+	workersBusy  int64
+	queueDepth   int64
+	requestsShed uint64
+)
+
+// WorkerPool limits the concurrent image transformations. Requests exceeding
+// the workers wait in a queue, served by priority then arrival order. When
+// the queue is full, the lowest priority queued request is shed in favor of
+// a higher priority one, or else the new request is shed.
+type WorkerPool struct {
+	Workers  int
+	MaxQueue int
+	Timeout  time.Duration
+
+	mu    sync.Mutex
+	busy  int
+	queue []*poolWaiter
+}
+
+// poolWaiter is a request waiting for a worker. ready receives nil when
+// granted a worker, or the error when shed.
+type poolWaiter struct {
+	priority int
+	ready    chan error
+}
+
+// NewWorkerPool creates a worker pool with the queue size and wait timeout,
+// zero waiting until the request is canceled
+func NewWorkerPool(workers, maxQueue int, timeout time.Duration) *WorkerPool {
+	return &WorkerPool{Workers: workers, MaxQueue: maxQueue, Timeout: timeout}
+}
+
+// Acquire waits for a worker, returning ErrOverloaded if the request is shed,
+// or ErrClientClosedRequest if canceled while queued. Acquired workers must
+// be released. No-op if the pool is not enabled.
+func (p *WorkerPool) Acquire(ctx context.Context, priority int) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	if p.busy < p.Workers && len(p.queue) == 0 {
+		p.busy++
+		p.mu.Unlock()
+		atomic.AddInt64(&workersBusy, 1)
+		return nil
+	}
+
+	if len(p.queue) >= p.MaxQueue {
+		i := p.lowest()
+		if i < 0 || p.queue[i].priority >= priority {
+			p.mu.Unlock()
+			atomic.AddUint64(&requestsShed, 1)
+			return ErrOverloaded
+		}
+		p.remove(i).ready <- ErrOverloaded
+		atomic.AddUint64(&requestsShed, 1)
+	}
+
+	waiter := &poolWaiter{priority: priority, ready: make(chan error, 1)}
+	p.queue = append(p.queue, waiter)
+	atomic.StoreInt64(&queueDepth, int64(len(p.queue)))
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case shed := <-waiter.ready:
+		return shed
+	case <-ctx.Done():
+		err = ErrClientClosedRequest
+	case <-timeout:
+		err = ErrOverloaded
+	}
+
+	p.mu.Lock()
+	for i, queued := range p.queue {
+		if queued == waiter {
+			p.remove(i)
+			p.mu.Unlock()
+			if err == ErrOverloaded {
+				atomic.AddUint64(&requestsShed, 1)
+			}
+			return err
+		}
+	}
+	p.mu.Unlock()
+
+	// Granted a worker, or shed, meanwhile
+	if shed := <-waiter.ready; shed != nil {
+		return shed
+	}
+	p.Release()
+	return err
+}
+
+// TryAcquire acquires an idle worker, if any, without waiting nor taking the
+// turn of the queued requests. Acquired workers must be released. Always
+// succeeds if the pool is not enabled.
+func (p *WorkerPool) TryAcquire() bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.busy >= p.Workers || len(p.queue) > 0 {
+		return false
+	}
+	p.busy++
+	atomic.AddInt64(&workersBusy, 1)
+	return true
+}
+
+// Release releases a worker, granted to the highest priority queued request
+func (p *WorkerPool) Release() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := p.highest(); i >= 0 {
+		p.remove(i).ready <- nil
+		return
+	}
+	p.busy--
+	atomic.AddInt64(&workersBusy, -1)
+}
+
+// Run runs the transformation once acquired a worker, released on completion
+// of the transformation and of the background operations retaining it from
+// the transformation context, see retainWorker
+func (p *WorkerPool) Run(ctx context.Context, priority int, transform func(ctx context.Context) (Image, error)) (Image, error) {
+	if err := p.Acquire(ctx, priority); err != nil {
+		return Image{}, err
+	}
+	lease := &workerLease{pool: p, refs: 1}
+	defer lease.release()
+	return transform(context.WithValue(ctx, workerContextKey{}, lease))
+}
+
+// workerLease is an acquired worker, released once released by every holder
+type workerLease struct {
+	pool *WorkerPool
+	refs int32
+}
+
+func (l *workerLease) release() {
+	if atomic.AddInt32(&l.refs, -1) == 0 {
+		l.pool.Release()
+	}
+}
+
+// retainWorker keeps the worker running the transformation acquired until the
+// returned function is called, so the operations still running once replied
+// keep counting against the workers
+func retainWorker(ctx context.Context) func() {
+	lease, ok := ctx.Value(workerContextKey{}).(*workerLease)
+	if !ok {
+		return func() {}
+	}
+	atomic.AddInt32(&lease.refs, 1)
+	return lease.release
+}
+
+// highest returns the index of the highest priority, oldest, queued request
+func (p *WorkerPool) highest() int {
+	index := -1
+	for i, waiter := range p.queue {
+		if index < 0 || waiter.priority > p.queue[index].priority {
+			index = i
+		}
+	}
+	return index
+}
+
+// lowest returns the index of the lowest priority, newest, queued request
+func (p *WorkerPool) lowest() int {
+	index := -1
+	for i, waiter := range p.queue {
+		if index < 0 || waiter.priority <= p.queue[index].priority {
+			index = i
+		}
+	}
+	return index
+}
+
+// remove removes the queued request, keeping the arrival order
+func (p *WorkerPool) remove(i int) *poolWaiter {
+	waiter := p.queue[i]
+	p.queue = append(p.queue[:i], p.queue[i+1:]...)
+	atomic.StoreInt64(&queueDepth, int64(len(p.queue)))
+	return waiter
+}
+
+// requestPriority returns the priority of the internal requests, such as the
+// prefetch ones, or else of the authorized API key, if defined, or else the
+// priority header, if enabled. Defaults to zero.
+func requestPriority(r *http.Request, o ServerOptions) int {
+	if priority, ok := r.Context().Value(priorityContextKey{}).(int); ok {
+		return priority
+	}
+	if limits, ok := o.APIKeys[authorizedAPIKey(r)]; ok && limits.Priority != 0 {
+		return limits.Priority
+	}
+	if o.PriorityHeader != "" {
+		if priority, err := strconv.Atoi(r.Header.Get(o.PriorityHeader)); err == nil {
+			return priority
+		}
+	}
+	return 0
+}
+
+// replyOverloaded replies the shed requests, to be retried later
+func replyOverloaded(r *http.Request, w http.ResponseWriter, o ServerOptions) {
+	w.Header().Set("Retry-After", strconv.Itoa(loadShedRetryAfter))
+	ErrorReply(r, w, ErrOverloaded, o)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// queuedAcquire acquires a worker in background, once queued with the
+// priority, unique among the queued requests
+func queuedAcquire(t *testing.T, ctx context.Context, p *WorkerPool, priority int) <-chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- p.Acquire(ctx, priority) }()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		p.mu.Lock()
+		for _, waiter := range p.queue {
+			if waiter.priority == priority {
+				p.mu.Unlock()
+				return result
+			}
+		}
+		p.mu.Unlock()
+	}
+	t.Fatal("Request not queued")
+	return nil
+}
+
+func TestWorkerPoolPriority(t *testing.T) {
+	p := NewWorkerPool(1, 2, 0)
+	ctx := context.Background()
+	if err := p.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	low := queuedAcquire(t, ctx, p, 0)
+	high := queuedAcquire(t, ctx, p, 10)
+
+	// The queue is full: the lowest priority request is shed for a higher one
+	premium := queuedAcquire(t, ctx, p, 5)
+	if err := <-low; err != ErrOverloaded {
+		t.Errorf("Expected low priority request to be shed, got %v", err)
+	}
+	if err := p.Acquire(ctx, 1); err != ErrOverloaded {
+		t.Errorf("Expected new low priority request to be shed, got %v", err)
+	}
+
+	// Released workers are granted by priority
+	p.Release()
+	if err := <-high; err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	p.Release()
+	if err := <-premium; err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	p.Release()
+	if p.busy != 0 || len(p.queue) != 0 {
+		t.Errorf("Invalid pool state: %d busy, %d queued", p.busy, len(p.queue))
+	}
+}
+
+func TestWorkerPoolTimeout(t *testing.T) {
+	p := NewWorkerPool(1, 1, 10*time.Millisecond)
+	if err := p.Acquire(context.Background(), 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := p.Acquire(context.Background(), 0); err != ErrOverloaded {
+		t.Errorf("Expected timeout to shed the request, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := queuedAcquire(t, ctx, p, 0)
+	cancel()
+	if err := <-canceled; err != ErrClientClosedRequest {
+		t.Errorf("Expected canceled request error, got %v", err)
+	}
+
+	p.Release()
+	if p.busy != 0 || len(p.queue) != 0 {
+		t.Errorf("Invalid pool state: %d busy, %d queued", p.busy, len(p.queue))
+	}
+}
+
+func TestWorkerPoolAbandonedTransform(t *testing.T) {
+	p := NewWorkerPool(1, 1, 0)
+	unblock := make(chan struct{})
+	blocking := func(buf []byte, o ImageOptions) (Image, error) {
+		<-unblock
+		return Image{}, nil
+	}
+
+	budget := TransformBudget{Timeout: 10 * time.Millisecond}
+	_, err := p.Run(context.Background(), 0, func(ctx context.Context) (Image, error) {
+		return budget.Run(blocking, nil, ImageOptions{}.WithContext(ctx))
+	})
+	if err != ErrTransformTimeout {
+		t.Fatalf("Expected transform timeout, got %v", err)
+	}
+	if p.TryAcquire() {
+		t.Fatal("Expected the abandoned transform to keep its worker")
+	}
+
+	close(unblock)
+	for i := 0; !p.TryAcquire(); i++ {
+		if i == 100 {
+			t.Fatal("Expected the worker released once the transform completed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.Release()
+	if p.busy != 0 {
+		t.Errorf("Invalid pool state: %d busy", p.busy)
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	o := ServerOptions{APIKeys: APIKeys{"premium": {Priority: 10}, "basic": {}}, PriorityHeader: "X-Priority"}
+
+	cases := []struct {
+		key      string
+		header   string
+		priority int
+	}{
+		{"premium", "1", 10},
+		{"basic", "3", 3},
+		{"", "invalid", 0},
+		{"", "", 0},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		if tc.key != "" {
+			r = withAPIKey(r, tc.key)
+		}
+		r.Header.Set("X-Priority", tc.header)
+		if priority := requestPriority(r, o); priority != tc.priority {
+			t.Errorf("%s %q: expected priority %d, got %d", tc.key, tc.header, tc.priority, priority)
+		}
+	}
+
+	// Internal requests priority takes precedence
+	r := withAPIKey(httptest.NewRequest(http.MethodGet, "/resize", nil), "premium")
+	r = r.WithContext(context.WithValue(r.Context(), priorityContextKey{}, prefetchPriority))
+	if priority := requestPriority(r, o); priority != prefetchPriority {
+		t.Errorf("Expected the prefetch priority, got %d", priority)
+	}
+}
+
+func TestReplyOverloaded(t *testing.T) {
+	w := httptest.NewRecorder()
+	replyOverloaded(httptest.NewRequest(http.MethodGet, "/resize", nil), w, ServerOptions{})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Invalid overloaded response: %d %v", w.Code, w.Header())
+	}
+}
@@ -4,13 +4,17 @@ package main
 import (
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
 const formatPattern = "%s - - [%s] \"%s\" %d %d %.4f\n"
 
+// slowFormatPattern flags the requests slower than the slow threshold
+const slowFormatPattern = "%s - - [%s] \"%s\" %d %d %.4f slow\n"
+
 // LogRecord implements an Apache-compatible HTTP logging
 type LogRecord struct {
 	http.ResponseWriter
@@ -22,13 +26,18 @@ type LogRecord struct {
 	protocol      string
 	time          time.Time
 	elapsedTime   time.Duration
+	slow          bool
 }
 
 // Log writes a log entry to the output stream
 func (r *LogRecord) Log(out io.Writer) {
 	timeFormat := r.time.Format("02/Jan/2006 15:04:05")
 	request := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
-	_, _ = fmt.Fprintf(out, formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
+	pattern := formatPattern
+	if r.slow {
+		pattern = slowFormatPattern
+	}
+	_, _ = fmt.Fprintf(out, pattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
 }
 
 // Write counts bytes written and forwards to ResponseWriter
@@ -38,36 +47,72 @@ func (r *LogRecord) Write(p []byte) (int, error) {
 	return written, err
 }
 
+// Flush forwards to ResponseWriter, if supported, allowing streaming responses
+func (r *LogRecord) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, used by http.ResponseController
+func (r *LogRecord) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // WriteHeader sets status code and forwards to ResponseWriter
 func (r *LogRecord) WriteHeader(status int) {
 	r.status = status
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// LogSampling defines the access log sampling. Requests replied with an
+// error or slower than the slow threshold are always logged, along with
+// their params, regardless of the sampling and the log level.
+type LogSampling struct {
+	// Rate is the ratio of the info level logs written, from 0 to 1.
+	// Zero disables the sampling.
+	Rate float64
+	// Slow is the duration threshold of the slow requests. Zero disables it.
+	Slow time.Duration
+}
+
+// sampled reports whether the info level log must be written
+func (s LogSampling) sampled() bool {
+	return s.Rate <= 0 || s.Rate >= 1 || rand.Float64() < s.Rate
+}
+
 // LogHandler handles HTTP request logging
 type LogHandler struct {
 	handler  http.Handler
 	io       io.Writer
+	errors   io.Writer
 	logLevel string
+	sampling LogSampling
 }
 
 // NewLog creates a new logger handler
 func NewLog(handler http.Handler, io io.Writer, logLevel string) http.Handler {
-	return &LogHandler{handler, io, logLevel}
+	return &LogHandler{handler: handler, io: io, logLevel: logLevel}
+}
+
+// NewLogWithErrors creates a new logger handler which also writes the server
+// errors (5xx responses) to a separate error log, regardless of the log level
+func NewLogWithErrors(handler http.Handler, io, errors io.Writer, logLevel string) http.Handler {
+	return &LogHandler{handler: handler, io: io, errors: errors, logLevel: logLevel}
+}
+
+// NewSampledLog creates a new logger handler like NewLogWithErrors, sampling
+// the info level logs and flagging the slow requests
+func NewSampledLog(handler http.Handler, io, errors io.Writer, logLevel string, sampling LogSampling) http.Handler {
+	return &LogHandler{handler: handler, io: io, errors: errors, logLevel: logLevel, sampling: sampling}
 }
 
 // ServeHTTP implements http.Handler interface
 func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Extract client IP without port
-	clientIP := r.RemoteAddr
-	if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
-		clientIP = clientIP[:colon]
-	}
-
 	// Create log record
 	record := &LogRecord{
 		ResponseWriter: w,
-		ip:             clientIP,
+		ip:             clientIP(r),
 		time:           time.Time{},
 		method:         r.Method,
 		uri:            r.RequestURI,
@@ -83,18 +128,33 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	record.time = finishTime.UTC()
 	record.elapsedTime = finishTime.Sub(startTime)
+	record.slow = h.sampling.Slow > 0 && record.elapsedTime >= h.sampling.Slow
+
+	if h.errors != nil && record.status >= http.StatusInternalServerError {
+		record.Log(h.errors)
+	}
 
 	// Log based on configured level
 	switch h.logLevel {
 	case "error":
-		if record.status >= http.StatusInternalServerError {
+		if record.status >= http.StatusInternalServerError || record.slow {
 			record.Log(h.io)
 		}
 	case "warning":
-		if record.status >= http.StatusBadRequest {
+		if record.status >= http.StatusBadRequest || record.slow {
 			record.Log(h.io)
 		}
 	case "info":
-		record.Log(h.io)
+		if record.status >= http.StatusBadRequest || record.slow || h.sampling.sampled() {
+			record.Log(h.io)
+		}
+	}
+}
+
+// clientIP returns the request client IP without port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
+	return r.RemoteAddr
 }
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type fakeWriter func([]byte) (int, error)
@@ -62,3 +63,74 @@ func TestLogError(t *testing.T) {
 		t.Fatalf("Invalid log output: %s", data)
 	}
 }
+
+func TestLogWithErrors(t *testing.T) {
+	var access, errors []byte
+	accessWriter := fakeWriter(func(b []byte) (int, error) {
+		access = append(access, b...)
+		return len(b), nil
+	})
+	errorWriter := fakeWriter(func(b []byte) (int, error) {
+		errors = append(errors, b...)
+		return len(b), nil
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	log := NewLogWithErrors(http.HandlerFunc(handler), accessWriter, errorWriter, "info")
+
+	ts := httptest.NewServer(log)
+	defer ts.Close()
+
+	_, _ = http.Get(ts.URL)
+	_, _ = http.Get(ts.URL + "/fail")
+
+	if strings.Count(string(access), "\n") != 2 {
+		t.Errorf("Invalid access log output: %s", access)
+	}
+	if !strings.Contains(string(errors), " 500 ") || strings.Contains(string(errors), " 200 ") {
+		t.Errorf("Invalid error log output: %s", errors)
+	}
+}
+
+func TestSampledLog(t *testing.T) {
+	var access []byte
+	accessWriter := fakeWriter(func(b []byte) (int, error) {
+		access = append(access, b...)
+		return len(b), nil
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/slow":
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	sampling := LogSampling{Rate: 0.000001, Slow: 10 * time.Millisecond}
+	log := NewSampledLog(http.HandlerFunc(handler), accessWriter, nil, "info", sampling)
+
+	ts := httptest.NewServer(log)
+	defer ts.Close()
+
+	for i := 0; i < 10; i++ {
+		_, _ = http.Get(ts.URL)
+	}
+	_, _ = http.Get(ts.URL + "/fail")
+	_, _ = http.Get(ts.URL + "/slow?width=300")
+
+	lines := strings.Split(strings.TrimSpace(string(access)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Invalid sampled access log output: %s", access)
+	}
+	if !strings.Contains(lines[0], " 400 ") {
+		t.Errorf("Errors must always be logged: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "/slow?width=300") || !strings.HasSuffix(lines[1], " slow") {
+		t.Errorf("Slow requests must always be logged: %s", lines[1])
+	}
+}
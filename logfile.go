@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFileMode is the permission used when creating log files
+const logFileMode = 0644
+
+// LogFile is an append-only log file. It can be reopened after being moved by
+// external tools such as logrotate, and optionally rotates itself when its
+// size exceeds the given maximum, renaming it with a timestamp suffix.
+type LogFile struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+}
+
+// OpenLogFile opens or creates the log file. A maxSize of zero disables the
+// size based rotation.
+func OpenLogFile(path string, maxSize int64) (*LogFile, error) {
+	l := &LogFile{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write appends the log entry, rotating the file first if required
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the log file at the same path
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_ = l.file.Close()
+	return l.open()
+}
+
+// Close closes the log file
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *LogFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logFileMode)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames the current log file and opens a new one. If the file
+// cannot be renamed, entries keep being appended to the current file.
+func (l *LogFile) rotate() error {
+	_ = l.file.Close()
+
+	backup := fmt.Sprintf("%s.%s", l.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	_ = os.Rename(l.path, backup)
+	return l.open()
+}
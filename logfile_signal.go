@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenLogsOnSignal reopens the log files when receiving SIGUSR1, as sent
+// by logrotate postrotate scripts
+func reopenLogsOnSignal(files ...*LogFile) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			for _, file := range files {
+				if err := file.Reopen(); err != nil {
+					log.Printf("cannot reopen log file: %s", err)
+				}
+			}
+		}
+	}()
+}
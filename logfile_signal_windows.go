@@ -0,0 +1,4 @@
+package main
+
+// reopenLogsOnSignal is a no-op since SIGUSR1 is not available on Windows
+func reopenLogsOnSignal(files ...*LogFile) {}
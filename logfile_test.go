@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := OpenLogFile(path, 10)
+	if err != nil {
+		t.Fatalf("Cannot open log file: %s", err)
+	}
+	defer file.Close()
+
+	_, _ = file.Write([]byte("first\n"))
+	_, _ = file.Write([]byte("second\n"))
+
+	buf, _ := os.ReadFile(path)
+	if string(buf) != "second\n" {
+		t.Errorf("Invalid log file content: %q", buf)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotated log file, got: %v", backups)
+	}
+	if buf, _ := os.ReadFile(backups[0]); string(buf) != "first\n" {
+		t.Errorf("Invalid rotated log file content: %q", buf)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := OpenLogFile(path, 0)
+	if err != nil {
+		t.Fatalf("Cannot open log file: %s", err)
+	}
+	defer file.Close()
+
+	_, _ = file.Write([]byte("before\n"))
+	_ = os.Rename(path, path+".1")
+	if err := file.Reopen(); err != nil {
+		t.Fatalf("Cannot reopen log file: %s", err)
+	}
+	_, _ = file.Write([]byte("after\n"))
+
+	if buf, _ := os.ReadFile(path); string(buf) != "after\n" {
+		t.Errorf("Invalid log file content: %q", buf)
+	}
+	if buf, _ := os.ReadFile(path + ".1"); string(buf) != "before\n" {
+		t.Errorf("Invalid moved log file content: %q", buf)
+	}
+}
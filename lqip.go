@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+const (
+	// defaultLQIPWidth is the placeholder width when the request doesn't
+	// define the width param
+	defaultLQIPWidth = 20
+
+	// maxLQIPWidth limits the placeholder size, as it's meant to be inlined
+	maxLQIPWidth = 64
+
+	// defaultLQIPQuality is the placeholder quality when the request doesn't
+	// define the quality param, as the details are lost when upscaled anyway
+	defaultLQIPQuality = 20
+)
+
+// LQIPPreview represents a low quality image placeholder, inlined as data URI
+type LQIPPreview struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Type    string `json:"type"`
+	DataURI string `json:"dataURI"`
+}
+
+// LQIP generates a tiny, heavily compressed and optionally blurred preview of
+// the image, replied as image or as JSON with the base64 data URI. JPEG and
+// WebP images are shrunk on load by libvips, so large images are never fully
+// decoded. Images with alpha channel default to WebP, or else JPEG.
+func LQIP(buf []byte, o ImageOptions) (Image, error) {
+	if o.Height > 0 {
+		return Image{}, NewParamError("Invalid param: height is not supported, the placeholder keeps the image aspect ratio", "height")
+	}
+	if o.Width == 0 {
+		o.Width = defaultLQIPWidth
+	}
+	if o.Width > maxLQIPWidth {
+		return Image{}, NewParamError(fmt.Sprintf("Invalid param: width must be up to %d", maxLQIPWidth), "width")
+	}
+	if o.Quality == 0 {
+		o.Quality = defaultLQIPQuality
+	}
+
+	if o.Type == "" {
+		meta, err := bimg.Metadata(buf)
+		if err != nil {
+			return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+		}
+		o.Type = "jpeg"
+		if meta.Alpha {
+			o.Type = "webp"
+		}
+	}
+
+	opts := BimgOptions(o)
+	opts.StripMetadata = true
+	opts.NoProfile = true
+	image, err := Process(buf, opts)
+	if err != nil || o.Output != SrcsetOutputJSON {
+		return image, err
+	}
+
+	size, err := bimg.Size(image.Body)
+	if err != nil {
+		return Image{}, NewError("Cannot read image placeholder: "+err.Error(), http.StatusInternalServerError)
+	}
+	body, err := json.Marshal(LQIPPreview{
+		Width:   size.Width,
+		Height:  size.Height,
+		Type:    image.Mime,
+		DataURI: "data:" + image.Mime + ";base64," + base64.StdEncoding.EncodeToString(image.Body),
+	})
+	if err != nil {
+		return Image{}, NewError("Cannot encode image placeholder: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: "application/json"}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestLQIP(t *testing.T) {
+	image, err := LQIP(readTestFile(t, "large.jpg"), ImageOptions{Sigma: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid content type: %s", image.Mime)
+	}
+	if size, err := bimg.Size(image.Body); err != nil || size.Width != defaultLQIPWidth {
+		t.Errorf("Invalid placeholder size: %+v", size)
+	}
+
+	image, err = LQIP(readTestFile(t, "test.png"), ImageOptions{Width: 32, Output: SrcsetOutputJSON})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var preview LQIPPreview
+	if err := json.Unmarshal(image.Body, &preview); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	if preview.Width != 32 || preview.Type != "image/webp" || !strings.HasPrefix(preview.DataURI, "data:image/webp;base64,") {
+		t.Errorf("Invalid placeholder: %+v", preview)
+	}
+	if _, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(preview.DataURI, "data:image/webp;base64,")); err != nil {
+		t.Errorf("Invalid data URI: %s", err)
+	}
+}
+
+func TestLQIPInvalidParams(t *testing.T) {
+	for _, opts := range []ImageOptions{
+		{Width: maxLQIPWidth + 1},
+		{Height: 20},
+	} {
+		if _, err := LQIP(nil, opts); err == nil {
+			t.Errorf("Expected error for options %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// Metadata fields which can be kept when metadata stripping is enforced
+const (
+	MetadataICC         = "icc"
+	MetadataOrientation = "orientation"
+)
+
+const (
+	jpegMarkerSOI  = 0xD8
+	jpegMarkerSOS  = 0xDA
+	jpegMarkerAPP0 = 0xE0
+	jpegMarkerAPP1 = 0xE1
+	jpegMarkerAPP2 = 0xE2
+
+	// iccChunkSize is the maximum ICC profile payload per JPEG APP2 segment
+	iccChunkSize = 65519
+)
+
+var (
+	iccJPEGHeader = []byte("ICC_PROFILE\x00")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// jpegSegment represents a JPEG marker segment preceding the image scan
+type jpegSegment struct {
+	marker byte
+	offset int
+	data   []byte
+}
+
+// jpegSegments returns the marker segments found before the start of scan
+func jpegSegments(buf []byte) []jpegSegment {
+	var segments []jpegSegment
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != jpegMarkerSOI {
+		return segments
+	}
+
+	for i := 2; i+4 <= len(buf) && buf[i] == 0xFF; {
+		marker := buf[i+1]
+		if marker == jpegMarkerSOS {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if length < 2 || i+2+length > len(buf) {
+			break
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, offset: i, data: buf[i+4 : i+2+length]})
+		i += 2 + length
+	}
+	return segments
+}
+
+// extractICCProfile returns the ICC profile embedded in a JPEG or PNG image
+func extractICCProfile(buf []byte) []byte {
+	switch bimg.DetermineImageType(buf) {
+	case bimg.JPEG:
+		type chunk struct {
+			seq  byte
+			data []byte
+		}
+
+		var chunks []chunk
+		for _, segment := range jpegSegments(buf) {
+			if segment.marker == jpegMarkerAPP2 && len(segment.data) > 14 && bytes.HasPrefix(segment.data, iccJPEGHeader) {
+				chunks = append(chunks, chunk{seq: segment.data[12], data: segment.data[14:]})
+			}
+		}
+
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+
+		var profile []byte
+		for _, c := range chunks {
+			profile = append(profile, c.data...)
+		}
+		return profile
+
+	case bimg.PNG:
+		data := pngChunk(buf, "iCCP")
+		// Profile name, null separator and compression method precede the profile
+		sep := bytes.IndexByte(data, 0)
+		if sep == -1 || sep+2 > len(data) {
+			return nil
+		}
+
+		r, err := zlib.NewReader(bytes.NewReader(data[sep+2:]))
+		if err != nil {
+			return nil
+		}
+		defer r.Close()
+
+		profile, err := io.ReadAll(r)
+		if err != nil {
+			return nil
+		}
+		return profile
+	}
+
+	return nil
+}
+
+// iccColorSpace returns the data color space signature of the ICC profile
+// header, e.g: RGB, GRAY or CMYK
+func iccColorSpace(profile []byte) string {
+	if len(profile) < 20 {
+		return ""
+	}
+	return strings.TrimSpace(string(profile[16:20]))
+}
+
+// imageColorSpace returns the ICC color space signature matching the pixels
+// of a JPEG or PNG image
+func imageColorSpace(buf []byte) (string, bool) {
+	spaces := map[int]string{1: "GRAY", 3: "RGB", 4: "CMYK"}
+
+	switch bimg.DetermineImageType(buf) {
+	case bimg.JPEG:
+		for _, segment := range jpegSegments(buf) {
+			if isJPEGFrameMarker(segment.marker) && len(segment.data) >= 6 {
+				space, ok := spaces[int(segment.data[5])]
+				return space, ok
+			}
+		}
+
+	case bimg.PNG:
+		if len(buf) < 26 || string(buf[12:16]) != "IHDR" {
+			return "", false
+		}
+		// Gray and gray with alpha color types, or else RGB and palette ones
+		if colorType := buf[25]; colorType == 0 || colorType == 4 {
+			return "GRAY", true
+		}
+		return "RGB", true
+	}
+
+	return "", false
+}
+
+// embedICCProfile embeds the ICC profile into a JPEG or PNG image, keeping
+// other formats untouched.
+func embedICCProfile(buf, profile []byte) []byte {
+	if len(profile) == 0 {
+		return buf
+	}
+
+	switch bimg.DetermineImageType(buf) {
+	case bimg.JPEG:
+		if len(extractICCProfile(buf)) > 0 {
+			return buf
+		}
+
+		count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+		if count > 255 {
+			return buf
+		}
+
+		var segments bytes.Buffer
+		for i := 0; i < count; i++ {
+			end := (i + 1) * iccChunkSize
+			if end > len(profile) {
+				end = len(profile)
+			}
+
+			payload := append(append([]byte{}, iccJPEGHeader...), byte(i+1), byte(count))
+			payload = append(payload, profile[i*iccChunkSize:end]...)
+			writeJPEGSegment(&segments, jpegMarkerAPP2, payload)
+		}
+		return insertJPEGSegments(buf, segments.Bytes())
+
+	case bimg.PNG:
+		if pngChunk(buf, "iCCP") != nil || len(buf) < 33 || string(buf[12:16]) != "IHDR" {
+			return buf
+		}
+
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		_, _ = w.Write(profile)
+		_ = w.Close()
+
+		data := append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...)
+
+		// The iCCP chunk must precede the image data, insert it after IHDR
+		var out bytes.Buffer
+		out.Write(buf[:33])
+		writePNGChunk(&out, "iCCP", data)
+		out.Write(buf[33:])
+		return out.Bytes()
+	}
+
+	return buf
+}
+
+// embedOrientation writes a minimal EXIF segment holding the orientation tag
+// into a JPEG image, keeping other formats untouched.
+func embedOrientation(buf []byte, orientation int) []byte {
+	if orientation < 2 || orientation > 8 || bimg.DetermineImageType(buf) != bimg.JPEG {
+		return buf
+	}
+
+	for _, segment := range jpegSegments(buf) {
+		if segment.marker == jpegMarkerAPP1 && bytes.HasPrefix(segment.data, []byte("Exif\x00\x00")) {
+			return buf
+		}
+	}
+
+	exif := []byte("Exif\x00\x00")
+	// Big endian TIFF header with the first IFD at offset 8
+	exif = append(exif, 'M', 'M', 0, 42, 0, 0, 0, 8)
+	// Single IFD entry: orientation tag (0x0112), SHORT type, one value
+	exif = append(exif, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0)
+	// No next IFD
+	exif = append(exif, 0, 0, 0, 0)
+
+	var segment bytes.Buffer
+	writeJPEGSegment(&segment, jpegMarkerAPP1, exif)
+	return insertJPEGSegments(buf, segment.Bytes())
+}
+
+// keepMetadata restores the allowed metadata fields from the source image
+// into the output image, which has been stripped of any metadata.
+func keepMetadata(source, output []byte, fields []string, noRotation bool) []byte {
+	for _, field := range fields {
+		switch field {
+		case MetadataICC:
+			// A profile of another color space, e.g: CMYK converted to sRGB,
+			// would misrender the output, which is then left untagged as sRGB
+			profile := extractICCProfile(source)
+			if space, ok := imageColorSpace(output); ok && space == iccColorSpace(profile) {
+				output = embedICCProfile(output, profile)
+			}
+		case MetadataOrientation:
+			// Auto rotated images don't need the orientation anymore
+			if !noRotation {
+				continue
+			}
+			if meta, err := bimg.Metadata(source); err == nil {
+				output = embedOrientation(output, meta.Orientation)
+			}
+		}
+	}
+	return output
+}
+
+// insertJPEGSegments inserts the raw segments after the SOI and JFIF markers
+func insertJPEGSegments(buf, segments []byte) []byte {
+	offset := 2
+	if s := jpegSegments(buf); len(s) > 0 && s[0].marker == jpegMarkerAPP0 {
+		offset = s[0].offset + 4 + len(s[0].data)
+	}
+
+	out := make([]byte, 0, len(buf)+len(segments))
+	out = append(out, buf[:offset]...)
+	out = append(out, segments...)
+	return append(out, buf[offset:]...)
+}
+
+func writeJPEGSegment(w *bytes.Buffer, marker byte, payload []byte) {
+	w.Write([]byte{0xFF, marker})
+	_ = binary.Write(w, binary.BigEndian, uint16(len(payload)+2))
+	w.Write(payload)
+}
+
+// pngChunk returns the data of the first PNG chunk of the given type
+func pngChunk(buf []byte, chunkType string) []byte {
+	if !bytes.HasPrefix(buf, pngSignature) {
+		return nil
+	}
+
+	for i := len(pngSignature); i+8 <= len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[i:]))
+		if length < 0 || i+12+length > len(buf) {
+			return nil
+		}
+		if string(buf[i+4:i+8]) == chunkType {
+			return buf[i+8 : i+8+length]
+		}
+		if string(buf[i+4:i+8]) == "IDAT" {
+			return nil
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+func writePNGChunk(w *bytes.Buffer, chunkType string, data []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	w.WriteString(chunkType)
+	w.Write(data)
+	_ = binary.Write(w, binary.BigEndian, crc.Sum32())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testRasterImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	var buf bytes.Buffer
+	if err := encode(&buf, image.NewNRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEmbedICCProfile(t *testing.T) {
+	// Large enough to be split across multiple JPEG segments
+	profile := bytes.Repeat([]byte("icc profile "), 7000)
+
+	t.Run("JPEG", func(t *testing.T) {
+		buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+
+		out := embedICCProfile(buf, profile)
+		if !bytes.Equal(extractICCProfile(out), profile) {
+			t.Error("Invalid embedded ICC profile")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("Cannot decode image: %s", err)
+		}
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+
+		out := embedICCProfile(buf, profile)
+		if !bytes.Equal(extractICCProfile(out), profile) {
+			t.Error("Invalid embedded ICC profile")
+		}
+		if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("Cannot decode image: %s", err)
+		}
+	})
+
+	t.Run("Empty profile", func(t *testing.T) {
+		buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+		if out := embedICCProfile(buf, nil); !bytes.Equal(out, buf) {
+			t.Error("Image must not change without profile")
+		}
+	})
+}
+
+func TestKeepMetadataICC(t *testing.T) {
+	source := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+	output := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+
+	for space, kept := range map[string]bool{"RGB ": true, "CMYK": false, "GRAY": false} {
+		profile := make([]byte, 128)
+		copy(profile[16:], space)
+
+		out := keepMetadata(embedICCProfile(source, profile), output, []string{MetadataICC}, false)
+		if embedded := extractICCProfile(out) != nil; embedded != kept {
+			t.Errorf("Invalid %s profile kept into the RGB output: %t", space, embedded)
+		}
+	}
+}
+
+func TestEmbedOrientation(t *testing.T) {
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+
+	out := embedOrientation(buf, 6)
+	segments := jpegSegments(out)
+	if len(segments) == 0 || segments[0].marker != jpegMarkerAPP1 {
+		t.Fatal("Missing EXIF segment")
+	}
+	if data := segments[0].data; data[len(data)-7] != 6 {
+		t.Errorf("Invalid orientation value: %d", data[len(data)-7])
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("Cannot decode image: %s", err)
+	}
+
+	if out := embedOrientation(buf, 1); !bytes.Equal(out, buf) {
+		t.Error("Default orientation must not be embedded")
+	}
+}
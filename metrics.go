@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// operationSamples is the number of latest durations kept per operation to
+// compute the duration percentiles
+const operationSamples = 1024
+
+// OperationStats holds the metrics of an image operation, accumulated since
+// the server started. Percentiles are computed over the latest durations.
+type OperationStats struct {
+	Success     uint64  `json:"success"`
+	Failure     uint64  `json:"failure"`
+	AvgDuration float64 `json:"avgDurationMs"`
+	P50Duration float64 `json:"p50DurationMs"`
+	P95Duration float64 `json:"p95DurationMs"`
+	P99Duration float64 `json:"p99DurationMs"`
+	BytesIn     uint64  `json:"bytesIn"`
+	BytesOut    uint64  `json:"bytesOut"`
+}
+
+// operationMetrics accumulates the metrics of an image operation
+type operationMetrics struct {
+	success  uint64
+	failure  uint64
+	total    time.Duration
+	bytesIn  uint64
+	bytesOut uint64
+	// samples is a ring buffer of the latest durations
+	samples []time.Duration
+	next    int
+}
+
+var (
+	operationsMu      sync.Mutex
+	operationsMetrics = map[string]*operationMetrics{}
+)
+
+// recordOperation records the image operation run, its duration and the
+// input and output image sizes
+func recordOperation(name string, duration time.Duration, bytesIn, bytesOut int, err error) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	m, ok := operationsMetrics[name]
+	if !ok {
+		m = &operationMetrics{}
+		operationsMetrics[name] = m
+	}
+
+	if err != nil {
+		m.failure++
+	} else {
+		m.success++
+		m.bytesOut += uint64(bytesOut)
+	}
+	m.bytesIn += uint64(bytesIn)
+	m.total += duration
+
+	if len(m.samples) < operationSamples {
+		m.samples = append(m.samples, duration)
+	} else {
+		m.samples[m.next] = duration
+		m.next = (m.next + 1) % operationSamples
+	}
+}
+
+// operationStats returns the metrics of every image operation run, by name
+func operationStats() map[string]OperationStats {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	stats := make(map[string]OperationStats, len(operationsMetrics))
+	for name, m := range operationsMetrics {
+		samples := append([]time.Duration{}, m.samples...)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		stats[name] = OperationStats{
+			Success:     m.success,
+			Failure:     m.failure,
+			AvgDuration: toMilliseconds(m.total / time.Duration(m.success+m.failure)),
+			P50Duration: toMilliseconds(percentile(samples, 0.50)),
+			P95Duration: toMilliseconds(percentile(samples, 0.95)),
+			P99Duration: toMilliseconds(percentile(samples, 0.99)),
+			BytesIn:     m.bytesIn,
+			BytesOut:    m.bytesOut,
+		}
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// toMilliseconds converts the duration to milliseconds with precision
+func toMilliseconds(d time.Duration) float64 {
+	return toFixed(float64(d)/float64(time.Millisecond), 3)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordOperation(t *testing.T) {
+	for i := 1; i <= 100; i++ {
+		recordOperation("metrics-test", time.Duration(i)*time.Millisecond, 1000, 100, nil)
+	}
+	recordOperation("metrics-test", 0, 1000, 0, errors.New("failed"))
+
+	stats, ok := operationStats()["metrics-test"]
+	if !ok {
+		t.Fatal("Missing operation metrics")
+	}
+	if stats.Success != 100 || stats.Failure != 1 {
+		t.Errorf("Invalid operations count: %d success, %d failure", stats.Success, stats.Failure)
+	}
+	if stats.BytesIn != 101000 || stats.BytesOut != 10000 {
+		t.Errorf("Invalid bytes processed: %d in, %d out", stats.BytesIn, stats.BytesOut)
+	}
+	if stats.AvgDuration != 50 {
+		t.Errorf("Invalid average duration: %f", stats.AvgDuration)
+	}
+	if stats.P50Duration != 50 || stats.P95Duration != 95 || stats.P99Duration != 99 {
+		t.Errorf("Invalid duration percentiles: %+v", stats)
+	}
+}
+
+func TestOperationSamplesRing(t *testing.T) {
+	for i := 0; i < operationSamples+10; i++ {
+		recordOperation("metrics-ring-test", time.Millisecond, 0, 0, nil)
+	}
+
+	operationsMu.Lock()
+	samples := len(operationsMetrics["metrics-ring-test"].samples)
+	operationsMu.Unlock()
+	if samples != operationSamples {
+		t.Errorf("Invalid samples count: %d", samples)
+	}
+}
@@ -2,26 +2,30 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"github.com/h2non/bimg"
 	"github.com/rs/cors"
 	"github.com/throttled/throttled/v2"
 	"github.com/throttled/throttled/v2/store/memstore"
-	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
 
-type ImageOperation func([]byte, ImageOptions) (Image, error)
-
 func Middleware(fn http.HandlerFunc, o ServerOptions) http.Handler {
 	next := http.Handler(fn)
 
-	if len(o.Endpoints) > 0 {
+	if o.MaxBodySize > 0 || len(o.MaxBodySizes) > 0 {
+		next = limitRequestBody(next, o)
+	}
+	if len(o.Endpoints) > 0 || len(o.EnabledEndpoints) > 0 {
 		next = validateEndpoints(next, o)
 	}
 	if o.Concurrency > 0 {
@@ -30,20 +34,31 @@ func Middleware(fn http.HandlerFunc, o ServerOptions) http.Handler {
 	if o.CORS {
 		next = cors.Default().Handler(next)
 	}
-	if o.APIKey != "" {
-		next = authorize(next, o)
+	if len(o.APIKeys) > 0 {
+		next = throttleAPIKeys(next, o)
+	}
+	if auth := authProvider(o); auth != nil {
+		next = authorize(next, auth, o)
 	}
 	if o.HTTPCacheTTL >= 0 {
-		next = addCacheHeaders(next, o.HTTPCacheTTL)
+		next = addCacheHeaders(next, o.HTTPCacheTTL, o.CacheStaleTTL)
 	}
 
-	return validateRequest(addDefaultHeaders(next), o)
+	return validateRequest(addDefaultHeaders(next, o), o)
 }
 
-func ImageMiddleware(o ServerOptions) func(ImageOperation) http.Handler {
-	return func(operation ImageOperation) http.Handler {
-		fn := createImageHandler(o, operation)
-		handler := validateImageRequest(Middleware(fn, o), o)
+func ImageMiddleware(o ServerOptions) func(Operation) http.Handler {
+	return func(operation Operation) http.Handler {
+		fn := accountUsage(imageController(o, operation), o)
+		handler := validateImageRequest(Middleware(fn.ServeHTTP, o), o)
+		handler = addNegotiationHeaders(handler, o)
+		if len(o.DefaultParams) > 0 {
+			handler = addDefaultParams(handler, o)
+		}
+
+		if len(o.URLEncryptionKey) > 0 {
+			handler = decryptSourceURL(handler, o)
+		}
 
 		if o.EnableURLSignature {
 			handler = checkURLSignature(handler, o)
@@ -53,124 +68,157 @@ func ImageMiddleware(o ServerOptions) func(ImageOperation) http.Handler {
 	}
 }
 
-// Helper functions for image retrieval
-func getImageFromURL(r *http.Request, o ServerOptions) ([]byte, error) {
-	source := MatchSource(r)
-	if source == nil {
-		return nil, fmt.Errorf("missing image source")
-	}
+func validateEndpoints(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := path.Base(r.URL.Path)
+		if r.URL.Path == path.Join(o.PathPrefix, "/") {
+			endpoint = ""
+		}
+		if isEndpointEnabled(endpoint, o) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ErrorReply(r, w, ErrNotImplemented, o)
+	})
+}
 
-	return source.GetImage(r)
+// throttleRequests throttles the requests per client IP, resolved from the
+// trusted proxies headers, if any
+func throttleRequests(next http.Handler, o ServerOptions) http.Handler {
+	quota := throttled.RateQuota{MaxRate: throttled.PerSec(o.Concurrency), MaxBurst: o.Burst}
+	return rateLimit(next, quota, &throttled.VaryBy{RemoteAddr: true}, o)
 }
 
-func getImageFromRequest(r *http.Request) ([]byte, error) {
-	file, _, err := r.FormFile("file")
+// rateLimit throttles the requests exceeding the quota, exposing the limit
+// state via the RateLimit-* (and legacy X-RateLimit-*) response headers
+func rateLimit(next http.Handler, quota throttled.RateQuota, varyBy *throttled.VaryBy, o ServerOptions) http.Handler {
+	store, err := memstore.New(65536)
 	if err != nil {
-		return nil, err
+		return throttleError(err, o)
 	}
-	defer file.Close()
-
-	return io.ReadAll(file)
-}
-
-func createImageHandler(o ServerOptions, operation ImageOperation) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var buf []byte
-		var err error
 
-		if r.Method == http.MethodGet {
-			buf, err = getImageFromURL(r, o)
-		} else {
-			buf, err = getImageFromRequest(r)
-		}
+	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
+	if err != nil {
+		return throttleError(err, o)
+	}
 
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited, result, err := rateLimiter.RateLimit(varyBy.Key(r), 1)
 		if err != nil {
-			ErrorReply(r, w, NewError("Error getting image: "+err.Error(), http.StatusBadRequest), o)
+			throttleError(err, o).ServeHTTP(w, r)
 			return
 		}
 
-		if len(buf) == 0 {
-			ErrorReply(r, w, ErrEmptyBody, o)
+		setRateLimitHeaders(w, result, limited)
+		if limited {
+			ErrorReply(r, w, ErrTooManyRequests, o)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		opts, err := buildParamsFromQuery(r.URL.Query())
-		if err != nil {
-			ErrorReply(r, w, NewError("Error parsing parameters: "+err.Error(), http.StatusBadRequest), o)
+func setRateLimitHeaders(w http.ResponseWriter, result throttled.RateLimitResult, limited bool) {
+	header := w.Header()
+	limit := strconv.Itoa(result.Limit)
+	remaining := strconv.Itoa(result.Remaining)
+	reset := strconv.Itoa(ceilSeconds(result.ResetAfter))
+
+	header.Set("RateLimit-Limit", limit)
+	header.Set("RateLimit-Remaining", remaining)
+	header.Set("RateLimit-Reset", reset)
+	header.Set("X-RateLimit-Limit", limit)
+	header.Set("X-RateLimit-Remaining", remaining)
+	header.Set("X-RateLimit-Reset", reset)
+
+	if limited && result.RetryAfter >= 0 {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+func throttleError(err error, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ErrorReply(r, w, NewError(fmt.Sprintf("throttle error: %v", err), http.StatusInternalServerError), o)
+	})
+}
+
+// ceilSeconds rounds up the duration to seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// limitRequestBody restricts the request body size per endpoint, falling
+// back to the global limit. Requests declaring a larger Content-Length are
+// rejected before reading the body.
+func limitRequestBody(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := o.MaxBodySize
+		if endpointLimit, ok := o.MaxBodySizes[path.Base(r.URL.Path)]; ok {
+			limit = endpointLimit
+		}
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		image, err := operation(buf, opts)
-		if err != nil {
-			ErrorReply(r, w, NewError("Error processing image: "+err.Error(), http.StatusBadRequest), o)
+		if r.ContentLength > limit {
+			xerr := NewSizeError(ErrEntityTooLarge, r.ContentLength, limit)
+			o.AuditLog.Log(r, AuditImageTooLarge, "", xerr)
+			ErrorReply(r, w, xerr, o)
 			return
 		}
-
-		w.Header().Set("Content-Type", image.Mime)
-		w.Header().Set("Content-Length", fmt.Sprint(len(image.Body)))
-		w.Write(image.Body)
-	}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func validateEndpoints(next http.Handler, o ServerOptions) http.Handler {
+func authorize(next http.Handler, auth AuthProvider, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if o.Endpoints.IsValid(r) {
-			next.ServeHTTP(w, r)
+		authorized, err := auth.Authorize(r)
+		if err != nil {
+			xerr, ok := err.(Error)
+			if !ok {
+				xerr = ErrUnauthorized
+			}
+			if xerr == ErrInvalidAPIKey {
+				o.AuditLog.Log(r, AuditInvalidAPIKey, "key", xerr)
+			} else if xerr != ErrAuthUnavailable {
+				o.AuditLog.Log(r, AuditUnauthorized, "", xerr)
+			}
+			ErrorReply(r, w, xerr, o)
 			return
 		}
-		ErrorReply(r, w, ErrNotImplemented, o)
+		next.ServeHTTP(w, authorized)
 	})
 }
 
-func throttleRequests(next http.Handler, o ServerOptions) http.Handler {
-	store, err := memstore.New(65536)
-	if err != nil {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, fmt.Sprintf("throttle error: %v", err), http.StatusInternalServerError)
-		})
+func addDefaultHeaders(next http.Handler, o ServerOptions) http.Handler {
+	// Versions are only disclosed along with the full index
+	server := fmt.Sprintf("imaginary %s (bimg %s)", Version, bimg.Version)
+	if o.IndexMode != "" && o.IndexMode != IndexModeFull {
+		server = "imaginary"
 	}
-
-	quota := throttled.RateQuota{MaxRate: throttled.PerSec(o.Concurrency), MaxBurst: o.Burst}
-	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
-	if err != nil {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, fmt.Sprintf("throttle error: %v", err), http.StatusInternalServerError)
-		})
-	}
-
-	return (&throttled.HTTPRateLimiter{
-		RateLimiter: rateLimiter,
-		VaryBy:      &throttled.VaryBy{Method: true},
-	}).RateLimit(next)
-}
-
-func authorize(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := r.Header.Get("API-Key")
-		if key == "" {
-			key = r.URL.Query().Get("key")
-		}
-		if key != o.APIKey {
-			ErrorReply(r, w, ErrInvalidAPIKey, o)
-			return
-		}
+		w.Header().Set("Server", server)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func addDefaultHeaders(next http.Handler) http.Handler {
+func addNegotiationHeaders(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Server", fmt.Sprintf("imaginary %s (bimg %s)", Version, bimg.Version))
+		setNegotiationHeaders(w, r, o)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func addCacheHeaders(next http.Handler, ttl int) http.Handler {
+func addCacheHeaders(next http.Handler, ttl, staleTTL int) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet && !isPublicPath(r.URL.Path) {
 			expires := time.Now().Add(time.Duration(ttl) * time.Second)
 			w.Header().Set("Expires", strings.Replace(expires.Format(time.RFC1123), "UTC", "GMT", -1))
-			w.Header().Set("Cache-Control", getCacheControl(ttl))
+			w.Header().Set("Cache-Control", getCacheControl(ttl, staleTTL))
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -178,7 +226,7 @@ func addCacheHeaders(next http.Handler, ttl int) http.Handler {
 
 func validateRequest(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost && !isMountWrite(r, o) {
 			ErrorReply(r, w, ErrMethodNotAllowed, o)
 			return
 		}
@@ -193,7 +241,7 @@ func validateImageRequest(next http.Handler, o ServerOptions) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
-			if o.Mount == "" && !o.EnableURLSource {
+			if !hasMounts(o) && !o.EnableURLSource {
 				ErrorReply(r, w, ErrGetMethodNotAllowed, o)
 				return
 			}
@@ -202,24 +250,40 @@ func validateImageRequest(next http.Handler, o ServerOptions) http.Handler {
 	})
 }
 
+// addDefaultParams adds the server default params the request query omits.
+// URL signatures are checked before, against the client query, also kept for
+// the uploaded image signatures.
+func addDefaultParams(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(context.WithValue(r.Context(), clientQueryKey{}, r.URL.RawQuery))
+		r2.URL.RawQuery = withDefaultParams(r.URL.Query(), o.DefaultParams).Encode()
+		next.ServeHTTP(w, r2)
+	})
+}
+
 func checkURLSignature(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 		sign := query.Get("sign")
 		query.Del("sign")
 
-		h := hmac.New(sha256.New, []byte(o.URLSignatureKey))
-		h.Write([]byte(r.URL.Path))
-		h.Write([]byte(query.Encode()))
-		expectedSign := h.Sum(nil)
+		key, ok := urlSignatureKey(query, o)
+		if !ok {
+			o.AuditLog.Log(r, AuditInvalidSignature, signatureKeyIDParam, ErrUnknownSignatureKey)
+			ErrorReply(r, w, ErrUnknownSignatureKey, o)
+			return
+		}
+		expectedSign := signURL(key, o.URLSignatureAlg, r.URL.Path, query)
 
 		urlSign, err := base64.RawURLEncoding.DecodeString(sign)
 		if err != nil {
+			o.AuditLog.Log(r, AuditInvalidSignature, "sign", ErrInvalidURLSignature)
 			ErrorReply(r, w, ErrInvalidURLSignature, o)
 			return
 		}
 
 		if !hmac.Equal(urlSign, expectedSign) {
+			o.AuditLog.Log(r, AuditInvalidSignature, "sign", ErrURLSignatureMismatch)
 			ErrorReply(r, w, ErrURLSignatureMismatch, o)
 			return
 		}
@@ -230,16 +294,31 @@ func checkURLSignature(next http.Handler, o ServerOptions) http.Handler {
 
 func isPublicPath(path string) bool {
 	switch path {
-	case "/", "/health", "/form":
+	case "/", "/health", "/health/live", "/health/ready", "/form":
 		return true
 	default:
 		return false
 	}
 }
 
-func getCacheControl(ttl int) string {
+// getCacheControl returns the Cache-Control header of the TTL, allowing the
+// caches to serve the expired responses while revalidating them during the
+// stale TTL, if any
+func getCacheControl(ttl, staleTTL int) string {
 	if ttl == 0 {
 		return "private, no-cache, no-store, must-revalidate"
 	}
+	if staleTTL > 0 {
+		return fmt.Sprintf("public, s-maxage=%d, max-age=%d, stale-while-revalidate=%d, no-transform", ttl, ttl, staleTTL)
+	}
 	return fmt.Sprintf("public, s-maxage=%d, max-age=%d, no-transform", ttl, ttl)
 }
+
+// signURL returns the HMAC digest of the URL path and query, which must
+// not include the sign param, using the signature algorithm
+func signURL(key, alg, urlPath string, query url.Values) []byte {
+	h := hmac.New(signatureHash(alg), []byte(key))
+	h.Write([]byte(urlPath))
+	h.Write([]byte(query.Encode()))
+	return h.Sum(nil)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+)
+
+func TestThrottleRequests(t *testing.T) {
+	o := ServerOptions{Concurrency: 1, Burst: 0, HTTPCacheTTL: -1}
+	handler := Middleware(func(w http.ResponseWriter, r *http.Request) {}, o)
+
+	var limited *httptest.ResponseRecorder
+	for i := 0; i < 3 && limited == nil; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/resize", nil))
+		if w.Header().Get("RateLimit-Limit") == "" {
+			t.Fatal("Missing RateLimit-Limit header")
+		}
+		if w.Code == http.StatusTooManyRequests {
+			limited = w
+		}
+	}
+
+	if limited == nil {
+		t.Fatal("Expected the requests to be throttled")
+	}
+	if limited.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header")
+	}
+
+	var body Error
+	if err := json.Unmarshal(limited.Body.Bytes(), &body); err != nil || body.Code != http.StatusTooManyRequests {
+		t.Errorf("Invalid error body: %s", limited.Body.String())
+	}
+}
+
+func TestThrottleRequestsPerClient(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.1")
+	o := ServerOptions{Concurrency: 1, Burst: 0, HTTPCacheTTL: -1}
+	handler := resolveClientIP(Middleware(func(w http.ResponseWriter, r *http.Request) {}, o), proxies)
+
+	request := func(client string) int {
+		r := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		r.RemoteAddr = "10.0.0.1:4321"
+		r.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// The clients behind the same proxy have their own quota
+	if code := request("203.0.113.1"); code == http.StatusTooManyRequests {
+		t.Fatal("Unexpected throttled first client request")
+	}
+	if code := request("203.0.113.2"); code == http.StatusTooManyRequests {
+		t.Fatal("Unexpected throttled second client request")
+	}
+
+	limited := false
+	for i := 0; i < 3 && !limited; i++ {
+		limited = request("203.0.113.1") == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Error("Expected the first client requests to be throttled")
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	result := throttled.RateLimitResult{Limit: 10, Remaining: 0, ResetAfter: 1500 * time.Millisecond, RetryAfter: 200 * time.Millisecond}
+	setRateLimitHeaders(w, result, true)
+
+	expected := map[string]string{
+		"RateLimit-Limit":     "10",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+		"X-RateLimit-Limit":   "10",
+		"Retry-After":         "1",
+	}
+	for header, value := range expected {
+		if w.Header().Get(header) != value {
+			t.Errorf("Invalid %s header: %s", header, w.Header().Get(header))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	setRateLimitHeaders(w, throttled.RateLimitResult{Limit: 10, Remaining: 9, RetryAfter: -1}, false)
+	if w.Header().Get("Retry-After") != "" {
+		t.Error("Unexpected Retry-After header")
+	}
+}
+
+func TestEnableEndpoints(t *testing.T) {
+	for _, prefix := range []string{"/", "/api/v1"} {
+		opts := ServerOptions{PathPrefix: prefix, EnabledEndpoints: Endpoints{"health", "form"}, Endpoints: Endpoints{"form"}}
+		ts := httptest.NewServer(NewServerMux(opts))
+
+		cases := []struct {
+			endpoint string
+			status   int
+		}{
+			{"", http.StatusOK},
+			{"health", http.StatusOK},
+			{"form", http.StatusNotImplemented},
+			{"qr", http.StatusNotImplemented},
+		}
+		for _, tc := range cases {
+			res, err := http.Get(ts.URL + path.Join(prefix, tc.endpoint))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("%s: invalid response status: %d", path.Join(prefix, tc.endpoint), res.StatusCode)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestAddDefaultParams(t *testing.T) {
+	o := ServerOptions{DefaultParams: url.Values{"quality": {"80"}, "type": {"auto"}}}
+	var query url.Values
+	handler := addDefaultParams(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+	}), o)
+
+	r := httptest.NewRequest(http.MethodGet, "/resize?width=300&quality=90", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if query.Get("width") != "300" || query.Get("quality") != "90" || query.Get("type") != "auto" {
+		t.Errorf("Invalid request params: %v", query)
+	}
+	if r.URL.Query().Get("type") != "" {
+		t.Error("The original request should not be modified")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/h2non/bimg"
+)
+
+// ImageClassifierRemote is the name of the remote HTTP classifier, used by
+// default when the classifier param is missing
+const ImageClassifierRemote = "remote"
+
+// maxClassifierResponseSize limits the size of the remote classifier responses
+const maxClassifierResponseSize = 64 << 10
+
+// ModerationScores maps the moderation categories, such as nsfw or violence,
+// to their likelihood between 0 and 1
+type ModerationScores map[string]float64
+
+// Classifier defines the interface implemented by content moderation
+// backends, such as NSFW detection models, scoring an image per category.
+type Classifier interface {
+	Classify(ctx context.Context, buf []byte) (ModerationScores, error)
+}
+
+// classifierRegistry manages the registered classifiers
+var classifierRegistry = struct {
+	classifiers map[string]Classifier
+	mu          sync.RWMutex
+}{classifiers: make(map[string]Classifier)}
+
+// RegisterClassifier registers a new classifier by name
+func RegisterClassifier(name string, classifier Classifier) {
+	if classifier == nil {
+		return
+	}
+
+	classifierRegistry.mu.Lock()
+	classifierRegistry.classifiers[name] = classifier
+	classifierRegistry.mu.Unlock()
+}
+
+// GetClassifier returns the classifier registered with the given name, if any
+func GetClassifier(name string) Classifier {
+	classifierRegistry.mu.RLock()
+	defer classifierRegistry.mu.RUnlock()
+	return classifierRegistry.classifiers[name]
+}
+
+// HTTPClassifier delegates content moderation to an external HTTP service,
+// which receives the image as POST payload and replies with the scores as a
+// JSON object, e.g: {"nsfw": 0.02, "violence": 0.01}
+type HTTPClassifier struct {
+	URL    *url.URL
+	client *http.Client
+}
+
+// NewHTTPClassifier creates a new remote HTTP classifier
+func NewHTTPClassifier(endpoint *url.URL) *HTTPClassifier {
+	return &HTTPClassifier{
+		URL:    endpoint,
+		client: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// Classify sends the image to the remote classifier service
+func (c *HTTPClassifier) Classify(ctx context.Context, buf []byte) (ModerationScores, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.URL.String(), bytes.NewReader(buf))
+	req.Header.Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling remote classifier: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error calling remote classifier: (status=%d)", res.StatusCode)
+	}
+
+	var scores ModerationScores
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxClassifierResponseSize)).Decode(&scores); err != nil {
+		return nil, fmt.Errorf("error reading remote classifier response: %w", err)
+	}
+	return scores, nil
+}
+
+// Moderate scores the image content with the requested classifier
+func Moderate(buf []byte, o ImageOptions) (Image, error) {
+	name := o.Classifier
+	if name == "" {
+		name = ImageClassifierRemote
+	}
+
+	classifier := GetClassifier(name)
+	if classifier == nil {
+		return Image{}, NewParamError("Unsupported classifier: "+name, "classifier")
+	}
+
+	scores, err := classifier.Classify(o.Context(), buf)
+	if err != nil {
+		return Image{}, NewError("Cannot classify image: "+err.Error(), http.StatusBadGateway)
+	}
+	if scores == nil {
+		scores = ModerationScores{}
+	}
+	for category, score := range scores {
+		if score < 0 || score > 1 {
+			return Image{}, NewError(fmt.Sprintf("Invalid classifier score for %s: %g", category, score), http.StatusBadGateway)
+		}
+	}
+
+	body, err := json.Marshal(struct {
+		Classifier string           `json:"classifier"`
+		Scores     ModerationScores `json:"scores"`
+	}{name, scores})
+	if err != nil {
+		return Image{}, NewError("Cannot encode moderation scores: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	return Image{Body: body, Mime: "application/json"}, nil
+}
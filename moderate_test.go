@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type staticClassifier ModerationScores
+
+func (c staticClassifier) Classify(ctx context.Context, buf []byte) (ModerationScores, error) {
+	return ModerationScores(c), nil
+}
+
+func TestModerate(t *testing.T) {
+	RegisterClassifier("static", staticClassifier{"nsfw": 0.25, "violence": 0})
+	defer delete(classifierRegistry.classifiers, "static")
+
+	image, err := Moderate(readTestFile(t, "imaginary.jpg"), ImageOptions{Classifier: "static"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Errorf("Invalid content type: %s", image.Mime)
+	}
+
+	var result struct {
+		Classifier string
+		Scores     ModerationScores
+	}
+	if err := json.Unmarshal(image.Body, &result); err != nil {
+		t.Fatalf("Cannot decode response: %s", err)
+	}
+	if result.Classifier != "static" || result.Scores["nsfw"] != 0.25 || len(result.Scores) != 2 {
+		t.Errorf("Invalid moderation result: %s", image.Body)
+	}
+}
+
+func TestModerateErrors(t *testing.T) {
+	RegisterClassifier("invalid", staticClassifier{"nsfw": 1.5})
+	defer delete(classifierRegistry.classifiers, "invalid")
+
+	cases := []struct {
+		classifier string
+		status     int
+	}{
+		{"", http.StatusBadRequest},
+		{"unknown", http.StatusBadRequest},
+		{"invalid", http.StatusBadGateway},
+	}
+
+	for _, tc := range cases {
+		_, err := Moderate(readTestFile(t, "imaginary.jpg"), ImageOptions{Classifier: tc.classifier})
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != tc.status {
+			t.Errorf("Classifier %q: expected %d error, got %v", tc.classifier, tc.status, err)
+		}
+	}
+}
+
+func TestHTTPClassifier(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "image/jpeg" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"nsfw": 0.02, "violence": 0.01}`))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	scores, err := NewHTTPClassifier(u).Classify(context.Background(), readTestFile(t, "imaginary.jpg"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if scores["nsfw"] != 0.02 || scores["violence"] != 0.01 {
+		t.Errorf("Invalid scores: %v", scores)
+	}
+
+	u.Path = "/missing"
+	ts.Config.Handler = http.NotFoundHandler()
+	if _, err := NewHTTPClassifier(u).Classify(context.Background(), readTestFile(t, "imaginary.jpg")); err == nil {
+		t.Error("Expected error for failed classifier requests")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	mountParam = "mount"
+	// embedMountPrefix references the file systems registered via
+	// RegisterEmbeddedMount, such as embed:assets
+	embedMountPrefix = "embed:"
+)
+
+var mountNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Mounts maps the mount names, selected via the mount param, to their local
+// directory
+type Mounts map[string]string
+
+// mountFlags collects the repeated -mount flags
+type mountFlags []string
+
+func (m *mountFlags) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mountFlags) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// newMountFlags defines a flag which can be repeated
+func newMountFlags(name, usage string) *mountFlags {
+	values := &mountFlags{}
+	flag.Var(values, name, usage)
+	return values
+}
+
+// parseMounts parses the -mount flags, either a directory, served by default,
+// or a named directory, such as assets=/srv/assets, selected via the mount param
+func parseMounts(values []string) (string, Mounts, error) {
+	var mount string
+	mounts := Mounts{}
+	for _, value := range values {
+		name, dir := "", value
+		if i := strings.Index(value, "="); i > 0 && mountNamePattern.MatchString(value[:i]) {
+			name, dir = value[:i], value[i+1:]
+		}
+		if dir == "" {
+			return "", nil, fmt.Errorf("missing mount directory: %s", value)
+		}
+
+		if name == "" {
+			if mount != "" {
+				return "", nil, fmt.Errorf("duplicated default mount: %s", value)
+			}
+			mount = dir
+			continue
+		}
+		if _, ok := mounts[name]; ok {
+			return "", nil, fmt.Errorf("duplicated mount name: %s", name)
+		}
+		mounts[name] = dir
+	}
+	return mount, mounts, nil
+}
+
+// selectMount returns the directory of the mount selected by the mount param,
+// or the default mount otherwise
+func selectMount(r *http.Request, mount string, mounts Mounts) (string, error) {
+	name := r.URL.Query().Get(mountParam)
+	if name == "" {
+		if mount == "" && len(mounts) > 0 {
+			return "", ErrMissingParamMount
+		}
+		if mount == "" {
+			return "", ErrMissingImageSource
+		}
+		return mount, nil
+	}
+
+	dir, ok := mounts[name]
+	if !ok {
+		return "", ErrUnknownMount
+	}
+	return dir, nil
+}
+
+// hasMounts reports whether the file system image source is enabled
+func hasMounts(o ServerOptions) bool {
+	return o.Mount != "" || len(o.Mounts) > 0
+}
+
+var (
+	embeddedMounts = map[string]fs.FS{}
+	archiveMounts  = map[string]fs.FS{}
+	mountsMu       sync.Mutex
+)
+
+// RegisterEmbeddedMount registers a file system, such as an embed.FS compiled
+// into the binary, to be mounted as -mount embed:<name>
+func RegisterEmbeddedMount(name string, fsys fs.FS) {
+	mountsMu.Lock()
+	embeddedMounts[name] = fsys
+	mountsMu.Unlock()
+}
+
+// isArchiveMount reports whether the mount is a ZIP archive instead of a directory
+func isArchiveMount(mount string) bool {
+	return strings.EqualFold(filepath.Ext(mount), ".zip")
+}
+
+// openMount returns the file system of the mount: a registered embedded file
+// system, a ZIP archive, opened once and kept open, or a local directory
+func openMount(mount string) (fs.FS, error) {
+	if name := strings.TrimPrefix(mount, embedMountPrefix); name != mount {
+		mountsMu.Lock()
+		defer mountsMu.Unlock()
+		fsys, ok := embeddedMounts[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown embedded mount: %s", name)
+		}
+		return fsys, nil
+	}
+
+	if isArchiveMount(mount) {
+		mountsMu.Lock()
+		defer mountsMu.Unlock()
+		if fsys, ok := archiveMounts[mount]; ok {
+			return fsys, nil
+		}
+		archive, err := zip.OpenReader(mount)
+		if err != nil {
+			return nil, err
+		}
+		archiveMounts[mount] = archive
+		return archive, nil
+	}
+
+	return os.DirFS(mount), nil
+}
+
+// mountFilePath returns the file param as a path within the mount file system,
+// rejecting the paths escaping it
+func mountFilePath(file string) (string, error) {
+	name := strings.TrimPrefix(path.Clean(filepath.ToSlash(file)), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", ErrInvalidFilePath
+	}
+	return name, nil
+}
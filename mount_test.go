@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseMounts(t *testing.T) {
+	mount, mounts, err := parseMounts([]string{"/srv/images", "assets=/srv/assets", "uploads=/srv/up=loads"})
+	if err != nil {
+		t.Fatalf("Cannot parse the mounts: %s", err)
+	}
+	if mount != "/srv/images" || !reflect.DeepEqual(mounts, Mounts{"assets": "/srv/assets", "uploads": "/srv/up=loads"}) {
+		t.Errorf("Invalid mounts: %s %v", mount, mounts)
+	}
+
+	// Paths with an equal sign are not taken as named mounts
+	if mount, mounts, err = parseMounts([]string{"./x=y/z"}); err != nil || mount != "./x=y/z" || len(mounts) != 0 {
+		t.Errorf("Invalid default mount: %s %v %v", mount, mounts, err)
+	}
+
+	for _, values := range [][]string{{"assets="}, {"assets=/a", "assets=/b"}, {"/a", "/b"}} {
+		if _, _, err := parseMounts(values); err == nil {
+			t.Errorf("Expected error for mounts: %v", values)
+		}
+	}
+}
+
+func TestFileSystemImageSourceMounts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"assets", "uploads"} {
+		_ = os.Mkdir(filepath.Join(dir, name), 0755)
+		_ = ioutil.WriteFile(filepath.Join(dir, name, "image.jpg"), []byte(name), 0644)
+	}
+	mounts := Mounts{"assets": filepath.Join(dir, "assets"), "uploads": filepath.Join(dir, "uploads")}
+
+	cases := []struct {
+		mount string
+		query string
+		body  string
+		err   error
+	}{
+		{"", "mount=assets&file=image.jpg", "assets", nil},
+		{"", "mount=uploads&file=image.jpg", "uploads", nil},
+		{"", "mount=uploads&file=../assets/image.jpg", "", ErrInvalidFilePath},
+		{"", "mount=other&file=image.jpg", "", ErrUnknownMount},
+		{"", "file=image.jpg", "", ErrMissingParamMount},
+		{filepath.Join(dir, "assets"), "file=image.jpg", "assets", nil},
+	}
+
+	for _, c := range cases {
+		source := NewFileSystemImageSource(&SourceConfig{MountPath: c.mount, Mounts: mounts})
+		body, err := source.GetImage(httptest.NewRequest(http.MethodGet, "/resize?"+c.query, nil))
+		if err != c.err || string(body) != c.body {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", c.query, c.body, c.err, body, err)
+		}
+	}
+}
+
+func TestFileSystemImageSourceArchive(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "assets.zip")
+	out, _ := os.Create(archive)
+	writer := zip.NewWriter(out)
+	for _, name := range []string{"logo.png", "kiosk/screen-1.jpg"} {
+		file, _ := writer.Create(name)
+		_, _ = file.Write([]byte(name))
+	}
+	_ = writer.Close()
+	_ = out.Close()
+
+	if err := validateMountDirectory(archive); err != nil {
+		t.Fatalf("Invalid archive mount: %s", err)
+	}
+
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: archive})
+	for file, body := range map[string]string{"logo.png": "logo.png", "/kiosk/screen-*.jpg": "kiosk/screen-1.jpg"} {
+		image, err := source.GetImage(httptest.NewRequest(http.MethodGet, "/resize?file="+file, nil))
+		if err != nil || string(image) != body {
+			t.Errorf("%s: expected %q, got %q (%v)", file, body, image, err)
+		}
+	}
+	if _, err := source.GetImage(httptest.NewRequest(http.MethodGet, "/resize?file=../assets.zip", nil)); err != ErrInvalidFilePath {
+		t.Errorf("Expected invalid file path error, got: %v", err)
+	}
+
+	listing, err := listMountFiles(archive, "kiosk/")
+	if err != nil || len(listing.Files) != 1 || listing.Files[0].Path != "kiosk/screen-1.jpg" {
+		t.Errorf("Invalid archive listing: %+v (%v)", listing, err)
+	}
+}
+
+func TestFileSystemImageSourceEmbedded(t *testing.T) {
+	RegisterEmbeddedMount("fixtures", fstest.MapFS{"images/logo.png": {Data: []byte("logo")}})
+
+	source := NewFileSystemImageSource(&SourceConfig{Mounts: Mounts{"fixtures": "embed:fixtures"}})
+	image, err := source.GetImage(httptest.NewRequest(http.MethodGet, "/resize?mount=fixtures&file=images/logo.png", nil))
+	if err != nil || string(image) != "logo" {
+		t.Errorf("Invalid embedded image %q: %v", image, err)
+	}
+
+	if err := validateMountDirectory("embed:missing"); err == nil {
+		t.Error("Expected unknown embedded mount error")
+	}
+}
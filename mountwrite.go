@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// isMountWrite reports whether the request stores or deletes a file of the
+// mount directories via the /files endpoint, if enabled
+func isMountWrite(r *http.Request, o ServerOptions) bool {
+	if !o.EnableMountWrites || path.Base(r.URL.Path) != "files" {
+		return false
+	}
+	return r.Method == http.MethodPut || r.Method == http.MethodDelete
+}
+
+// writableMountFile returns the local path of the file param, and its path
+// within the selected mount, which must be a directory. Only image files are
+// writable, outside of the hidden directories.
+func writableMountFile(r *http.Request, o ServerOptions) (string, string, error) {
+	// The file param is unescaped as the file system source does
+	file, err := url.QueryUnescape(r.URL.Query().Get(fileParam))
+	if err != nil {
+		return "", "", ErrInvalidFilePath
+	}
+	if file == "" {
+		return "", "", ErrMissingParamFile
+	}
+	name, err := mountFilePath(file)
+	if err != nil {
+		return "", "", err
+	}
+	if name == "." || isGlobPattern(name) || !isImageFile(name) {
+		return "", "", ErrInvalidFilePath
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", "", ErrInvalidFilePath
+		}
+	}
+
+	mount, err := selectMount(r, o.Mount, o.Mounts)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.HasPrefix(mount, embedMountPrefix) || isArchiveMount(mount) {
+		return "", "", ErrReadOnlyMount
+	}
+	return filepath.Join(mount, filepath.FromSlash(name)), name, nil
+}
+
+// putMountFile stores the request body image, either raw or the file field of
+// a multipart form, under the file param path, replacing the existing file,
+// if any, and purging its cached variants. The image is validated against
+// the image limits and, if the type param is present, transcoded along with
+// the other image params, such as quality, before being stored.
+func putMountFile(w http.ResponseWriter, r *http.Request, o ServerOptions) {
+	file, name, err := writableMountFile(r, o)
+	if err != nil {
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
+	buf, err := NewBodyImageSource(newSourceConfig(o)).GetImage(r)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if err != nil {
+		xerr, ok := err.(Error)
+		if !ok {
+			xerr = NewError("Cannot read the image: "+err.Error(), http.StatusBadRequest)
+		}
+		ErrorReply(r, w, xerr, o)
+		return
+	}
+	if o.MaxAllowedSize > 0 && len(buf) > o.MaxAllowedSize {
+		xerr := NewSizeError(ErrImageTooLarge, int64(len(buf)), int64(o.MaxAllowedSize))
+		o.AuditLog.Log(r, AuditImageTooLarge, "", xerr)
+		ErrorReply(r, w, xerr, o)
+		return
+	}
+	if _, err := validateImage(buf, imageLimits(o)); err != nil {
+		switch err {
+		case ErrResolutionTooBig:
+			o.AuditLog.Log(r, AuditResolutionTooBig, "", err)
+		case ErrTooManyFrames:
+			o.AuditLog.Log(r, AuditInputRejected, "", err)
+		}
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
+	if r.URL.Query().Get("type") != "" {
+		opts, err := buildParamsFromQuery(r.URL.Query())
+		if err != nil {
+			ErrorReply(r, w, paramsError(err), o)
+			return
+		}
+		image, err := o.WorkerPool.Run(r.Context(), requestPriority(r, o), func(ctx context.Context) (Image, error) {
+			return o.TransformBudget.Run(Convert, buf, opts.WithContext(ctx))
+		})
+		if err == ErrOverloaded {
+			replyOverloaded(r, w, o)
+			return
+		}
+		if err != nil {
+			ErrorReply(r, w, operationError(err), o)
+			return
+		}
+		buf = image.Body
+	}
+
+	// The file extension defines the image type served by default
+	imageType := ImageTypeFromMime(detectMimeType(buf))
+	if ext := ImageType(strings.TrimPrefix(path.Ext(name), ".")); ext != bimg.UNKNOWN && ext != imageType {
+		ErrorReply(r, w, NewParamError("The file extension doesn't match the image type: "+bimg.ImageTypeName(imageType), fileParam), o)
+		return
+	}
+
+	previous, err := os.ReadFile(file)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err := writeFileAtomic(file, buf); err != nil {
+		ErrorReply(r, w, NewError("Cannot store the image: "+err.Error(), http.StatusInternalServerError), o)
+		return
+	}
+	if !created && sourceDigest(previous) != sourceDigest(buf) {
+		o.Cache.Purge(sourceDigest(previous))
+	}
+
+	stored := ListedFile{Path: name, Size: int64(len(buf))}
+	if info, err := os.Stat(file); err == nil {
+		stored.Modified = info.ModTime().UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(stored)
+}
+
+// deleteMountFile removes the file of the file param, and purges its cached
+// variants
+func deleteMountFile(w http.ResponseWriter, r *http.Request, o ServerOptions) {
+	file, _, err := writableMountFile(r, o)
+	if err != nil {
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
+	info, err := os.Stat(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		ErrorReply(r, w, ErrImageNotFound, o)
+		return
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		ErrorReply(r, w, ErrInvalidFilePath, o)
+		return
+	}
+
+	var previous []byte
+	if o.Cache != nil {
+		previous, _ = os.ReadFile(file)
+	}
+	if err := os.Remove(file); err != nil {
+		ErrorReply(r, w, NewError("Cannot delete the image: "+err.Error(), http.StatusInternalServerError), o)
+		return
+	}
+	if previous != nil {
+		o.Cache.Purge(sourceDigest(previous))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
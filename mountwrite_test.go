@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritableMountFile(t *testing.T) {
+	mount := t.TempDir()
+	o := ServerOptions{Mount: mount, Mounts: Mounts{"archive": "assets.zip", "embedded": "embed:assets"}}
+	cases := []struct {
+		query string
+		file  string
+		err   error
+	}{
+		{"file=products/a.jpg", filepath.Join(mount, "products", "a.jpg"), nil},
+		{"file=/products/../a.webp", filepath.Join(mount, "a.webp"), nil},
+		{"file=../../etc/a.png", "", ErrInvalidFilePath},
+		{"", "", ErrMissingParamFile},
+		{"file=notes.txt", "", ErrInvalidFilePath},
+		{"file=.cache/a.jpg", "", ErrInvalidFilePath},
+		{"file=screen-*.jpg", "", ErrInvalidFilePath},
+		{"file=a.jpg&mount=archive", "", ErrReadOnlyMount},
+		{"file=a.jpg&mount=embedded", "", ErrReadOnlyMount},
+		{"file=a.jpg&mount=unknown", "", ErrUnknownMount},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPut, "/files?"+tc.query, nil)
+		file, _, err := writableMountFile(r, o)
+		if file != tc.file || err != tc.err {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", tc.query, tc.file, tc.err, file, err)
+		}
+	}
+}
+
+func TestPutMountFile(t *testing.T) {
+	mount := t.TempDir()
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{Mount: mount, APIKey: "secret", EnableMountWrites: true, Cache: cache}
+	handler := Middleware(filesController(o), o)
+	image, _ := os.ReadFile("testdata/large.jpg")
+
+	put := func(query string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/files?"+query, bytes.NewReader(body))
+		r.Header.Set("API-Key", "secret")
+		r.Header.Set("Content-Type", "image/jpeg")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := put("file=products/a.jpg", image)
+	var stored ListedFile
+	_ = json.NewDecoder(w.Body).Decode(&stored)
+	if w.Code != http.StatusCreated || stored.Path != "products/a.jpg" || stored.Size != int64(len(image)) {
+		t.Fatalf("Invalid response: %d %+v", w.Code, stored)
+	}
+	if buf, err := os.ReadFile(filepath.Join(mount, "products", "a.jpg")); err != nil || !bytes.Equal(buf, image) {
+		t.Errorf("Invalid stored image: %v", err)
+	}
+
+	// Replaced images purge their cached variants
+	cache.PutSource(testCacheKey("variant"), sourceDigest(image), Image{Body: []byte("webp image"), Mime: "image/webp"})
+	if w := put("file=products/a.jpg", image[:len(image)-1]); w.Code != http.StatusOK {
+		t.Errorf("Invalid replace response: %d", w.Code)
+	}
+	if _, ok := cache.Get(testCacheKey("variant")); ok {
+		t.Error("Cached variant not purged")
+	}
+
+	// Stored images must be images of the file extension type
+	if w := put("file=products/b.jpg", []byte("not an image")); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request status, got: %d", w.Code)
+	}
+	if w := put("file=products/b.png", image); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request status, got: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "products", "b.png")); !os.IsNotExist(err) {
+		t.Error("Unexpected stored image")
+	}
+}
+
+func TestDeleteMountFile(t *testing.T) {
+	mount := newFilesMount(t)
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{Mount: mount, APIKey: "secret", EnableMountWrites: true, Cache: cache}
+	handler := Middleware(filesController(o), o)
+
+	del := func(query string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/files?"+query, nil)
+		r.Header.Set("API-Key", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	variant := testCacheKey("variant")
+	cache.PutSource(variant, sourceDigest([]byte("logo.png")), Image{Body: []byte("webp image"), Mime: "image/webp"})
+	other := testCacheKey("other")
+	cache.PutSource(other, sourceDigest([]byte("kiosk/menu.jpg")), Image{Body: []byte("webp image"), Mime: "image/webp"})
+
+	if code := del("file=logo.png"); code != http.StatusNoContent {
+		t.Fatalf("Invalid response status: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "logo.png")); !os.IsNotExist(err) {
+		t.Error("Image not deleted")
+	}
+	if _, ok := cache.Get(variant); ok {
+		t.Error("Cached variant not purged")
+	}
+	if _, ok := cache.Get(other); !ok {
+		t.Error("Cached image of another source purged")
+	}
+
+	for query, code := range map[string]int{"file=logo.png": http.StatusNotFound, "file=kiosk": http.StatusBadRequest, "file=.hidden.jpg": http.StatusBadRequest} {
+		if got := del(query); got != code {
+			t.Errorf("%s: expected status %d, got %d", query, code, got)
+		}
+	}
+
+	// Listing isn't enabled along with the mount writes only
+	r := httptest.NewRequest(http.MethodGet, "/files", nil)
+	r.Header.Set("API-Key", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed status, got: %d", w.Code)
+	}
+}
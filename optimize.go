@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+// OptimizeJPEG runs the operation and encodes its JPEG result with the mozjpeg
+// compression techniques supported by libvips: trellis quantization,
+// overshoot deringing, progressive scans optimization and the quantization
+// table tuned for them. Outputs are progressive unless interlace=false.
+func OptimizeJPEG(operation Operation, buf []byte, o ImageOptions) (Image, error) {
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+
+	o.Optimize = false
+	if outputType != bimg.JPEG {
+		return operation(buf, o)
+	}
+
+	// Render the transformation in a lossless format encoded only once as JPEG
+	lossless := o
+	lossless.Type = "png"
+	lossless.Compression = pipelineIntermediateCompression
+	image, err := operation(buf, lossless)
+	if err != nil || image.Mime != "image/png" {
+		return image, err
+	}
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = bimg.Quality
+	}
+	interlace := o.Interlace || !o.IsDefinedField.Interlace
+
+	body, err := vipsJPEGSaveOptimized(image.Body, quality, o.StripMetadata, interlace)
+	if err != nil {
+		return Image{}, NewError("Cannot encode optimized JPEG: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: "image/jpeg", Width: image.Width, Height: image.Height}, nil
+}
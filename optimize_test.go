@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestOptimizeJPEG(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	optimized, err := Operation(Resize).Run(buf, ImageOptions{Width: 300, Quality: 80, Optimize: true})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if optimized.Mime != "image/jpeg" {
+		t.Error("Invalid image MIME type")
+	}
+	if err := assertSize(optimized.Body, 300, 404); err != nil {
+		t.Error(err)
+	}
+
+	baseline, _ := Resize(buf, ImageOptions{Width: 300, Quality: 80})
+	if len(optimized.Body) > len(baseline.Body) {
+		t.Errorf("Optimized image is larger than the baseline: %d > %d", len(optimized.Body), len(baseline.Body))
+	}
+
+	// Other output formats are not affected
+	image, err := Operation(Resize).Run(buf, ImageOptions{Width: 300, Type: "png", Optimize: true})
+	if err != nil || image.Mime != "image/png" {
+		t.Errorf("Invalid PNG output: %v %s", err, image.Mime)
+	}
+}
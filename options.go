@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"image"
 	"strconv"
 	"strings"
 
@@ -16,6 +18,8 @@ type ImageOptions struct {
 	AreaWidth     int
 	AreaHeight    int
 	Quality       int
+	AutoQuality   bool
+	QualityTarget float64
 	Compression   int
 	Rotate        int
 	Top           int
@@ -43,12 +47,156 @@ type ImageOptions struct {
 	AspectRatio   string
 	Color         []uint8
 	Background    []uint8
+	Matrix        []float64
+	Points        []float64
+	BlockSize     int
+	Regions       []Region
 	Interlace     bool
 	Speed         int
+	Effort        int
+	Lossless      bool
+	Optimize      bool
+	Depth         int
+	IfSmaller     bool
+	NoEnlarge     bool
+	Upscaler      string
+	Classifier    string
+	ECLevel       string
+	Barcode       string
+	Colors        int
+	Method        string
+	WhiteBalance  bool
+	Sepia         bool
+	Interpolator  bimg.Interpolator
 	Extend        bimg.Extend
 	Gravity       bimg.Gravity
+	Anchor        Anchor
+	XOffset       int
+	YOffset       int
 	Colorspace    bimg.Interpretation
 	Operations    PipelineOperations
+	Branches      PipelineBranches
+	Output        string
+	Format        string
+	Widths        []int
+	Preset        string
+	Sizes         string
+	Alt           string
+	Formats       []string
+	PageSize      string
+	Pages         []string
+	EntryName     string
+	Debug         bool
+	Frame         int
+	FrameStep     int
+	MaxFrames     int
+	Loop          int
+	Delay         int
+
+	// ctx is the context of the request being processed
+	ctx context.Context
+	// files holds the additional multipart form files, by field name
+	files map[string][]byte
+	// inputName is the source image file name, without extension
+	inputName string
+	// limits are checked against the images decoded by the operations, other
+	// than the source image
+	limits ImageLimits
+	// progress is notified before running each pipeline operation
+	progress func(step, total int)
+	// report collects the pipeline operations runs
+	report *PipelineReport
+	// imageURL builds the URLs of other endpoints for the same source image
+	imageURL func(endpoint string, params map[string]string) string
+	// workers runs the pipeline branches concurrently, on its idle workers
+	workers *WorkerPool
+}
+
+// Context returns the context of the request being processed.
+// The returned context is never nil, it defaults to the background context.
+func (o ImageOptions) Context() context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of the options using the given context
+func (o ImageOptions) WithContext(ctx context.Context) ImageOptions {
+	o.ctx = ctx
+	return o
+}
+
+// WithFiles returns a shallow copy of the options using the given multipart
+// form files, which can be referenced by field name from the image param
+func (o ImageOptions) WithFiles(files map[string][]byte) ImageOptions {
+	o.files = files
+	return o
+}
+
+// WithInputName returns a shallow copy of the options using the given source
+// image file name, used by the entry names of the bundled results
+func (o ImageOptions) WithInputName(name string) ImageOptions {
+	o.inputName = name
+	return o
+}
+
+// InputName returns the source image file name, without extension
+func (o ImageOptions) InputName() string {
+	if o.inputName == "" {
+		return defaultInputName
+	}
+	return o.inputName
+}
+
+// WithLimits returns a shallow copy of the options checking the given limits
+// against the pipeline intermediate results and the additional images
+func (o ImageOptions) WithLimits(limits ImageLimits) ImageOptions {
+	o.limits = limits
+	return o
+}
+
+// WithProgress returns a shallow copy of the options notifying the given
+// function before running each pipeline operation
+func (o ImageOptions) WithProgress(progress func(step, total int)) ImageOptions {
+	o.progress = progress
+	return o
+}
+
+// WithReport returns a shallow copy of the options collecting the pipeline
+// operations runs into the given report
+func (o ImageOptions) WithReport(report *PipelineReport) ImageOptions {
+	o.report = report
+	return o
+}
+
+// WithWorkers returns a shallow copy of the options running the pipeline
+// branches on the idle workers of the given pool, if any
+func (o ImageOptions) WithWorkers(workers *WorkerPool) ImageOptions {
+	o.workers = workers
+	return o
+}
+
+// WithImageURL returns a shallow copy of the options using the given function
+// to build the URLs of other endpoints for the same source image
+func (o ImageOptions) WithImageURL(imageURL func(endpoint string, params map[string]string) string) ImageOptions {
+	o.imageURL = imageURL
+	return o
+}
+
+// ImageURL returns the URL of the endpoint for the same source image, with
+// the given params, if the source image can be referenced by URL
+func (o ImageOptions) ImageURL(endpoint string, params map[string]string) (string, bool) {
+	if o.imageURL == nil {
+		return "", false
+	}
+	return o.imageURL(endpoint, params), true
+}
+
+// File returns the multipart form file sent in the given field
+func (o ImageOptions) File(field string) ([]byte, bool) {
+	buf, ok := o.files[field]
+	return buf, ok
 }
 
 // IsDefinedField holds boolean ImageOptions fields. If true it means the field was specified in the request. This
@@ -65,6 +213,23 @@ type IsDefinedField struct {
 	StripMetadata bool
 	Interlace     bool
 	Palette       bool
+	Effort        bool
+	NoEnlarge     bool
+	Gravity       bool
+	Loop          bool
+}
+
+// Region represents a rectangular area of the image
+type Region struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Rect returns the region as an image rectangle
+func (r Region) Rect() image.Rectangle {
+	return image.Rect(r.Left, r.Top, r.Left+r.Width, r.Top+r.Height)
 }
 
 // PipelineOperation represents the structure for an operation field.
@@ -79,12 +244,22 @@ type PipelineOperation struct {
 // PipelineOperations defines the expected interface for a list of operations.
 type PipelineOperations []PipelineOperation
 
+// PipelineBranch represents an independent chain of operations applied to
+// the pipeline source image.
+type PipelineBranch struct {
+	Name       string             `json:"name"`
+	Operations PipelineOperations `json:"operations"`
+}
+
+// PipelineBranches defines the expected interface for a list of branches.
+type PipelineBranches []PipelineBranch
+
 func transformByAspectRatio(params map[string]interface{}) (width, height int) {
 	width, _ = coerceTypeInt(params["width"])
 	height, _ = coerceTypeInt(params["height"])
 
 	aspectRatio, ok := params["aspectratio"].(map[string]int)
-	if !ok {
+	if !ok || aspectRatio["width"] <= 0 || aspectRatio["height"] <= 0 {
 		return
 	}
 
@@ -124,6 +299,15 @@ func shouldTransformByAspectRatio(height, width int) bool {
 	return true
 }
 
+// EncoderSpeed returns the AVIF and PNG encoders speed. The effort param, from
+// 0 (fastest) to 9 (smallest output), takes precedence over the speed param.
+func (o ImageOptions) EncoderSpeed() int {
+	if o.IsDefinedField.Effort {
+		return 9 - o.Effort
+	}
+	return o.Speed
+}
+
 // BimgOptions creates a new bimg compatible options struct mapping the fields properly
 func BimgOptions(o ImageOptions) bimg.Options {
 	opts := bimg.Options{
@@ -145,10 +329,12 @@ func BimgOptions(o ImageOptions) bimg.Options {
 		Rotate:         bimg.Angle(o.Rotate),
 		Interlace:      o.Interlace,
 		Palette:        o.Palette,
-		Speed:          o.Speed,
+		Speed:          o.EncoderSpeed(),
+		Lossless:       o.Lossless,
+		Interpolator:   o.Interpolator,
 	}
 
-	if len(o.Background) != 0 {
+	if len(o.Background) > 2 {
 		opts.Background = bimg.Color{R: o.Background[0], G: o.Background[1], B: o.Background[2]}
 	}
 
@@ -13,3 +13,25 @@ func TestBimgOptions(t *testing.T) {
 		t.Error("Invalid width and height")
 	}
 }
+
+func TestBimgOptionsEncoder(t *testing.T) {
+	opts, err := buildParamsFromQuery(map[string][]string{"lossless": {"true"}, "effort": {"7"}, "speed": {"6"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bopts := BimgOptions(opts); !bopts.Lossless || bopts.Speed != 2 {
+		t.Errorf("Invalid encoder options: lossless=%t speed=%d", bopts.Lossless, bopts.Speed)
+	}
+
+	// Speed applies when the effort is not defined
+	if bopts := BimgOptions(ImageOptions{Speed: 6}); bopts.Lossless || bopts.Speed != 6 {
+		t.Errorf("Invalid encoder options: lossless=%t speed=%d", bopts.Lossless, bopts.Speed)
+	}
+	if bopts := BimgOptions(ImageOptions{IsDefinedField: IsDefinedField{Effort: true}}); bopts.Speed != 9 {
+		t.Errorf("Invalid encoder speed for effort 0: %d", bopts.Speed)
+	}
+
+	if _, err := buildParamsFromQuery(map[string][]string{"effort": {"10"}}); err == nil {
+		t.Error("Expected error for out of range effort")
+	}
+}
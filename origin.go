@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// OriginMatcher matches the remote image URLs against an allowed origin,
+// such as https://*.cdn.example.com:8443/assets/*
+//
+// An empty scheme matches both http and https. The host and path may contain
+// * wildcards: a host wildcard matches any characters, and a leading *.
+// also matches the bare domain, while a path wildcard matches any characters
+// within a path segment. The path is matched as prefix. A missing port only
+// matches the default port of the URL scheme.
+type OriginMatcher struct {
+	Scheme string
+	Host   string
+	Port   string
+	Path   string
+}
+
+// NewOriginMatcher returns the matcher of the given allowed origin
+func NewOriginMatcher(origin *url.URL) OriginMatcher {
+	return OriginMatcher{
+		Scheme: strings.ToLower(origin.Scheme),
+		Host:   strings.ToLower(origin.Hostname()),
+		Port:   origin.Port(),
+		Path:   origin.Path,
+	}
+}
+
+// Match reports whether the URL matches the allowed origin
+func (m OriginMatcher) Match(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return false
+	}
+	if m.Scheme != "" && m.Scheme != scheme {
+		return false
+	}
+
+	port := m.Port
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+	urlPort := u.Port()
+	if urlPort == "" {
+		urlPort = defaultPort(scheme)
+	}
+	if urlPort != port {
+		return false
+	}
+
+	return m.matchHost(strings.ToLower(u.Hostname())) && matchPathPrefix(m.Path, u.Path)
+}
+
+func (m OriginMatcher) matchHost(host string) bool {
+	if strings.HasPrefix(m.Host, "*.") && host == m.Host[2:] {
+		return true
+	}
+	matched, err := path.Match(m.Host, host)
+	return err == nil && matched
+}
+
+// matchPathPrefix reports whether the path starts with the pattern, whose
+// wildcards match any characters within a path segment
+func matchPathPrefix(pattern, p string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return strings.HasPrefix(p, pattern)
+	}
+	if !strings.HasPrefix(p, pattern[:star]) {
+		return false
+	}
+
+	pattern, p = pattern[star+1:], p[star:]
+	for i := 0; ; i++ {
+		if matchPathPrefix(pattern, p[i:]) {
+			return true
+		}
+		if i == len(p) || p[i] == '/' {
+			return false
+		}
+	}
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// shouldRestrictOrigin reports whether the URL matches none of the allowed
+// origins, if any
+func shouldRestrictOrigin(u *url.URL, origins []*url.URL) bool {
+	if len(origins) == 0 {
+		return false
+	}
+	for _, origin := range origins {
+		if NewOriginMatcher(origin).Match(u) {
+			return false
+		}
+	}
+	return true
+}
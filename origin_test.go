@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestOriginMatcher(t *testing.T) {
+	cases := []struct {
+		origin  string
+		url     string
+		matches bool
+	}{
+		{"https://example.org", "https://example.org/logo.jpg", true},
+		{"https://example.org", "http://example.org/logo.jpg", false},
+		{"https://example.org", "https://example.org:8443/logo.jpg", false},
+		{"https://example.org", "https://example.org:443/logo.jpg", true},
+		{"http://example.org", "http://example.org/logo.jpg", true},
+		{"example.org", "http://example.org/logo.jpg", true},
+		{"example.org", "https://EXAMPLE.org/logo.jpg", true},
+		{"example.org", "ftp://example.org/logo.jpg", false},
+		{"example.org", "https://example.org:8080/logo.jpg", false},
+		{"https://example.org:8443", "https://example.org:8443/logo.jpg", true},
+		{"https://example.org:8443", "https://example.org/logo.jpg", false},
+		{"*.cdn.example.com:8443/assets/*", "https://eu.cdn.example.com:8443/assets/logo.jpg", true},
+		{"*.cdn.example.com:8443/assets/*", "http://a.b.cdn.example.com:8443/assets/x/logo.jpg", true},
+		{"*.cdn.example.com:8443/assets/*", "https://cdn.example.com:8443/assets/logo.jpg", true},
+		{"*.cdn.example.com:8443/assets/*", "https://eu.cdn.example.com/assets/logo.jpg", false},
+		{"*.cdn.example.com:8443/assets/*", "https://eu.cdn.example.com:8443/static/logo.jpg", false},
+		{"*.cdn.example.com:8443/assets/*", "https://evilcdn.example.com:8443/assets/logo.jpg", false},
+		{"https://img-*.example.org", "https://img-42.example.org/logo.jpg", true},
+		{"https://img-*.example.org", "https://static.example.org/logo.jpg", false},
+		{"https://example.org/users/*/avatars/", "https://example.org/users/42/avatars/logo.jpg", true},
+		{"https://example.org/users/*/avatars/", "https://example.org/users/42/photos/avatars/logo.jpg", false},
+		{"https://example.org/bucket-*", "https://example.org/bucket-eu/logo.jpg", true},
+	}
+
+	for _, c := range cases {
+		origins := parseOrigins(c.origin)
+		if len(origins) != 1 {
+			t.Fatalf("Cannot parse origin %s", c.origin)
+		}
+		u, _ := url.Parse(c.url)
+		if matches := NewOriginMatcher(origins[0]).Match(u); matches != c.matches {
+			t.Errorf("Origin %s matching %s: expected %t, got %t", c.origin, c.url, c.matches, matches)
+		}
+	}
+}
+
+func TestShouldRestrictOriginSchemeAndPort(t *testing.T) {
+	origins := parseOrigins("https://*.example.org, http://localhost:8080/images/")
+
+	for _, allowed := range []string{"https://cdn.example.org/logo.jpg", "http://localhost:8080/images/logo.jpg"} {
+		u, _ := url.Parse(allowed)
+		if shouldRestrictOrigin(u, origins) {
+			t.Errorf("Expected %s to be allowed", allowed)
+		}
+	}
+	for _, restricted := range []string{"http://cdn.example.org/logo.jpg", "http://localhost/images/logo.jpg", "https://localhost:8080/images/logo.jpg"} {
+		u, _ := url.Parse(restricted)
+		if !shouldRestrictOrigin(u, origins) {
+			t.Errorf("Expected %s to be restricted", restricted)
+		}
+	}
+	if u, _ := url.Parse("http://any.org/logo.jpg"); shouldRestrictOrigin(u, nil) {
+		t.Error("Expected any origin to be allowed without allowed origins")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/h2non/bimg"
+)
+
+const (
+	// defaultPaletteColors is the number of colors returned when the request
+	// doesn't define the colors param
+	defaultPaletteColors = 5
+
+	// maxPaletteColors limits the number of colors of the palette
+	maxPaletteColors = 16
+
+	// paletteSampleSize is the size the images are downscaled to before
+	// extracting the palette, as details don't change the dominant colors
+	paletteSampleSize = 100
+
+	// paletteIterations is the number of k-means refinement iterations
+	paletteIterations = 5
+)
+
+// ImagePalette represents the dominant colors of an image
+type ImagePalette struct {
+	Colors    []PaletteColor `json:"colors"`
+	TextColor string         `json:"textColor"`
+}
+
+// PaletteColor represents a dominant color and the percentage of the image it covers
+type PaletteColor struct {
+	Hex        string   `json:"hex"`
+	RGB        [3]uint8 `json:"rgb"`
+	Percentage float64  `json:"percentage"`
+	TextColor  string   `json:"textColor"`
+}
+
+// paletteCluster groups the image pixels with similar colors
+type paletteCluster struct {
+	pixels [][3]uint8
+	mean   [3]float64
+}
+
+// Palette returns the dominant colors of the image as JSON, including the
+// text color with the highest contrast over each color and over the image
+func Palette(buf []byte, o ImageOptions) (Image, error) {
+	colors := o.Colors
+	if colors == 0 {
+		colors = defaultPaletteColors
+	}
+	if colors < 1 || colors > maxPaletteColors {
+		return Image{}, NewParamError(fmt.Sprintf("Invalid param: colors must be between 1 and %d", maxPaletteColors), "colors")
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+	if size.Width > paletteSampleSize || size.Height > paletteSampleSize {
+		opts := bimg.Options{Type: bimg.PNG, NoAutoRotate: o.NoRotation}
+		if size.Width > size.Height {
+			opts.Width = paletteSampleSize
+		} else {
+			opts.Height = paletteSampleSize
+		}
+		sample, err := Process(buf, opts)
+		if err != nil {
+			return Image{}, err
+		}
+		buf = sample.Body
+	}
+
+	img, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, NewError(err.Error(), http.StatusBadRequest)
+	}
+
+	body, err := json.Marshal(extractPalette(img, colors))
+	if err != nil {
+		return Image{}, NewError("Cannot encode image palette: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: "application/json"}, nil
+}
+
+// extractPalette finds the dominant colors of the opaque pixels using median
+// cut, refined with k-means, sorted by the percentage of the image they cover
+func extractPalette(img *image.NRGBA, colors int) ImagePalette {
+	var pixels [][3]uint8
+	var sum [3]float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			if img.Pix[i+3] < 128 {
+				continue
+			}
+			p := [3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}
+			pixels = append(pixels, p)
+			for c := 0; c < 3; c++ {
+				sum[c] += float64(p[c])
+			}
+		}
+	}
+
+	palette := ImagePalette{Colors: []PaletteColor{}, TextColor: "#000000"}
+	if len(pixels) == 0 {
+		return palette
+	}
+	for c := 0; c < 3; c++ {
+		sum[c] /= float64(len(pixels))
+	}
+	palette.TextColor = textColor(sum)
+
+	clusters := medianCut(pixels, colors)
+	for i := 0; i < paletteIterations; i++ {
+		clusters = assignClusters(pixels, clusters)
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].pixels) > len(clusters[j].pixels)
+	})
+	for _, cluster := range clusters {
+		if len(cluster.pixels) == 0 {
+			continue
+		}
+		var rgb [3]uint8
+		for c := 0; c < 3; c++ {
+			rgb[c] = uint8(math.Round(cluster.mean[c]))
+		}
+		palette.Colors = append(palette.Colors, PaletteColor{
+			Hex:        fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]),
+			RGB:        rgb,
+			Percentage: math.Round(float64(len(cluster.pixels))/float64(len(pixels))*10000) / 100,
+			TextColor:  textColor(cluster.mean),
+		})
+	}
+	return palette
+}
+
+// medianCut splits the pixels into up to n clusters, splitting the cluster
+// with the widest weighted channel range at its median each time
+func medianCut(pixels [][3]uint8, n int) []paletteCluster {
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		best, channel, score := -1, 0, 0
+		for i, box := range boxes {
+			c, r := widestChannel(box)
+			if s := r * len(box); r > 0 && s > score {
+				best, channel, score = i, c, s
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i][channel] < box[j][channel] })
+		median := len(box) / 2
+		boxes[best] = box[:median:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	clusters := make([]paletteCluster, len(boxes))
+	for i, box := range boxes {
+		clusters[i] = paletteCluster{pixels: box, mean: meanColor(box)}
+	}
+	return clusters
+}
+
+// assignClusters moves each pixel to the cluster with the nearest mean color
+func assignClusters(pixels [][3]uint8, clusters []paletteCluster) []paletteCluster {
+	next := make([]paletteCluster, len(clusters))
+	for _, p := range pixels {
+		nearest, distance := 0, math.MaxFloat64
+		for i, cluster := range clusters {
+			var d float64
+			for c := 0; c < 3; c++ {
+				delta := float64(p[c]) - cluster.mean[c]
+				d += delta * delta
+			}
+			if d < distance {
+				nearest, distance = i, d
+			}
+		}
+		next[nearest].pixels = append(next[nearest].pixels, p)
+	}
+	for i := range next {
+		if len(next[i].pixels) > 0 {
+			next[i].mean = meanColor(next[i].pixels)
+		}
+	}
+	return next
+}
+
+// widestChannel returns the RGB channel with the widest range of values
+func widestChannel(pixels [][3]uint8) (channel, width int) {
+	for c := 0; c < 3; c++ {
+		lo, hi := 255, 0
+		for _, p := range pixels {
+			v := int(p[c])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > width {
+			channel, width = c, hi-lo
+		}
+	}
+	return channel, width
+}
+
+func meanColor(pixels [][3]uint8) (mean [3]float64) {
+	for _, p := range pixels {
+		for c := 0; c < 3; c++ {
+			mean[c] += float64(p[c])
+		}
+	}
+	for c := 0; c < 3; c++ {
+		mean[c] /= float64(len(pixels))
+	}
+	return mean
+}
+
+// textColor returns black or white, whichever has the highest WCAG contrast
+// ratio over the background color
+func textColor(background [3]float64) string {
+	var luminance float64
+	for c, weight := range [3]float64{0.2126, 0.7152, 0.0722} {
+		v := background[c] / 255
+		if v <= 0.03928 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		luminance += weight * v
+	}
+
+	// Contrast ratio over white is 1.05 / (L + 0.05), over black (L + 0.05) / 0.05
+	if 1.05/(luminance+0.05) > (luminance+0.05)/0.05 {
+		return "#ffffff"
+	}
+	return "#000000"
+}
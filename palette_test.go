@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+func TestExtractPalette(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 10))
+	for x := 0; x < 100; x++ {
+		c := color.NRGBA{R: 255, A: 255}
+		switch {
+		case x >= 90:
+			c = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		case x >= 60:
+			c = color.NRGBA{B: 200 + uint8(x%5), A: 255}
+		case x < 5:
+			// Transparent pixels are ignored
+			c = color.NRGBA{G: 255}
+		}
+		for y := 0; y < 10; y++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	palette := extractPalette(img, 3)
+	if len(palette.Colors) != 3 {
+		t.Fatalf("Invalid number of colors: %d", len(palette.Colors))
+	}
+
+	expected := []struct {
+		hex        string
+		percentage float64
+		textColor  string
+	}{
+		{"#ff0000", 57.89, "#000000"},
+		{"#0000ca", 31.58, "#ffffff"},
+		{"#ffffff", 10.53, "#000000"},
+	}
+	for i, e := range expected {
+		c := palette.Colors[i]
+		if c.Hex != e.hex || c.Percentage != e.percentage || c.TextColor != e.textColor {
+			t.Errorf("Invalid color %d: %+v", i, c)
+		}
+	}
+	if palette.Colors[1].RGB != [3]uint8{0, 0, 202} {
+		t.Errorf("Invalid RGB color: %v", palette.Colors[1].RGB)
+	}
+
+	// Fewer distinct colors than requested
+	if palette := extractPalette(img, 10); len(palette.Colors) > 7 {
+		t.Errorf("Invalid number of colors: %d", len(palette.Colors))
+	}
+
+	// Fully transparent images
+	palette = extractPalette(image.NewNRGBA(image.Rect(0, 0, 10, 10)), 5)
+	if len(palette.Colors) != 0 || palette.TextColor != "#000000" {
+		t.Errorf("Invalid palette of transparent image: %+v", palette)
+	}
+}
+
+func TestTextColor(t *testing.T) {
+	cases := []struct {
+		background [3]float64
+		expected   string
+	}{
+		{[3]float64{255, 255, 255}, "#000000"},
+		{[3]float64{0, 0, 0}, "#ffffff"},
+		{[3]float64{255, 255, 0}, "#000000"},
+		{[3]float64{0, 0, 128}, "#ffffff"},
+		{[3]float64{100, 100, 100}, "#ffffff"},
+		{[3]float64{128, 128, 128}, "#000000"},
+	}
+
+	for _, tc := range cases {
+		if color := textColor(tc.background); color != tc.expected {
+			t.Errorf("Invalid text color for %v: %s", tc.background, color)
+		}
+	}
+}
+
+func TestPaletteInvalidColors(t *testing.T) {
+	for _, colors := range []int{-1, maxPaletteColors + 1} {
+		_, err := Palette(readTestFile(t, "imaginary.jpg"), ImageOptions{Colors: colors})
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+			t.Errorf("Colors %d: expected bad request error, got %v", colors, err)
+		}
+	}
+}
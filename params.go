@@ -13,50 +13,105 @@ import (
 
 var ErrUnsupportedValue = errors.New("unsupported value")
 
+// ParamError reports the param which value cannot be coerced
+type ParamError struct {
+	Param string
+	err   error
+}
+
+func (e ParamError) Error() string {
+	return e.err.Error()
+}
+
+func (e ParamError) Unwrap() error {
+	return e.err
+}
+
 // Coercion defines type coercion function signature
 type Coercion func(*ImageOptions, interface{}) error
 
 // Map of parameter names to their coercion functions
 var paramTypeCoercions = map[string]Coercion{
-	"width":       coerceWidth,
-	"height":      coerceHeight,
-	"quality":     coerceQuality,
-	"top":         coerceTop,
-	"left":        coerceLeft,
-	"areawidth":   coerceAreaWidth,
-	"areaheight":  coerceAreaHeight,
-	"compression": coerceCompression,
-	"rotate":      coerceRotate,
-	"margin":      coerceMargin,
-	"factor":      coerceFactor,
-	"dpi":         coerceDPI,
-	"textwidth":   coerceTextWidth,
-	"opacity":     coerceOpacity,
-	"flip":        coerceFlip,
-	"flop":        coerceFlop,
-	"nocrop":      coerceNoCrop,
-	"noprofile":   coerceNoProfile,
-	"norotation":  coerceNoRotation,
-	"noreplicate": coerceNoReplicate,
-	"force":       coerceForce,
-	"embed":       coerceEmbed,
-	"stripmeta":   coerceStripMeta,
-	"text":        coerceText,
-	"image":       coerceImage,
-	"font":        coerceFont,
-	"type":        coerceImageType,
-	"color":       coerceColor,
-	"colorspace":  coerceColorSpace,
-	"gravity":     coerceGravity,
-	"background":  coerceBackground,
-	"extend":      coerceExtend,
-	"sigma":       coerceSigma,
-	"minampl":     coerceMinAmpl,
-	"operations":  coerceOperations,
-	"interlace":   coerceInterlace,
-	"aspectratio": coerceAspectRatio,
-	"palette":     coercePalette,
-	"speed":       coerceSpeed,
+	"width":        coerceWidth,
+	"height":       coerceHeight,
+	"quality":      coerceQuality,
+	"top":          coerceTop,
+	"left":         coerceLeft,
+	"areawidth":    coerceAreaWidth,
+	"areaheight":   coerceAreaHeight,
+	"compression":  coerceCompression,
+	"rotate":       coerceRotate,
+	"margin":       coerceMargin,
+	"factor":       coerceFactor,
+	"dpi":          coerceDPI,
+	"textwidth":    coerceTextWidth,
+	"opacity":      coerceOpacity,
+	"flip":         coerceFlip,
+	"flop":         coerceFlop,
+	"nocrop":       coerceNoCrop,
+	"noprofile":    coerceNoProfile,
+	"norotation":   coerceNoRotation,
+	"autorotate":   coerceAutoRotate,
+	"noreplicate":  coerceNoReplicate,
+	"force":        coerceForce,
+	"embed":        coerceEmbed,
+	"stripmeta":    coerceStripMeta,
+	"text":         coerceText,
+	"image":        coerceImage,
+	"font":         coerceFont,
+	"type":         coerceImageType,
+	"color":        coerceColor,
+	"colorspace":   coerceColorSpace,
+	"gravity":      coerceGravity,
+	"xoffset":      coerceXOffset,
+	"yoffset":      coerceYOffset,
+	"background":   coerceBackground,
+	"extend":       coerceExtend,
+	"sigma":        coerceSigma,
+	"minampl":      coerceMinAmpl,
+	"operations":   coerceOperations,
+	"branches":     coerceBranches,
+	"output":       coerceOutput,
+	"interlace":    coerceInterlace,
+	"aspectratio":  coerceAspectRatio,
+	"palette":      coercePalette,
+	"speed":        coerceSpeed,
+	"effort":       coerceEffort,
+	"lossless":     coerceLossless,
+	"optimize":     coerceOptimize,
+	"depth":        coerceDepth,
+	"ifsmaller":    coerceIfSmaller,
+	"matrix":       coerceMatrix,
+	"points":       coercePoints,
+	"blocksize":    coerceBlockSize,
+	"regions":      coerceRegions,
+	"interpolator": coerceInterpolator,
+	"upscaler":     coerceUpscaler,
+	"classifier":   coerceClassifier,
+	"level":        coerceECLevel,
+	"barcode":      coerceBarcode,
+	"colors":       coerceColors,
+	"method":       coerceMethod,
+	"whitebalance": coerceWhiteBalance,
+	"format":       coerceFormat,
+	"widths":       coerceWidths,
+	"preset":       coercePreset,
+	"sizes":        coerceSizes,
+	"alt":          coerceAlt,
+	"formats":      coerceFormats,
+	"pagesize":     coercePageSize,
+	"pages":        coercePages,
+	"entryname":    coerceEntryName,
+	"debug":        coerceDebug,
+	"frame":        coerceFrame,
+	"framestep":    coerceFrameStep,
+	"maxframes":    coerceMaxFrames,
+	"loop":         coerceLoop,
+	"delay":        coerceDelay,
+
+	// sharp and imgproxy compatible name, plus its lowercase form
+	"withoutEnlargement": coerceWithoutEnlargement,
+	"withoutenlargement": coerceWithoutEnlargement,
 }
 
 // Type coercion helper functions
@@ -101,6 +156,24 @@ func coerceTypeString(param interface{}) (string, error) {
 	return "", ErrUnsupportedValue
 }
 
+func coerceTypeFloatList(param interface{}) ([]float64, error) {
+	switch v := param.(type) {
+	case string:
+		return parseFloatList(v)
+	case []interface{}:
+		values := make([]float64, 0, len(v))
+		for _, item := range v {
+			n, ok := item.(float64)
+			if !ok {
+				return nil, ErrUnsupportedValue
+			}
+			values = append(values, n)
+		}
+		return values, nil
+	}
+	return nil, ErrUnsupportedValue
+}
+
 func coerceHeight(io *ImageOptions, param interface{}) (err error) {
 	io.Height, err = coerceTypeInt(param)
 	return err
@@ -112,6 +185,11 @@ func coerceWidth(io *ImageOptions, param interface{}) (err error) {
 }
 
 func coerceQuality(io *ImageOptions, param interface{}) (err error) {
+	if v, ok := param.(string); ok && strings.ToLower(v) == "auto" {
+		io.AutoQuality = true
+		return nil
+	}
+
 	io.Quality, err = coerceTypeInt(param)
 	return err
 }
@@ -202,6 +280,15 @@ func coerceNoRotation(io *ImageOptions, param interface{}) (err error) {
 	return err
 }
 
+// coerceAutoRotate is the inverse of the norotation param, overriding the
+// -disable-autorotate server default as well
+func coerceAutoRotate(io *ImageOptions, param interface{}) (err error) {
+	autoRotate, err := coerceTypeBool(param)
+	io.NoRotation = !autoRotate
+	io.IsDefinedField.NoRotation = true
+	return err
+}
+
 func coerceNoReplicate(io *ImageOptions, param interface{}) (err error) {
 	io.NoReplicate, err = coerceTypeBool(param)
 	io.IsDefinedField.NoReplicate = true
@@ -258,6 +345,7 @@ func coerceColor(io *ImageOptions, param interface{}) error {
 func coerceColorSpace(io *ImageOptions, param interface{}) error {
 	if v, ok := param.(string); ok {
 		io.Colorspace = parseColorspace(v)
+		io.Sepia = v == "sepia"
 		return nil
 	}
 
@@ -267,12 +355,24 @@ func coerceColorSpace(io *ImageOptions, param interface{}) error {
 func coerceGravity(io *ImageOptions, param interface{}) error {
 	if v, ok := param.(string); ok {
 		io.Gravity = parseGravity(v)
+		io.Anchor = parseAnchor(v)
+		io.IsDefinedField.Gravity = true
 		return nil
 	}
 
 	return ErrUnsupportedValue
 }
 
+func coerceXOffset(io *ImageOptions, param interface{}) (err error) {
+	io.XOffset, err = coerceTypeInt(param)
+	return err
+}
+
+func coerceYOffset(io *ImageOptions, param interface{}) (err error) {
+	io.YOffset, err = coerceTypeInt(param)
+	return err
+}
+
 func coerceBackground(io *ImageOptions, param interface{}) error {
 	if v, ok := param.(string); ok {
 		io.Background = parseColor(v)
@@ -319,6 +419,33 @@ func coerceOperations(io *ImageOptions, param interface{}) (err error) {
 	return ErrUnsupportedValue
 }
 
+func coerceBranches(io *ImageOptions, param interface{}) (err error) {
+	if v, ok := param.(string); ok {
+		branches, err := parseJSONBranches(v)
+		if err == nil {
+			io.Branches = branches
+		}
+
+		return err
+	}
+
+	return ErrUnsupportedValue
+}
+
+func coerceOutput(io *ImageOptions, param interface{}) (err error) {
+	io.Output, err = coerceTypeString(param)
+	if err != nil {
+		return err
+	}
+
+	switch io.Output {
+	case "", PipelineOutputMultipart, PipelineOutputZip, SrcsetOutputJSON, PictureOutputHTML:
+		return nil
+	default:
+		return ErrUnsupportedValue
+	}
+}
+
 func coerceInterlace(io *ImageOptions, param interface{}) (err error) {
 	io.Interlace, err = coerceTypeBool(param)
 	io.IsDefinedField.Interlace = true
@@ -336,6 +463,262 @@ func coerceSpeed(io *ImageOptions, param interface{}) (err error) {
 	return err
 }
 
+func coerceEffort(io *ImageOptions, param interface{}) (err error) {
+	io.Effort, err = coerceTypeInt(param)
+	if err == nil && (io.Effort < 0 || io.Effort > 9) {
+		return ErrUnsupportedValue
+	}
+	io.IsDefinedField.Effort = true
+	return err
+}
+
+func coerceLossless(io *ImageOptions, param interface{}) (err error) {
+	io.Lossless, err = coerceTypeBool(param)
+	return err
+}
+
+func coerceIfSmaller(io *ImageOptions, param interface{}) (err error) {
+	io.IfSmaller, err = coerceTypeBool(param)
+	return err
+}
+
+func coerceWithoutEnlargement(io *ImageOptions, param interface{}) (err error) {
+	io.NoEnlarge, err = coerceTypeBool(param)
+	io.IsDefinedField.NoEnlarge = true
+	return err
+}
+
+func coerceOptimize(io *ImageOptions, param interface{}) (err error) {
+	io.Optimize, err = coerceTypeBool(param)
+	return err
+}
+
+func coerceDepth(io *ImageOptions, param interface{}) (err error) {
+	io.Depth, err = coerceTypeInt(param)
+	if err == nil && io.Depth != depth8 && io.Depth != depth10 && io.Depth != depth12 && io.Depth != depth16 {
+		return ErrUnsupportedValue
+	}
+	return err
+}
+
+func coerceMatrix(io *ImageOptions, param interface{}) (err error) {
+	io.Matrix, err = coerceTypeFloatList(param)
+	return err
+}
+
+func coercePoints(io *ImageOptions, param interface{}) (err error) {
+	io.Points, err = coerceTypeFloatList(param)
+	return err
+}
+
+func coerceBlockSize(io *ImageOptions, param interface{}) (err error) {
+	io.BlockSize, err = coerceTypeInt(param)
+	return err
+}
+
+func coerceRegions(io *ImageOptions, param interface{}) (err error) {
+	switch v := param.(type) {
+	case string:
+		io.Regions, err = parseJSONRegions(v)
+		return err
+	case []interface{}:
+		// Pipeline params are already decoded, normalize them through JSON
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		io.Regions, err = parseJSONRegions(string(buf))
+		return err
+	}
+
+	return ErrUnsupportedValue
+}
+
+func coerceInterpolator(io *ImageOptions, param interface{}) (err error) {
+	if v, ok := param.(string); ok {
+		io.Interpolator, err = parseInterpolator(v)
+		return err
+	}
+
+	return ErrUnsupportedValue
+}
+
+func coerceUpscaler(io *ImageOptions, param interface{}) (err error) {
+	io.Upscaler, err = coerceTypeString(param)
+	return err
+}
+
+func coerceClassifier(io *ImageOptions, param interface{}) (err error) {
+	io.Classifier, err = coerceTypeString(param)
+	return err
+}
+
+func coerceECLevel(io *ImageOptions, param interface{}) (err error) {
+	io.ECLevel, err = coerceTypeString(param)
+	return err
+}
+
+func coerceBarcode(io *ImageOptions, param interface{}) (err error) {
+	io.Barcode, err = coerceTypeString(param)
+	return err
+}
+
+func coerceColors(io *ImageOptions, param interface{}) (err error) {
+	io.Colors, err = coerceTypeInt(param)
+	return err
+}
+
+func coerceMethod(io *ImageOptions, param interface{}) (err error) {
+	io.Method, err = coerceTypeString(param)
+	return err
+}
+
+func coerceWhiteBalance(io *ImageOptions, param interface{}) (err error) {
+	io.WhiteBalance, err = coerceTypeBool(param)
+	return err
+}
+
+func coerceWidths(io *ImageOptions, param interface{}) error {
+	values, err := coerceTypeFloatList(param)
+	if err != nil {
+		return err
+	}
+
+	io.Widths = make([]int, len(values))
+	for i, value := range values {
+		if value < 1 || value != math.Floor(value) {
+			return ErrUnsupportedValue
+		}
+		io.Widths[i] = int(value)
+	}
+	return nil
+}
+
+func coercePreset(io *ImageOptions, param interface{}) (err error) {
+	io.Preset, err = coerceTypeString(param)
+	return err
+}
+
+func coerceSizes(io *ImageOptions, param interface{}) (err error) {
+	io.Sizes, err = coerceTypeString(param)
+	return err
+}
+
+func coerceAlt(io *ImageOptions, param interface{}) (err error) {
+	io.Alt, err = coerceTypeString(param)
+	return err
+}
+
+func coerceFormats(io *ImageOptions, param interface{}) error {
+	value, err := coerceTypeString(param)
+	if err != nil {
+		return err
+	}
+
+	io.Formats = nil
+	for _, format := range strings.Split(value, ",") {
+		format = strings.TrimSpace(format)
+		if ImageType(format) == bimg.UNKNOWN {
+			return ErrUnsupportedValue
+		}
+		io.Formats = append(io.Formats, format)
+	}
+	return nil
+}
+
+func coercePageSize(io *ImageOptions, param interface{}) (err error) {
+	io.PageSize, err = coerceTypeString(param)
+	if err != nil {
+		return err
+	}
+	if _, ok := pdfPageSizes[strings.ToLower(io.PageSize)]; !ok && io.PageSize != PDFPageSizeFit {
+		return ErrUnsupportedValue
+	}
+	return nil
+}
+
+func coercePages(io *ImageOptions, param interface{}) error {
+	value, err := coerceTypeString(param)
+	if err != nil {
+		return err
+	}
+
+	io.Pages = nil
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			io.Pages = append(io.Pages, field)
+		}
+	}
+	return nil
+}
+
+func coerceFrame(io *ImageOptions, param interface{}) (err error) {
+	io.Frame, err = coerceTypeInt(param)
+	if err == nil && io.Frame < 1 {
+		return ErrUnsupportedValue
+	}
+	return err
+}
+
+func coerceFrameStep(io *ImageOptions, param interface{}) (err error) {
+	io.FrameStep, err = coerceTypeInt(param)
+	if err == nil && io.FrameStep < 1 {
+		return ErrUnsupportedValue
+	}
+	return err
+}
+
+func coerceMaxFrames(io *ImageOptions, param interface{}) (err error) {
+	io.MaxFrames, err = coerceTypeInt(param)
+	if err == nil && io.MaxFrames < 1 {
+		return ErrUnsupportedValue
+	}
+	return err
+}
+
+func coerceLoop(io *ImageOptions, param interface{}) (err error) {
+	io.Loop, err = coerceTypeInt(param)
+	if err == nil && io.Loop < 0 {
+		return ErrUnsupportedValue
+	}
+	io.IsDefinedField.Loop = true
+	return err
+}
+
+// coerceDelay parses the frames delay in milliseconds, stored by GIF images
+// in hundredths of a second
+func coerceDelay(io *ImageOptions, param interface{}) (err error) {
+	io.Delay, err = coerceTypeInt(param)
+	if err == nil && (io.Delay < 10 || io.Delay > maxFrameDelay) {
+		return ErrUnsupportedValue
+	}
+	return err
+}
+
+func coerceEntryName(io *ImageOptions, param interface{}) (err error) {
+	io.EntryName, err = coerceTypeString(param)
+	return err
+}
+
+func coerceDebug(io *ImageOptions, param interface{}) (err error) {
+	io.Debug, err = coerceTypeBool(param)
+	return err
+}
+
+func coerceFormat(io *ImageOptions, param interface{}) (err error) {
+	io.Format, err = coerceTypeString(param)
+	if err != nil {
+		return err
+	}
+
+	switch io.Format {
+	case "", ResponseFormatJSON:
+		return nil
+	default:
+		return ErrUnsupportedValue
+	}
+}
+
 // Parameter coercion functions
 func buildParamsFromOperation(op PipelineOperation) (ImageOptions, error) {
 	var options ImageOptions
@@ -344,7 +727,7 @@ func buildParamsFromOperation(op PipelineOperation) (ImageOptions, error) {
 	for key, value := range op.Params {
 		if fn, ok := paramTypeCoercions[key]; ok {
 			if err := fn(&options, value); err != nil {
-				return ImageOptions{}, fmt.Errorf("error processing parameter %q with value %v: %w", key, value, err)
+				return ImageOptions{}, ParamError{key, fmt.Errorf("error processing parameter %q with value %v: %w", key, value, err)}
 			}
 		}
 	}
@@ -358,13 +741,46 @@ func buildParamsFromQuery(query url.Values) (ImageOptions, error) {
 	for key := range query {
 		if fn, ok := paramTypeCoercions[key]; ok {
 			if err := fn(&options, query.Get(key)); err != nil {
-				return ImageOptions{}, fmt.Errorf("error processing parameter %q with value %q: %w", key, query.Get(key), err)
+				return ImageOptions{}, ParamError{key, fmt.Errorf("error processing parameter %q with value %q: %w", key, query.Get(key), err)}
 			}
 		}
 	}
 	return options, nil
 }
 
+// parseDefaultParams parses the server default params, defined as a URL
+// query string, such as: quality=80&type=auto&stripmeta=true
+func parseDefaultParams(input string) (url.Values, error) {
+	query, err := url.ParseQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	for key := range query {
+		if _, ok := paramTypeCoercions[key]; !ok {
+			return nil, fmt.Errorf("unknown param %q", key)
+		}
+	}
+	if _, err := buildParamsFromQuery(query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// withDefaultParams returns a copy of the query including the default params
+// the query omits
+func withDefaultParams(query, defaults url.Values) url.Values {
+	merged := make(url.Values, len(query)+len(defaults))
+	for key, values := range query {
+		merged[key] = values
+	}
+	for key, values := range defaults {
+		if _, ok := merged[key]; !ok {
+			merged[key] = values
+		}
+	}
+	return merged
+}
+
 // Helper functions for parsing values
 func parseBool(val string) (bool, error) {
 	if val == "" {
@@ -389,6 +805,21 @@ func parseFloat(param string) (float64, error) {
 	return math.Abs(val), err
 }
 
+func parseFloatList(val string) ([]float64, error) {
+	var values []float64
+	if val == "" {
+		return values, nil
+	}
+	for _, num := range strings.Split(val, ",") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
 func parseColorspace(val string) bimg.Interpretation {
 	if val == "bw" {
 		return bimg.InterpretationBW
@@ -418,6 +849,26 @@ func parseJSONOperations(data string) (PipelineOperations, error) {
 	return operations, d.Decode(&operations)
 }
 
+func parseJSONBranches(data string) (PipelineBranches, error) {
+	var branches PipelineBranches
+	if len(data) < 2 {
+		return branches, nil
+	}
+	d := json.NewDecoder(strings.NewReader(data))
+	d.DisallowUnknownFields()
+	return branches, d.Decode(&branches)
+}
+
+func parseJSONRegions(data string) ([]Region, error) {
+	var regions []Region
+	if len(data) < 2 {
+		return regions, nil
+	}
+	d := json.NewDecoder(strings.NewReader(data))
+	d.DisallowUnknownFields()
+	return regions, d.Decode(&regions)
+}
+
 func parseExtendMode(val string) bimg.Extend {
 	val = strings.TrimSpace(strings.ToLower(val))
 	switch val {
@@ -436,6 +887,24 @@ func parseExtendMode(val string) bimg.Extend {
 	}
 }
 
+// parseInterpolator parses the interpolator used to enlarge images. libvips
+// always reduces with a lanczos3 kernel, so neither lanczos3 nor mitchell
+// can be selected.
+func parseInterpolator(val string) (bimg.Interpolator, error) {
+	switch strings.TrimSpace(strings.ToLower(val)) {
+	case "", "bicubic":
+		return bimg.Bicubic, nil
+	case "bilinear":
+		return bimg.Bilinear, nil
+	case "nohalo":
+		return bimg.Nohalo, nil
+	case "nearest":
+		return bimg.Nearest, nil
+	default:
+		return bimg.Bicubic, ErrUnsupportedValue
+	}
+}
+
 func parseGravity(val string) bimg.Gravity {
 	gravityMap := map[string]bimg.Gravity{
 		"south": bimg.GravitySouth,
@@ -443,9 +912,14 @@ func parseGravity(val string) bimg.Gravity {
 		"east":  bimg.GravityEast,
 		"west":  bimg.GravityWest,
 		"smart": bimg.GravitySmart,
+		// Corners fall back to their north or south edge, unless anchored
+		"north_west": bimg.GravityNorth,
+		"north_east": bimg.GravityNorth,
+		"south_west": bimg.GravitySouth,
+		"south_east": bimg.GravitySouth,
 	}
 
-	val = strings.TrimSpace(strings.ToLower(val))
+	val = strings.Replace(strings.TrimSpace(strings.ToLower(val)), "-", "_", -1)
 	if g, ok := gravityMap[val]; ok {
 		return g
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"math"
 	"net/url"
+	"reflect"
 	"testing"
 
 	"github.com/h2non/bimg"
@@ -173,6 +174,28 @@ func TestGravity(t *testing.T) {
 	}
 }
 
+func TestParseInterpolator(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected bimg.Interpolator
+		err      bool
+	}{
+		{"nearest", bimg.Nearest, false},
+		{"Bilinear", bimg.Bilinear, false},
+		{"nohalo", bimg.Nohalo, false},
+		{"lanczos3", bimg.Bicubic, true},
+		{"", bimg.Bicubic, false},
+		{"mitchell", bimg.Bicubic, true},
+	}
+
+	for _, test := range cases {
+		val, err := parseInterpolator(test.value)
+		if val != test.expected || (err != nil) != test.err {
+			t.Errorf("Invalid interpolator %s: %#v (%v)", test.value, val, err)
+		}
+	}
+}
+
 func TestReadMapParams(t *testing.T) {
 	cases := []struct {
 		params   map[string]interface{}
@@ -225,6 +248,51 @@ func TestReadMapParams(t *testing.T) {
 	}
 }
 
+func TestReadQualityAutoParam(t *testing.T) {
+	q := url.Values{}
+	q.Set("quality", "auto")
+
+	params, err := buildParamsFromQuery(q)
+	if err != nil {
+		t.Fatalf("Failed reading params, %s", err)
+	}
+	if !params.AutoQuality || params.Quality != 0 {
+		t.Errorf("Invalid auto quality params: %#v", params)
+	}
+}
+
+func TestReadAutoRotateParam(t *testing.T) {
+	for value, noRotation := range map[string]bool{"true": false, "false": true} {
+		params, err := buildParamsFromQuery(url.Values{"autorotate": {value}})
+		if err != nil {
+			t.Fatalf("Failed reading params, %s", err)
+		}
+		if params.NoRotation != noRotation || !params.IsDefinedField.NoRotation {
+			t.Errorf("autorotate=%s: invalid norotation %t", value, params.NoRotation)
+		}
+	}
+}
+
+func TestParseJSONRegions(t *testing.T) {
+	regions, err := parseJSONRegions(`[{"top":10,"left":20,"width":30,"height":40},{"width":5,"height":5}]`)
+	if err != nil {
+		t.Fatalf("Cannot parse regions: %s", err)
+	}
+	if len(regions) != 2 || regions[0] != (Region{Top: 10, Left: 20, Width: 30, Height: 40}) {
+		t.Errorf("Invalid regions: %#v", regions)
+	}
+
+	if _, err := parseJSONRegions(`[{"x":10}]`); err == nil {
+		t.Error("Expected unknown region fields to fail")
+	}
+
+	var io ImageOptions
+	err = coerceRegions(&io, []interface{}{map[string]interface{}{"top": 1.0, "width": 2.0, "height": 3.0}})
+	if err != nil || len(io.Regions) != 1 || io.Regions[0].Height != 3 {
+		t.Errorf("Invalid pipeline regions coercion: %#v (%v)", io.Regions, err)
+	}
+}
+
 func TestParseFunctions(t *testing.T) {
 	t.Run("parseBool", func(t *testing.T) {
 		if r, err := parseBool("true"); r != true {
@@ -404,4 +472,117 @@ func TestCoerceTypeFns(t *testing.T) {
 			}
 		}
 	})
+	t.Run("coerceTypeFloatList", func(t *testing.T) {
+		cases := []struct {
+			Input  interface{}
+			Expect []float64
+			Err    error
+		}{
+			{Input: "1, 0.5,-20", Expect: []float64{1, 0.5, -20}},
+			{Input: []interface{}{1.0, -0.5}, Expect: []float64{1, -0.5}},
+			{Input: []interface{}{"1"}, Err: ErrUnsupportedValue},
+			{Input: 0, Err: ErrUnsupportedValue},
+		}
+
+		for _, tc := range cases {
+
+			result, err := coerceTypeFloatList(tc.Input)
+			if err != nil && tc.Err == nil {
+				t.Errorf("Did not expect error %s\n%+v", err, tc)
+				t.FailNow()
+			}
+
+			if tc.Err != nil && tc.Err != err {
+				t.Errorf("Expected an error to be thrown\nExpected: %s\nReceived: %s", tc.Err, err)
+				t.FailNow()
+			}
+
+			if tc.Err == nil && len(result) != len(tc.Expect) {
+				t.Errorf("Expected proper coercion %s\n%+v\n%+v", err, result, tc)
+				continue
+			}
+
+			for i := range result {
+				if math.Abs(result[i]-tc.Expect[i]) > epsilon {
+					t.Errorf("Expected proper coercion %s\n%+v\n%+v", err, result, tc)
+				}
+			}
+		}
+	})
+}
+
+func TestCoerceColorspace(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected bimg.Interpretation
+		sepia    bool
+	}{
+		{"srgb", bimg.InterpretationSRGB, false},
+		{"bw", bimg.InterpretationBW, false},
+		{"sepia", bimg.InterpretationSRGB, true},
+	}
+
+	for _, tc := range cases {
+		opts := ImageOptions{}
+		if err := coerceColorSpace(&opts, tc.value); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if opts.Colorspace != tc.expected || opts.Sepia != tc.sepia {
+			t.Errorf("Invalid colorspace %q: %v %v", tc.value, opts.Colorspace, opts.Sepia)
+		}
+	}
+}
+
+func TestParseDefaultParams(t *testing.T) {
+	params, err := parseDefaultParams("quality=80&type=auto&stripmeta=true&interpolator=nohalo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if params.Get("quality") != "80" || params.Get("interpolator") != "nohalo" {
+		t.Errorf("Invalid default params: %v", params)
+	}
+
+	for _, input := range []string{"foo=bar", "quality=high", "interpolator=foo", "quality=%zz"} {
+		if _, err := parseDefaultParams(input); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
+
+func TestWithDefaultParams(t *testing.T) {
+	defaults := url.Values{"quality": {"80"}, "type": {"webp"}}
+	query := url.Values{"width": {"300"}, "type": {"png"}}
+
+	merged := withDefaultParams(query, defaults)
+	if merged.Get("width") != "300" || merged.Get("type") != "png" || merged.Get("quality") != "80" {
+		t.Errorf("Invalid merged params: %v", merged)
+	}
+	if _, ok := query["quality"]; ok {
+		t.Error("The request query should not be modified")
+	}
+}
+
+func TestCoerceFormat(t *testing.T) {
+	opts := ImageOptions{}
+	if err := coerceFormat(&opts, "json"); err != nil || opts.Format != ResponseFormatJSON {
+		t.Errorf("Invalid format: %v %s", err, opts.Format)
+	}
+	if err := coerceFormat(&opts, "xml"); err != ErrUnsupportedValue {
+		t.Errorf("Expected unsupported value error, got %v", err)
+	}
+}
+
+func TestCoerceWidths(t *testing.T) {
+	opts := ImageOptions{}
+	if err := coerceWidths(&opts, "320, 640,1280"); err != nil || !reflect.DeepEqual(opts.Widths, []int{320, 640, 1280}) {
+		t.Errorf("Invalid widths: %v %v", err, opts.Widths)
+	}
+	if err := coerceWidths(&opts, []interface{}{320.0, 640.0}); err != nil || !reflect.DeepEqual(opts.Widths, []int{320, 640}) {
+		t.Errorf("Invalid widths: %v %v", err, opts.Widths)
+	}
+	for _, value := range []string{"320,0", "-1", "320.5", "foo"} {
+		if err := coerceWidths(&opts, value); err == nil {
+			t.Errorf("Expected error for %s", value)
+		}
+	}
 }
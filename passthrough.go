@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/h2non/bimg"
+)
+
+// passthroughEndpoints are the operations leaving the image unchanged when
+// the requested dimensions match the source image ones
+var passthroughEndpoints = map[string]bool{
+	"resize":    true,
+	"fit":       true,
+	"enlarge":   true,
+	"thumbnail": true,
+	"crop":      true,
+	"smartcrop": true,
+	"convert":   true,
+}
+
+// passthroughParams are the params not affecting the output image. Any
+// other param, including the -default-params ones, disables the passthrough.
+var passthroughParams = map[string]bool{
+	"width":     true,
+	"height":    true,
+	"type":      true,
+	"ifsmaller": true,
+	"format":    true,
+	"file":      true,
+	"mount":     true,
+	"url":       true,
+	"field":     true,
+	"fallback":  true,
+	"sign":      true,
+}
+
+// isPassthrough reports whether the operation would return the source image
+// unchanged, so it can be replied as is, saving a decode and encode cycle
+// and its generation loss: the output type and dimensions match the source
+// image ones, or the image already fits within them with ifsmaller=true,
+// and no other param is defined.
+func isPassthrough(endpoint string, query url.Values, buf []byte, size bimg.ImageSize, opts ImageOptions, o ServerOptions) bool {
+	if !passthroughEndpoints[endpoint] || o.StripMetadata {
+		return false
+	}
+	for key := range query {
+		if !passthroughParams[key] {
+			return false
+		}
+	}
+	if opts.Type != "" && ImageType(opts.Type) != bimg.DetermineImageType(buf) {
+		return false
+	}
+	if endpoint != "convert" && opts.Width == 0 && opts.Height == 0 {
+		return false
+	}
+
+	fits := func(requested, actual int) bool {
+		if opts.IfSmaller {
+			return requested == 0 || actual <= requested
+		}
+		return requested == 0 || actual == requested
+	}
+	if !fits(opts.Width, size.Width) || !fits(opts.Height, size.Height) {
+		return false
+	}
+
+	// Images auto rotated via their EXIF orientation change
+	if !opts.NoRotation {
+		meta, err := bimg.Metadata(buf)
+		if err != nil || meta.Orientation > 1 {
+			return false
+		}
+	}
+	return true
+}
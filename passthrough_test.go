@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestIsPassthrough(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size := bimg.ImageSize{Width: 550, Height: 740}
+
+	cases := []struct {
+		endpoint string
+		query    string
+		o        ServerOptions
+		expected bool
+	}{
+		{"resize", "width=550", ServerOptions{}, true},
+		{"resize", "width=550&height=740&type=jpeg&file=a.jpg", ServerOptions{}, true},
+		{"convert", "type=jpeg", ServerOptions{}, true},
+		{"resize", "width=300", ServerOptions{}, false},
+		{"resize", "width=800&ifsmaller=true", ServerOptions{}, true},
+		{"resize", "width=300&ifsmaller=true", ServerOptions{}, false},
+		{"resize", "width=550&type=webp", ServerOptions{}, false},
+		{"resize", "width=550&quality=80", ServerOptions{}, false},
+		{"resize", "width=550", ServerOptions{StripMetadata: true}, false},
+		{"resize", "", ServerOptions{}, false},
+		{"blur", "width=550&sigma=2", ServerOptions{}, false},
+	}
+
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		opts, err := buildParamsFromQuery(query)
+		if err != nil {
+			t.Fatalf("Cannot read params %s: %s", c.query, err)
+		}
+		// Skip the EXIF orientation check
+		opts.NoRotation = true
+		if passthrough := isPassthrough(c.endpoint, query, buf, size, opts, c.o); passthrough != c.expected {
+			t.Errorf("%s?%s: expected passthrough %t, got %t", c.endpoint, c.query, c.expected, passthrough)
+		}
+	}
+}
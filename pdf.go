@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+const (
+	// maxPDFPages limits the number of pages per PDF document
+	maxPDFPages = 100
+
+	// defaultPDFDPI maps one image pixel to one PDF point
+	defaultPDFDPI = 72
+
+	// PDFPageSizeFit sizes every page to its image plus the margins
+	PDFPageSizeFit = "fit"
+)
+
+// pdfPageSizes defines the supported page sizes, in portrait orientation,
+// in PDF points (1/72 inch)
+var pdfPageSizes = map[string][2]float64{
+	"a3":     {841.89, 1190.55},
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// pdfPage represents a PDF page holding a single JPEG image
+type pdfPage struct {
+	jpeg     []byte
+	gray     bool
+	width    int
+	height   int
+	pageSize [2]float64
+	// Image position and size on the page
+	rect [4]float64
+}
+
+// ToPDF combines the image, plus the images sent in the multipart form fields
+// named by the pages param, into a multi-page PDF document, one image per
+// page. Images are embedded as JPEG, as is if already JPEG encoded.
+func ToPDF(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Pages)+1 > maxPDFPages {
+		return Image{}, NewParamError(fmt.Sprintf("Maximum PDF pages (%d) exceeded", maxPDFPages), "pages")
+	}
+	if o.Margin < 0 {
+		return Image{}, NewParamError("Invalid param: margin must be positive", "margin")
+	}
+
+	images := [][]byte{buf}
+	for _, field := range o.Pages {
+		page, ok := o.File(field)
+		if !ok || len(page) == 0 {
+			return Image{}, NewParamError("Missing PDF page form file: "+field, "pages")
+		}
+		if o.limits != (ImageLimits{}) {
+			if _, err := validateImage(page, o.limits); err != nil {
+				return Image{}, err
+			}
+		}
+		images = append(images, page)
+	}
+
+	pages := make([]pdfPage, len(images))
+	for i, image := range images {
+		page, err := newPDFPage(image, o)
+		if err != nil {
+			return Image{}, fmt.Errorf("PDF page %d failed: %w", i+1, err)
+		}
+		pages[i] = page
+	}
+
+	return Image{Body: writePDF(pages), Mime: "application/pdf"}, nil
+}
+
+// newPDFPage encodes the image as JPEG, unless already a RGB or grayscale
+// JPEG not requiring auto rotation, and lays it out on the page
+func newPDFPage(buf []byte, o ImageOptions) (pdfPage, error) {
+	metadata, err := bimg.Metadata(buf)
+	if err != nil {
+		return pdfPage{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+
+	if metadata.Size.Width == 0 || metadata.Size.Height == 0 {
+		return pdfPage{}, NewError("Width or height of requested image is zero", http.StatusNotAcceptable)
+	}
+
+	page := pdfPage{jpeg: buf, width: metadata.Size.Width, height: metadata.Size.Height}
+	page.gray = metadata.Channels == 1
+
+	embeddable := metadata.Type == "jpeg" && (metadata.Space == "srgb" || metadata.Space == "b-w") &&
+		(metadata.Channels == 1 || metadata.Channels == 3) && (o.NoRotation || metadata.Orientation <= 1)
+	if !embeddable {
+		opts := bimg.Options{
+			Type:          bimg.JPEG,
+			Quality:       o.Quality,
+			NoAutoRotate:  o.NoRotation,
+			StripMetadata: true,
+			// Transparent areas are flattened on white paper
+			Background: bimg.Color{R: 255, G: 255, B: 255},
+		}
+		if page.gray {
+			opts.Interpretation = bimg.InterpretationBW
+		} else {
+			opts.Interpretation = bimg.InterpretationSRGB
+		}
+
+		image, err := Process(buf, opts)
+		if err != nil {
+			return pdfPage{}, err
+		}
+		size, err := bimg.Size(image.Body)
+		if err != nil {
+			return pdfPage{}, err
+		}
+		page.jpeg, page.width, page.height = image.Body, size.Width, size.Height
+	}
+
+	dpi := o.DPI
+	if dpi <= 0 {
+		dpi = defaultPDFDPI
+	}
+	margin := float64(o.Margin)
+	width := float64(page.width) * 72 / float64(dpi)
+	height := float64(page.height) * 72 / float64(dpi)
+
+	size, ok := pdfPageSizes[strings.ToLower(o.PageSize)]
+	if !ok {
+		page.pageSize = [2]float64{width + 2*margin, height + 2*margin}
+		page.rect = [4]float64{margin, margin, width, height}
+		return page, nil
+	}
+
+	// Landscape images are laid out on landscape pages
+	if page.width > page.height {
+		size[0], size[1] = size[1], size[0]
+	}
+	page.pageSize = size
+
+	// Images exceeding the printable area are scaled down to fit, centered
+	area := [2]float64{math.Max(size[0]-2*margin, 1), math.Max(size[1]-2*margin, 1)}
+	if scale := math.Min(area[0]/width, area[1]/height); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+	page.rect = [4]float64{(size[0] - width) / 2, (size[1] - height) / 2, width, height}
+	return page, nil
+}
+
+// writePDF writes the PDF document, made of the catalog, the pages tree and
+// the page, content stream and image objects of every page
+func writePDF(pages []pdfPage) []byte {
+	var b bytes.Buffer
+	var offsets []int
+
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			b.WriteString("stream\n")
+			b.Write(stream)
+			b.WriteString("\nendstream\n")
+		}
+		b.WriteString("endobj\n")
+	}
+
+	// Binary comment marking the file as binary for transfer tools
+	b.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+i*3)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)), nil)
+
+	for i, page := range pages {
+		id := 3 + i*3
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+			pdfNumber(page.pageSize[0]), pdfNumber(page.pageSize[1]), id+2, id+1), nil)
+
+		content := []byte(fmt.Sprintf("q %s 0 0 %s %s %s cm /Im0 Do Q",
+			pdfNumber(page.rect[2]), pdfNumber(page.rect[3]), pdfNumber(page.rect[0]), pdfNumber(page.rect[1])))
+		object(fmt.Sprintf("<< /Length %d >>", len(content)), content)
+
+		colorSpace := "/DeviceRGB"
+		if page.gray {
+			colorSpace = "/DeviceGray"
+		}
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+			page.width, page.height, colorSpace, len(page.jpeg)), page.jpeg)
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.Bytes()
+}
+
+// pdfNumber formats the number with up to 2 decimals, as PDF reals
+func pdfNumber(n float64) string {
+	s := strings.TrimRight(fmt.Sprintf("%.2f", n), "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPDFNumber(t *testing.T) {
+	cases := map[float64]string{
+		0:      "0",
+		100:    "100",
+		595.28: "595.28",
+		841.9:  "841.9",
+		12.5:   "12.5",
+	}
+
+	for n, expected := range cases {
+		if s := pdfNumber(n); s != expected {
+			t.Errorf("Invalid PDF number for %f: %s != %s", n, s, expected)
+		}
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	pages := []pdfPage{
+		{jpeg: []byte("jpeg1"), width: 100, height: 50, pageSize: [2]float64{100, 50}, rect: [4]float64{0, 0, 100, 50}},
+		{jpeg: []byte("jpeg2"), gray: true, width: 10, height: 10, pageSize: [2]float64{595.28, 841.89}, rect: [4]float64{292.64, 415.95, 10, 10}},
+	}
+	pdf := writePDF(pages)
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("Invalid PDF header or trailer")
+	}
+	for _, expected := range []string{
+		"/Kids [3 0 R 6 0 R] /Count 2",
+		"/MediaBox [0 0 595.28 841.89]",
+		"q 10 0 0 10 292.64 415.95 cm /Im0 Do Q",
+		"/ColorSpace /DeviceGray",
+		"xref\n0 9\n",
+	} {
+		if !strings.Contains(string(pdf), expected) {
+			t.Errorf("Missing PDF content: %q", expected)
+		}
+	}
+
+	// Every xref entry must point to its object
+	offset := bytes.Index(pdf, []byte("3 0 obj"))
+	if !strings.Contains(string(pdf), fmt.Sprintf("%010d 00000 n ", offset)) {
+		t.Errorf("Invalid xref offset of the first page: %d", offset)
+	}
+}
+
+func TestToPDF(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	page2, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	opts := ImageOptions{Pages: []string{"page2"}, PageSize: "a4", Margin: 36}
+	img, err := ToPDF(buf, opts.WithFiles(map[string][]byte{"page2": page2}))
+	if err != nil {
+		t.Fatalf("Cannot generate PDF: %s", err)
+	}
+	if img.Mime != "application/pdf" {
+		t.Errorf("Invalid MIME type: %s", img.Mime)
+	}
+	if !bytes.Contains(img.Body, []byte("/Count 2")) {
+		t.Error("Invalid PDF pages count")
+	}
+
+	if _, err := ToPDF(buf, ImageOptions{Pages: []string{"missing"}}); err == nil {
+		t.Error("Expected error with missing page form file")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// PictureOutputHTML is the picture output replying the HTML markup
+const PictureOutputHTML = "html"
+
+// defaultPictureFormats are the picture sources formats, by preference, the
+// last one being the fallback image format
+var defaultPictureFormats = []string{"avif", "webp", "jpeg"}
+
+// PicturePreset defines the renditions of a picture element
+type PicturePreset struct {
+	Widths  []int    `json:"widths"`
+	Sizes   string   `json:"sizes"`
+	Formats []string `json:"formats"`
+}
+
+// PicturePresets maps the preset names to their definition
+type PicturePresets map[string]PicturePreset
+
+// PictureElement represents the picture element sources, by format, and its
+// fallback image, along with the resulting HTML markup
+type PictureElement struct {
+	Sources []PictureSource `json:"sources"`
+	Src     string          `json:"src"`
+	Sizes   string          `json:"sizes,omitempty"`
+	Width   int             `json:"width"`
+	Height  int             `json:"height"`
+	Alt     string          `json:"alt"`
+	HTML    string          `json:"html"`
+}
+
+// PictureSource represents the renditions of the image in a given format
+type PictureSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+}
+
+// ReadPicturePresets reads the picture presets from a JSON file
+func ReadPicturePresets(path string) (PicturePresets, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var presets PicturePresets
+	if err := json.Unmarshal(buf, &presets); err != nil {
+		return nil, fmt.Errorf("invalid picture presets file: %w", err)
+	}
+	if err := presets.Validate(); err != nil {
+		return nil, err
+	}
+
+	return presets, nil
+}
+
+// Validate checks the presets widths and formats
+func (p PicturePresets) Validate() error {
+	for name, preset := range p {
+		if len(preset.Widths) == 0 || len(preset.Widths) > maxSrcsetWidths {
+			return fmt.Errorf("invalid picture preset %q: between 1 and %d widths are required", name, maxSrcsetWidths)
+		}
+		for _, width := range preset.Widths {
+			if width < 1 {
+				return fmt.Errorf("invalid picture preset %q: invalid width %d", name, width)
+			}
+		}
+		for _, format := range preset.Formats {
+			if ImageType(format) == bimg.UNKNOWN {
+				return fmt.Errorf("invalid picture preset %q: unknown format %q", name, format)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns the image options including the preset definition the
+// options omit
+func (p PicturePreset) Apply(o ImageOptions) ImageOptions {
+	if len(o.Widths) == 0 {
+		o.Widths = p.Widths
+	}
+	if o.Sizes == "" {
+		o.Sizes = p.Sizes
+	}
+	if len(o.Formats) == 0 {
+		o.Formats = p.Formats
+	}
+	return o
+}
+
+// Picture replies the ready to embed picture element markup, or its JSON
+// representation, with a source per format referencing the image renditions
+// for the given widths via the resize endpoint URLs
+func Picture(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Widths) == 0 {
+		return Image{}, NewMissingParamError("Missing required param: widths or preset", "")
+	}
+	if len(o.Widths) > maxSrcsetWidths {
+		return Image{}, NewParamError(fmt.Sprintf("Maximum srcset widths (%d) exceeded", maxSrcsetWidths), "widths")
+	}
+
+	formats := o.Formats
+	if len(formats) == 0 {
+		formats = defaultPictureFormats
+	}
+	if formats = supportedPictureFormats(formats); len(formats) == 0 {
+		return Image{}, NewParamError("None of the picture formats is supported", "formats")
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+	widths := srcsetWidths(o.Widths, size.Width)
+
+	picture := PictureElement{Sizes: o.Sizes, Alt: o.Alt, Sources: make([]PictureSource, len(formats))}
+	for i, format := range formats {
+		renditions, err := srcsetRenditions(widths, size, map[string]string{
+			"type":    format,
+			"preset":  "",
+			"formats": "",
+			"sizes":   "",
+			"alt":     "",
+		}, o)
+		if err != nil {
+			return Image{}, err
+		}
+		picture.Sources[i] = PictureSource{Type: GetImageMimeType(ImageType(format)), Srcset: srcsetAttribute(renditions)}
+
+		// The largest rendition of the last format is the fallback image
+		if i == len(formats)-1 {
+			largest := renditions[len(renditions)-1]
+			picture.Src, picture.Width, picture.Height = largest.URL, largest.Width, largest.Height
+		}
+	}
+	picture.HTML = pictureMarkup(picture)
+
+	if o.Output == SrcsetOutputJSON {
+		body, err := json.Marshal(picture)
+		if err != nil {
+			return Image{}, NewError("Cannot encode picture: "+err.Error(), http.StatusInternalServerError)
+		}
+		return Image{Body: body, Mime: "application/json"}, nil
+	}
+	return Image{Body: []byte(picture.HTML), Mime: "text/html; charset=utf-8"}, nil
+}
+
+// supportedPictureFormats returns the formats libvips can save
+func supportedPictureFormats(formats []string) []string {
+	var supported []string
+	for _, format := range formats {
+		if bimg.IsImageTypeSupportedByVips(ImageType(format)).Save {
+			supported = append(supported, format)
+		}
+	}
+	return supported
+}
+
+// pictureMarkup renders the picture element, using the last source as the
+// fallback image srcset
+func pictureMarkup(p PictureElement) string {
+	var sizes string
+	if p.Sizes != "" {
+		sizes = fmt.Sprintf(` sizes="%s"`, html.EscapeString(p.Sizes))
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, source := range p.Sources[:len(p.Sources)-1] {
+		fmt.Fprintf(&b, "  <source type=\"%s\" srcset=\"%s\"%s>\n", source.Type, html.EscapeString(source.Srcset), sizes)
+	}
+	fallback := p.Sources[len(p.Sources)-1]
+	fmt.Fprintf(&b, "  <img src=\"%s\" srcset=\"%s\"%s width=\"%d\" height=\"%d\" alt=\"%s\" loading=\"lazy\" decoding=\"async\">\n",
+		html.EscapeString(p.Src), html.EscapeString(fallback.Srcset), sizes, p.Width, p.Height, html.EscapeString(p.Alt))
+	b.WriteString("</picture>\n")
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPicturePresets(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "presets.json")
+	_ = os.WriteFile(file, []byte(`{"hero": {"widths": [640, 1280], "sizes": "100vw"}, "thumb": {"widths": [160], "formats": ["webp", "jpeg"]}}`), 0600)
+	presets, err := ReadPicturePresets(file)
+	if err != nil {
+		t.Fatalf("Cannot read picture presets: %s", err)
+	}
+	if len(presets) != 2 || presets["hero"].Sizes != "100vw" || !reflect.DeepEqual(presets["thumb"].Formats, []string{"webp", "jpeg"}) {
+		t.Errorf("Invalid picture presets: %+v", presets)
+	}
+
+	for _, preset := range []string{
+		`{"foo": {}}`,
+		`{"foo": {"widths": [0]}}`,
+		`{"foo": {"widths": [320], "formats": ["bar"]}}`,
+	} {
+		invalid := path.Join(dir, "invalid.json")
+		_ = os.WriteFile(invalid, []byte(preset), 0600)
+		if _, err := ReadPicturePresets(invalid); err == nil {
+			t.Errorf("Expected error for preset %s", preset)
+		}
+	}
+}
+
+func TestPicturePresetApply(t *testing.T) {
+	preset := PicturePreset{Widths: []int{320, 640}, Sizes: "100vw", Formats: []string{"webp", "jpeg"}}
+
+	opts := preset.Apply(ImageOptions{Sizes: "50vw"})
+	if !reflect.DeepEqual(opts.Widths, preset.Widths) || opts.Sizes != "50vw" || !reflect.DeepEqual(opts.Formats, preset.Formats) {
+		t.Errorf("Invalid options: %+v", opts)
+	}
+}
+
+func TestPicture(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/picture?url=http://example.org/image.jpg&widths=320,640&output=json&alt=foo&sizes=50vw", nil)
+	o := ServerOptions{PathPrefix: "/", EnableURLSignature: true, URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	opts := ImageOptions{Widths: []int{320, 640}, Output: SrcsetOutputJSON, Alt: "foo", Sizes: "50vw"}.WithImageURL(requestImageURL(r, o))
+
+	image, err := Picture(readTestFile(t, "large.jpg"), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var picture PictureElement
+	if err := json.Unmarshal(image.Body, &picture); err != nil {
+		t.Fatal(err)
+	}
+	if len(picture.Sources) != len(defaultPictureFormats) || picture.Sources[0].Type != "image/avif" || picture.Width != 640 {
+		t.Fatalf("Invalid picture: %+v", picture)
+	}
+	if !strings.Contains(picture.Src, "type=jpeg") || strings.Contains(picture.Src, "alt=") || !strings.Contains(picture.Src, "sign=") {
+		t.Errorf("Invalid picture image URL: %s", picture.Src)
+	}
+	if !strings.HasPrefix(picture.HTML, "<picture>") || !strings.Contains(picture.HTML, `alt="foo"`) {
+		t.Errorf("Invalid picture markup: %s", picture.HTML)
+	}
+}
+
+func TestPictureMarkup(t *testing.T) {
+	markup := pictureMarkup(PictureElement{
+		Sources: []PictureSource{
+			{Type: "image/webp", Srcset: "/resize?type=webp&width=320 320w"},
+			{Type: "image/jpeg", Srcset: "/resize?type=jpeg&width=320 320w"},
+		},
+		Src:    "/resize?type=jpeg&width=320",
+		Sizes:  "100vw",
+		Width:  320,
+		Height: 180,
+		Alt:    `"quoted" <alt>`,
+	})
+
+	expected := `<picture>
+  <source type="image/webp" srcset="/resize?type=webp&amp;width=320 320w" sizes="100vw">
+  <img src="/resize?type=jpeg&amp;width=320" srcset="/resize?type=jpeg&amp;width=320 320w" sizes="100vw" width="320" height="180" alt="&#34;quoted&#34; &lt;alt&gt;" loading="lazy" decoding="async">
+</picture>
+`
+	if markup != expected {
+		t.Errorf("Invalid picture markup:\n%s", markup)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	d "runtime/debug"
+	"sync"
+	"time"
+)
+
+// Pipeline branches output formats, also used by srcset
+const (
+	PipelineOutputMultipart = "multipart"
+	PipelineOutputZip       = "zip"
+)
+
+const (
+	// maxPipelineBranches limits the number of branches per pipeline
+	maxPipelineBranches = 10
+
+	// pipelineIntermediateCompression favours speed when encoding the
+	// lossless PNG images passed between pipeline operations
+	pipelineIntermediateCompression = 1
+)
+
+// branchNamePattern restricts branch names to safe file names
+var branchNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// pipelineBranches runs every branch on the same source image, concurrently
+// as far as the worker pool allows, returning the results bundled as multipart
+// or ZIP archive. The output type defines the default type of the branches
+// results.
+func pipelineBranches(buf []byte, outputType string, o ImageOptions) (Image, error) {
+	if len(o.Branches) > maxPipelineBranches {
+		return Image{}, NewParamError(fmt.Sprintf("Maximum pipeline branches (%d) exceeded", maxPipelineBranches), "branches")
+	}
+	if o.Output == SrcsetOutputJSON {
+		return Image{}, NewParamError("Unsupported pipeline branches output: json", "output")
+	}
+
+	names := make([]string, len(o.Branches))
+	seen := make(map[string]bool, len(o.Branches))
+	for i, branch := range o.Branches {
+		name := branch.Name
+		if name == "" {
+			name = fmt.Sprintf("branch-%d", i+1)
+		}
+		if !branchNamePattern.MatchString(name) || name == "." || name == ".." {
+			return Image{}, NewParamError(fmt.Sprintf("Invalid pipeline branch name: %s", name), "branches")
+		}
+		if seen[name] {
+			return Image{}, NewParamError(fmt.Sprintf("Duplicated pipeline branch name: %s", name), "branches")
+		}
+		seen[name] = true
+		names[i] = name
+	}
+
+	results := make([]Image, len(o.Branches))
+	errs := make([]error, len(o.Branches))
+
+	run := func(i int) {
+		// Panics are recovered per branch, since they can't be raised again
+		// by the request goroutine once the other branches are running
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic running pipeline branch %q: %v\n%s", names[i], err, d.Stack())
+				errs[i] = ErrInternalServer
+			}
+		}()
+		opts := o.WithReport(o.report.forBranch(names[i]))
+		results[i], _, errs[i] = runPipeline(buf, o.Branches[i].Operations, outputType, false, opts)
+	}
+
+	// Branches run concurrently on the idle workers, counted as busy, or else
+	// one after another on the worker of the request
+	var wg sync.WaitGroup
+	for i := range o.Branches {
+		if i < len(o.Branches)-1 && o.workers.TryAcquire() {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer o.workers.Release()
+				run(i)
+			}(i)
+			continue
+		}
+		run(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return Image{}, fmt.Errorf("pipeline branch %q failed: %w", names[i], err)
+		}
+	}
+
+	if o.Output == PipelineOutputZip {
+		return zipBranches(names, results, o)
+	}
+	return multipartBranches(names, results, o)
+}
+
+// multipartBranches bundles the branches results as multipart/mixed body
+func multipartBranches(names []string, results []Image, o ImageOptions) (Image, error) {
+	filenames, err := entryFilenames(names, results, o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	for i, result := range results {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", result.Mime)
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; name=%q; filename=%q", names[i], filenames[i]))
+
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return Image{}, err
+		}
+		if _, err := part.Write(result.Body); err != nil {
+			return Image{}, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return Image{}, err
+	}
+
+	return Image{Body: body.Bytes(), Mime: "multipart/mixed; boundary=" + w.Boundary()}, nil
+}
+
+// zipBranches bundles the branches results as ZIP archive
+func zipBranches(names []string, results []Image, o ImageOptions) (Image, error) {
+	filenames, err := entryFilenames(names, results, o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var body bytes.Buffer
+	w := zip.NewWriter(&body)
+
+	for i, result := range results {
+		// Images are already compressed, store them as is
+		header := &zip.FileHeader{
+			Name:     filenames[i],
+			Method:   zip.Store,
+			Modified: time.Now(),
+		}
+
+		file, err := w.CreateHeader(header)
+		if err != nil {
+			return Image{}, err
+		}
+		if _, err := file.Write(result.Body); err != nil {
+			return Image{}, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return Image{}, err
+	}
+
+	return Image{Body: body.Bytes(), Mime: "application/zip"}, nil
+}
+
+// branchFilename returns the branch result file name, using the MIME
+// subtype as extension
+func branchFilename(name string, result Image) string {
+	if ext := ExtractImageTypeFromMime(result.Mime); ext != "" {
+		return name + "." + ext
+	}
+	return name
+}
+
+// pipelineOperations returns the pipeline operations, including the branches ones
+func pipelineOperations(o ImageOptions) PipelineOperations {
+	operations := append(PipelineOperations{}, o.Operations...)
+	for _, branch := range o.Branches {
+		operations = append(operations, branch.Operations...)
+	}
+	return operations
+}
+
+// pipelineHasAutoType reports whether any pipeline operation uses type=auto
+func pipelineHasAutoType(o ImageOptions) bool {
+	for _, operation := range pipelineOperations(o) {
+		if operation.Params["type"] == "auto" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePipelineAutoType replaces the type=auto params of the pipeline
+// operations by the image type negotiated with the client. An empty type
+// keeps the pipeline output type.
+func resolvePipelineAutoType(o ImageOptions, imageType string) {
+	for _, operation := range pipelineOperations(o) {
+		if operation.Params["type"] != "auto" {
+			continue
+		}
+		if imageType == "" {
+			delete(operation.Params, "type")
+		} else {
+			operation.Params["type"] = imageType
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// PipelineWarningsHeader is the response header listing the pipeline steps
+// whose failure was ignored
+const PipelineWarningsHeader = "X-Pipeline-Warnings"
+
+// PipelineStep reports a pipeline operation run: its params, duration and
+// output image dimensions, or its error. Failures of the operations ignoring
+// them report the error too, but aren't failed steps.
+type PipelineStep struct {
+	Step      int                    `json:"step"`
+	Branch    string                 `json:"branch,omitempty"`
+	Operation string                 `json:"operation"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Duration  float64                `json:"durationMs"`
+	Width     int                    `json:"width,omitempty"`
+	Height    int                    `json:"height,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Failed    bool                   `json:"failed,omitempty"`
+}
+
+// PipelineReport collects the steps of a pipeline run, replied along with the
+// pipeline errors, or instead of the image with debug=true. The branches steps
+// are collected by the report of the whole pipeline. A nil report discards
+// the steps.
+type PipelineReport struct {
+	mu     sync.Mutex
+	steps  []PipelineStep
+	parent *PipelineReport
+	branch string
+}
+
+// forBranch returns the report collecting the steps of the named branch
+func (r *PipelineReport) forBranch(name string) *PipelineReport {
+	if r == nil {
+		return nil
+	}
+	return &PipelineReport{parent: r, branch: name}
+}
+
+// add records the pipeline step
+func (r *PipelineReport) add(step PipelineStep) {
+	if r == nil {
+		return
+	}
+	if r.parent != nil {
+		step.Branch = r.branch
+		r.parent.add(step)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+}
+
+// Steps returns the steps recorded so far, in running order
+func (r *PipelineReport) Steps() []PipelineStep {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]PipelineStep{}, r.steps...)
+}
+
+// FailedStep returns the step aborting the pipeline, if any
+func (r *PipelineReport) FailedStep() (PipelineStep, bool) {
+	for _, step := range r.Steps() {
+		if step.Failed {
+			return step, true
+		}
+	}
+	return PipelineStep{}, false
+}
+
+// SkippedSteps returns the steps whose failure was ignored, as defined by
+// their ignore_failure field
+func (r *PipelineReport) SkippedSteps() []PipelineStep {
+	var skipped []PipelineStep
+	for _, step := range r.Steps() {
+		if step.Error != "" && !step.Failed {
+			skipped = append(skipped, step)
+		}
+	}
+	return skipped
+}
+
+// record adds the report of the operation run, started at the given time.
+// The output image dimensions are read from its header.
+func (r *PipelineReport) record(i int, operation PipelineOperation, start time.Time, image Image, err error) {
+	if r == nil {
+		return
+	}
+
+	step := PipelineStep{
+		Step:      i + 1,
+		Operation: operation.Name,
+		Params:    operation.Params,
+		Duration:  toMilliseconds(time.Since(start)),
+	}
+	if err != nil {
+		step.Error = err.Error()
+		step.Failed = !operation.IgnoreFailure
+	} else if width, height, ok := imageDimensions(image.Body); ok {
+		step.Width, step.Height = width, height
+	} else if size, err := bimg.Size(image.Body); err == nil {
+		step.Width, step.Height = size.Width, size.Height
+	}
+	r.add(step)
+}
+
+// pipelineErrorReply is the pipeline error replied along with the steps run
+type pipelineErrorReply struct {
+	Error
+	FailedStep *PipelineStep  `json:"failedStep,omitempty"`
+	Steps      []PipelineStep `json:"steps"`
+}
+
+// replyPipelineError replies the error along with the pipeline report, if any
+// step was run, unless the errors are replied with a placeholder image
+func replyPipelineError(r *http.Request, w http.ResponseWriter, xerr Error, report *PipelineReport, o ServerOptions) {
+	steps := report.Steps()
+	if len(steps) == 0 || placeholderEnabled(o) {
+		ErrorReply(r, w, xerr, o)
+		return
+	}
+
+	reply := pipelineErrorReply{Error: xerr, Steps: steps}
+	if step, ok := report.FailedStep(); ok {
+		reply.FailedStep = &step
+	}
+	body, _ := json.Marshal(reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(xerr.HTTPCode())
+	w.Write(body)
+}
+
+// pipelineDebugReply is replied instead of the pipeline output image with
+// debug=true
+type pipelineDebugReply struct {
+	Mime     string         `json:"mime"`
+	Width    int            `json:"width"`
+	Height   int            `json:"height"`
+	Bytes    int            `json:"bytes"`
+	Duration float64        `json:"durationMs"`
+	Steps    []PipelineStep `json:"steps"`
+	Warnings []PipelineStep `json:"warnings,omitempty"`
+}
+
+// writePipelineReport replies the pipeline report and the output image
+// summary, instead of the image
+func writePipelineReport(w http.ResponseWriter, image Image, report *PipelineReport, elapsed time.Duration) {
+	width, height := image.Width, image.Height
+	if width == 0 || height == 0 {
+		width, height, _ = imageDimensions(image.Body)
+	}
+
+	body, _ := json.Marshal(pipelineDebugReply{
+		Mime:     image.Mime,
+		Width:    width,
+		Height:   height,
+		Bytes:    len(image.Body),
+		Duration: toMilliseconds(elapsed),
+		Steps:    report.Steps(),
+		Warnings: report.SkippedSteps(),
+	})
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// setPipelineWarnings adds the X-Pipeline-Warnings header values of the
+// skipped steps, e.g: step=2; operation=watermark; error="Invalid param"
+func setPipelineWarnings(w http.ResponseWriter, report *PipelineReport) {
+	for _, step := range report.SkippedSteps() {
+		warning := fmt.Sprintf("step=%d; operation=%s", step.Step, step.Operation)
+		if step.Branch != "" {
+			warning += "; branch=" + step.Branch
+		}
+		w.Header().Add(PipelineWarningsHeader, warning+"; error="+strconv.Quote(step.Error))
+	}
+}
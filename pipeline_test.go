@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+func TestMultipartBranches(t *testing.T) {
+	results := []Image{
+		{Body: []byte("first"), Mime: "image/jpeg"},
+		{Body: []byte("second"), Mime: "image/webp"},
+	}
+
+	image, err := multipartBranches([]string{"small", "large"}, results, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot bundle branches: %s", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(image.Mime)
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Invalid MIME type: %s", image.Mime)
+	}
+
+	r := multipart.NewReader(bytes.NewReader(image.Body), params["boundary"])
+	for i, expected := range []string{"small.jpeg", "large.webp"} {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("Cannot read part %d: %s", i, err)
+		}
+		if part.FileName() != expected {
+			t.Errorf("Invalid file name: %s != %s", part.FileName(), expected)
+		}
+		if part.Header.Get("Content-Type") != results[i].Mime {
+			t.Errorf("Invalid part content type: %s", part.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(part)
+		if !bytes.Equal(body, results[i].Body) {
+			t.Errorf("Invalid part body: %s", body)
+		}
+	}
+}
+
+func TestZipBranches(t *testing.T) {
+	results := []Image{
+		{Body: []byte("first"), Mime: "image/jpeg"},
+		{Body: []byte("second"), Mime: "image/png"},
+	}
+
+	image, err := zipBranches([]string{"small", "large"}, results, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot bundle branches: %s", err)
+	}
+	if image.Mime != "application/zip" {
+		t.Fatalf("Invalid MIME type: %s", image.Mime)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(image.Body), int64(len(image.Body)))
+	if err != nil {
+		t.Fatalf("Invalid ZIP archive: %s", err)
+	}
+	for i, expected := range []string{"small.jpeg", "large.png"} {
+		if r.File[i].Name != expected {
+			t.Errorf("Invalid file name: %s != %s", r.File[i].Name, expected)
+		}
+	}
+}
+
+func TestPipelineBranchesValidation(t *testing.T) {
+	cases := []PipelineBranches{
+		{{Name: "../foo", Operations: PipelineOperations{{Name: "flip"}}}},
+		{{Name: "foo", Operations: PipelineOperations{{Name: "flip"}}}, {Name: "foo", Operations: PipelineOperations{{Name: "flop"}}}},
+		make(PipelineBranches, maxPipelineBranches+1),
+	}
+
+	for _, branches := range cases {
+		if _, err := Pipeline([]byte("image"), ImageOptions{Branches: branches}); err == nil {
+			t.Errorf("Expected error for branches: %+v", branches)
+		}
+	}
+}
+
+func TestPipelineBranches(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{
+		Output: PipelineOutputZip,
+		Branches: PipelineBranches{
+			{Name: "small", Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"width": 100}}}},
+			{Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"width": 200, "type": "png"}}}},
+		},
+	}
+
+	image, err := Pipeline(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(image.Body), int64(len(image.Body)))
+	if err != nil {
+		t.Fatalf("Invalid ZIP archive: %s", err)
+	}
+	if len(r.File) != 2 || r.File[0].Name != "small.jpeg" || r.File[1].Name != "branch-2.png" {
+		t.Fatalf("Invalid ZIP archive files")
+	}
+
+	for i, width := range []int{100, 200} {
+		f, _ := r.File[i].Open()
+		body, _ := ioutil.ReadAll(f)
+		f.Close()
+
+		size, err := bimg.Size(body)
+		if err != nil || size.Width != width {
+			t.Errorf("Invalid image width: %d != %d", size.Width, width)
+		}
+	}
+}
+
+func TestPipelineBranchesWorkers(t *testing.T) {
+	pool := NewWorkerPool(2, 0, 0)
+	if err := pool.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release()
+
+	var mu sync.Mutex
+	busy := 0
+	OperationsMap["busy"] = func(buf []byte, o ImageOptions) (Image, error) {
+		pool.mu.Lock()
+		mu.Lock()
+		if pool.busy > busy {
+			busy = pool.busy
+		}
+		mu.Unlock()
+		pool.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return Image{Body: buf, Mime: "image/jpeg"}, nil
+	}
+	OperationsMap["panic"] = func(buf []byte, o ImageOptions) (Image, error) {
+		panic("libvips failure")
+	}
+	defer delete(OperationsMap, "busy")
+	defer delete(OperationsMap, "panic")
+
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+	branches := make(PipelineBranches, 4)
+	for i := range branches {
+		branches[i].Operations = PipelineOperations{{Name: "busy"}}
+	}
+	if _, err := Pipeline(buf, ImageOptions{Branches: branches}.WithWorkers(pool)); err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	// The request worker and the single idle one
+	if busy != 2 || pool.busy != 1 {
+		t.Errorf("Invalid busy workers: %d, %d once done", busy, pool.busy)
+	}
+
+	branches[0].Operations = PipelineOperations{{Name: "panic"}}
+	if _, err := Pipeline(buf, ImageOptions{Branches: branches}.WithWorkers(pool)); !errors.Is(err, ErrInternalServer) {
+		t.Errorf("Expected internal server error, got %v", err)
+	}
+	if pool.busy != 1 {
+		t.Errorf("Worker not released: %d", pool.busy)
+	}
+}
+
+func TestPipelineLosslessIntermediates(t *testing.T) {
+	var types []string
+	OperationsMap["record"] = func(buf []byte, o ImageOptions) (Image, error) {
+		types = append(types, o.Type)
+		return Image{Body: buf, Mime: GetImageMimeType(ImageType(o.Type))}, nil
+	}
+	defer delete(OperationsMap, "record")
+
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+
+	cases := []struct {
+		operations PipelineOperations
+		expected   []string
+	}{
+		{PipelineOperations{{Name: "record"}}, []string{"jpeg"}},
+		{PipelineOperations{{Name: "record"}, {Name: "record"}, {Name: "record"}}, []string{"png", "png", "jpeg"}},
+		{PipelineOperations{{Name: "record"}, {Name: "record", Params: map[string]interface{}{"type": "webp"}}, {Name: "record"}}, []string{"png", "webp", "webp"}},
+	}
+
+	for _, test := range cases {
+		types = nil
+		if _, err := Pipeline(buf, ImageOptions{Operations: test.operations}); err != nil {
+			t.Fatalf("Cannot process image: %s", err)
+		}
+		if strings.Join(types, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Invalid operations types: %v != %v", types, test.expected)
+		}
+	}
+}
+
+func TestResolvePipelineAutoType(t *testing.T) {
+	opts := ImageOptions{
+		Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"type": "auto"}}},
+		Branches: PipelineBranches{
+			{Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"type": "auto"}}}},
+			{Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"type": "png"}}}},
+		},
+	}
+
+	if !pipelineHasAutoType(opts) {
+		t.Fatal("Pipeline must use auto type")
+	}
+
+	resolvePipelineAutoType(opts, "webp")
+	if opts.Operations[0].Params["type"] != "webp" || opts.Branches[0].Operations[0].Params["type"] != "webp" {
+		t.Error("Auto type not resolved")
+	}
+	if opts.Branches[1].Operations[0].Params["type"] != "png" {
+		t.Error("Explicit type must not change")
+	}
+	if pipelineHasAutoType(opts) {
+		t.Error("Pipeline must not use auto type")
+	}
+}
+
+func TestPipelineReport(t *testing.T) {
+	OperationsMap["same"] = func(buf []byte, o ImageOptions) (Image, error) {
+		return Image{Body: buf, Mime: "image/png"}, nil
+	}
+	OperationsMap["fail"] = func(buf []byte, o ImageOptions) (Image, error) {
+		return Image{}, NewError("Operation failed", http.StatusBadRequest)
+	}
+	defer delete(OperationsMap, "same")
+	defer delete(OperationsMap, "fail")
+
+	buf := testRasterImage(t, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	report := &PipelineReport{}
+	opts := ImageOptions{Operations: PipelineOperations{
+		{Name: "same", Params: map[string]interface{}{"width": 100}},
+		{Name: "fail", IgnoreFailure: true},
+		{Name: "fail"},
+		{Name: "same"},
+	}}.WithReport(report)
+
+	if _, err := Pipeline(buf, opts); err == nil {
+		t.Fatal("Expected pipeline error")
+	}
+
+	steps := report.Steps()
+	if len(steps) != 3 {
+		t.Fatalf("Invalid number of steps: %d", len(steps))
+	}
+	if steps[0].Operation != "same" || steps[0].Params["width"] != 100 || steps[0].Width != 8 || steps[0].Height != 8 || steps[0].Error != "" {
+		t.Errorf("Invalid step: %+v", steps[0])
+	}
+	if steps[1].Error != "Operation failed" || steps[1].Failed {
+		t.Errorf("Ignored failure must not fail the step: %+v", steps[1])
+	}
+	if step, ok := report.FailedStep(); !ok || step.Step != 3 || step.Operation != "fail" {
+		t.Errorf("Invalid failed step: %+v", step)
+	}
+	if skipped := report.SkippedSteps(); len(skipped) != 1 || skipped[0].Step != 2 {
+		t.Errorf("Invalid skipped steps: %+v", skipped)
+	}
+
+	// Branches steps are reported by branch
+	report = &PipelineReport{}
+	opts = ImageOptions{Branches: PipelineBranches{
+		{Name: "ok", Operations: PipelineOperations{{Name: "same"}}},
+		{Name: "ko", Operations: PipelineOperations{{Name: "fail"}}},
+	}}.WithReport(report)
+	if _, err := Pipeline(buf, opts); err == nil {
+		t.Fatal("Expected pipeline error")
+	}
+	if step, ok := report.FailedStep(); !ok || step.Branch != "ko" || step.Step != 1 {
+		t.Errorf("Invalid failed step: %+v", step)
+	}
+}
+
+func TestReplyPipelineError(t *testing.T) {
+	report := &PipelineReport{}
+	report.record(0, PipelineOperation{Name: "fail"}, time.Now(), Image{}, NewError("Operation failed", http.StatusBadRequest))
+
+	w := httptest.NewRecorder()
+	replyPipelineError(httptest.NewRequest(http.MethodPost, "/pipeline", nil), w, NewError("Operation failed", http.StatusBadRequest), report, ServerOptions{})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+
+	var reply struct {
+		Message    string         `json:"message"`
+		FailedStep *PipelineStep  `json:"failedStep"`
+		Steps      []PipelineStep `json:"steps"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("Invalid JSON reply: %s", err)
+	}
+	if reply.Message != "Operation failed" || len(reply.Steps) != 1 || reply.FailedStep == nil || reply.FailedStep.Operation != "fail" {
+		t.Errorf("Invalid reply: %s", w.Body.String())
+	}
+
+	// Errors without steps are replied as usual
+	w = httptest.NewRecorder()
+	replyPipelineError(httptest.NewRequest(http.MethodPost, "/pipeline", nil), w, ErrMissingImageSource, nil, ServerOptions{})
+	if !bytes.Equal(w.Body.Bytes(), ErrMissingImageSource.JSON()) {
+		t.Errorf("Invalid reply: %s", w.Body.String())
+	}
+}
+
+func TestSetPipelineWarnings(t *testing.T) {
+	report := &PipelineReport{}
+	report.record(0, PipelineOperation{Name: "resize"}, time.Now(), Image{}, nil)
+	report.record(1, PipelineOperation{Name: "watermark", IgnoreFailure: true}, time.Now(), Image{}, NewError(`Invalid "text" param`, http.StatusBadRequest))
+	report.forBranch("small").record(0, PipelineOperation{Name: "blur", IgnoreFailure: true}, time.Now(), Image{}, NewError("Blur failed", http.StatusBadRequest))
+
+	w := httptest.NewRecorder()
+	setPipelineWarnings(w, report)
+
+	expected := []string{
+		`step=2; operation=watermark; error="Invalid \"text\" param"`,
+		`step=1; operation=blur; branch=small; error="Blur failed"`,
+	}
+	if warnings := w.Header().Values(PipelineWarningsHeader); strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Invalid warnings: %q", warnings)
+	}
+
+	// Pipelines without skipped steps don't define the header
+	w = httptest.NewRecorder()
+	setPipelineWarnings(w, nil)
+	if _, ok := w.Header()[PipelineWarningsHeader]; ok {
+		t.Error("Unexpected warnings header")
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
 	"io"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -11,3 +17,100 @@ const placeholderData = `/9j/4AAQSkZJRgABAQAAAQABAAD/2wBDAAYEBQYFBAYGBQYHBwYIChA
 
 // Decode base64 placeholder image into byte slice
 var placeholder, _ = io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(placeholderData)))
+
+// defaultPlaceholderSize is the size of generated placeholders when the
+// request doesn't define any dimension
+const defaultPlaceholderSize = 1200
+
+// maxPlaceholderPixels limits the size of the placeholders, defined by the
+// failing requests before any validation
+const maxPlaceholderPixels = 4 * 1000 * 1000
+
+// defaultPlaceholderColor is the color of generated placeholders when no
+// placeholder color is configured
+var defaultPlaceholderColor = []uint8{238, 238, 238}
+
+// placeholderImage returns the placeholder image configured for the status
+// code, its class (e.g. 5xx) or the default one, in that order.
+func placeholderImage(code int, o ServerOptions) []byte {
+	if buf, ok := o.Placeholders[strconv.Itoa(code)]; ok {
+		return buf
+	}
+	if buf, ok := o.Placeholders[fmt.Sprintf("%dxx", code/100)]; ok {
+		return buf
+	}
+	if o.PlaceholderColor == nil {
+		return o.PlaceholderImage
+	}
+	return nil
+}
+
+// placeholderSize returns the size of the placeholder for the requested
+// dimensions, scaled down keeping the aspect ratio when exceeding the
+// placeholders limit or -max-allowed-resolution. Generated placeholders are
+// square if only one dimension is requested, or the default size if none.
+func placeholderSize(width, height int, generated bool, o ServerOptions) (int, int) {
+	if generated {
+		if width <= 0 {
+			width = height
+		}
+		if height <= 0 {
+			height = width
+		}
+		if width <= 0 {
+			width, height = defaultPlaceholderSize, defaultPlaceholderSize
+		}
+	}
+
+	limit := float64(maxPlaceholderPixels)
+	if max := o.MaxAllowedPixels * 1000000; max > 0 && max < limit {
+		limit = max
+	}
+	// A missing dimension is bounded as a square image
+	w, h := math.Max(float64(width), 0), math.Max(float64(height), 0)
+	if w == 0 {
+		w = h
+	}
+	if h == 0 {
+		h = w
+	}
+	if w*h <= limit {
+		return width, height
+	}
+
+	scale := math.Sqrt(limit / (w * h))
+	w, h = math.Max(1, math.Floor(w*scale)), math.Max(1, math.Floor(h*scale))
+	// Extreme aspect ratios keep a single pixel on the shortest side
+	if w*h > limit {
+		if w > h {
+			w = math.Floor(limit / h)
+		} else {
+			h = math.Floor(limit / w)
+		}
+	}
+	if width <= 0 {
+		return 0, int(h)
+	}
+	if height <= 0 {
+		return int(w), 0
+	}
+	return int(w), int(h)
+}
+
+// generatePlaceholder generates a single pixel solid color PNG image, enlarged
+// by libvips to the placeholder size, so its raster is never allocated in
+// memory
+func generatePlaceholder(rgb []uint8) ([]byte, error) {
+	if len(rgb) < 3 {
+		rgb = defaultPlaceholderColor
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255})
+
+	var buf bytes.Buffer
+	if err := pngEncoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
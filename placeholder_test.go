@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestPlaceholderImage(t *testing.T) {
+	o := ServerOptions{
+		PlaceholderImage: []byte("default"),
+		Placeholders: map[string][]byte{
+			"404": []byte("notfound"),
+			"5xx": []byte("error"),
+		},
+	}
+
+	cases := []struct {
+		code     int
+		expected string
+	}{
+		{404, "notfound"},
+		{500, "error"},
+		{503, "error"},
+		{400, "default"},
+	}
+
+	for _, test := range cases {
+		if buf := placeholderImage(test.code, o); string(buf) != test.expected {
+			t.Errorf("Invalid placeholder for %d: %s", test.code, buf)
+		}
+	}
+
+	o.PlaceholderColor = []uint8{255, 0, 0}
+	if buf := placeholderImage(400, o); buf != nil {
+		t.Error("Placeholder must be generated when a color is defined")
+	}
+}
+
+func TestGeneratePlaceholder(t *testing.T) {
+	buf, err := generatePlaceholder([]uint8{255, 0, 0})
+	if err != nil {
+		t.Fatalf("Cannot generate placeholder: %s", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("Invalid placeholder image: %s", err)
+	}
+	// The placeholder is enlarged by libvips, instead of allocated at its size
+	if size := img.Bounds().Size(); size.X != 1 || size.Y != 1 {
+		t.Errorf("Invalid placeholder size: %dx%d", size.X, size.Y)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Errorf("Invalid placeholder color: %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestPlaceholderSize(t *testing.T) {
+	cases := []struct {
+		width, height    int
+		generated        bool
+		maxAllowedPixels float64
+		expectedWidth    int
+		expectedHeight   int
+	}{
+		{0, 0, true, 0, defaultPlaceholderSize, defaultPlaceholderSize},
+		{300, 0, true, 0, 300, 300},
+		{0, 200, true, 0, 200, 200},
+		{300, 200, true, 0, 300, 200},
+		{0, 0, false, 0, 0, 0},
+		{300, 0, false, 0, 300, 0},
+		{100000, 100000, true, 0, 2000, 2000},
+		{100000, 0, false, 0, 2000, 0},
+		{8000, 2000, true, 0, 4000, 1000},
+		{2000, 2000, true, 1, 1000, 1000},
+		{1 << 40, 1, true, 0, 4000000, 1},
+	}
+
+	for _, test := range cases {
+		o := ServerOptions{MaxAllowedPixels: test.maxAllowedPixels}
+		width, height := placeholderSize(test.width, test.height, test.generated, o)
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("%+v: invalid placeholder size: %dx%d", test, width, height)
+		}
+	}
+}
+
+func TestReplyWithGeneratedPlaceholder(t *testing.T) {
+	o := ServerOptions{PlaceholderColor: []uint8{0, 128, 255}}
+
+	req := httptest.NewRequest(http.MethodGet, "/resize?width=300&type=png", nil)
+	res := httptest.NewRecorder()
+	ErrorReply(req, res, ErrNotFound, o)
+
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("Invalid response status: %d", res.Code)
+	}
+	if res.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid content type: %s", res.Header().Get("Content-Type"))
+	}
+	if res.Header().Get("Error") == "" {
+		t.Error("Missing error header")
+	}
+
+	size, err := bimg.Size(res.Body.Bytes())
+	if err != nil || size.Width != 300 || size.Height != 300 {
+		t.Errorf("Invalid placeholder size: %dx%d", size.Width, size.Height)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// PolicyDefault is the policy name applied to every endpoint
+const PolicyDefault = "*"
+
+// ParamPolicy restricts the values accepted by a request param
+type ParamPolicy struct {
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// OperationPolicy restricts the params and image sources accepted by an endpoint
+type OperationPolicy struct {
+	// Allowed lists the accepted params. Any param is accepted when empty.
+	Allowed []string `json:"allowed,omitempty"`
+	// Params defines the constraints of the param values.
+	Params map[string]ParamPolicy `json:"params,omitempty"`
+	// Sources lists the accepted image sources. Any source is accepted when empty.
+	Sources []ImageSourceType `json:"sources,omitempty"`
+}
+
+// Policy maps endpoint names to the policy they must satisfy. Requests must
+// satisfy both the default ("*") and their endpoint policy.
+type Policy map[string]OperationPolicy
+
+// ReadPolicy reads and validates a JSON policy file
+func ReadPolicy(path string) (Policy, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(buf, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file: %w", err)
+	}
+
+	for endpoint, p := range policy {
+		for _, name := range p.Allowed {
+			if _, ok := paramTypeCoercions[name]; !ok {
+				return nil, fmt.Errorf("invalid policy for %q: unknown param %q", endpoint, name)
+			}
+		}
+		for name := range p.Params {
+			if _, ok := paramTypeCoercions[name]; !ok {
+				return nil, fmt.Errorf("invalid policy for %q: unknown param %q", endpoint, name)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// CheckQuery validates the request query params against the endpoint policy
+func (p Policy) CheckQuery(endpoint string, query url.Values) error {
+	params := make(map[string]interface{}, len(query))
+	for key := range query {
+		params[key] = query.Get(key)
+	}
+	return p.CheckParams(endpoint, params)
+}
+
+// CheckParams validates the params against the endpoint policy
+func (p Policy) CheckParams(endpoint string, params map[string]interface{}) error {
+	for _, name := range []string{PolicyDefault, endpoint} {
+		if policy, ok := p[name]; ok {
+			if err := policy.checkParams(params); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSource validates the image source against the endpoint policy
+func (p Policy) CheckSource(endpoint string, source ImageSourceType) error {
+	for _, name := range []string{PolicyDefault, endpoint} {
+		if policy, ok := p[name]; ok && !policy.allowsSource(source) {
+			return NewError(fmt.Sprintf("Image source %q is not allowed", source), http.StatusBadRequest).WithKind(KindPolicyViolation)
+		}
+	}
+	return nil
+}
+
+func (p OperationPolicy) checkParams(params map[string]interface{}) error {
+	for key, value := range params {
+		if _, ok := paramTypeCoercions[key]; !ok {
+			continue
+		}
+
+		if len(p.Allowed) > 0 && !containsString(p.Allowed, key) {
+			return NewError(fmt.Sprintf("Param %q is not allowed", key), http.StatusBadRequest).WithKind(KindPolicyViolation).WithParam(key)
+		}
+
+		if rule, ok := p.Params[key]; ok {
+			if err := rule.check(value); err != nil {
+				return NewError(fmt.Sprintf("Param %q %s", key, err), http.StatusBadRequest).WithKind(KindPolicyViolation).WithParam(key)
+			}
+		}
+	}
+	return nil
+}
+
+func (p OperationPolicy) allowsSource(source ImageSourceType) bool {
+	if len(p.Sources) == 0 {
+		return true
+	}
+	for _, s := range p.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ParamPolicy) check(value interface{}) error {
+	if len(p.Values) > 0 && !containsString(p.Values, fmt.Sprint(value)) {
+		return fmt.Errorf("must be one of %v", p.Values)
+	}
+
+	if p.Min == nil && p.Max == nil {
+		return nil
+	}
+
+	num, err := coerceTypeFloat(value)
+	if err != nil {
+		return fmt.Errorf("must be a number")
+	}
+	if p.Min != nil && num < *p.Min {
+		return fmt.Errorf("must be greater than or equal to %g", *p.Min)
+	}
+	if p.Max != nil && num > *p.Max {
+		return fmt.Errorf("must be lower than or equal to %g", *p.Max)
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func testPolicy() Policy {
+	min, max := 40.0, 90.0
+	width := 4096.0
+	return Policy{
+		PolicyDefault: {Params: map[string]ParamPolicy{
+			"width":   {Max: &width},
+			"quality": {Min: &min, Max: &max},
+		}},
+		"resize": {
+			Allowed: []string{"width", "height", "quality", "type"},
+			Params:  map[string]ParamPolicy{"type": {Values: []string{"jpeg", "webp"}}},
+		},
+		"pipeline": {Sources: []ImageSourceType{ImageSourceTypeBody}},
+	}
+}
+
+func TestPolicyCheckQuery(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		query    string
+		valid    bool
+	}{
+		{"resize", "width=300&quality=80&type=webp", true},
+		{"resize", "width=300&url=http://foo/bar.jpg&key=secret", true},
+		{"resize", "width=5000", false},
+		{"resize", "width=300&quality=95", false},
+		{"resize", "width=300&quality=foo", false},
+		{"resize", "width=300&type=png", false},
+		{"resize", "width=300&rotate=90", false},
+		{"crop", "width=300&rotate=90&type=png", true},
+		{"crop", "width=4097", false},
+	}
+
+	policy := testPolicy()
+	for _, test := range cases {
+		query, _ := url.ParseQuery(test.query)
+		err := policy.CheckQuery(test.endpoint, query)
+		if test.valid && err != nil {
+			t.Errorf("Unexpected error for %s?%s: %s", test.endpoint, test.query, err)
+		}
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected error for %s?%s", test.endpoint, test.query)
+			} else if err.(Error).HTTPCode() != 400 {
+				t.Errorf("Invalid error status: %d", err.(Error).HTTPCode())
+			}
+		}
+	}
+}
+
+func TestPolicyCheckPipelineParams(t *testing.T) {
+	policy := testPolicy()
+
+	if err := policy.CheckParams("resize", map[string]interface{}{"width": 300.0, "type": "webp"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := policy.CheckParams("resize", map[string]interface{}{"width": 8000.0}); err == nil {
+		t.Error("Expected error for width param")
+	}
+	if err := policy.CheckParams("flip", map[string]interface{}{"quality": 20.0}); err == nil {
+		t.Error("Expected error for quality param")
+	}
+}
+
+func TestPolicyCheckSource(t *testing.T) {
+	policy := testPolicy()
+
+	if err := policy.CheckSource("pipeline", ImageSourceTypeBody); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := policy.CheckSource("pipeline", ImageSourceTypeHTTP); err == nil {
+		t.Error("Expected error for HTTP source")
+	}
+	if err := policy.CheckSource("resize", ImageSourceTypeHTTP); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "policy.json")
+	_ = os.WriteFile(file, []byte(`{"*": {"params": {"width": {"max": 4096}}}, "pipeline": {"sources": ["payload"]}}`), 0600)
+	policy, err := ReadPolicy(file)
+	if err != nil {
+		t.Fatalf("Cannot read policy: %s", err)
+	}
+	if *policy[PolicyDefault].Params["width"].Max != 4096 || policy["pipeline"].Sources[0] != ImageSourceTypeBody {
+		t.Errorf("Invalid policy: %+v", policy)
+	}
+
+	invalid := path.Join(dir, "invalid.json")
+	_ = os.WriteFile(invalid, []byte(`{"resize": {"allowed": ["foo"]}}`), 0600)
+	if _, err := ReadPolicy(invalid); err == nil {
+		t.Error("Expected error for unknown param")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPrefetchURLs limits the number of source URLs per prefetch job
+	maxPrefetchURLs = 1000
+
+	// maxPrefetchErrors limits the number of errors reported per prefetch job
+	maxPrefetchErrors = 100
+
+	// prefetchRetries is the number of retries of the prefetch requests shed by
+	// the worker pool
+	prefetchRetries = 3
+
+	// prefetchJobTTL is the time finished prefetch jobs remain available
+	prefetchJobTTL = time.Hour
+)
+
+// Prefetch job statuses
+const (
+	PrefetchRunning = "running"
+	PrefetchDone    = "done"
+)
+
+// prefetchJobs holds the prefetch jobs by ID
+var prefetchJobs sync.Map
+
+// PrefetchRequest defines the source URLs to transform and cache ahead of
+// time: the renditions of the picture presets, and the image requests, made
+// of an endpoint and its params, e.g: /resize?width=300&type=webp
+type PrefetchRequest struct {
+	URLs     []string `json:"urls"`
+	Presets  []string `json:"presets"`
+	Requests []string `json:"requests"`
+}
+
+// PrefetchError reports a failed prefetch request
+type PrefetchError struct {
+	URL     string `json:"url"`
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// PrefetchJob reports the progress of a prefetch request
+type PrefetchJob struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Requests int             `json:"requests"`
+	Failed   int             `json:"failed"`
+	Errors   []PrefetchError `json:"errors,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+// prefetchJob is a prefetch job being run, or finished
+type prefetchJob struct {
+	mu  sync.Mutex
+	job PrefetchJob
+}
+
+// Snapshot returns a copy of the job progress
+func (j *prefetchJob) Snapshot() PrefetchJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.job
+	job.Errors = append([]PrefetchError(nil), j.job.Errors...)
+	return job
+}
+
+// record accounts the prefetch request response
+func (j *prefetchJob) record(target string, buf *responseBuffer) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Requests++
+	if buf.status == http.StatusOK {
+		return
+	}
+	j.job.Failed++
+	if len(j.job.Errors) < maxPrefetchErrors {
+		var xerr Error
+		_ = json.Unmarshal(buf.body.Bytes(), &xerr)
+		j.job.Errors = append(j.job.Errors, PrefetchError{URL: target, Status: buf.status, Message: xerr.Message})
+	}
+}
+
+// finish marks the job as done, removed once expired
+func (j *prefetchJob) finish() {
+	j.mu.Lock()
+	now := time.Now()
+	j.job.Status, j.job.Finished = PrefetchDone, &now
+	j.mu.Unlock()
+	time.AfterFunc(prefetchJobTTL, func() { prefetchJobs.Delete(j.job.ID) })
+}
+
+// prefetchController starts the prefetch jobs, authorized by the prefetch
+// key, and replies their progress. The image requests are served in
+// background, one at a time at the lowest worker pool priority, by the server
+// routes without authorization, so their responses are cached as if
+// requested by the clients.
+func prefetchController(o ServerOptions) http.HandlerFunc {
+	mux := internalServerMux(o)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(o.PrefetchKey)) != 1 {
+			o.AuditLog.Log(r, AuditInvalidAPIKey, "Authorization", ErrInvalidAPIKey)
+			ErrorReply(r, w, ErrInvalidAPIKey, o)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method == http.MethodGet {
+			job, ok := prefetchJobs.Load(r.URL.Query().Get("id"))
+			if !ok {
+				ErrorReply(r, w, ErrNotFound, o)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(job.(*prefetchJob).Snapshot())
+			return
+		}
+
+		var req PrefetchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			ErrorReply(r, w, NewError("Invalid prefetch request: "+err.Error(), http.StatusBadRequest), o)
+			return
+		}
+		targets, err := prefetchTargets(req, o)
+		if err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+
+		job := &prefetchJob{job: PrefetchJob{ID: newRequestID(), Status: PrefetchRunning, Started: time.Now()}}
+		prefetchJobs.Store(job.job.ID, job)
+		go runPrefetchJob(job, targets, r, mux, o.Webhooks)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", path.Join(o.PathPrefix, "/prefetch")+"?id="+job.job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job.Snapshot())
+	}
+}
+
+// internalServerMux returns the server routes serving the internal requests
+func internalServerMux(o ServerOptions) http.Handler {
+	return NewServerMux(internalOptions(o))
+}
+
+// internalOptions returns the server options of the internal requests,
+// without authorization nor throttling
+func internalOptions(o ServerOptions) ServerOptions {
+	o.PrefetchKey = ""
+	o.APIKey = ""
+	o.APIKeys = nil
+	o.Auth = nil
+	o.Concurrency = 0
+	return o
+}
+
+// prefetchTarget is the image request of a source URL to prefetch. Picture
+// targets are resolved to the URLs of their renditions.
+type prefetchTarget struct {
+	url     string
+	picture bool
+}
+
+// prefetchTargets validates the prefetch request, returning the picture and
+// image request URLs of every source URL
+func prefetchTargets(req PrefetchRequest, o ServerOptions) ([]prefetchTarget, error) {
+	if !o.EnableURLSource {
+		return nil, ErrGetMethodNotAllowed
+	}
+	if len(req.URLs) == 0 {
+		return nil, NewMissingParamError("Missing required param: urls", "urls")
+	}
+	if len(req.URLs) > maxPrefetchURLs {
+		return nil, NewParamError(fmt.Sprintf("Maximum prefetch URLs (%d) exceeded", maxPrefetchURLs), "urls")
+	}
+	if len(req.Presets) == 0 && len(req.Requests) == 0 {
+		return nil, NewMissingParamError("Missing required param: presets or requests", "")
+	}
+
+	for _, name := range req.Presets {
+		if _, ok := o.PicturePresets[name]; !ok {
+			return nil, ErrUnknownPreset
+		}
+	}
+	requests := make([]*url.URL, len(req.Requests))
+	for i, request := range req.Requests {
+		u, err := url.Parse(request)
+		if err != nil {
+			return nil, NewParamError("Invalid prefetch request: "+request, "requests")
+		}
+		if _, ok := imageEndpoints[path.Clean("/"+u.Path)]; !ok {
+			return nil, NewParamError("Invalid prefetch request: "+request, "requests")
+		}
+		requests[i] = u
+	}
+
+	var targets []prefetchTarget
+	for _, source := range req.URLs {
+		if u, err := url.Parse(source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, ErrInvalidImageURL
+		}
+		base := &http.Request{URL: &url.URL{RawQuery: url.Values{URLQueryKey: {source}}.Encode()}}
+		imageURL := requestImageURL(base, o)
+
+		for _, name := range req.Presets {
+			target := imageURL("/picture", map[string]string{"preset": name, "output": SrcsetOutputJSON})
+			targets = append(targets, prefetchTarget{url: target, picture: true})
+		}
+		for _, u := range requests {
+			params := map[string]string{}
+			for key, values := range u.Query() {
+				params[key] = values[0]
+			}
+			delete(params, URLQueryKey)
+			targets = append(targets, prefetchTarget{url: imageURL(path.Clean("/"+u.Path), params)})
+		}
+	}
+	return targets, nil
+}
+
+// runPrefetchJob serves the prefetch targets one at a time, with the host and
+// the context values of the prefetch request, so the responses are cached
+// under the same keys as the clients ones. The webhooks are notified once
+// done.
+func runPrefetchJob(job *prefetchJob, targets []prefetchTarget, r *http.Request, mux http.Handler, hooks *Webhooks) {
+	defer func() {
+		job.finish()
+		hooks.NotifyJob(job.Snapshot())
+	}()
+	ctx := context.WithValue(detachedContext{r.Context()}, priorityContextKey{}, prefetchPriority)
+
+	for _, target := range targets {
+		buf := prefetchURL(ctx, target.url, r, mux)
+		if !target.picture || buf.status != http.StatusOK {
+			job.record(target.url, buf)
+			continue
+		}
+
+		var picture PictureElement
+		if err := json.Unmarshal(buf.body.Bytes(), &picture); err != nil {
+			log.Printf("cannot read the prefetch picture: %s", err)
+			continue
+		}
+		for _, rendition := range pictureURLs(picture) {
+			job.record(rendition, prefetchURL(ctx, rendition, r, mux))
+		}
+	}
+}
+
+// prefetchURL serves the image request, retried when shed by the worker pool
+func prefetchURL(ctx context.Context, target string, r *http.Request, mux http.Handler) *responseBuffer {
+	var buf *responseBuffer
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		buf = newResponseBuffer()
+		if err != nil {
+			buf.WriteHeader(http.StatusBadRequest)
+			return buf
+		}
+		req.Host = r.Host
+		req.RemoteAddr = r.RemoteAddr
+		mux.ServeHTTP(buf, req)
+
+		if buf.status != http.StatusServiceUnavailable || retry >= prefetchRetries {
+			return buf
+		}
+		time.Sleep(time.Duration(retry+1) * loadShedRetryAfter * time.Second)
+	}
+}
+
+// pictureURLs returns the unique renditions URLs of the picture sources and
+// fallback image
+func pictureURLs(picture PictureElement) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	for _, source := range picture.Sources {
+		for _, candidate := range strings.Split(source.Srcset, ", ") {
+			if fields := strings.Fields(candidate); len(fields) > 0 {
+				add(fields[0])
+			}
+		}
+	}
+	add(picture.Src)
+	return urls
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefetchTargets(t *testing.T) {
+	o := ServerOptions{
+		EnableURLSource: true,
+		PathPrefix:      "/",
+		PicturePresets:  PicturePresets{"hero": {Widths: []int{640, 1280}}},
+	}
+
+	targets, err := prefetchTargets(PrefetchRequest{
+		URLs:     []string{"https://cdn.shop.com/a.jpg"},
+		Presets:  []string{"hero"},
+		Requests: []string{"/resize?width=300&type=webp&url=https://other.com/b.jpg"},
+	}, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || !targets[0].picture || targets[1].picture {
+		t.Fatalf("Invalid targets: %+v", targets)
+	}
+
+	picture, _ := url.Parse(targets[0].url)
+	if picture.Path != "/picture" || picture.Query().Get("preset") != "hero" || picture.Query().Get("output") != "json" {
+		t.Errorf("Invalid picture target: %s", targets[0].url)
+	}
+	resize, _ := url.Parse(targets[1].url)
+	query := resize.Query()
+	if resize.Path != "/resize" || query.Get("width") != "300" || query.Get("type") != "webp" || query.Get("url") != "https://cdn.shop.com/a.jpg" {
+		t.Errorf("Invalid request target: %s", targets[1].url)
+	}
+
+	cases := []struct {
+		req   PrefetchRequest
+		param string
+	}{
+		{PrefetchRequest{Presets: []string{"hero"}}, "urls"},
+		{PrefetchRequest{URLs: []string{"https://cdn.shop.com/a.jpg"}}, ""},
+		{PrefetchRequest{URLs: []string{"https://cdn.shop.com/a.jpg"}, Presets: []string{"unknown"}}, "preset"},
+		{PrefetchRequest{URLs: []string{"https://cdn.shop.com/a.jpg"}, Requests: []string{"/health"}}, "requests"},
+		{PrefetchRequest{URLs: []string{"file:///etc/passwd"}, Presets: []string{"hero"}}, "url"},
+	}
+	for _, tc := range cases {
+		_, err := prefetchTargets(tc.req, o)
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest || xerr.Param != tc.param {
+			t.Errorf("%+v: expected %q param error, got %v", tc.req, tc.param, err)
+		}
+	}
+}
+
+func TestPrefetchTargetsSigned(t *testing.T) {
+	o := ServerOptions{EnableURLSource: true, PathPrefix: "/", EnableURLSignature: true, URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	targets, err := prefetchTargets(PrefetchRequest{URLs: []string{"https://cdn.shop.com/a.jpg"}, Requests: []string{"/resize?width=300"}}, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	checkURLSignature(next, o).ServeHTTP(w, httptest.NewRequest(http.MethodGet, targets[0].url, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Invalid URL signature: %s", targets[0].url)
+	}
+}
+
+func TestPictureURLs(t *testing.T) {
+	picture := PictureElement{
+		Sources: []PictureSource{
+			{Type: "image/webp", Srcset: "/resize?type=webp&width=640 640w, /resize?type=webp&width=1280 1280w"},
+			{Type: "image/jpeg", Srcset: "/resize?type=jpeg&width=640 640w, /resize?type=jpeg&width=1280 1280w"},
+		},
+		Src: "/resize?type=jpeg&width=1280",
+	}
+
+	urls := pictureURLs(picture)
+	expected := []string{"/resize?type=webp&width=640", "/resize?type=webp&width=1280", "/resize?type=jpeg&width=640", "/resize?type=jpeg&width=1280"}
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Errorf("Invalid picture URLs: %v", urls)
+	}
+}
+
+func TestPrefetchController(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{EnableURLSource: true, PathPrefix: "/", Cache: cache, PrefetchKey: "prefetch-secret", MaxAllowedSize: 1024}
+	controller := prefetchController(o)
+
+	request := func(method, target, auth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		controller(w, r)
+		return w
+	}
+
+	body := `{"urls": ["` + origin.URL + `/missing.jpg"], "requests": ["/resize?width=100&type=jpeg"]}`
+	if w := request(http.MethodPost, "/prefetch", "invalid", body); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/prefetch", "prefetch-secret", "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %d", w.Code)
+	}
+	if w := request(http.MethodGet, "/prefetch?id=unknown", "prefetch-secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected not found, got %d", w.Code)
+	}
+
+	w := request(http.MethodPost, "/prefetch", "prefetch-secret", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	var job PrefetchJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || job.ID == "" || w.Header().Get("Location") != "/prefetch?id="+job.ID {
+		t.Fatalf("Invalid job: %s", w.Body.String())
+	}
+
+	// The job reports the failed requests once done
+	for deadline := time.Now().Add(5 * time.Second); job.Status != PrefetchDone && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		w = request(http.MethodGet, "/prefetch?id="+job.ID, "prefetch-secret", "")
+		job = PrefetchJob{}
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("Invalid job: %s", w.Body.String())
+		}
+	}
+	if job.Status != PrefetchDone || job.Requests != 1 || job.Failed != 1 || len(job.Errors) != 1 || job.Errors[0].Status == http.StatusOK {
+		t.Errorf("Invalid finished job: %+v", job)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Progress phases reported to the job subscribers
+const (
+	ProgressFetch     = "fetch"
+	ProgressDecode    = "decode"
+	ProgressTransform = "transform"
+	ProgressDone      = "done"
+)
+
+const (
+	// JobIDHeader is the request header identifying the job to report progress for
+	JobIDHeader = "X-Job-ID"
+
+	// maxProgressJobs limits the number of jobs tracked at the same time
+	maxProgressJobs = 10000
+
+	// maxJobIDLength limits the size of the job identifiers
+	maxJobIDLength = 128
+
+	// progressJobTTL is the time finished jobs remain available to late subscribers
+	progressJobTTL = time.Minute
+
+	// progressKeepAlive is the interval of the SSE comments keeping idle connections open
+	progressKeepAlive = 15 * time.Second
+)
+
+// ProgressEvent is a job progress update. Step and Total report the
+// pipeline operation being processed, Status the final response status.
+type ProgressEvent struct {
+	Phase  string `json:"phase"`
+	Step   int    `json:"step,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+type progressJob struct {
+	last        *ProgressEvent
+	subscribers map[chan ProgressEvent]struct{}
+}
+
+// ProgressHub dispatches the progress events of the jobs being processed to
+// their subscribers, which receive the last event first when subscribing.
+type ProgressHub struct {
+	mu   sync.Mutex
+	jobs map[string]*progressJob
+}
+
+// NewProgressHub creates a new progress hub
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{jobs: make(map[string]*progressJob)}
+}
+
+// Publish sends the event to the job subscribers. Slow subscribers may miss
+// intermediate events, but never the last one.
+func (h *ProgressHub) Publish(id string, event ProgressEvent) {
+	if h == nil || id == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	job := h.job(id)
+	if job == nil {
+		return
+	}
+	job.last = &event
+
+	for ch := range job.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Drop the oldest pending event to make room for the last one
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+
+	if event.Phase == ProgressDone {
+		time.AfterFunc(progressJobTTL, func() { h.remove(id, job) })
+	}
+}
+
+// Subscribe returns the job events channel and the function to unsubscribe
+func (h *ProgressHub) Subscribe(id string) (<-chan ProgressEvent, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	job := h.job(id)
+	if job == nil {
+		return nil, nil, NewError("Too many progress jobs", http.StatusServiceUnavailable)
+	}
+
+	ch := make(chan ProgressEvent, 16)
+	if job.last != nil {
+		ch <- *job.last
+	}
+	job.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(job.subscribers, ch)
+		if len(job.subscribers) == 0 && job.last == nil && h.jobs[id] == job {
+			delete(h.jobs, id)
+		}
+	}
+	return ch, cancel, nil
+}
+
+// job returns the job, creating it if required, or nil if the limit of
+// tracked jobs is reached. The lock must be held.
+func (h *ProgressHub) job(id string) *progressJob {
+	if job, ok := h.jobs[id]; ok {
+		return job
+	}
+	if len(h.jobs) >= maxProgressJobs {
+		return nil
+	}
+	job := &progressJob{subscribers: make(map[chan ProgressEvent]struct{})}
+	h.jobs[id] = job
+	return job
+}
+
+func (h *ProgressHub) remove(id string, job *progressJob) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.jobs[id] == job {
+		delete(h.jobs, id)
+	}
+}
+
+// publishProgress publishes the progress event of the request job, if any
+func publishProgress(r *http.Request, o ServerOptions, event ProgressEvent) {
+	if o.Progress != nil {
+		o.Progress.Publish(jobID(r), event)
+	}
+}
+
+// progressWriter captures the response status reported when the job is done
+type progressWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *progressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *progressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// jobID returns the job identifier of the request, if valid
+func jobID(r *http.Request) string {
+	id := r.Header.Get(JobIDHeader)
+	if len(id) > maxJobIDLength {
+		return ""
+	}
+	return id
+}
+
+// progressController streams the job progress events as Server-Sent Events
+// until the job is done or the client disconnects
+func progressController(o ServerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("job")
+		if id == "" || len(id) > maxJobIDLength {
+			ErrorReply(r, w, NewParamError("Missing or invalid param: job", "job"), o)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			ErrorReply(r, w, NewError("Streaming is not supported", http.StatusInternalServerError), o)
+			return
+		}
+
+		events, cancel, err := o.Progress.Subscribe(id)
+		if err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Del("Expires")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(progressKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case event := <-events:
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Phase, data)
+				flusher.Flush()
+				if event.Phase == ProgressDone {
+					return
+				}
+			}
+		}
+	}
+}
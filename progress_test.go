@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressHub(t *testing.T) {
+	hub := NewProgressHub()
+
+	events, cancel, err := hub.Subscribe("job")
+	if err != nil {
+		t.Fatalf("Cannot subscribe: %s", err)
+	}
+	defer cancel()
+
+	hub.Publish("job", ProgressEvent{Phase: ProgressFetch})
+	hub.Publish("other", ProgressEvent{Phase: ProgressFetch})
+	hub.Publish("job", ProgressEvent{Phase: ProgressTransform, Step: 1, Total: 2})
+
+	if event := <-events; event.Phase != ProgressFetch {
+		t.Errorf("Invalid event: %+v", event)
+	}
+	if event := <-events; event.Phase != ProgressTransform || event.Step != 1 || event.Total != 2 {
+		t.Errorf("Invalid event: %+v", event)
+	}
+
+	// Late subscribers receive the last event
+	hub.Publish("job", ProgressEvent{Phase: ProgressDone, Status: http.StatusOK})
+	late, cancelLate, _ := hub.Subscribe("job")
+	defer cancelLate()
+	if event := <-late; event.Phase != ProgressDone || event.Status != http.StatusOK {
+		t.Errorf("Invalid last event: %+v", event)
+	}
+}
+
+func TestProgressHubUnsubscribe(t *testing.T) {
+	hub := NewProgressHub()
+	_, cancel, _ := hub.Subscribe("job")
+	cancel()
+
+	if len(hub.jobs) != 0 {
+		t.Errorf("Expected idle jobs to be removed, got: %d", len(hub.jobs))
+	}
+}
+
+func TestProgressController(t *testing.T) {
+	o := ServerOptions{Progress: NewProgressHub()}
+	ts := httptest.NewServer(progressController(o))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/progress?job=abc", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot connect: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	o.Progress.Publish("abc", ProgressEvent{Phase: ProgressFetch})
+	o.Progress.Publish("abc", ProgressEvent{Phase: ProgressDone, Status: http.StatusOK})
+
+	var lines []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	expected := []string{
+		"event: fetch", `data: {"phase":"fetch"}`,
+		"event: done", `data: {"phase":"done","status":200}`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Invalid events stream:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestImageControllerProgress(t *testing.T) {
+	o := ServerOptions{Progress: NewProgressHub(), Mount: "testdata"}
+	LoadSources(o)
+
+	events, cancel, _ := o.Progress.Subscribe("job")
+	defer cancel()
+
+	r := httptest.NewRequest(http.MethodGet, "/info?file=missing.jpg", nil)
+	r.Header.Set(JobIDHeader, "job")
+	imageController(o, Info)(httptest.NewRecorder(), r)
+
+	if event := <-events; event.Phase != ProgressFetch {
+		t.Errorf("Invalid event: %+v", event)
+	}
+	if event := <-events; event.Phase != ProgressDone || event.Status != http.StatusNotFound {
+		t.Errorf("Invalid done event: %+v", event)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10,::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("Invalid trusted proxies: %v", proxies)
+	}
+
+	for ip, trusted := range map[string]bool{
+		"10.1.2.3":     true,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"::1":          true,
+		"invalid":      false,
+	} {
+		if proxies.Contains(ip) != trusted {
+			t.Errorf("Invalid trusted proxy check for %s", ip)
+		}
+	}
+
+	for _, input := range []string{"10.0.0.0/33", "foo"} {
+		if _, err := ParseTrustedProxies(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8")
+
+	cases := []struct {
+		remoteAddr, forwardedFor, realIP, expected string
+	}{
+		{"203.0.113.7:1234", "198.51.100.1", "", "203.0.113.7"},
+		{"10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "1.1.1.1, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"10.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if ip := proxies.ClientIP(r); ip != tc.expected {
+			t.Errorf("Invalid client IP for %+v: %s", tc, ip)
+		}
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8")
+
+	var remoteAddr string
+	handler := resolveClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}), proxies)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "2001:db8::1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if remoteAddr != "[2001:db8::1]:1234" {
+		t.Errorf("Invalid remote address: %s", remoteAddr)
+	}
+}
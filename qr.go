@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/h2non/bimg"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/datamatrix"
+	"github.com/makiuchi-d/gozxing/oned"
+	gozxingqr "github.com/makiuchi-d/gozxing/qrcode"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// defaultQRSize is the size in pixels of generated QR codes when the
+	// request doesn't define the width param
+	defaultQRSize = 256
+
+	// maxQRSize limits the size in pixels of generated QR codes
+	maxQRSize = 4096
+
+	// qrLogoRatio is the logo size relative to the QR code size, small enough
+	// to be recovered by the high error correction level
+	qrLogoRatio = 0.2
+
+	// maxQRDecodeSize limits the size of the images scanned for QR codes,
+	// larger images are downscaled first
+	maxQRDecodeSize = 2048
+)
+
+// errBarcodeNotFound is returned when no readable code is found in the image
+var errBarcodeNotFound = errors.New("no QR code or barcode found")
+
+// Barcode is a decoded QR code or barcode
+type Barcode struct {
+	Text   string `json:"text"`
+	Format string `json:"format"`
+	Level  string `json:"level,omitempty"`
+}
+
+// barcodeFormat defines a barcode param value, generated and decoded by
+// gozxing, while QR codes are generated by go-qrcode
+type barcodeFormat struct {
+	format gozxing.BarcodeFormat
+	writer func() gozxing.Writer
+}
+
+// barcodeFormats maps the barcode param values to their format
+var barcodeFormats = map[string]barcodeFormat{
+	"code128":    {gozxing.BarcodeFormat_CODE_128, oned.NewCode128Writer},
+	"code39":     {gozxing.BarcodeFormat_CODE_39, oned.NewCode39Writer},
+	"code93":     {gozxing.BarcodeFormat_CODE_93, oned.NewCode93Writer},
+	"codabar":    {gozxing.BarcodeFormat_CODABAR, oned.NewCodaBarWriter},
+	"ean8":       {gozxing.BarcodeFormat_EAN_8, oned.NewEAN8Writer},
+	"ean13":      {gozxing.BarcodeFormat_EAN_13, oned.NewEAN13Writer},
+	"upca":       {gozxing.BarcodeFormat_UPC_A, oned.NewUPCAWriter},
+	"upce":       {gozxing.BarcodeFormat_UPC_E, oned.NewUPCEWriter},
+	"itf":        {gozxing.BarcodeFormat_ITF, oned.NewITFWriter},
+	"datamatrix": {gozxing.BarcodeFormat_DATA_MATRIX, datamatrix.NewDataMatrixWriter},
+}
+
+// barcodeReaders lists the readers of the decoded formats, QR codes first.
+// Readers keep state while decoding, so they're created per image.
+var barcodeReaders = []func() gozxing.Reader{
+	gozxingqr.NewQRCodeReader,
+	func() gozxing.Reader { return datamatrix.NewDataMatrixReader() },
+	func() gozxing.Reader { return oned.NewMultiFormatUPCEANReader(nil) },
+	oned.NewCode128Reader,
+	oned.NewCode39Reader,
+	oned.NewCode93Reader,
+	oned.NewCodaBarReader,
+	oned.NewITFReader,
+}
+
+// qrRecoveryLevels maps the level param values to the error correction levels
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrController generates the QR code encoding the text param
+func qrController(o ServerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			ErrorReply(r, w, NewError("HTTP method not allowed. Try with a GET method", http.StatusMethodNotAllowed), o)
+			return
+		}
+
+		opts, err := buildParamsFromQuery(r.URL.Query())
+		if err != nil {
+			ErrorReply(r, w, paramsError(err), o)
+			return
+		}
+
+		outputType := bimg.PNG
+		if opts.Type != "" {
+			outputType = ImageType(opts.Type)
+		}
+		if outputType != bimg.UNKNOWN && !o.AllowedOutputTypes.Allows(outputType) {
+			ErrorReply(r, w, ErrOutputFormatDenied, o)
+			return
+		}
+
+		image, err := GenerateQR(opts.WithContext(r.Context()))
+		if err != nil {
+			if xerr, ok := err.(Error); ok {
+				ErrorReply(r, w, xerr, o)
+			} else {
+				ErrorReply(r, w, NewError("Error generating QR code: "+err.Error(), http.StatusBadRequest), o)
+			}
+			return
+		}
+
+		writeImageResponse(w, image, o)
+	}
+}
+
+// GenerateQR encodes the text param as QR code image, optionally with the
+// image param as logo at its center, or as the barcode of the barcode param
+func GenerateQR(o ImageOptions) (Image, error) {
+	if o.Text == "" {
+		return Image{}, NewMissingParamError("Missing required param: text", "text")
+	}
+
+	size := o.Width
+	if size == 0 {
+		size = defaultQRSize
+	}
+	if size < 0 || size > maxQRSize {
+		return Image{}, NewParamError(fmt.Sprintf("Invalid param: width must be between 1 and %d", maxQRSize), "width")
+	}
+
+	if o.Type != "" && ImageType(o.Type) == bimg.UNKNOWN {
+		return Image{}, ErrOutputFormat
+	}
+
+	var buf []byte
+	var err error
+	if name := strings.ToLower(o.Barcode); name != "" && name != "qr" {
+		buf, err = encodeBarcode(o, name, size)
+	} else {
+		buf, err = encodeQR(o, size)
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	if o.Type != "" && ImageType(o.Type) != bimg.PNG {
+		return Convert(buf, ImageOptions{Type: o.Type, Quality: o.Quality, Compression: o.Compression})
+	}
+	return Image{Body: buf, Mime: "image/png"}, nil
+}
+
+// encodeQR encodes the text param as QR code PNG image
+func encodeQR(o ImageOptions, size int) ([]byte, error) {
+	// Logos hide part of the code, use the highest error correction by default
+	name := strings.ToUpper(o.ECLevel)
+	if name == "" {
+		name = "M"
+		if o.Image != "" {
+			name = "H"
+		}
+	}
+	level, ok := qrRecoveryLevels[name]
+	if !ok {
+		return nil, NewParamError("Invalid param: level must be L, M, Q or H", "level")
+	}
+
+	code, err := qrcode.New(o.Text, level)
+	if err != nil {
+		return nil, NewError("Cannot encode QR code: "+err.Error(), http.StatusBadRequest)
+	}
+	if len(o.Color) >= 3 {
+		code.ForegroundColor = color.NRGBA{R: o.Color[0], G: o.Color[1], B: o.Color[2], A: 255}
+	}
+	if len(o.Background) >= 3 {
+		code.BackgroundColor = color.NRGBA{R: o.Background[0], G: o.Background[1], B: o.Background[2], A: 255}
+	}
+
+	buf, err := code.PNG(size)
+	if err != nil {
+		return nil, NewError("Cannot encode QR code image: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	if o.Image != "" {
+		return addQRLogo(buf, o)
+	}
+	return buf, nil
+}
+
+// encodeBarcode encodes the text param as the named barcode PNG image. Linear
+// barcodes are as high as half their width by default.
+func encodeBarcode(o ImageOptions, name string, size int) ([]byte, error) {
+	barcode, ok := barcodeFormats[name]
+	if !ok {
+		names := []string{"qr"}
+		for name := range barcodeFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, NewParamError("Invalid param: barcode must be one of: "+strings.Join(names, ", "), "barcode")
+	}
+	if o.Image != "" {
+		return nil, NewParamError("Invalid param: logos are only supported by QR codes", "image")
+	}
+
+	height := o.Height
+	if height == 0 {
+		height = size / 2
+	}
+	if barcode.format == gozxing.BarcodeFormat_DATA_MATRIX {
+		height = size
+	}
+	if height < 0 || height > maxQRSize {
+		return nil, NewParamError(fmt.Sprintf("Invalid param: height must be between 1 and %d", maxQRSize), "height")
+	}
+
+	matrix, err := barcode.writer().Encode(o.Text, barcode.format, size, height, nil)
+	if err != nil {
+		return nil, NewError("Cannot encode barcode: "+err.Error(), http.StatusBadRequest)
+	}
+
+	palette := color.Palette{color.NRGBA{R: 255, G: 255, B: 255, A: 255}, color.NRGBA{A: 255}}
+	if len(o.Background) >= 3 {
+		palette[0] = color.NRGBA{R: o.Background[0], G: o.Background[1], B: o.Background[2], A: 255}
+	}
+	if len(o.Color) >= 3 {
+		palette[1] = color.NRGBA{R: o.Color[0], G: o.Color[1], B: o.Color[2], A: 255}
+	}
+
+	img := image.NewPaletted(matrix.Bounds(), palette)
+	for y := 0; y < matrix.GetHeight(); y++ {
+		for x := 0; x < matrix.GetWidth(); x++ {
+			if matrix.Get(x, y) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, NewError("Cannot encode barcode image: "+err.Error(), http.StatusInternalServerError)
+	}
+	return buf.Bytes(), nil
+}
+
+// addQRLogo draws the logo image at the center of the QR code
+func addQRLogo(buf []byte, o ImageOptions) ([]byte, error) {
+	logo, err := watermarkImage(o)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return nil, err
+	}
+	logoSize, err := bimg.Size(logo)
+	if err != nil || logoSize.Width == 0 || logoSize.Height == 0 {
+		return nil, NewError("Unable to read watermark image", http.StatusBadRequest)
+	}
+
+	// Fit the logo in a square keeping its aspect ratio
+	box := int(float64(size.Width) * qrLogoRatio)
+	width, height := box, box
+	if logoSize.Width > logoSize.Height {
+		height = box * logoSize.Height / logoSize.Width
+	} else {
+		width = box * logoSize.Width / logoSize.Height
+	}
+	if width < 1 || height < 1 {
+		return nil, NewParamError("Invalid param: width is too small to add a logo", "width")
+	}
+
+	resized, err := Process(logo, bimg.Options{Width: width, Height: height, Force: true, Type: bimg.PNG})
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := Process(buf, bimg.Options{
+		Type: bimg.PNG,
+		WatermarkImage: bimg.WatermarkImage{
+			Buf:     resized.Body,
+			Left:    (size.Width - width) / 2,
+			Top:     (size.Height - height) / 2,
+			Opacity: 1,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return image.Body, nil
+}
+
+// decodeBarcode reads the first QR code or barcode found in the image, dark
+// on light or inverted
+func decodeBarcode(img image.Image) (Barcode, error) {
+	// UPC-A codes are read as EAN-13 codes, unless UPC-A is a possible format
+	formats := []gozxing.BarcodeFormat{gozxing.BarcodeFormat_QR_CODE}
+	for _, barcode := range barcodeFormats {
+		formats = append(formats, barcode.format)
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER:               true,
+		gozxing.DecodeHintType_POSSIBLE_FORMATS:         formats,
+		gozxing.DecodeHintType_RETURN_CODABAR_START_END: true,
+	}
+
+	source := gozxing.NewLuminanceSourceFromImage(img)
+	for _, src := range []gozxing.LuminanceSource{source, source.Invert()} {
+		bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(src))
+		if err != nil {
+			return Barcode{}, err
+		}
+
+		for _, reader := range barcodeReaders {
+			result, err := reader().Decode(bitmap, hints)
+			if err != nil {
+				continue
+			}
+
+			code := Barcode{Text: result.GetText(), Format: barcodeFormatName(result.GetBarcodeFormat())}
+			if level, ok := result.GetResultMetadata()[gozxing.ResultMetadataType_ERROR_CORRECTION_LEVEL].(string); ok {
+				code.Level = level
+			}
+			return code, nil
+		}
+	}
+	return Barcode{}, errBarcodeNotFound
+}
+
+// barcodeFormatName returns the barcode param value of the format
+func barcodeFormatName(format gozxing.BarcodeFormat) string {
+	for name, barcode := range barcodeFormats {
+		if barcode.format == format {
+			return name
+		}
+	}
+	if format == gozxing.BarcodeFormat_QR_CODE {
+		return "qr"
+	}
+	return strings.ToLower(format.String())
+}
+
+// DecodeQR reads the QR code or barcode of the image, returning its content
+// as JSON
+func DecodeQR(buf []byte, o ImageOptions) (Image, error) {
+	// Normalize the image as grayscale PNG readable by the standard library
+	opts := bimg.Options{Type: bimg.PNG, Interpretation: bimg.InterpretationBW}
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+	if size.Width > maxQRDecodeSize || size.Height > maxQRDecodeSize {
+		if size.Width > size.Height {
+			opts.Width = maxQRDecodeSize
+		} else {
+			opts.Height = maxQRDecodeSize
+		}
+	}
+
+	normalized, err := Process(buf, opts)
+	if err != nil {
+		return Image{}, err
+	}
+	img, err := png.Decode(bytes.NewReader(normalized.Body))
+	if err != nil {
+		return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+
+	code, err := decodeBarcode(img)
+	if err != nil {
+		return Image{}, NewError("No QR code or barcode found in the image", http.StatusBadRequest)
+	}
+
+	body, err := json.Marshal(code)
+	if err != nil {
+		return Image{}, NewError("Cannot encode barcode: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: "application/json"}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+func TestGenerateQR(t *testing.T) {
+	image, err := GenerateQR(ImageOptions{Text: "https://example.org", Width: 300, Color: []uint8{0, 0, 128}, Background: []uint8{255, 255, 224}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid content type: %s", image.Mime)
+	}
+
+	img, err := png.Decode(bytes.NewReader(image.Body))
+	if err != nil {
+		t.Fatalf("Cannot decode image: %s", err)
+	}
+	if img.Bounds().Dx() != 300 || img.Bounds().Dy() != 300 {
+		t.Errorf("Invalid image size: %v", img.Bounds())
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 224 {
+		t.Errorf("Invalid background color: %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+
+	code, err := decodeBarcode(img)
+	if err != nil || code.Text != "https://example.org" || code.Format != "qr" || code.Level != "M" {
+		t.Errorf("Invalid QR code: %v %+v", err, code)
+	}
+
+	// Custom error correction level
+	image, _ = GenerateQR(ImageOptions{Text: "hello", ECLevel: "q"})
+	img, _ = png.Decode(bytes.NewReader(image.Body))
+	if img.Bounds().Dx() != defaultQRSize {
+		t.Errorf("Invalid default size: %d", img.Bounds().Dx())
+	}
+	if code, err := decodeBarcode(img); err != nil || code.Level != "Q" {
+		t.Errorf("Invalid QR code level: %v %+v", err, code)
+	}
+}
+
+func TestGenerateBarcode(t *testing.T) {
+	cases := map[string]string{
+		"code128":    "imaginary-42",
+		"code39":     "IMAGINARY",
+		"code93":     "IMAGINARY",
+		"codabar":    "A40156B",
+		"ean8":       "96385074",
+		"ean13":      "5901234123457",
+		"upca":       "036000291452",
+		"upce":       "01234565",
+		"itf":        "1234567890",
+		"datamatrix": "https://example.org",
+	}
+
+	for name, text := range cases {
+		image, err := GenerateQR(ImageOptions{Text: text, Barcode: name, Width: 400})
+		if err != nil {
+			t.Errorf("%s: cannot generate barcode: %s", name, err)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(image.Body))
+		if err != nil {
+			t.Fatalf("%s: cannot decode image: %s", name, err)
+		}
+
+		code, err := decodeBarcode(img)
+		if err != nil || code.Text != text || code.Format != name || code.Level != "" {
+			t.Errorf("%s: invalid barcode: %v %+v", name, err, code)
+		}
+	}
+}
+
+func TestDecodeBarcodeInverted(t *testing.T) {
+	code, _ := qrcode.New("https://github.com/h2non/imaginary", qrcode.Medium)
+	code.ForegroundColor, code.BackgroundColor = color.White, color.Black
+
+	result, err := decodeBarcode(code.Image(300))
+	if err != nil || result.Text != "https://github.com/h2non/imaginary" {
+		t.Errorf("Cannot decode inverted QR code: %v %+v", err, result)
+	}
+
+	if _, err := decodeBarcode(image.NewGray(image.Rect(0, 0, 100, 100))); err == nil {
+		t.Error("Expected error without code")
+	}
+}
+
+func TestGenerateQRErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		opts ImageOptions
+	}{
+		{"missing text", ImageOptions{}},
+		{"invalid level", ImageOptions{Text: "hello", ECLevel: "X"}},
+		{"too large", ImageOptions{Text: "hello", Width: maxQRSize + 1}},
+		{"invalid type", ImageOptions{Text: "hello", Type: "foo"}},
+		{"text too long", ImageOptions{Text: string(make([]byte, 8000))}},
+		{"invalid barcode", ImageOptions{Text: "hello", Barcode: "pdf417"}},
+		{"invalid barcode text", ImageOptions{Text: "hello", Barcode: "ean13"}},
+		{"barcode logo", ImageOptions{Text: "hello", Barcode: "code128", Image: "http://localhost/logo.png"}},
+	}
+
+	for _, tc := range cases {
+		_, err := GenerateQR(tc.opts)
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestQRController(t *testing.T) {
+	ts := httptest.NewServer(NewServerMux(ServerOptions{PathPrefix: "/"}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/qr?text=imaginary&width=200")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Invalid response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	res.Body.Close()
+
+	res, _ = http.Get(ts.URL + "/qr?width=200")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Missing text should be rejected, got %d", res.StatusCode)
+	}
+	res.Body.Close()
+
+	res, _ = http.Post(ts.URL+"/qr?text=imaginary", "text/plain", nil)
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST requests should not be allowed, got %d", res.StatusCode)
+	}
+	res.Body.Close()
+}
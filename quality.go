@@ -0,0 +1,167 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/h2non/bimg"
+)
+
+const (
+	// autoQualityMin and autoQualityMax bound the quality search range
+	autoQualityMin = 30
+	autoQualityMax = 95
+
+	// defaultAutoQualityTarget is the default maximum DSSIM allowed by quality=auto
+	defaultAutoQualityTarget = 0.01
+
+	// ssimWindow defines the size of the SSIM comparison windows in pixels
+	ssimWindow = 8
+)
+
+// AutoQuality runs the operation and encodes its result with the lowest
+// quality whose structural dissimilarity (DSSIM) against a lossless
+// rendition of the same output stays below the configured target.
+func AutoQuality(operation Operation, buf []byte, o ImageOptions) (Image, error) {
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+
+	o.AutoQuality = false
+	if !isLossyImageType(outputType) {
+		return operation(buf, o)
+	}
+
+	// Render the transformation once in a lossless format used as reference
+	lossless := o
+	lossless.Type = "png"
+	reference, err := operation(buf, lossless)
+	if err != nil || reference.Mime != "image/png" {
+		return reference, err
+	}
+
+	target := o.QualityTarget
+	if target <= 0 {
+		target = defaultAutoQualityTarget
+	}
+
+	referenceRaster, err := decodeRaster(reference.Body, ImageOptions{NoRotation: true})
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts := bimg.Options{
+		Type:          outputType,
+		NoAutoRotate:  true,
+		StripMetadata: o.StripMetadata,
+		Interlace:     o.Interlace,
+		Speed:         o.EncoderSpeed(),
+	}
+
+	// Binary search the lowest quality meeting the target
+	var best Image
+	low, high := autoQualityMin, autoQualityMax
+	for low <= high {
+		if o.Context().Err() != nil {
+			return Image{}, ErrClientClosedRequest
+		}
+
+		opts.Quality = (low + high) / 2
+
+		candidate, err := Process(reference.Body, opts)
+		if err != nil {
+			return Image{}, err
+		}
+
+		candidateRaster, err := decodeRaster(candidate.Body, ImageOptions{NoRotation: true})
+		if err != nil {
+			return Image{}, err
+		}
+
+		if dssim(referenceRaster, candidateRaster) <= target {
+			best = candidate
+			high = opts.Quality - 1
+		} else {
+			low = opts.Quality + 1
+		}
+	}
+
+	if best.Body == nil {
+		opts.Quality = autoQualityMax
+		return Process(reference.Body, opts)
+	}
+
+	return best, nil
+}
+
+// isLossyImageType reports whether the quality param applies to the image type
+func isLossyImageType(t bimg.ImageType) bool {
+	switch t {
+	case bimg.JPEG, bimg.WEBP, bimg.HEIF, bimg.AVIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// dssim returns the structural dissimilarity between two rasters of the same
+// size, computed as 1/SSIM - 1 over the luma of non-overlapping windows.
+func dssim(a, b *image.NRGBA) float64 {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return math.Inf(1)
+	}
+
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	size := a.Bounds().Size()
+	minA, minB := a.Bounds().Min, b.Bounds().Min
+	var total float64
+	var windows int
+
+	for wy := 0; wy < size.Y; wy += ssimWindow {
+		for wx := 0; wx < size.X; wx += ssimWindow {
+			var sumA, sumB, sumAA, sumBB, sumAB, n float64
+			for y := wy; y < wy+ssimWindow && y < size.Y; y++ {
+				for x := wx; x < wx+ssimWindow && x < size.X; x++ {
+					la := luma(a.NRGBAAt(minA.X+x, minA.Y+y))
+					lb := luma(b.NRGBAAt(minB.X+x, minB.Y+y))
+					sumA += la
+					sumB += lb
+					sumAA += la * la
+					sumBB += lb * lb
+					sumAB += la * lb
+					n++
+				}
+			}
+
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covar := sumAB/n - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*covar + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+
+	if windows == 0 {
+		return 0
+	}
+
+	ssim := total / float64(windows)
+	if ssim <= 0 {
+		return math.Inf(1)
+	}
+	return 1/ssim - 1
+}
+
+// luma returns the Rec. 601 luma of the given color
+func luma(c color.NRGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
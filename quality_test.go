@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestDSSIM(t *testing.T) {
+	a := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	b := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			a.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+			b.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+
+	if d := dssim(a, b); d > epsilon {
+		t.Errorf("Identical images must have no dissimilarity: %f", d)
+	}
+
+	b.SetNRGBA(3, 3, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+	if d := dssim(a, b); d <= 0 {
+		t.Errorf("Different images must have dissimilarity: %f", d)
+	}
+
+	if d := dssim(a, image.NewNRGBA(image.Rect(0, 0, 8, 8))); d < 1 {
+		t.Errorf("Images with different sizes must not be similar: %f", d)
+	}
+}
+
+func TestIsLossyImageType(t *testing.T) {
+	if !isLossyImageType(bimg.JPEG) || !isLossyImageType(bimg.WEBP) {
+		t.Error("JPEG and WEBP must be lossy formats")
+	}
+	if isLossyImageType(bimg.PNG) {
+		t.Error("PNG must not be a lossy format")
+	}
+}
+
+func TestAutoQuality(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{Width: 300, Height: 300, AutoQuality: true}
+
+	img, err := Operation(Resize).Run(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", img.Mime)
+	}
+	if err := assertSize(img.Body, 300, 300); err != nil {
+		t.Error(err)
+	}
+}
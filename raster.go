@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+
+	"github.com/h2non/bimg"
+)
+
+// maxRasterPixels limits the size of the rasters allocated in memory
+const maxRasterPixels = 100 * 1000 * 1000
+
+// pngEncoder favours speed since raster buffers are only an intermediate step
+var pngEncoder = &png.Encoder{CompressionLevel: png.BestSpeed}
+
+// decodeRaster decodes the image buffer into an in-memory RGBA raster.
+// libvips performs the decoding (and EXIF auto rotation) through a lossless
+// PNG intermediate, so every input format supported by bimg can be used.
+func decodeRaster(buf []byte, o ImageOptions) (*image.NRGBA, error) {
+	pbuf, err := bimg.Resize(buf, bimg.Options{Type: bimg.PNG, NoAutoRotate: o.NoRotation})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	src, err := png.Decode(bytes.NewReader(pbuf))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	if img, ok := src.(*image.NRGBA); ok {
+		return img, nil
+	}
+
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+// encodeRaster encodes the raster back into the output image format.
+// The original buffer type is preserved unless a different one is requested.
+func encodeRaster(img image.Image, original []byte, o ImageOptions) (Image, error) {
+	var out bytes.Buffer
+	if err := pngEncoder.Encode(&out, img); err != nil {
+		return Image{}, fmt.Errorf("cannot encode image: %w", err)
+	}
+
+	opts := BimgOptions(o)
+	opts.Width = 0
+	opts.Height = 0
+	opts.GaussianBlur = bimg.GaussianBlur{}
+	if opts.Type == bimg.UNKNOWN {
+		opts.Type = bimg.DetermineImageType(original)
+	}
+
+	return Process(out.Bytes(), opts)
+}
+
+// affineMatrix represents a 2x3 affine transformation matrix:
+//
+//	x' = a*x + b*y + c
+//	y' = d*x + e*y + f
+type affineMatrix [6]float64
+
+// invert returns the inverse transformation, mapping output to input coordinates
+func (m affineMatrix) invert() (affineMatrix, error) {
+	det := m[0]*m[4] - m[1]*m[3]
+	if math.Abs(det) < 1e-12 {
+		return affineMatrix{}, errors.New("affine matrix is not invertible")
+	}
+
+	return affineMatrix{
+		m[4] / det, -m[1] / det, (m[1]*m[5] - m[4]*m[2]) / det,
+		-m[3] / det, m[0] / det, (m[3]*m[2] - m[0]*m[5]) / det,
+	}, nil
+}
+
+func (m affineMatrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[1]*y + m[2], m[3]*x + m[4]*y + m[5]
+}
+
+// homography represents a 3x3 projective transformation matrix with h[8] = 1
+type homography [9]float64
+
+func (h homography) apply(x, y float64) (float64, float64) {
+	w := h[6]*x + h[7]*y + h[8]
+	return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w
+}
+
+// newHomography computes the projective transformation mapping each of the
+// four src points to the matching dst point, solving the 8x8 linear system.
+func newHomography(src, dst [4][2]float64) (homography, error) {
+	var a [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y := src[i][0], src[i][1]
+		u, v := dst[i][0], dst[i][1]
+		a[i*2] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		a[i*2+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return homography{}, errors.New("corner points are degenerated")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			factor := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= factor * a[col][k]
+			}
+		}
+	}
+
+	var h homography
+	for i := 0; i < 8; i++ {
+		h[i] = a[i][8] / a[i][i]
+	}
+	h[8] = 1
+	return h, nil
+}
+
+// quadDimensions returns the output size preserving the longest edges of the
+// quadrilateral defined by the top-left, top-right, bottom-right and
+// bottom-left corners.
+func quadDimensions(quad [4][2]float64) (int, int) {
+	dist := func(a, b [2]float64) float64 {
+		return math.Hypot(a[0]-b[0], a[1]-b[1])
+	}
+
+	width := math.Max(dist(quad[0], quad[1]), dist(quad[3], quad[2]))
+	height := math.Max(dist(quad[0], quad[3]), dist(quad[1], quad[2]))
+	return int(math.Round(width)), int(math.Round(height))
+}
+
+// warpRaster builds a width x height raster sampling the source image through
+// the given output-to-input coordinates mapping. Pixels mapped outside of the
+// source bounds are filled with the background color.
+func warpRaster(src *image.NRGBA, width, height int, bg color.NRGBA, mapping func(x, y float64) (float64, float64)) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := mapping(float64(x)+0.5, float64(y)+0.5)
+			dst.SetNRGBA(x, y, sampleBilinear(src, sx-0.5, sy-0.5, bg))
+		}
+	}
+	return dst
+}
+
+// sampleBilinear returns the bilinear interpolated color at the given position
+func sampleBilinear(img *image.NRGBA, x, y float64, bg color.NRGBA) color.NRGBA {
+	b := img.Bounds()
+	if x < -1 || y < -1 || x > float64(b.Dx()) || y > float64(b.Dy()) || math.IsNaN(x) || math.IsNaN(y) {
+		return bg
+	}
+
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	pixel := func(px, py int) [4]float64 {
+		if px < 0 || py < 0 || px >= b.Dx() || py >= b.Dy() {
+			return [4]float64{float64(bg.R), float64(bg.G), float64(bg.B), float64(bg.A)}
+		}
+		c := img.NRGBAAt(b.Min.X+px, b.Min.Y+py)
+		return [4]float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+	}
+
+	p00, p10 := pixel(x0, y0), pixel(x0+1, y0)
+	p01, p11 := pixel(x0, y0+1), pixel(x0+1, y0+1)
+
+	var out [4]uint8
+	for i := range out {
+		top := p00[i]*(1-fx) + p10[i]*fx
+		bottom := p01[i]*(1-fx) + p11[i]*fx
+		out[i] = uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+	return color.NRGBA{R: out[0], G: out[1], B: out[2], A: out[3]}
+}
+
+// pixelateRaster replaces the pixels within the given area by the average
+// color of the size x size blocks they belong to.
+func pixelateRaster(img *image.NRGBA, area image.Rectangle, size int) {
+	area = area.Intersect(img.Bounds())
+	// Keep the block offsets from overflowing past the area
+	if size > area.Dx() && size > area.Dy() {
+		size = area.Dx()
+		if area.Dy() > size {
+			size = area.Dy()
+		}
+	}
+	if size <= 0 {
+		return
+	}
+	for by := area.Min.Y; by < area.Max.Y; by += size {
+		for bx := area.Min.X; bx < area.Max.X; bx += size {
+			block := image.Rect(bx, by, bx+size, by+size).Intersect(area)
+
+			var sum [4]int
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					c := img.NRGBAAt(x, y)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+					sum[3] += int(c.A)
+				}
+			}
+
+			n := block.Dx() * block.Dy()
+			if n == 0 {
+				continue
+			}
+			avg := color.NRGBA{
+				R: uint8(sum[0] / n),
+				G: uint8(sum[1] / n),
+				B: uint8(sum[2] / n),
+				A: uint8(sum[3] / n),
+			}
+			draw.Draw(img, block, &image.Uniform{C: avg}, image.Point{}, draw.Src)
+		}
+	}
+}
+
+// rasterLuma returns the luma of the pixel at the given Pix offset
+func rasterLuma(img *image.NRGBA, i int) int {
+	return (299*int(img.Pix[i]) + 587*int(img.Pix[i+1]) + 114*int(img.Pix[i+2]) + 500) / 1000
+}
+
+// lumaHistogram returns the luma histogram of the non transparent pixels
+func lumaHistogram(img *image.NRGBA) (hist [256]int, total int) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		hist[rasterLuma(img, i)]++
+		total++
+	}
+	return hist, total
+}
+
+// applyRasterLUT maps the color channels of every pixel through the lookup tables
+func applyRasterLUT(img *image.NRGBA, lut [3][256]uint8) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = lut[0][img.Pix[i]]
+		img.Pix[i+1] = lut[1][img.Pix[i+1]]
+		img.Pix[i+2] = lut[2][img.Pix[i+2]]
+	}
+}
+
+// whiteBalanceRaster removes the color cast assuming the average color of the
+// image is neutral gray (gray world), limiting the channel gains to 0.5-2x.
+func whiteBalanceRaster(img *image.NRGBA) {
+	var sum [3]float64
+	var n int
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			sum[c] += float64(img.Pix[i+c])
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	gray := (sum[0] + sum[1] + sum[2]) / 3
+	var lut [3][256]uint8
+	for c := 0; c < 3; c++ {
+		gain := 1.0
+		if sum[c] > 0 {
+			gain = math.Max(0.5, math.Min(2, gray/sum[c]))
+		}
+		for v := 0; v < 256; v++ {
+			lut[c][v] = uint8(math.Min(255, math.Round(float64(v)*gain)))
+		}
+	}
+	applyRasterLUT(img, lut)
+}
+
+// stretchContrastRaster stretches the luma range to the full 0-255 range,
+// ignoring the 0.5% darkest and brightest pixels (auto levels).
+func stretchContrastRaster(img *image.NRGBA) {
+	hist, total := lumaHistogram(img)
+	clip := total / 200
+
+	low, high := 0, 255
+	for count := 0; low < 255; low++ {
+		if count += hist[low]; count > clip {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		if count += hist[high]; count > clip {
+			break
+		}
+	}
+	if high <= low {
+		return
+	}
+
+	var lut [3][256]uint8
+	for v := 0; v < 256; v++ {
+		stretched := math.Round(float64(v-low) * 255 / float64(high-low))
+		lut[0][v] = uint8(math.Max(0, math.Min(255, stretched)))
+	}
+	lut[1], lut[2] = lut[0], lut[0]
+	applyRasterLUT(img, lut)
+}
+
+// equalizeRaster spreads the luma histogram uniformly over the 0-255 range,
+// scaling the color channels of each pixel to preserve its hue.
+func equalizeRaster(img *image.NRGBA) {
+	hist, total := lumaHistogram(img)
+
+	var cdf [256]int
+	cdfMin, count := 0, 0
+	for v := 0; v < 256; v++ {
+		count += hist[v]
+		cdf[v] = count
+		if cdfMin == 0 {
+			cdfMin = count
+		}
+	}
+	if total == cdfMin {
+		return
+	}
+
+	var mapping [256]float64
+	for v := 0; v < 256; v++ {
+		mapping[v] = math.Max(0, float64(cdf[v]-cdfMin)*255/float64(total-cdfMin))
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		luma := rasterLuma(img, i)
+		for c := 0; c < 3; c++ {
+			v := mapping[luma]
+			if luma > 0 {
+				v = float64(img.Pix[i+c]) * mapping[luma] / float64(luma)
+			}
+			img.Pix[i+c] = uint8(math.Min(255, math.Round(v)))
+		}
+	}
+}
+
+// sepiaRaster tones the image in sepia, using the sepia transformation matrix
+func sepiaRaster(img *image.NRGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+		img.Pix[i] = uint8(math.Min(255, math.Round(0.393*r+0.769*g+0.189*b)))
+		img.Pix[i+1] = uint8(math.Min(255, math.Round(0.349*r+0.686*g+0.168*b)))
+		img.Pix[i+2] = uint8(math.Min(255, math.Round(0.272*r+0.534*g+0.131*b)))
+	}
+}
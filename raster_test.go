@@ -0,0 +1,248 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestAffineMatrixInvert(t *testing.T) {
+	matrix := affineMatrix{2, 0.5, 10, -0.25, 1.5, -4}
+	inverse, err := matrix.invert()
+	if err != nil {
+		t.Fatalf("Cannot invert matrix: %s", err)
+	}
+
+	x, y := matrix.apply(12, 34)
+	x, y = inverse.apply(x, y)
+	if math.Abs(x-12) > epsilon || math.Abs(y-34) > epsilon {
+		t.Errorf("Invalid inverse transformation: %f,%f != 12,34", x, y)
+	}
+
+	if _, err := (affineMatrix{1, 2, 0, 2, 4, 0}).invert(); err == nil {
+		t.Error("Expected singular matrix to fail")
+	}
+}
+
+func TestNewHomography(t *testing.T) {
+	src := [4][2]float64{{0, 0}, {100, 0}, {100, 50}, {0, 50}}
+	dst := [4][2]float64{{10, 20}, {210, 5}, {190, 120}, {15, 100}}
+
+	h, err := newHomography(src, dst)
+	if err != nil {
+		t.Fatalf("Cannot compute homography: %s", err)
+	}
+
+	for i := range src {
+		x, y := h.apply(src[i][0], src[i][1])
+		if math.Abs(x-dst[i][0]) > epsilon || math.Abs(y-dst[i][1]) > epsilon {
+			t.Errorf("Invalid point mapping: %f,%f != %f,%f", x, y, dst[i][0], dst[i][1])
+		}
+	}
+
+	degenerated := [4][2]float64{{0, 0}, {0, 0}, {0, 0}, {0, 0}}
+	if _, err := newHomography(src, degenerated); err == nil {
+		t.Error("Expected degenerated points to fail")
+	}
+}
+
+func TestQuadDimensions(t *testing.T) {
+	width, height := quadDimensions([4][2]float64{{0, 0}, {300, 0}, {280, 400}, {10, 390}})
+	if width != 300 || height != 400 {
+		t.Errorf("Invalid dimensions: %dx%d", width, height)
+	}
+}
+
+func TestWarpRaster(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	src.SetNRGBA(1, 0, color.NRGBA{G: 255, A: 255})
+	src.SetNRGBA(0, 1, color.NRGBA{B: 255, A: 255})
+	src.SetNRGBA(1, 1, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+
+	// Horizontal mirror
+	inverse, _ := affineMatrix{-1, 0, 2, 0, 1, 0}.invert()
+	out := warpRaster(src, 2, 2, color.NRGBA{}, inverse.apply)
+
+	if c := out.NRGBAAt(0, 0); c != (color.NRGBA{G: 255, A: 255}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+	if c := out.NRGBAAt(1, 1); c != (color.NRGBA{B: 255, A: 255}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+}
+
+func TestImageTransform(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	t.Run("Points", func(t *testing.T) {
+		opts := ImageOptions{Points: []float64{10, 10, 510, 30, 500, 700, 20, 690}, Width: 300, Height: 400}
+		img, err := Transform(buf, opts)
+		if err != nil {
+			t.Fatalf("Cannot process image: %s", err)
+		}
+		if img.Mime != "image/jpeg" {
+			t.Error("Invalid image MIME type")
+		}
+		if err := assertSize(img.Body, 300, 400); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Matrix", func(t *testing.T) {
+		opts := ImageOptions{Matrix: []float64{1, 0.2, 0, 0, 1, 0}, Type: "png"}
+		img, err := Transform(buf, opts)
+		if err != nil {
+			t.Fatalf("Cannot process image: %s", err)
+		}
+		if img.Mime != "image/png" {
+			t.Error("Invalid image MIME type")
+		}
+		// The original image is 550x740
+		if err := assertSize(img.Body, 550, 740); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Invalid params", func(t *testing.T) {
+		if _, err := Transform(buf, ImageOptions{Matrix: []float64{1, 0}}); err == nil {
+			t.Error("Expected invalid matrix to fail")
+		}
+		// The output pixels overflow int
+		opts := ImageOptions{Matrix: []float64{1, 0, 0, 0, 1, 0}, Width: 1 << 32, Height: 1 << 32}
+		if _, err := Transform(buf, opts); err == nil {
+			t.Error("Expected overflowing output dimensions to fail")
+		}
+	})
+}
+
+func TestPixelateRaster(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 200, A: 255})
+	img.SetNRGBA(1, 1, color.NRGBA{R: 100, A: 255})
+	img.SetNRGBA(3, 3, color.NRGBA{B: 255, A: 255})
+
+	pixelateRaster(img, image.Rect(0, 0, 2, 2), 2)
+
+	expected := color.NRGBA{R: 75, A: 127}
+	for _, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		if c := img.NRGBAAt(p.X, p.Y); c != expected {
+			t.Errorf("Invalid pixel color at %v: %#v", p, c)
+		}
+	}
+
+	if c := img.NRGBAAt(3, 3); c != (color.NRGBA{B: 255, A: 255}) {
+		t.Errorf("Pixel outside of the area must not change: %#v", c)
+	}
+
+	// The block offsets would overflow without capping the block size
+	pixelateRaster(img, image.Rect(0, 0, 4, 4), int(^uint(0)>>1))
+	if c := img.NRGBAAt(3, 3); c != img.NRGBAAt(0, 0) {
+		t.Errorf("Invalid pixel color of the single block: %#v", c)
+	}
+	pixelateRaster(img, image.Rect(8, 8, 16, 16), 2)
+}
+
+func TestImagePixelate(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	opts := ImageOptions{BlockSize: 20, Regions: []Region{{Top: 10, Left: 10, Width: 200, Height: 100}}}
+	img, err := Pixelate(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Error("Invalid image MIME type")
+	}
+	// The original image is 550x740
+	if err := assertSize(img.Body, 550, 740); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Pixelate(buf, ImageOptions{Regions: []Region{{Width: 10}}}); err == nil {
+		t.Error("Expected invalid region to fail")
+	}
+}
+
+func TestStretchContrastRaster(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 50, G: 50, B: 50, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 100, G: 100, B: 100, A: 255})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 150, G: 150, B: 150, A: 255})
+
+	stretchContrastRaster(img)
+
+	for x, expected := range []uint8{0, 128, 255} {
+		if c := img.NRGBAAt(x, 0); c != (color.NRGBA{R: expected, G: expected, B: expected, A: 255}) {
+			t.Errorf("Invalid pixel color at %d: %#v", x, c)
+		}
+	}
+}
+
+func TestEqualizeRaster(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x, v := range []uint8{10, 10, 20, 30} {
+		img.SetNRGBA(x, 0, color.NRGBA{R: v, G: v, B: v, A: 255})
+	}
+
+	equalizeRaster(img)
+
+	for x, expected := range []uint8{0, 0, 128, 255} {
+		if c := img.NRGBAAt(x, 0); c.R != expected || c.G != expected || c.B != expected {
+			t.Errorf("Invalid pixel color at %d: %#v", x, c)
+		}
+	}
+}
+
+func TestWhiteBalanceRaster(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 120, G: 100, B: 80, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 240, G: 200, B: 160, A: 255})
+
+	whiteBalanceRaster(img)
+
+	// The yellow cast is removed, the gray average is preserved
+	if c := img.NRGBAAt(0, 0); c != (color.NRGBA{R: 100, G: 100, B: 100, A: 255}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+	if c := img.NRGBAAt(1, 0); c != (color.NRGBA{R: 200, G: 200, B: 200, A: 255}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+}
+
+func TestImageEnhance(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	img, err := Enhance(buf, ImageOptions{Method: EnhanceEqualize, WhiteBalance: true})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Error("Invalid image MIME type")
+	}
+	// The original image is 550x740
+	if err := assertSize(img.Body, 550, 740); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Enhance(buf, ImageOptions{Method: "sharpen"}); err == nil {
+		t.Error("Expected invalid method to fail")
+	}
+}
+
+func TestSepiaRaster(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 100, G: 100, B: 100, A: 128})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+
+	sepiaRaster(img)
+
+	if c := img.NRGBAAt(0, 0); c != (color.NRGBA{R: 135, G: 120, B: 94, A: 128}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+	if c := img.NRGBAAt(1, 0); c != (color.NRGBA{R: 255, G: 255, B: 239, A: 255}) {
+		t.Errorf("Invalid pixel color: %#v", c)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	d "runtime/debug"
+)
+
+// RequestIDHeader is the header identifying the request, forwarded by the
+// clients or generated, and replied back
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of the forwarded request IDs
+const maxRequestIDLength = 128
+
+// addRequestID identifies the request by the forwarded request ID, if valid,
+// or a random one, and replies it back to correlate the responses and logs
+func addRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isValidRequestID checks the request ID is printable ASCII of bounded length
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// recoverPanics recovers the panics of the handlers, logging the stack trace
+// along with the request ID, and replies the internal server error, or the
+// placeholder image. If the response was already started the connection is
+// aborted instead, as net/http does.
+func recoverPanics(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverResponseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("panic serving %s %s (request id %s): %v\n%s", r.Method, r.URL.RequestURI(), r.Header.Get(RequestIDHeader), err, d.Stack())
+			if rw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			ErrorReply(r, w, ErrInternalServer, o)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverResponseWriter tracks whether the response was started
+type recoverResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader records the response was started and forwards to ResponseWriter
+func (w *recoverResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the response was started and forwards to ResponseWriter
+func (w *recoverResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush forwards to ResponseWriter, if supported, allowing streaming responses
+func (w *recoverResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, used by http.ResponseController
+func (w *recoverResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	handler := addRequestID(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}), ServerOptions{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	req.Header.Set(RequestIDHeader, "foo-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Invalid status code: %d", w.Code)
+	}
+	var xerr Error
+	if err := json.Unmarshal(w.Body.Bytes(), &xerr); err != nil || xerr.Kind != "internal_server_error" {
+		t.Errorf("Invalid error body: %s", w.Body.String())
+	}
+	if id := w.Header().Get(RequestIDHeader); id != "foo-123" {
+		t.Errorf("Invalid request ID: %s", id)
+	}
+	if !strings.Contains(logs.String(), "panic serving GET /resize (request id foo-123): oops") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("Invalid panic log: %s", logs.String())
+	}
+}
+
+func TestRecoverPanicsStartedResponse(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("oops")
+	}), ServerOptions{})
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("Expected the handler to be aborted, got %v", err)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/resize", nil))
+}
+
+func TestAddRequestID(t *testing.T) {
+	cases := []struct {
+		id       string
+		expected bool
+	}{
+		{"foo-123", true},
+		{"", false},
+		{"foo bar", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tc := range cases {
+		var received string
+		handler := addRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Get(RequestIDHeader)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.id != "" {
+			req.Header.Set(RequestIDHeader, tc.id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		id := w.Header().Get(RequestIDHeader)
+		if id != received || (id == tc.id) != tc.expected || id == "" {
+			t.Errorf("Invalid request ID for %q: %q", tc.id, id)
+		}
+	}
+}
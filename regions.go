@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// maxExtractRegions limits the number of regions extracted per request
+const maxExtractRegions = 50
+
+// ExtractRegions extracts every region of the image, such as the photos of a
+// scanned sheet, bundled as ZIP archive (default) or multipart body. The
+// image is decoded once, the regions being cut out of the same raster.
+func ExtractRegions(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Regions) > maxExtractRegions {
+		return Image{}, NewParamError(fmt.Sprintf("Maximum extract regions (%d) exceeded", maxExtractRegions), "regions")
+	}
+	if o.Output == SrcsetOutputJSON || o.Output == PictureOutputHTML {
+		return Image{}, NewParamError("Unsupported extract regions output: "+o.Output, "output")
+	}
+
+	if width, height, ok := imageDimensions(buf); ok && height > 0 && width > maxRasterPixels/height {
+		return Image{}, NewError("Image is too big to extract regions", http.StatusRequestEntityTooLarge)
+	}
+
+	img, err := decodeRaster(buf, o)
+	if err != nil {
+		return Image{}, NewError(err.Error(), http.StatusBadRequest)
+	}
+
+	names := make([]string, len(o.Regions))
+	results := make([]Image, len(o.Regions))
+	for i, region := range o.Regions {
+		if region.Width <= 0 || region.Height <= 0 {
+			return Image{}, NewParamError("Invalid region: width and height are required", "regions")
+		}
+		area := region.Rect().Intersect(img.Bounds())
+		if area.Empty() {
+			return Image{}, NewParamError(fmt.Sprintf("Invalid region %d: out of the image bounds", i+1), "regions")
+		}
+
+		if results[i], err = encodeRaster(img.SubImage(area).(*image.NRGBA), buf, o); err != nil {
+			return Image{}, fmt.Errorf("extract region %d failed: %w", i+1, err)
+		}
+		names[i] = fmt.Sprintf("region-%d", i+1)
+	}
+
+	if o.Output == PipelineOutputMultipart {
+		return multipartBranches(names, results, o)
+	}
+	return zipBranches(names, results, o)
+}
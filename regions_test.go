@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestExtractRegions(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	opts := ImageOptions{Regions: []Region{
+		{Top: 10, Left: 10, Width: 100, Height: 50},
+		{Top: 200, Left: 300, Width: 400, Height: 100},
+	}}
+	img, err := Extract(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot extract regions: %s", err)
+	}
+	if img.Mime != "application/zip" {
+		t.Fatalf("Invalid MIME type: %s", img.Mime)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(img.Body), int64(len(img.Body)))
+	if err != nil {
+		t.Fatalf("Cannot read ZIP archive: %s", err)
+	}
+	if len(archive.File) != 2 || archive.File[0].Name != "region-1.jpeg" {
+		t.Fatalf("Invalid ZIP archive files: %+v", archive.File)
+	}
+
+	file, _ := archive.File[1].Open()
+	region, _ := ioutil.ReadAll(file)
+	// The second region is clipped to the 550px wide image
+	if err := assertSize(region, 250, 100); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtractRegionsLimit(t *testing.T) {
+	opts := ImageOptions{Regions: make([]Region, maxExtractRegions+1)}
+	if _, err := Extract([]byte("image"), opts); err == nil {
+		t.Error("Expected error exceeding the maximum regions")
+	}
+
+	// The pixels of the 4294967295x4294967295 PNG header overflow int
+	buf := append(append([]byte{}, pngSignature...), 0, 0, 0, 13, 'I', 'H', 'D', 'R', 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	_, err := ExtractRegions(buf, ImageOptions{Regions: []Region{{Width: 10, Height: 10}}})
+	if e, ok := err.(Error); !ok || e.HTTPCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected too big image error, got: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// defaultRemoteOperationTimeout is the default remote operation request timeout
+const defaultRemoteOperationTimeout = 30 * time.Second
+
+// RemoteOperation delegates an image transformation, such as background
+// removal with a ML model, to an external HTTP service. The service receives
+// the image as POST payload and replies with the transformed image.
+type RemoteOperation struct {
+	Name   string
+	URL    *url.URL
+	client *http.Client
+}
+
+// NewRemoteOperation creates a new remote HTTP operation
+func NewRemoteOperation(name string, endpoint *url.URL, timeout time.Duration) *RemoteOperation {
+	return &RemoteOperation{
+		Name:   name,
+		URL:    endpoint,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// RegisterRemoteOperation makes the remote operation available as pipeline
+// operation. Built-in operations cannot be replaced.
+func RegisterRemoteOperation(op *RemoteOperation) error {
+	if _, exists := OperationsMap[op.Name]; exists {
+		return fmt.Errorf("operation already exists: %s", op.Name)
+	}
+	OperationsMap[op.Name] = op.Run
+	return nil
+}
+
+// Run sends the image to the remote service, converting the returned image
+// into the requested output type, if any
+func (op *RemoteOperation) Run(buf []byte, o ImageOptions) (Image, error) {
+	req, _ := http.NewRequestWithContext(o.Context(), http.MethodPost, op.URL.String(), bytes.NewReader(buf))
+	req.Header.Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := op.client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return Image{}, NewError(fmt.Sprintf("Remote operation %s timed out", op.Name), http.StatusGatewayTimeout)
+		}
+		return Image{}, NewError(fmt.Sprintf("Remote operation %s failed: %s", op.Name, err), http.StatusBadGateway)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Image{}, NewError(fmt.Sprintf("Remote operation %s failed: (status=%d)", op.Name, res.StatusCode), http.StatusBadGateway)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxMemory+1))
+	if err != nil {
+		return Image{}, NewError(fmt.Sprintf("Remote operation %s failed: %s", op.Name, err), http.StatusBadGateway)
+	}
+	if len(body) > maxMemory {
+		return Image{}, NewError(fmt.Sprintf("Remote operation %s response is too large", op.Name), http.StatusBadGateway)
+	}
+
+	imageType := bimg.DetermineImageType(body)
+	if imageType == bimg.UNKNOWN || !bimg.IsImageTypeSupportedByVips(imageType).Load {
+		return Image{}, NewError(fmt.Sprintf("Remote operation %s returned an unsupported image", op.Name), http.StatusBadGateway)
+	}
+
+	if o.Type != "" && ImageType(o.Type) != imageType {
+		return Convert(body, o)
+	}
+	return Image{Body: body, Mime: GetImageMimeType(imageType)}, nil
+}
+
+// parseRemoteOperations parses the comma separated name=url entries
+func parseRemoteOperations(input string, timeout time.Duration) ([]*RemoteOperation, error) {
+	var operations []*RemoteOperation
+	for _, entry := range strings.Split(input, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid remote operation entry: %s", entry)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid remote operation URL: %s", parts[1])
+		}
+		operations = append(operations, NewRemoteOperation(parts[0], u, timeout))
+	}
+	return operations, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRemoteOperation(t *testing.T) {
+	input := readTestFile(t, "imaginary.jpg")
+	output := generatePlaceholderPNG(t, 10, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "image/jpeg" || !bytes.Equal(body, input) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(output)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	op := NewRemoteOperation("removebg", u, time.Second)
+
+	image, err := op.Run(input, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if image.Mime != "image/png" || !bytes.Equal(image.Body, output) {
+		t.Errorf("Invalid remote operation result: %s", image.Mime)
+	}
+
+	// Same output type, no conversion required
+	if _, err := op.Run(input, ImageOptions{Type: "png"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestRemoteOperationErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"error status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusBadGateway},
+		{"not an image", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("not an image"))
+		}, http.StatusBadGateway},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}, http.StatusGatewayTimeout},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(tc.handler)
+		u, _ := url.Parse(ts.URL)
+		op := NewRemoteOperation("removebg", u, 50*time.Millisecond)
+
+		_, err := op.Run(readTestFile(t, "imaginary.jpg"), ImageOptions{})
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != tc.status {
+			t.Errorf("%s: expected %d error, got %v", tc.name, tc.status, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestRegisterRemoteOperation(t *testing.T) {
+	operations, err := parseRemoteOperations("removebg=http://localhost:9000/removebg, denoise=https://ml.example.org/denoise", time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(operations) != 2 || operations[1].Name != "denoise" || operations[1].URL.Host != "ml.example.org" {
+		t.Fatalf("Invalid remote operations: %v", operations)
+	}
+
+	if err := RegisterRemoteOperation(operations[0]); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer delete(OperationsMap, "removebg")
+	if _, ok := OperationsMap["removebg"]; !ok {
+		t.Error("Remote operation should be available as pipeline operation")
+	}
+
+	if err := RegisterRemoteOperation(NewRemoteOperation("resize", operations[0].URL, time.Second)); err == nil {
+		t.Error("Built-in operations should not be replaced")
+	}
+
+	for _, input := range []string{"removebg", "=http://localhost", "removebg=localhost:9000", "removebg=ftp://localhost/removebg"} {
+		if _, err := parseRemoteOperations(input, time.Second); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
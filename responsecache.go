@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// refreshingResponses holds the keys of the cached responses being refreshed
+// in background, refreshed once at a time
+var refreshingResponses sync.Map
+
+// refreshContextKey is the request context key of the internal requests
+// refreshing the cached responses, served and cached again even if fresh
+type refreshContextKey struct{}
+
+// responseCacheKey returns the disk cache key of the response to the remote
+// image request, if the responses are cached: the digest of the request host,
+// path and params, except the signature, the request headers the response
+// varies on, and the size limits, which depend on the API key. Unlike the
+// transformed images keys, the source image isn't part of the key, so the
+// cached responses are served without fetching it.
+func responseCacheKey(r *http.Request, sourceType ImageSourceType, o ServerOptions) (string, bool) {
+	if o.Cache == nil || o.CacheTTL <= 0 || sourceType != ImageSourceTypeHTTP || r.Method != http.MethodGet {
+		return "", false
+	}
+	query := r.URL.Query()
+	if _, ok := query["debug"]; ok {
+		return "", false
+	}
+	query.Del("sign")
+
+	h := sha256.New()
+	h.Write([]byte("response\n" + r.Host + "\n" + r.URL.Path + "\n" + query.Encode()))
+	for _, name := range varyHeaders(r, o) {
+		h.Write([]byte("\n" + name + ": " + r.Header.Get(name)))
+	}
+	fmt.Fprintf(h, "\nlimits: %d %g", o.MaxAllowedSize, o.MaxAllowedPixels)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// serveCachedResponse replies the cached response of the key during the cache
+// TTL. Once expired, it's still replied during the stale TTL, while refreshed
+// in background, so slow origins don't delay the responses. Missing or too
+// old responses, or refreshed ones, are served and cached.
+func serveCachedResponse(w http.ResponseWriter, r *http.Request, key string, serve http.HandlerFunc, o ServerOptions) {
+	ttl := time.Duration(o.CacheTTL) * time.Second
+	staleTTL := time.Duration(o.CacheStaleTTL) * time.Second
+
+	image, stored, ok := o.Cache.Entry(key)
+	if refresh, _ := r.Context().Value(refreshContextKey{}).(bool); refresh {
+		ok = false
+	}
+	age := time.Since(stored)
+	switch {
+	case ok && age < ttl:
+		w.Header().Set(CacheStatusHeader, "HIT")
+		writeCachedResponse(w, r, image, age, o)
+	case ok && age < ttl+staleTTL:
+		w.Header().Set(CacheStatusHeader, "STALE")
+		writeCachedResponse(w, r, image, age, o)
+		refreshResponse(r, key, serve, o)
+	default:
+		buf := newResponseBuffer()
+		serve(buf, r)
+		cacheResponse(key, buf, o)
+		buf.flush(w)
+	}
+}
+
+// writeCachedResponse replies the cached response, along with its age
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, image Image, age time.Duration, o ServerOptions) {
+	setNegotiationHeaders(w, r, o)
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	writeImageResponse(w, image, o)
+}
+
+// refreshResponse serves the request again in background, caching the
+// response, unless the response is already being refreshed. The request
+// context values are kept, but not its cancellation.
+func refreshResponse(r *http.Request, key string, serve http.HandlerFunc, o ServerOptions) {
+	if _, refreshing := refreshingResponses.LoadOrStore(key, true); refreshing {
+		return
+	}
+
+	r = r.Clone(detachedContext{r.Context()})
+	r.Header.Del(JobIDHeader)
+	go func() {
+		defer refreshingResponses.Delete(key)
+		buf := newResponseBuffer()
+		serve(buf, r)
+		cacheResponse(key, buf, o)
+	}()
+}
+
+// cacheResponse stores the successful buffered response. Placeholders, even
+// if replied with -placeholder-status 200, aren't cached.
+func cacheResponse(key string, buf *responseBuffer, o ServerOptions) {
+	if buf.status != http.StatusOK || buf.header.Get("Error") != "" {
+		return
+	}
+	image := Image{Body: buf.body.Bytes(), Mime: buf.header.Get("Content-Type")}
+	if err := o.Cache.Put(key, image); err != nil {
+		log.Printf("cannot write the disk cache: %s", err)
+	}
+}
+
+// detachedContext keeps the values of the parent context, but is never
+// cancelled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// responseBuffer buffers the response to be cached before replying it
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// flush replies the buffered response
+func (b *responseBuffer) flush(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
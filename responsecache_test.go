@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storeCachedResponse writes the cache entry as stored at the given time
+func storeCachedResponse(t *testing.T, cache *DiskCache, key string, body string, stored time.Time) {
+	meta, _ := json.Marshal(diskCacheMeta{Mime: "image/webp", Stored: stored})
+	path := cache.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(append(meta, '\n'), body...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeCachedResponse(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{Cache: cache, CacheTTL: 60, CacheStaleTTL: 600}
+
+	var served int32
+	refreshed := make(chan struct{}, 1)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Err() != nil {
+			t.Error("Refresh must not be cancelled with the request")
+		}
+		atomic.AddInt32(&served, 1)
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write([]byte("fresh"))
+		select {
+		case refreshed <- struct{}{}:
+		default:
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/resize?url=http://origin/image.jpg&width=100", nil)
+	key, ok := responseCacheKey(r, ImageSourceTypeHTTP, o)
+	if !ok {
+		t.Fatal("Remote image responses must be cached")
+	}
+
+	// Missing responses are served and cached
+	w := httptest.NewRecorder()
+	serveCachedResponse(w, r, key, serve, o)
+	<-refreshed
+	if w.Body.String() != "fresh" || atomic.LoadInt32(&served) != 1 {
+		t.Fatalf("Invalid response: %s", w.Body.String())
+	}
+
+	// Fresh responses are replied without serving the request
+	w = httptest.NewRecorder()
+	serveCachedResponse(w, r, key, serve, o)
+	if w.Body.String() != "fresh" || w.Header().Get(CacheStatusHeader) != "HIT" || atomic.LoadInt32(&served) != 1 {
+		t.Fatalf("Invalid cached response: %s %v", w.Body.String(), w.Header())
+	}
+
+	// Stale responses are replied, and refreshed in background
+	storeCachedResponse(t, cache, key, "stale", time.Now().Add(-5*time.Minute))
+	w = httptest.NewRecorder()
+	serveCachedResponse(w, r, key, serve, o)
+	if w.Body.String() != "stale" || w.Header().Get(CacheStatusHeader) != "STALE" || w.Header().Get("Age") != "300" {
+		t.Fatalf("Invalid stale response: %s %v", w.Body.String(), w.Header())
+	}
+	<-refreshed
+	for i := 0; i < 100; i++ {
+		if _, ok := refreshingResponses.Load(key); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if image, _, _ := cache.Entry(key); string(image.Body) != "fresh" {
+		t.Errorf("Stale response not refreshed: %s", image.Body)
+	}
+
+	// Responses older than the stale TTL are served again
+	storeCachedResponse(t, cache, key, "expired", time.Now().Add(-time.Hour))
+	w = httptest.NewRecorder()
+	serveCachedResponse(w, r, key, serve, o)
+	<-refreshed
+	if w.Body.String() != "fresh" || atomic.LoadInt32(&served) != 3 {
+		t.Errorf("Invalid response: %s", w.Body.String())
+	}
+}
+
+func TestServeCachedResponseErrors(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{Cache: cache, CacheTTL: 60}
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		ErrorReply(r, w, ErrImageNotFound, o)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/resize?url=http://origin/image.jpg", nil)
+	key, _ := responseCacheKey(r, ImageSourceTypeHTTP, o)
+
+	w := httptest.NewRecorder()
+	serveCachedResponse(w, r, key, serve, o)
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Invalid error response: %d %v", w.Code, w.Header())
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Error("Error responses must not be cached")
+	}
+
+	// Placeholders replied via -placeholder-status 200 aren't cached either
+	placeholder := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Error", string(ErrImageNotFound.JSON()))
+		w.Write([]byte("placeholder"))
+	}
+	w = httptest.NewRecorder()
+	serveCachedResponse(w, r, key, placeholder, o)
+	if w.Code != http.StatusOK || w.Body.String() != "placeholder" {
+		t.Errorf("Invalid placeholder response: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Error("Placeholder responses must not be cached")
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	cache := &DiskCache{}
+	o := ServerOptions{Cache: cache, CacheTTL: 60}
+	request := func(method, target string) *http.Request {
+		return httptest.NewRequest(method, target, nil)
+	}
+
+	base, ok := responseCacheKey(request(http.MethodGet, "/resize?url=http://origin/a.jpg&width=100&sign=abc"), ImageSourceTypeHTTP, o)
+	if !ok {
+		t.Fatal("Remote image responses must be cached")
+	}
+	if key, _ := responseCacheKey(request(http.MethodGet, "/resize?width=100&url=http://origin/a.jpg"), ImageSourceTypeHTTP, o); key != base {
+		t.Error("Key must not depend on the params order nor the signature")
+	}
+	if key, _ := responseCacheKey(request(http.MethodGet, "/resize?url=http://origin/b.jpg&width=100"), ImageSourceTypeHTTP, o); key == base {
+		t.Error("Key must depend on the source image URL")
+	}
+	limited := APIKeyLimits{MaxAllowedSize: 1048576, MaxAllowedPixels: 1}.Apply(o)
+	if key, _ := responseCacheKey(request(http.MethodGet, "/resize?url=http://origin/a.jpg&width=100"), ImageSourceTypeHTTP, limited); key == base {
+		t.Error("Key must depend on the API key limits")
+	}
+
+	cases := []struct {
+		name       string
+		r          *http.Request
+		sourceType ImageSourceType
+		o          ServerOptions
+	}{
+		{"mount source", request(http.MethodGet, "/resize?file=a.jpg"), ImageSourceTypeFileSystem, o},
+		{"uploaded image", request(http.MethodPost, "/resize"), ImageSourceTypeBody, o},
+		{"debug", request(http.MethodGet, "/pipeline?url=http://origin/a.jpg&debug=true"), ImageSourceTypeHTTP, o},
+		{"without TTL", request(http.MethodGet, "/resize?url=http://origin/a.jpg"), ImageSourceTypeHTTP, ServerOptions{Cache: cache}},
+		{"without cache", request(http.MethodGet, "/resize?url=http://origin/a.jpg"), ImageSourceTypeHTTP, ServerOptions{CacheTTL: 60}},
+	}
+	for _, c := range cases {
+		if _, ok := responseCacheKey(c.r, c.sourceType, c.o); ok {
+			t.Errorf("%s: unexpected cached response", c.name)
+		}
+	}
+}
+
+func TestGetCacheControl(t *testing.T) {
+	cases := []struct {
+		ttl, staleTTL int
+		expected      string
+	}{
+		{0, 0, "private, no-cache, no-store, must-revalidate"},
+		{0, 600, "private, no-cache, no-store, must-revalidate"},
+		{300, 0, "public, s-maxage=300, max-age=300, no-transform"},
+		{300, 600, "public, s-maxage=300, max-age=300, stale-while-revalidate=600, no-transform"},
+	}
+	for _, c := range cases {
+		if value := getCacheControl(c.ttl, c.staleTTL); value != c.expected {
+			t.Errorf("Invalid Cache-Control: %s != %s", value, c.expected)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// anyRoute is the route name of the middleware applied to every route,
+// unless overridden by the route itself
+const anyRoute = "*"
+
+// coreRoutes lists the routes other than the image endpoints
+var coreRoutes = []string{"/", "/form", "/health", "/health/live", "/health/ready", "/progress", "/files", "/usage", "/prefetch", "/qr"}
+
+// RouteMiddleware enables or disables the middleware of a route. Enabled
+// middleware keep the server flags configuration, and undefined values fall
+// back to the "*" route, if any, or else are enabled.
+type RouteMiddleware struct {
+	Auth      *bool `json:"auth"`
+	Signature *bool `json:"signature"`
+	Throttle  *bool `json:"throttle"`
+	CORS      *bool `json:"cors"`
+	Cache     *bool `json:"cache"`
+}
+
+// RouteMiddlewares maps the routes, e.g: /pipeline, to their middleware
+type RouteMiddlewares map[string]RouteMiddleware
+
+// ReadRouteMiddlewares reads the middleware per route from a JSON file. The
+// auth of /files can't be disabled while it lists or writes the mount files.
+func ReadRouteMiddlewares(path string, o ServerOptions) (RouteMiddlewares, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes RouteMiddlewares
+	if err := json.Unmarshal(buf, &routes); err != nil {
+		return nil, fmt.Errorf("invalid routes file: %w", err)
+	}
+
+	for route := range routes {
+		if !isKnownRoute(route) {
+			return nil, fmt.Errorf("invalid routes file: unknown route %q", route)
+		}
+	}
+
+	auth := routes.enabled("/files", func(r RouteMiddleware) *bool { return r.Auth })
+	if !auth && (o.EnableFileListing || o.EnableMountWrites) {
+		return nil, fmt.Errorf("invalid routes file: the /files auth is required by -enable-file-listing and -enable-mount-writes")
+	}
+	return routes, nil
+}
+
+// isKnownRoute checks if the route is served, or is the "*" route
+func isKnownRoute(route string) bool {
+	if _, ok := imageEndpoints[route]; ok || route == anyRoute {
+		return true
+	}
+	for _, name := range coreRoutes {
+		if route == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the server options of the route, without the options of
+// its disabled middleware
+func (m RouteMiddlewares) Apply(route string, o ServerOptions) ServerOptions {
+	if len(m) == 0 {
+		return o
+	}
+
+	if !m.enabled(route, func(r RouteMiddleware) *bool { return r.Auth }) {
+		o.APIKey = ""
+		o.APIKeys = nil
+		o.Auth = nil
+	}
+	if !m.enabled(route, func(r RouteMiddleware) *bool { return r.Signature }) {
+		o.EnableURLSignature = false
+		o.BodySignatureKey = ""
+	}
+	if !m.enabled(route, func(r RouteMiddleware) *bool { return r.Throttle }) {
+		o.Concurrency = 0
+	}
+	if !m.enabled(route, func(r RouteMiddleware) *bool { return r.CORS }) {
+		o.CORS = false
+	}
+	if !m.enabled(route, func(r RouteMiddleware) *bool { return r.Cache }) {
+		o.HTTPCacheTTL = -1
+	}
+	return o
+}
+
+// enabled checks if the middleware field is enabled for the route, or else
+// for every route
+func (m RouteMiddlewares) enabled(route string, field func(RouteMiddleware) *bool) bool {
+	for _, name := range []string{route, anyRoute} {
+		if enabled := field(m[name]); enabled != nil {
+			return *enabled
+		}
+	}
+	return true
+}
+
+// withMiddleware returns the route handler of the controller wrapped in the
+// common middleware chain
+func withMiddleware(controller func(ServerOptions) http.HandlerFunc) func(ServerOptions) http.Handler {
+	return func(o ServerOptions) http.Handler {
+		return Middleware(controller(o), o)
+	}
+}
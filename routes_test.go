@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadRouteMiddlewares(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "routes.json")
+	_ = os.WriteFile(file, []byte(`{"*": {"auth": false}, "/pipeline": {"auth": true, "cache": false}}`), 0600)
+	routes, err := ReadRouteMiddlewares(file, ServerOptions{})
+	if err != nil {
+		t.Fatalf("Cannot read routes: %s", err)
+	}
+	if len(routes) != 2 || routes["/pipeline"].Auth == nil || !*routes["/pipeline"].Auth || routes["/pipeline"].Signature != nil {
+		t.Errorf("Invalid routes: %+v", routes)
+	}
+
+	for _, input := range []string{`{"pipeline": {}}`, `{"/foo": {}}`, `{"/info": {"auth": "no"}}`} {
+		invalid := path.Join(dir, "invalid.json")
+		_ = os.WriteFile(invalid, []byte(input), 0600)
+		if _, err := ReadRouteMiddlewares(invalid, ServerOptions{}); err == nil {
+			t.Errorf("Expected error for routes %s", input)
+		}
+	}
+
+	for _, o := range []ServerOptions{{EnableFileListing: true}, {EnableMountWrites: true}} {
+		for _, input := range []string{`{"/files": {"auth": false}}`, `{"*": {"auth": false}}`} {
+			_ = os.WriteFile(file, []byte(input), 0600)
+			if _, err := ReadRouteMiddlewares(file, o); err == nil {
+				t.Errorf("Expected error for routes %s with options %+v", input, o)
+			}
+		}
+	}
+	_ = os.WriteFile(file, []byte(`{"*": {"auth": false}, "/files": {"auth": true}}`), 0600)
+	if _, err := ReadRouteMiddlewares(file, ServerOptions{EnableMountWrites: true}); err != nil {
+		t.Errorf("Cannot read routes requiring the /files auth: %s", err)
+	}
+}
+
+func TestRouteMiddlewaresApply(t *testing.T) {
+	disabled, enabled := false, true
+	routes := RouteMiddlewares{
+		"*":         {Auth: &disabled, Cache: &disabled},
+		"/pipeline": {Auth: &enabled},
+		"/info":     {Signature: &disabled, Throttle: &disabled},
+	}
+	o := ServerOptions{APIKey: "secret", EnableURLSignature: true, Concurrency: 10, CORS: true, HTTPCacheTTL: 60}
+
+	if opts := routes.Apply("/pipeline", o); opts.APIKey != "secret" || !opts.EnableURLSignature || opts.HTTPCacheTTL != -1 {
+		t.Errorf("Invalid /pipeline options: %+v", opts)
+	}
+	if opts := routes.Apply("/info", o); opts.APIKey != "" || opts.EnableURLSignature || opts.Concurrency != 0 || !opts.CORS {
+		t.Errorf("Invalid /info options: %+v", opts)
+	}
+	if opts := RouteMiddlewares(nil).Apply("/info", o); opts.APIKey != "secret" || opts.HTTPCacheTTL != 60 {
+		t.Errorf("Invalid options without routes: %+v", opts)
+	}
+}
+
+func TestRouteMiddlewaresAuth(t *testing.T) {
+	disabled, enabled := false, true
+	o := ServerOptions{
+		PathPrefix: "/",
+		APIKey:     "secret",
+		Routes:     RouteMiddlewares{"*": {Auth: &disabled}, "/pipeline": {Auth: &enabled}},
+	}
+	ts := httptest.NewServer(NewServerMux(o))
+	defer ts.Close()
+
+	cases := []struct {
+		method string
+		route  string
+		status int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/health/live", http.StatusOK},
+		{http.MethodPost, "/pipeline", http.StatusUnauthorized},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest(test.method, ts.URL+test.route, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %s", test.route, res.Status)
+		}
+	}
+}
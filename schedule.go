@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// scheduleSourceTimeout is the timeout of the requests checking if the
+// scheduled prefetch sources changed
+const scheduleSourceTimeout = 30 * time.Second
+
+// ScheduledJob is a job run periodically, as defined by its cron expression:
+// either a prefetch, re-generating the renditions of the changed sources, or
+// a cleanup of the expired disk cache entries and output files
+type ScheduledJob struct {
+	Name     string             `json:"name"`
+	Schedule string             `json:"schedule"`
+	Prefetch *ScheduledPrefetch `json:"prefetch"`
+	Cleanup  *ScheduledCleanup  `json:"cleanup"`
+
+	cron       CronSchedule
+	validators map[string]string
+}
+
+// ScheduledPrefetch is a prefetch request, as the /prefetch endpoint ones,
+// served with the given Host header, so the responses are cached as the
+// clients requests of that host
+type ScheduledPrefetch struct {
+	PrefetchRequest
+	Host string `json:"host"`
+}
+
+// ScheduledCleanup removes the disk cache entries, and the files under the
+// directory, if any, older than the maximum age, e.g: 720h
+type ScheduledCleanup struct {
+	Cache  bool   `json:"cache"`
+	Dir    string `json:"dir"`
+	MaxAge string `json:"max_age"`
+
+	maxAge time.Duration
+}
+
+// ReadSchedules reads the scheduled jobs from a JSON file, validated against
+// the server options
+func ReadSchedules(path string, o ServerOptions) ([]*ScheduledJob, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*ScheduledJob
+	if err := json.Unmarshal(buf, &jobs); err != nil {
+		return nil, fmt.Errorf("invalid schedules file: %w", err)
+	}
+	for _, job := range jobs {
+		if err := job.validate(o); err != nil {
+			return nil, fmt.Errorf("invalid schedules file: job %q: %w", job.Name, err)
+		}
+	}
+	return jobs, nil
+}
+
+// validate parses the job schedule and checks its definition
+func (j *ScheduledJob) validate(o ServerOptions) error {
+	cron, err := ParseCron(j.Schedule)
+	if err != nil {
+		return err
+	}
+	j.cron = cron
+
+	switch {
+	case (j.Prefetch == nil) == (j.Cleanup == nil):
+		return errors.New("either prefetch or cleanup must be defined")
+	case j.Prefetch != nil:
+		if o.Cache == nil {
+			return errors.New("prefetch requires the -cache-dir flag")
+		}
+		if _, err := prefetchTargets(j.Prefetch.PrefetchRequest, hostOptions(j.Prefetch.Host, o)); err != nil {
+			return err
+		}
+		j.validators = make(map[string]string)
+	default:
+		if j.Cleanup.maxAge, err = time.ParseDuration(j.Cleanup.MaxAge); err != nil || j.Cleanup.maxAge <= 0 {
+			return fmt.Errorf("invalid cleanup max_age: %s", j.Cleanup.MaxAge)
+		}
+		if j.Cleanup.Cache && o.Cache == nil {
+			return errors.New("cache cleanup requires the -cache-dir flag")
+		}
+		if !j.Cleanup.Cache && j.Cleanup.Dir == "" {
+			return errors.New("cleanup requires cache or dir")
+		}
+		if j.Cleanup.Dir != "" {
+			if info, err := os.Stat(j.Cleanup.Dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("invalid cleanup dir: %s", j.Cleanup.Dir)
+			}
+		}
+	}
+	return nil
+}
+
+// hostOptions returns the server options of the virtual host, if defined
+func hostOptions(host string, o ServerOptions) ServerOptions {
+	r := &http.Request{Host: host}
+	if vhost, ok := o.VirtualHosts[requestHostname(r)]; ok {
+		o = vhost.Apply(o)
+		o.VirtualHostname = requestHostname(r)
+	}
+	return o
+}
+
+// runSchedules runs the scheduled jobs, each one at a time, with the server
+// routes of the virtual hosts, if any
+func runSchedules(jobs []*ScheduledJob, o ServerOptions) {
+	handler := NewVirtualHostsHandler(internalOptions(o))
+	for _, job := range jobs {
+		go func(job *ScheduledJob) {
+			for {
+				next := job.cron.Next(time.Now())
+				if next.IsZero() {
+					log.Printf("scheduled job %s never runs", job.Name)
+					return
+				}
+				time.Sleep(time.Until(next))
+				job.run(handler, o)
+			}
+		}(job)
+	}
+}
+
+// run runs the job, logging its outcome
+func (j *ScheduledJob) run(handler http.Handler, o ServerOptions) {
+	start := time.Now()
+	if j.Prefetch != nil {
+		job := j.prefetch(handler, o)
+		log.Printf("scheduled job %s: %d requests, %d failed in %s", j.Name, job.Requests, job.Failed, time.Since(start))
+		return
+	}
+
+	removed, err := j.cleanup(o)
+	if err != nil {
+		log.Printf("scheduled job %s failed: %s", j.Name, err)
+	}
+	log.Printf("scheduled job %s: %d files removed in %s", j.Name, removed, time.Since(start))
+}
+
+// prefetch refreshes the cached renditions of the sources changed since the
+// last run, or every source on the first run
+func (j *ScheduledJob) prefetch(handler http.Handler, o ServerOptions) PrefetchJob {
+	req := j.Prefetch.PrefetchRequest
+	req.URLs = nil
+	for _, source := range j.Prefetch.URLs {
+		if j.sourceChanged(source, o) {
+			req.URLs = append(req.URLs, source)
+		}
+	}
+	job := &prefetchJob{job: PrefetchJob{ID: newRequestID(), Status: PrefetchRunning, Started: time.Now()}}
+	if len(req.URLs) == 0 {
+		job.finish()
+		return job.Snapshot()
+	}
+
+	targets, err := prefetchTargets(req, hostOptions(j.Prefetch.Host, o))
+	if err != nil {
+		log.Printf("scheduled job %s failed: %s", j.Name, err)
+		job.finish()
+		return job.Snapshot()
+	}
+	r := &http.Request{Host: j.Prefetch.Host}
+	r = r.WithContext(context.WithValue(context.Background(), refreshContextKey{}, true))
+	runPrefetchJob(job, targets, r, handler, o.Webhooks)
+	return job.Snapshot()
+}
+
+// sourceChanged checks if the source ETag or Last-Modified header changed
+// since the last run, via a HEAD request. Sources without validators, or
+// failing to reply, are considered changed.
+func (j *ScheduledJob) sourceChanged(source string, o ServerOptions) bool {
+	u, err := url.Parse(source)
+	if err != nil || shouldRestrictOrigin(u, o.AllowedOrigins) {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scheduleSourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source, nil)
+	if err != nil {
+		return true
+	}
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return true
+	}
+
+	validator := res.Header.Get("ETag") + "\n" + res.Header.Get("Last-Modified")
+	if validator == "\n" {
+		return true
+	}
+	previous, ok := j.validators[source]
+	j.validators[source] = validator
+	return !ok || previous != validator
+}
+
+// cleanup removes the disk cache entries and the directory files older than
+// the maximum age, returning their number
+func (j *ScheduledJob) cleanup(o ServerOptions) (int, error) {
+	before := time.Now().Add(-j.Cleanup.maxAge)
+	removed := 0
+	if j.Cleanup.Cache {
+		removed += o.Cache.Expire(before)
+	}
+	if j.Cleanup.Dir == "" {
+		return removed, nil
+	}
+
+	err := filepath.WalkDir(j.Cleanup.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().Before(before) {
+			if err := os.Remove(path); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadSchedules(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{EnableURLSource: true, Cache: cache, PathPrefix: "/"}
+
+	file := filepath.Join(dir, "schedules.json")
+	os.WriteFile(file, []byte(`[
+		{"name": "presets", "schedule": "0 * * * *", "prefetch": {"urls": ["https://cdn.shop.com/a.jpg"], "requests": ["/resize?width=300"]}},
+		{"name": "retention", "schedule": "@daily", "cleanup": {"cache": true, "dir": "`+dir+`", "max_age": "720h"}}
+	]`), 0644)
+	jobs, err := ReadSchedules(file, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[1].Cleanup.maxAge != 720*time.Hour || jobs[0].cron.Next(time.Now()).IsZero() {
+		t.Errorf("Invalid scheduled jobs: %+v", jobs)
+	}
+
+	invalid := []string{
+		`{}`,
+		`[{"name": "none", "schedule": "@daily"}]`,
+		`[{"name": "cron", "schedule": "* * *", "cleanup": {"cache": true, "max_age": "1h"}}]`,
+		`[{"name": "age", "schedule": "@daily", "cleanup": {"cache": true, "max_age": "1 day"}}]`,
+		`[{"name": "target", "schedule": "@daily", "cleanup": {"max_age": "1h"}}]`,
+		`[{"name": "dir", "schedule": "@daily", "cleanup": {"dir": "/missing/dir", "max_age": "1h"}}]`,
+		`[{"name": "urls", "schedule": "@daily", "prefetch": {"urls": ["ftp://cdn.shop.com/a.jpg"], "requests": ["/resize?width=300"]}}]`,
+	}
+	for _, schedules := range invalid {
+		os.WriteFile(file, []byte(schedules), 0644)
+		if _, err := ReadSchedules(file, o); err == nil {
+			t.Errorf("%s: expected error", schedules)
+		}
+	}
+
+	// Prefetch and cache cleanup require the disk cache
+	os.WriteFile(file, []byte(`[{"name": "retention", "schedule": "@daily", "cleanup": {"cache": true, "max_age": "1h"}}]`), 0644)
+	if _, err := ReadSchedules(file, ServerOptions{}); err == nil {
+		t.Error("Expected error without disk cache")
+	}
+}
+
+func TestScheduledCleanup(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := Image{Body: []byte("webp image"), Mime: "image/webp"}
+	expired, fresh := testCacheKey("expired"), testCacheKey("fresh")
+	for _, key := range []string{expired, fresh} {
+		if err := cache.Put(key, image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(cache.path(expired), old, old)
+
+	os.MkdirAll(filepath.Join(dir, "thumbs"), 0755)
+	for _, name := range []string{"thumbs/old.webp", "new.webp"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("webp image"), 0644)
+	}
+	os.Chtimes(filepath.Join(dir, "thumbs", "old.webp"), old, old)
+
+	job := ScheduledJob{Cleanup: &ScheduledCleanup{Cache: true, Dir: dir, maxAge: 24 * time.Hour}}
+	removed, err := job.cleanup(ServerOptions{Cache: cache})
+	if err != nil || removed != 2 {
+		t.Errorf("Expected 2 removed files, got %d: %v", removed, err)
+	}
+	if _, ok := cache.Get(expired); ok {
+		t.Error("Expired cache entry not removed")
+	}
+	if _, ok := cache.Get(fresh); !ok {
+		t.Error("Fresh cache entry removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thumbs", "old.webp")); !os.IsNotExist(err) {
+		t.Error("Expired file not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.webp")); err != nil {
+		t.Errorf("Fresh file removed: %s", err)
+	}
+}
+
+func TestScheduledSourceChanged(t *testing.T) {
+	etag := `"v1"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/a.jpg" {
+			w.Header().Set("ETag", etag)
+		}
+	}))
+	defer ts.Close()
+
+	job := ScheduledJob{validators: make(map[string]string)}
+	o := ServerOptions{}
+	cases := []struct {
+		source  string
+		changed bool
+	}{
+		{ts.URL + "/a.jpg", true},
+		{ts.URL + "/a.jpg", false},
+		// Sources without validators are always refreshed
+		{ts.URL + "/b.jpg", true},
+		{ts.URL + "/b.jpg", true},
+	}
+	for i, tc := range cases {
+		if changed := job.sourceChanged(tc.source, o); changed != tc.changed {
+			t.Errorf("%d: %s: expected changed=%t", i, tc.source, tc.changed)
+		}
+	}
+
+	etag = `"v2"`
+	if !job.sourceChanged(ts.URL+"/a.jpg", o) {
+		t.Error("Changed source not detected")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+
+	"github.com/h2non/bimg"
+)
+
+// selfTestSVG is the image used to check the SVG support, which libvips can
+// load but not save
+const selfTestSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"><rect width="8" height="8" fill="#c00"/></svg>`
+
+// selfTest encodes a tiny image in every format and decodes it back, warming
+// up libvips and logging the formats not supported by the libvips build.
+// It returns the missing formats with the cause.
+func selfTest(formats []string) map[bimg.ImageType]error {
+	src := selfTestImage()
+	missing := map[bimg.ImageType]error{}
+	for _, name := range formats {
+		if err := selfTestFormat(src, ImageType(name)); err != nil {
+			log.Printf("self-test: missing %s image format support: %s", name, err)
+			missing[ImageType(name)] = err
+		}
+	}
+	debug("self-test: %d of %d image formats supported", len(formats)-len(missing), len(formats))
+	return missing
+}
+
+// selfTestFormat checks the format round trip of the source PNG image
+func selfTestFormat(src []byte, imageType bimg.ImageType) error {
+	switch imageType {
+	case bimg.UNKNOWN:
+		return fmt.Errorf("unknown image format")
+	case bimg.SVG:
+		_, err := bimg.Size([]byte(selfTestSVG))
+		return err
+	case bimg.PDF:
+		// Only checks the loader availability, as libvips can't save PDFs
+		if !bimg.IsImageTypeSupportedByVips(imageType).Load {
+			return fmt.Errorf("libvips loader not available")
+		}
+		return nil
+	}
+
+	buf, err := bimg.Resize(src, bimg.Options{Type: imageType})
+	if err != nil {
+		return fmt.Errorf("cannot encode: %s", err)
+	}
+	if bimg.DetermineImageType(buf) != imageType {
+		return fmt.Errorf("cannot encode: unexpected output format %s", bimg.DetermineImageTypeName(buf))
+	}
+	if _, err := bimg.Size(buf); err != nil {
+		return fmt.Errorf("cannot decode: %s", err)
+	}
+	return nil
+}
+
+// selfTestImage returns a tiny PNG image with a color gradient, so encoders
+// don't take shortcuts with uniform images
+func selfTestImage() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 32), G: uint8(y * 32), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestSelfTest(t *testing.T) {
+	missing := selfTest([]string{"jpeg", "png", "svg", "foo"})
+	if err, ok := missing[bimg.JPEG]; ok {
+		t.Errorf("JPEG should be supported: %s", err)
+	}
+	if err, ok := missing[bimg.PNG]; ok {
+		t.Errorf("PNG should be supported: %s", err)
+	}
+	if _, ok := missing[bimg.UNKNOWN]; !ok {
+		t.Error("Unknown formats should be missing")
+	}
+}
+
+func TestSelfTestImage(t *testing.T) {
+	img, err := png.Decode(bytes.NewReader(selfTestImage()))
+	if err != nil {
+		t.Fatalf("Cannot decode image: %s", err)
+	}
+	if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 8 {
+		t.Errorf("Invalid image size: %v", img.Bounds())
+	}
+}
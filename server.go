@@ -2,9 +2,11 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,8 +26,28 @@ type ServerOptions struct {
 	HTTPCacheTTL       int
 	HTTPReadTimeout    int
 	HTTPWriteTimeout   int
+	ShutdownTimeout    int
+	PIDFile            string
+	VirtualHosts       VirtualHosts
+	Routes             RouteMiddlewares
+	Sources            ImageSources
+	VirtualHostname    string
+	Usage              *Usage
+	UsageKey           string
+	PrefetchKey        string
+	Webhooks           *Webhooks
+	Schedules          []*ScheduledJob
 	MaxAllowedSize     int
+	HealthChecks       []string
+	DegradedLatency    time.Duration
+	MetadataRangeSize  int
 	MaxAllowedPixels   float64
+	MaxGIFFrames       int
+	MaxTIFFPages       int
+	MaxBodySize        int64
+	SpoolThreshold     int64
+	MaxBodySizes       map[string]int64
+	AutoQualityTarget  float64
 	CORS               bool
 	Gzip               bool
 	AuthForwarding     bool
@@ -33,21 +55,68 @@ type ServerOptions struct {
 	EnablePlaceholder  bool
 	EnableURLSignature bool
 	URLSignatureKey    string
+	URLSignatureKeys   map[string]string
+	URLSignatureAlg    string
+	URLEncryptionKey   []byte
+	BodySignatureKey   string
 	Address            string
 	PathPrefix         string
 	APIKey             string
+	APIKeys            APIKeys
+	Auth               AuthProvider
+	ClientCAs          *x509.CertPool
+	PicturePresets     PicturePresets
 	Mount              string
+	Mounts             Mounts
+	EnableFileListing  bool
+	EnableMountWrites  bool
+	DisableForm        bool
+	IndexMode          string
 	CertFile           string
 	KeyFile            string
 	Authorization      string
 	Placeholder        string
 	PlaceholderStatus  int
 	ForwardHeaders     []string
+	OriginUserAgent    string
+	OriginHeaders      http.Header
+	ForwardQuery       []string
+	OriginQuery        url.Values
 	PlaceholderImage   []byte
+	Placeholders       map[string][]byte
+	PlaceholderColor   []uint8
+	Fallbacks          map[string][]byte
 	Endpoints          Endpoints
+	EnabledEndpoints   Endpoints
+	DefaultParams      url.Values
+	AllowedOutputTypes ImageTypes
+	AllowedInputTypes  ImageTypes
 	AllowedOrigins     []*url.URL
 	LogLevel           string
+	LogFile            string
+	LogMaxSize         int64
+	LogSampling        LogSampling
+	ErrorLogFile       string
+	AuditLogFile       string
+	AuditLog           *AuditLog
+	TrustedProxies     TrustedProxies
+	Progress           *ProgressHub
 	ReturnSize         bool
+	ServerTiming       bool
+	NormalizeAccept    bool
+	EnableClientHints  bool
+	Policy             Policy
+	StripMetadata      bool
+	DisableAutoRotate  bool
+	NoEnlarge          bool
+	StripMetadataKeep  []string
+	C2PA               *C2PA
+	TransformBudget    TransformBudget
+	WorkerPool         *WorkerPool
+	PriorityHeader     string
+	Cache              *DiskCache
+	CacheTTL           int
+	CacheStaleTTL      int
 }
 
 // Endpoints represents a list of API endpoints
@@ -56,51 +125,111 @@ type Endpoints []string
 // IsValid checks if the request endpoint is allowed
 func (e Endpoints) IsValid(r *http.Request) bool {
 	parts := strings.Split(r.URL.Path, "/")
-	endpoint := parts[len(parts)-1]
+	return !e.Has(parts[len(parts)-1])
+}
+
+// isEndpointEnabled checks the endpoint against the enabled endpoints, if
+// defined, and the disabled endpoints. The index endpoint is always enabled.
+func isEndpointEnabled(endpoint string, o ServerOptions) bool {
+	if len(o.EnabledEndpoints) > 0 && endpoint != "" && !o.EnabledEndpoints.Has(endpoint) {
+		return false
+	}
+	return !o.Endpoints.Has(endpoint)
+}
+
+// Has checks if the endpoint is in the list
+func (e Endpoints) Has(endpoint string) bool {
 	for _, name := range e {
 		if endpoint == name {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+// imageEndpoints defines the image operation endpoints, also available as CLI commands
+var imageEndpoints = map[string]Operation{
+	"/resize":         Resize,
+	"/fit":            Fit,
+	"/enlarge":        Enlarge,
+	"/extract":        Extract,
+	"/crop":           Crop,
+	"/smartcrop":      SmartCrop,
+	"/rotate":         Rotate,
+	"/autorotate":     AutoRotate,
+	"/flip":           Flip,
+	"/flop":           Flop,
+	"/thumbnail":      Thumbnail,
+	"/zoom":           Zoom,
+	"/convert":        Convert,
+	"/watermark":      Watermark,
+	"/watermarkimage": WatermarkImage,
+	"/info":           Info,
+	"/blur":           GaussianBlur,
+	"/pipeline":       Pipeline,
+	"/transform":      Transform,
+	"/pixelate":       Pixelate,
+	"/enhance":        Enhance,
+	"/colorspace":     Colorspace,
+	"/moderate":       Moderate,
+	"/decode-qr":      DecodeQR,
+	"/palette":        Palette,
+	"/srcset":         Srcset,
+	"/picture":        Picture,
+	"/lqip":           LQIP,
+	"/topdf":          ToPDF,
 }
 
-// NewServerMux creates and configures the HTTP request multiplexer
+// NewServerMux creates and configures the HTTP request multiplexer. Every
+// route handler is built with the route options, see RouteMiddlewares.
 func NewServerMux(o ServerOptions) http.Handler {
 	mux := http.NewServeMux()
 
+	handle := func(route string, handler func(ServerOptions) http.Handler) {
+		mux.Handle(path.Join(o.PathPrefix, route), handler(o.Routes.Apply(route, o)))
+	}
+
 	// Core endpoints
-	mux.Handle(path.Join(o.PathPrefix, "/"), Middleware(indexController(o), o))
-	mux.Handle(path.Join(o.PathPrefix, "/form"), Middleware(formController(o), o))
-	mux.Handle(path.Join(o.PathPrefix, "/health"), Middleware(healthController, o))
+	handle("/", withMiddleware(indexController))
+	if !o.DisableForm {
+		handle("/form", withMiddleware(formController))
+	}
+	handle("/health", withMiddleware(func(ServerOptions) http.HandlerFunc { return healthController }))
+	handle("/health/live", withMiddleware(func(ServerOptions) http.HandlerFunc { return livenessController }))
+	handle("/health/ready", withMiddleware(readinessController))
+	if o.Progress != nil {
+		handle("/progress", withMiddleware(progressController))
+	}
+	if (o.EnableFileListing || o.EnableMountWrites) && hasMounts(o) {
+		handle("/files", withMiddleware(filesController))
+	}
+	if o.Usage != nil {
+		handle("/usage", func(o ServerOptions) http.Handler {
+			return validateRequest(addDefaultHeaders(usageController(o), o), o)
+		})
+	}
+
+	if o.PrefetchKey != "" && o.Cache != nil {
+		handle("/prefetch", func(o ServerOptions) http.Handler {
+			return validateRequest(addDefaultHeaders(prefetchController(o), o), o)
+		})
+	}
+
+	// QR code generation, signed as the image endpoints
+	handle("/qr", func(o ServerOptions) http.Handler {
+		qr := Middleware(qrController(o), o)
+		if o.EnableURLSignature {
+			qr = checkURLSignature(qr, o)
+		}
+		return qr
+	})
 
 	// Image processing middleware
-	image := ImageMiddleware(o)
-
-	// Image operation endpoints
-	endpoints := map[string]ImageOperation{
-		"/resize":         Resize,
-		"/fit":            Fit,
-		"/enlarge":        Enlarge,
-		"/extract":        Extract,
-		"/crop":           Crop,
-		"/smartcrop":      SmartCrop,
-		"/rotate":         Rotate,
-		"/autorotate":     AutoRotate,
-		"/flip":           Flip,
-		"/flop":           Flop,
-		"/thumbnail":      Thumbnail,
-		"/zoom":           Zoom,
-		"/convert":        Convert,
-		"/watermark":      Watermark,
-		"/watermarkimage": WatermarkImage,
-		"/info":           Info,
-		"/blur":           GaussianBlur,
-		"/pipeline":       Pipeline,
-	}
-
-	for route, operation := range endpoints {
-		mux.Handle(path.Join(o.PathPrefix, route), image(operation))
+	for route, operation := range imageEndpoints {
+		operation := operation
+		handle(route, func(o ServerOptions) http.Handler {
+			return ImageMiddleware(o)(operation)
+		})
 	}
 
 	return mux
@@ -130,10 +259,26 @@ func Server(o ServerOptions) {
 		NextProtos: []string{"h2", "http/1.1"},
 	}
 
+	// Verify the client certificates, if any, authorized by the mtls provider
+	if o.ClientCAs != nil {
+		tlsConfig.ClientCAs = o.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	accessLog, errorLog, auditLog := openLogs(o)
+	if auditLog != nil {
+		o.AuditLog = NewAuditLog(auditLog)
+	}
+
+	handler := trackInflight(NewSampledLog(addRequestID(recoverPanics(NewVirtualHostsHandler(o), o)), accessLog, errorLog, o.LogLevel, o.LogSampling))
+	if len(o.TrustedProxies) > 0 {
+		handler = resolveClientIP(handler, o.TrustedProxies)
+	}
+
 	// Initialize server
 	server := &http.Server{
 		Addr:           addr,
-		Handler:        NewLog(NewServerMux(o), os.Stdout, o.LogLevel),
+		Handler:        handler,
 		MaxHeaderBytes: 1 << 20,
 		ReadTimeout:    time.Duration(o.HTTPReadTimeout) * time.Second,
 		WriteTimeout:   time.Duration(o.HTTPWriteTimeout) * time.Second,
@@ -145,30 +290,105 @@ func Server(o ServerOptions) {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	// Check the TLS certificate before notifying the parent process on upgrade
+	if o.CertFile != "" && o.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); err != nil {
+			log.Fatalf("cannot start the server: %s", err)
+		}
+	}
+
+	// Listen, or inherit the listener from the parent process on upgrade
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("cannot start the server: %s", err)
+	}
+
 	// Start server
 	go func() {
-		if err := listenAndServe(server, o); err != nil && err != http.ErrServerClosed {
+		if err := serve(server, listener, o); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
 	}()
 
-	// Wait for shutdown signal
-	<-shutdown
+	if o.Cache != nil {
+		go syncDiskCache(o.Cache, diskCacheSyncInterval)
+	}
+	if len(o.Schedules) > 0 {
+		runSchedules(o.Schedules, o)
+	}
+
+	notifyReady()
+	if o.PIDFile != "" {
+		if err := writePIDFile(o.PIDFile); err != nil {
+			log.Printf("cannot write the PID file: %s", err)
+		}
+	}
+
+	// Wait for shutdown signal, or the upgraded process to be serving
+	select {
+	case <-shutdown:
+	case <-upgradeOnSignal(listener):
+	}
 	log.Print("shutting down server")
 
 	// Graceful shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
+	if err := shutdownServer(server, time.Duration(o.ShutdownTimeout)*time.Second); err != nil {
 		log.Fatalf("server shutdown failed: %v", err)
 	}
+	if err := o.Cache.Sync(); err != nil {
+		log.Printf("cannot write the disk cache index: %s", err)
+	}
 }
 
-// listenAndServe starts the server with or without TLS
-func listenAndServe(s *http.Server, o ServerOptions) error {
+// openLogs opens the access, error and audit log files, if defined, which are
+// reopened on SIGUSR1. The access log defaults to the standard output, while
+// the server errors are only written to the standard logger by default.
+func openLogs(o ServerOptions) (accessLog, errorLog, auditLog io.Writer) {
+	accessLog = os.Stdout
+
+	var files []*LogFile
+	if o.LogFile != "" {
+		file, err := OpenLogFile(o.LogFile, o.LogMaxSize)
+		if err != nil {
+			log.Fatalf("cannot start the server: %s", err)
+		}
+		accessLog = file
+		files = append(files, file)
+	}
+	if o.ErrorLogFile != "" {
+		file, err := OpenLogFile(o.ErrorLogFile, o.LogMaxSize)
+		if err != nil {
+			log.Fatalf("cannot start the server: %s", err)
+		}
+		errorLog = file
+		files = append(files, file)
+		log.SetOutput(file)
+	}
+	if o.AuditLogFile != "" {
+		file, err := OpenLogFile(o.AuditLogFile, o.LogMaxSize)
+		if err != nil {
+			log.Fatalf("cannot start the server: %s", err)
+		}
+		auditLog = file
+		files = append(files, file)
+	}
+
+	if len(files) > 0 {
+		reopenLogsOnSignal(files...)
+	}
+	return accessLog, errorLog, auditLog
+}
+
+// serve starts the server on the listener with or without TLS
+func serve(s *http.Server, l net.Listener, o ServerOptions) error {
 	if o.CertFile != "" && o.KeyFile != "" {
-		return s.ListenAndServeTLS(o.CertFile, o.KeyFile)
+		return s.ServeTLS(l, o.CertFile, o.KeyFile)
 	}
-	return s.ListenAndServe()
+	return s.Serve(l)
+}
+
+// writePIDFile writes the process ID to the file, so the process managers
+// track the new process after an upgrade
+func writePIDFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
 }
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -39,6 +42,154 @@ func TestIndex(t *testing.T) {
 	}
 }
 
+func TestIndexMode(t *testing.T) {
+	cases := []struct {
+		mode     string
+		status   int
+		versions bool
+	}{
+		{IndexModeFull, http.StatusOK, true},
+		{IndexModeMinimal, http.StatusOK, false},
+		{IndexModeNone, http.StatusNotFound, false},
+	}
+
+	for _, test := range cases {
+		opts := ServerOptions{PathPrefix: "/", MaxAllowedPixels: 18.0, IndexMode: test.mode}
+		ts := httptest.NewServer(NewServerMux(opts))
+
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		ts.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status with %s index: %s", test.mode, res.Status)
+		}
+		if strings.Contains(string(body), Version) != test.versions {
+			t.Errorf("Invalid versions disclosure with %s index: %s", test.mode, body)
+		}
+		if strings.Contains(res.Header.Get("Server"), Version) != test.versions {
+			t.Errorf("Invalid Server header with %s index: %s", test.mode, res.Header.Get("Server"))
+		}
+	}
+}
+
+func TestDisableForm(t *testing.T) {
+	ts := httptest.NewServer(NewServerMux(ServerOptions{PathPrefix: "/", DisableForm: true}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/form")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestIndexAndFormAuthorization(t *testing.T) {
+	ts := httptest.NewServer(NewServerMux(ServerOptions{PathPrefix: "/", APIKey: "secret"}))
+	defer ts.Close()
+
+	for _, endpoint := range []string{"/", "/form"} {
+		res, err := http.Get(ts.URL + endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Invalid response status for %s without API key: %s", endpoint, res.Status)
+		}
+	}
+}
+
+func TestImageTooLarge(t *testing.T) {
+	o := ServerOptions{MaxAllowedPixels: 18.0, MaxAllowedSize: 10}
+	LoadSources(o)
+
+	ts := httptest.NewServer(ImageMiddleware(o)(Crop))
+	defer ts.Close()
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "image.jpg")
+	_, _ = part.Write([]byte(strings.Repeat("x", 100)))
+	writer.Close()
+
+	cases := []struct {
+		contentType string
+		body        io.Reader
+	}{
+		{"image/jpeg", strings.NewReader(strings.Repeat("x", 100))},
+		{writer.FormDataContentType(), &form},
+	}
+
+	for _, test := range cases {
+		res, err := http.Post(ts.URL+"/crop?width=300", test.contentType, test.body)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+
+		var xerr Error
+		_ = json.NewDecoder(res.Body).Decode(&xerr)
+		if res.StatusCode != http.StatusRequestEntityTooLarge || xerr.Size != 100 || xerr.Limit != 10 {
+			t.Errorf("Invalid %s response: %s %+v", test.contentType, res.Status, xerr)
+		}
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	o := ServerOptions{MaxAllowedPixels: 18.0, MaxAllowedSize: 1 << 20, MaxBodySize: 2 << 20}
+	LoadSources(o)
+
+	ts := httptest.NewServer(ImageMiddleware(o)(Resize))
+	defer ts.Close()
+
+	// Streamed bodies are sent without Content-Length
+	post := func(contentType string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/resize?width=300", body)
+		req.Header.Set("Content-Type", contentType)
+		req.ContentLength = -1
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := post("image/jpeg", readFile("large.jpg"))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Invalid raw body response: %s", res.Status)
+	}
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, _ := writer.CreateFormFile("file", "large.jpg")
+		io.Copy(part, readFile("large.jpg"))
+		writer.Close()
+		pw.Close()
+	}()
+	if res := post(writer.FormDataContentType(), pr); res.StatusCode != http.StatusOK {
+		t.Errorf("Invalid multipart body response: %s", res.Status)
+	}
+
+	// The allowed image size is enforced while reading the body
+	res = post("image/jpeg", io.MultiReader(strings.NewReader(strings.Repeat("x", 2<<20-1))))
+	var xerr Error
+	_ = json.NewDecoder(res.Body).Decode(&xerr)
+	if res.StatusCode != http.StatusRequestEntityTooLarge || xerr.Kind != ErrImageTooLarge.Kind || xerr.Limit != 1<<20 {
+		t.Errorf("Invalid too large response: %s %+v", res.Status, xerr)
+	}
+
+	// The body size limit is enforced too
+	res = post("image/jpeg", io.MultiReader(strings.NewReader(strings.Repeat("x", 3<<20))))
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Invalid too large body response: %s", res.Status)
+	}
+}
+
 func TestCrop(t *testing.T) {
 	ts := testServer(controller(Crop))
 	buf := readFile("large.jpg")
@@ -232,6 +383,223 @@ func TestTypeAuto(t *testing.T) {
 	}
 }
 
+func TestTypeAutoNormalizeAccept(t *testing.T) {
+	cases := []struct {
+		acceptHeader string
+		class        string
+		expected     string
+	}{
+		{"", AcceptLegacy, "jpeg"},
+		{"image/png,*/*", AcceptLegacy, "jpeg"},
+		{"image/webp,*/*", AcceptWebP, "webp"},
+		{"image/avif;q=0,image/webp,*/*", AcceptWebP, "webp"},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", AcceptAVIF, "avif"},
+	}
+
+	for _, test := range cases {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			buf, _ := ioutil.ReadAll(r.Body)
+			imageHandler(w, r, buf, Resize, ServerOptions{MaxAllowedPixels: 18.0, NormalizeAccept: true})
+		}
+		ts := testServer(fn)
+		defer ts.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"?width=300&type=auto", readFile("large.jpg"))
+		req.Header.Add("Accept", test.acceptHeader)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+
+		if res.Header.Get("Normalized-Accept") != test.class {
+			t.Errorf("Invalid normalized accept header: %s != %s", res.Header.Get("Normalized-Accept"), test.class)
+		}
+
+		if res.Header.Get("Vary") != "Accept" {
+			t.Error("Vary header not set correctly")
+		}
+
+		image, _ := ioutil.ReadAll(res.Body)
+		if name := bimg.DetermineImageTypeName(image); name != test.expected {
+			t.Errorf("Invalid image type: %s != %s", name, test.expected)
+		}
+	}
+}
+
+func TestTypeAutoVaryOnError(t *testing.T) {
+	fn := ImageMiddleware(ServerOptions{})(Crop)
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/crop?width=300&type=auto", "image/jpeg", nil)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+
+	if res.StatusCode == 200 {
+		t.Fatal("Expected an error response")
+	}
+
+	if res.Header.Get("Vary") != "Accept" {
+		t.Fatal("Vary header not set correctly")
+	}
+}
+
+func TestAllowedOutputTypes(t *testing.T) {
+	o := ServerOptions{MaxAllowedPixels: 18.0, AllowedOutputTypes: ImageTypes{bimg.JPEG, bimg.WEBP}}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		imageHandler(w, r, buf, Resize, o)
+	}
+	ts := testServer(fn)
+	defer ts.Close()
+
+	for _, query := range []string{
+		"?width=300&type=pdf",
+		"?width=300&type=tiff",
+		`?operations=[{"operation":"resize","params":{"width":300,"type":"png"}}]`,
+	} {
+		res, err := http.Post(ts.URL+query, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: invalid response status: %s", query, res.Status)
+		}
+		if !strings.Contains(string(body), ErrOutputFormatDenied.Message) {
+			t.Errorf("%s: invalid error response: %s", query, body)
+		}
+	}
+
+	// Not allowed negotiated types keep the original image type
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "image/png")
+	if imageType := negotiateType(w, r, o); imageType != "" {
+		t.Errorf("Invalid negotiated type: %s", imageType)
+	}
+	r.Header.Set("Accept", "image/avif,image/webp")
+	if imageType := negotiateType(w, r, ServerOptions{NormalizeAccept: true, AllowedOutputTypes: o.AllowedOutputTypes}); imageType != "" || w.Header().Get("Normalized-Accept") != AcceptLegacy {
+		t.Errorf("Invalid negotiated type: %s %s", imageType, w.Header().Get("Normalized-Accept"))
+	}
+}
+
+func TestOperationErrorCode(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("vips error"), http.StatusBadRequest},
+		{NewError("Missing required param: text", http.StatusBadRequest), http.StatusBadRequest},
+		{NewError("Width or height of requested image is zero", http.StatusNotAcceptable), http.StatusBadRequest},
+		{NewError("Remote operation failed", http.StatusBadGateway), http.StatusBadGateway},
+		{fmt.Errorf("pipeline: %w", NewError("Remote operation timed out", http.StatusGatewayTimeout)), http.StatusGatewayTimeout},
+	}
+
+	for _, tc := range cases {
+		if code := operationErrorCode(tc.err); code != tc.expected {
+			t.Errorf("Invalid status code for %q: %d, expected %d", tc.err, code, tc.expected)
+		}
+	}
+}
+
+func TestOperationError(t *testing.T) {
+	cases := []struct {
+		err   error
+		kind  string
+		param string
+	}{
+		{fmt.Errorf("vips error"), KindProcessingError, ""},
+		{fmt.Errorf("pipeline: %w", NewMissingParamError("Missing required param: text", "text")), KindMissingParam, "text"},
+		{fmt.Errorf("pipeline: %w", ParamError{"width", ErrUnsupportedValue}), KindInvalidParam, "width"},
+		{NewError("Remote operation timed out", http.StatusGatewayTimeout), "gateway_timeout", ""},
+	}
+
+	for _, tc := range cases {
+		if xerr := operationError(tc.err); xerr.Kind != tc.kind || xerr.Param != tc.param {
+			t.Errorf("Invalid error code for %q: %s %s", tc.err, xerr.Kind, xerr.Param)
+		}
+	}
+}
+
+func TestParamsError(t *testing.T) {
+	_, err := buildParamsFromQuery(url.Values{"width": {"foo"}})
+	if xerr := paramsError(err); xerr.Kind != KindInvalidParam || xerr.Param != "width" || xerr.HTTPCode() != http.StatusBadRequest {
+		t.Errorf("Invalid params error: %+v", xerr)
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	cases := []struct {
+		err   error
+		kind  string
+		param string
+	}{
+		{ErrInvalidImageURL, KindInvalidParam, URLQueryKey},
+		{fmt.Errorf("%w: example.org/image.jpg", errForbiddenOrigin), KindOriginForbidden, URLQueryKey},
+		{fmt.Errorf("cannot read image"), "bad_request", ""},
+	}
+
+	for _, tc := range cases {
+		if xerr := sourceError(tc.err); xerr.Kind != tc.kind || xerr.Param != tc.param {
+			t.Errorf("Invalid error code for %q: %s %s", tc.err, xerr.Kind, xerr.Param)
+		}
+	}
+}
+
+func TestQueryHasAutoType(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected bool
+	}{
+		{"width=300", false},
+		{"width=300&type=auto", true},
+		{`operations=[{"operation":"resize","params":{"type":"webp"}}]`, false},
+		{`operations=[{"operation":"resize","params":{"type":"auto"}}]`, true},
+		{`branches=[{"operations":[{"operation":"resize","params":{"type":"auto"}}]}]`, true},
+	}
+
+	for _, test := range cases {
+		query := url.Values{}
+		for _, pair := range strings.SplitN(test.query, "&", 2) {
+			kv := strings.SplitN(pair, "=", 2)
+			query.Set(kv[0], kv[1])
+		}
+		if queryHasAutoType(query) != test.expected {
+			t.Errorf("Invalid auto type detection for %s", test.query)
+		}
+	}
+}
+
+func TestNormalizeAccept(t *testing.T) {
+	cases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", AcceptLegacy},
+		{"*/*", AcceptLegacy},
+		{"image/jpeg,image/png", AcceptLegacy},
+		{"image/webp", AcceptWebP},
+		{"image/webp;q=0.5, image/jpeg", AcceptWebP},
+		{"image/avif;q=0, image/webp", AcceptWebP},
+		{"image/avif,image/webp,*/*;q=0.8", AcceptAVIF},
+		{"invalid;;, image/avif", AcceptAVIF},
+	}
+
+	for _, test := range cases {
+		if class := normalizeAccept(test.accept); class != test.expected {
+			t.Errorf("Invalid class for %q: %s != %s", test.accept, class, test.expected)
+		}
+	}
+}
+
 func TestFit(t *testing.T) {
 	var err error
 
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownTimeout is the default time given to the in-flight requests
+// to complete on shutdown
+const defaultShutdownTimeout = 5
+
+// shutdownPollInterval is the interval checking the running transformations
+const shutdownPollInterval = 50 * time.Millisecond
+
+// inflightRequests counts the requests being served
+var inflightRequests int64
+
+// trackInflight counts the requests being served, reported when aborted on
+// shutdown
+func trackInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inflightRequests, 1)
+		defer atomic.AddInt64(&inflightRequests, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownServer stops accepting connections and drains the in-flight
+// requests, then awaits the transformations still running in background after
+// exceeding their budget. The requests and transformations still running when
+// the timeout is exceeded are aborted.
+func shutdownServer(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = waitTransforms(ctx)
+	}
+	if err != context.DeadlineExceeded {
+		return err
+	}
+
+	log.Printf("shutdown timeout exceeded, aborting %d requests and %d transformations",
+		atomic.LoadInt64(&inflightRequests), atomic.LoadInt64(&watchdogRunning))
+	return server.Close()
+}
+
+// waitTransforms waits for the running transformations to complete
+func waitTransforms(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&watchdogRunning) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
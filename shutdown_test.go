@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownServer(t *testing.T) {
+	cases := []struct {
+		name    string
+		delay   time.Duration
+		aborted bool
+	}{
+		{"drained", 50 * time.Millisecond, false},
+		{"timeout exceeded", time.Second, true},
+	}
+
+	for _, tc := range cases {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+
+		started := make(chan struct{})
+		server := &http.Server{Handler: trackInflight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(tc.delay)
+		}))}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = server.Serve(listener) }()
+
+		done := make(chan error, 1)
+		go func() {
+			res, err := http.Get("http://" + listener.Addr().String())
+			if err == nil {
+				res.Body.Close()
+			}
+			done <- err
+		}()
+		<-started
+
+		if err := shutdownServer(server, 200*time.Millisecond); err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+		if err := <-done; (err != nil) != tc.aborted {
+			t.Errorf("%s: unexpected request error: %v", tc.name, err)
+		}
+		if aborted := strings.Contains(logs.String(), "aborting 1 requests and 0 transformations"); aborted != tc.aborted {
+			t.Errorf("%s: invalid shutdown log: %s", tc.name, logs.String())
+		}
+		log.SetOutput(os.Stderr)
+	}
+}
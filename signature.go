@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// BodySignatureHeader is the request header providing the uploaded image
+// signature, required by the -body-signature-key flag
+const BodySignatureHeader = "X-Signature"
+
+// checkBodySignature verifies the X-Signature header against the HMAC digest
+// of the request URL path and client query, the uploaded image, and the form
+// files sent along with it, before processing them. URL signatures only cover
+// the path and query, not the uploaded files.
+func checkBodySignature(r *http.Request, buf []byte, o ServerOptions) error {
+	sign, err := base64.RawURLEncoding.DecodeString(r.Header.Get(BodySignatureHeader))
+	if err != nil || len(sign) == 0 {
+		o.AuditLog.Log(r, AuditInvalidSignature, "", ErrInvalidBodySignature)
+		return ErrInvalidBodySignature
+	}
+
+	files, err := readFormFiles(r)
+	if err != nil {
+		return NewError("Cannot read form files: "+err.Error(), http.StatusBadRequest)
+	}
+	query := clientQuery(r)
+	query.Del("sign")
+
+	if !hmac.Equal(sign, signBody(o.BodySignatureKey, o.URLSignatureAlg, r.URL.Path, query, buf, files)) {
+		o.AuditLog.Log(r, AuditInvalidSignature, "", ErrBodySignMismatch)
+		return ErrBodySignMismatch
+	}
+	return nil
+}
+
+// signBody returns the HMAC digest of the URL path, the query sorted by key,
+// the digest of the uploaded image, then the escaped field name and the
+// digest of each form file, sorted by field name. Digests use the signature
+// algorithm.
+func signBody(key, alg, urlPath string, query url.Values, buf []byte, files map[string][]byte) []byte {
+	h := hmac.New(signatureHash(alg), []byte(key))
+	h.Write([]byte(urlPath))
+	h.Write([]byte(query.Encode()))
+	h.Write(payloadDigest(alg, buf))
+
+	fields := make([]string, 0, len(files))
+	for field := range files {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		h.Write([]byte(url.QueryEscape(field) + "="))
+		h.Write(payloadDigest(alg, files[field]))
+	}
+	return h.Sum(nil)
+}
+
+// payloadDigest returns the digest of the uploaded file using the signature
+// algorithm
+func payloadDigest(alg string, buf []byte) []byte {
+	digest := signatureHash(alg)()
+	digest.Write(buf)
+	return digest.Sum(nil)
+}
+
+// clientQueryKey is the request context key of the client query, before
+// adding the default params
+type clientQueryKey struct{}
+
+// clientQuery returns the query sent by the client, without the default params
+func clientQuery(r *http.Request) url.Values {
+	if raw, ok := r.Context().Value(clientQueryKey{}).(string); ok {
+		query, _ := url.ParseQuery(raw)
+		return query
+	}
+	return r.URL.Query()
+}
+
+// URL signature algorithms
+const (
+	SignatureAlgSHA256 = "sha256"
+	SignatureAlgSHA512 = "sha512"
+)
+
+// signatureKeyIDParam is the query param selecting the URL signature key
+// among the -url-signature-keys ones
+const signatureKeyIDParam = "kid"
+
+// encryptedURLParam is the query param providing the AES-GCM encrypted
+// source image URL, decrypted into the url param
+const encryptedURLParam = "enc"
+
+// signatureHash returns the hash function of the URL signature algorithm
+func signatureHash(alg string) func() hash.Hash {
+	if alg == SignatureAlgSHA512 {
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// urlSignatureKey returns the URL signature key selected by the kid param,
+// or the default key if missing
+func urlSignatureKey(query url.Values, o ServerOptions) (string, bool) {
+	kid := query.Get(signatureKeyIDParam)
+	if kid == "" {
+		return o.URLSignatureKey, o.URLSignatureKey != ""
+	}
+	key, ok := o.URLSignatureKeys[kid]
+	return key, ok
+}
+
+// parseSignatureKeys parses the comma separated key IDs and URL signature
+// keys, e.g: 2024:4f46feebafc4b5e988f131c4ff8b5997
+func parseSignatureKeys(input string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(input, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		kid := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || kid == "" {
+			return nil, fmt.Errorf("invalid key: %s", entry)
+		}
+		key := strings.TrimSpace(parts[1])
+		if len(key) < minURLSignatureKeyLength {
+			return nil, fmt.Errorf("key %s must be a minimum of %d characters", kid, minURLSignatureKeyLength)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// parseEncryptionKey parses the hex encoded AES-128, AES-192 or AES-256 key
+func parseEncryptionKey(input string) ([]byte, error) {
+	key, err := hex.DecodeString(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, errors.New("the key must be 16, 24 or 32 bytes long")
+	}
+	return key, nil
+}
+
+// encryptedURLKey is the request context key of the encrypted source URL
+type encryptedURLKey struct{}
+
+// decryptSourceURL replaces the enc param by the decrypted source image URL,
+// as the url param. URL signatures are checked before, against the enc param.
+func decryptSourceURL(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		enc := query.Get(encryptedURLParam)
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sourceURL, err := decryptURL(o.URLEncryptionKey, enc)
+		if err != nil {
+			o.AuditLog.Log(r, AuditInvalidSignature, encryptedURLParam, ErrInvalidEncryptedURL)
+			ErrorReply(r, w, ErrInvalidEncryptedURL, o)
+			return
+		}
+
+		query.Del(encryptedURLParam)
+		query.Set(URLQueryKey, sourceURL)
+		r2 := r.Clone(context.WithValue(r.Context(), encryptedURLKey{}, enc))
+		r2.URL.RawQuery = query.Encode()
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// encryptedSourceURL returns the enc param the source image URL of the
+// request was decrypted from, if any
+func encryptedSourceURL(r *http.Request) (string, bool) {
+	enc, ok := r.Context().Value(encryptedURLKey{}).(string)
+	return enc, ok
+}
+
+// decryptURL decrypts the source image URL encrypted by encryptURL
+func decryptURL(key []byte, enc string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) < gcm.NonceSize() {
+		return "", errors.New("encrypted URL too short")
+	}
+	plain, err := gcm.Open(nil, buf[:gcm.NonceSize()], buf[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// concealSourceError returns the source error without its message, which may
+// include the source image URL, when the URL was encrypted
+func concealSourceError(r *http.Request, xerr Error) Error {
+	if _, ok := encryptedSourceURL(r); !ok {
+		return xerr
+	}
+	return NewError("Cannot fetch the source image", xerr.Code).WithKind(xerr.Kind)
+}
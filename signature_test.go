@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckBodySignature(t *testing.T) {
+	o := ServerOptions{BodySignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	image := []byte("image")
+	query := url.Values{"width": {"300"}}
+	sign := base64.RawURLEncoding.EncodeToString(signBody(o.BodySignatureKey, SignatureAlgSHA256, "/resize", query, image, nil))
+
+	cases := []struct {
+		path string
+		sign string
+		body []byte
+		err  error
+	}{
+		{"/resize?width=300", sign, image, nil},
+		{"/resize?width=300&sign=abc", sign, image, nil},
+		{"/resize?width=300", "", image, ErrInvalidBodySignature},
+		{"/resize?width=300", "*invalid*", image, ErrInvalidBodySignature},
+		{"/resize?width=300", sign, []byte("tampered"), ErrBodySignMismatch},
+		{"/crop?width=300", sign, image, ErrBodySignMismatch},
+		{"/resize?width=3000", sign, image, ErrBodySignMismatch},
+		{"/resize?width=300&height=300", sign, image, ErrBodySignMismatch},
+		{"/resize?width=300", base64.RawURLEncoding.EncodeToString(signBody("another key", SignatureAlgSHA256, "/resize", query, image, nil)), image, ErrBodySignMismatch},
+	}
+
+	for _, test := range cases {
+		req := httptest.NewRequest("POST", test.path, nil)
+		if test.sign != "" {
+			req.Header.Set(BodySignatureHeader, test.sign)
+		}
+
+		if err := checkBodySignature(req, test.body, o); err != test.err {
+			t.Errorf("Invalid signature check for %s %q: %v", test.path, test.sign, err)
+		}
+	}
+}
+
+func TestCheckBodySignatureFormFiles(t *testing.T) {
+	o := ServerOptions{BodySignatureKey: "4f46feebafc4b5e988f131c4ff8b5997", URLSignatureAlg: SignatureAlgSHA512}
+	query := url.Values{"image": {"logo"}}
+	files := map[string][]byte{"logo": []byte("watermark")}
+	sign := base64.RawURLEncoding.EncodeToString(signBody(o.BodySignatureKey, o.URLSignatureAlg, "/watermarkimage", query, []byte("image"), files))
+
+	for logo, expected := range map[string]error{"watermark": nil, "tampered": ErrBodySignMismatch} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for field, content := range map[string]string{"file": "image", "logo": logo} {
+			part, _ := form.CreateFormFile(field, field+".png")
+			_, _ = part.Write([]byte(content))
+		}
+		_ = form.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/watermarkimage?image=logo", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.Header.Set(BodySignatureHeader, sign)
+		buf, err := NewBodyImageSource(&SourceConfig{}).GetImage(r)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+
+		if err := checkBodySignature(r, buf, o); err != expected {
+			t.Errorf("Invalid signature check with %s logo: %v", logo, err)
+		}
+		_ = r.MultipartForm.RemoveAll()
+	}
+}
+
+func TestCheckBodySignatureDefaultParams(t *testing.T) {
+	o := ServerOptions{BodySignatureKey: "4f46feebafc4b5e988f131c4ff8b5997", DefaultParams: url.Values{"quality": {"80"}}}
+	image := []byte("image")
+	sign := base64.RawURLEncoding.EncodeToString(signBody(o.BodySignatureKey, SignatureAlgSHA256, "/resize", url.Values{"width": {"300"}}, image, nil))
+
+	var err error
+	handler := addDefaultParams(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err = checkBodySignature(r, image, o)
+	}), o)
+	req := httptest.NewRequest(http.MethodPost, "/resize?width=300", nil)
+	req.Header.Set(BodySignatureHeader, sign)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Errorf("Unexpected signature error: %v", err)
+	}
+}
+
+func TestCheckURLSignatureKeyID(t *testing.T) {
+	o := ServerOptions{
+		EnableURLSignature: true,
+		URLSignatureKey:    "4f46feebafc4b5e988f131c4ff8b5997",
+		URLSignatureKeys:   map[string]string{"2024": "9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2"},
+		URLSignatureAlg:    SignatureAlgSHA512,
+	}
+	signed := checkURLSignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), o)
+
+	sign := func(key, alg string, query url.Values) string {
+		query.Set("sign", base64.RawURLEncoding.EncodeToString(signURL(key, alg, "/resize", query)))
+		return "/resize?" + query.Encode()
+	}
+
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{sign(o.URLSignatureKey, SignatureAlgSHA512, url.Values{"width": {"300"}}), http.StatusOK},
+		{sign("9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2", SignatureAlgSHA512, url.Values{"width": {"300"}, "kid": {"2024"}}), http.StatusOK},
+		{sign(o.URLSignatureKey, SignatureAlgSHA256, url.Values{"width": {"300"}}), http.StatusForbidden},
+		{sign(o.URLSignatureKey, SignatureAlgSHA512, url.Values{"width": {"300"}, "kid": {"2024"}}), http.StatusForbidden},
+		{sign(o.URLSignatureKey, SignatureAlgSHA512, url.Values{"width": {"300"}, "kid": {"2023"}}), http.StatusBadRequest},
+	}
+
+	for _, test := range cases {
+		w := httptest.NewRecorder()
+		signed.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.url, w.Code)
+		}
+	}
+}
+
+func TestParseSignatureKeys(t *testing.T) {
+	keys, err := parseSignatureKeys("2024:4f46feebafc4b5e988f131c4ff8b5997, 2025:9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys["2025"] != "9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2" {
+		t.Errorf("Invalid keys: %v", keys)
+	}
+
+	for _, input := range []string{"4f46feebafc4b5e988f131c4ff8b5997", ":4f46feebafc4b5e988f131c4ff8b5997", "2024:short"} {
+		if _, err := parseSignatureKeys(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestDecryptSourceURL(t *testing.T) {
+	key, err := parseEncryptionKey("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{PathPrefix: "/", URLEncryptionKey: key}
+
+	enc, err := encryptURL(key, "http://origin.example.org/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sourceURL, srcsetURL string
+	handler := decryptSourceURL(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sourceURL = r.URL.Query().Get(URLQueryKey)
+		srcsetURL = requestImageURL(r, o)("/resize", map[string]string{"width": "320"})
+	}), o)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/srcset?enc="+enc, nil))
+	if w.Code != http.StatusOK || sourceURL != "http://origin.example.org/image.jpg" {
+		t.Fatalf("Invalid decrypted URL: %d %s", w.Code, sourceURL)
+	}
+
+	// Generated URLs keep the source URL encrypted
+	u, _ := url.Parse(srcsetURL)
+	if u.Query().Get(encryptedURLParam) != enc || u.Query().Get(URLQueryKey) != "" {
+		t.Errorf("Invalid generated URL: %s", srcsetURL)
+	}
+
+	otherKey, _ := parseEncryptionKey("0f0e0d0c0b0a09080706050403020100")
+	tampered, _ := encryptURL(otherKey, "http://origin.example.org/image.jpg")
+	for _, enc := range []string{tampered, "*invalid*", "c2hvcnQ"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/srcset?enc="+enc, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Invalid response status for %s: %d", enc, w.Code)
+		}
+	}
+
+	if _, err := parseEncryptionKey("0001020304"); err == nil {
+		t.Error("Expected invalid key length error")
+	}
+}
+
+// encryptURL encrypts the source image URL with AES-GCM, encoded as URL-safe
+// Base64 of the random nonce followed by the ciphertext
+func encryptURL(key []byte, sourceURL string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(sourceURL), nil)), nil
+}
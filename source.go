@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 )
 
 // ImageSourceType represents the type of image source
@@ -17,10 +18,18 @@ type SourceConfig struct {
 	AuthForwarding bool
 	Authorization  string
 	MountPath      string
+	Mounts         Mounts
 	Type           ImageSourceType
 	ForwardHeaders []string
+	UserAgent      string
+	Headers        http.Header
+	ForwardQuery   []string
+	Query          url.Values
 	AllowedOrigins []*url.URL
 	MaxAllowedSize int
+	MetadataRange  int
+	MaxBodySize    int64
+	SpoolThreshold int64
 }
 
 // ImageSource interface defines methods for image source handlers
@@ -29,6 +38,12 @@ type ImageSource interface {
 	GetImage(*http.Request) ([]byte, error)
 }
 
+// ModTimeSource is implemented by the image sources able to report the source
+// image modification time without reading it, enabling conditional requests
+type ModTimeSource interface {
+	ModTime(*http.Request) (time.Time, error)
+}
+
 // sourceRegistry manages image source registration and lookup
 type sourceRegistry struct {
 	sources   map[ImageSourceType]ImageSource
@@ -65,23 +80,67 @@ func LoadSources(o ServerOptions) {
 		}
 	}
 
-	// Create single config instance
-	config := &SourceConfig{
-		AuthForwarding: o.AuthForwarding,
-		Authorization:  o.Authorization,
-		MountPath:      o.Mount,
-		AllowedOrigins: o.AllowedOrigins,
-		MaxAllowedSize: o.MaxAllowedSize,
-		ForwardHeaders: o.ForwardHeaders,
+	for name, source := range newImageSources(o) {
+		registry.sources[name] = source
 	}
+}
+
+// ImageSources represents a set of image sources, created for the virtual
+// hosts options instead of the registered sources
+type ImageSources map[ImageSourceType]ImageSource
+
+// NewImageSources creates the registered image sources for the server options
+func NewImageSources(o ServerOptions) ImageSources {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return newImageSources(o)
+}
+
+// newImageSources creates the registered image sources, the registry being
+// locked by the caller
+func newImageSources(o ServerOptions) ImageSources {
+	// Create single config instance
+	config := newSourceConfig(o)
 
 	// Initialize sources with shared config
+	sources := make(ImageSources, len(registry.factories))
 	for name, factory := range registry.factories {
 		config.Type = name
 		if source := factory(config); source != nil {
-			registry.sources[name] = source
+			sources[name] = source
+		}
+	}
+	return sources
+}
+
+// Match finds the appropriate source for a request, and its type
+func (s ImageSources) Match(req *http.Request) (ImageSource, ImageSourceType) {
+	for name, source := range s {
+		if source != nil && source.Matches(req) {
+			return source, name
 		}
 	}
+	return nil, ""
+}
+
+// newSourceConfig returns the image sources configuration from the server options
+func newSourceConfig(o ServerOptions) *SourceConfig {
+	return &SourceConfig{
+		AuthForwarding: o.AuthForwarding,
+		Authorization:  o.Authorization,
+		MountPath:      o.Mount,
+		Mounts:         o.Mounts,
+		AllowedOrigins: o.AllowedOrigins,
+		MaxAllowedSize: o.MaxAllowedSize,
+		MetadataRange:  o.MetadataRangeSize,
+		MaxBodySize:    o.MaxBodySize,
+		SpoolThreshold: o.SpoolThreshold,
+		ForwardHeaders: o.ForwardHeaders,
+		UserAgent:      o.OriginUserAgent,
+		Headers:        o.OriginHeaders,
+		ForwardQuery:   o.ForwardQuery,
+		Query:          o.OriginQuery,
+	}
 }
 
 // MatchSource finds the appropriate source for a request
@@ -97,3 +156,16 @@ func MatchSource(req *http.Request) ImageSource {
 	}
 	return nil
 }
+
+// SourceType returns the registered type of the given image source
+func SourceType(source ImageSource) ImageSourceType {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	for name, s := range registry.sources {
+		if s == source {
+			return name
+		}
+	}
+	return ""
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"strings"
 )
@@ -14,9 +14,6 @@ const (
 	multipartPrefix = "multipart/"
 )
 
-// Add error definition
-var ErrEntityTooLarge = errors.New("entity too large")
-
 const ImageSourceTypeBody ImageSourceType = "payload"
 
 type BodyImageSource struct {
@@ -37,39 +34,72 @@ func (s *BodyImageSource) Matches(r *http.Request) bool {
 }
 
 func (s *BodyImageSource) GetImage(r *http.Request) ([]byte, error) {
-	if strings.HasPrefix(r.Header.Get("Content-Type"), multipartPrefix) {
-		return readFormBody(r)
+	limit := s.Config.MaxBodySize
+	if limit <= 0 {
+		limit = maxMemory
+	}
+
+	// Bodies exceeding the spool threshold are buffered to temporary files
+	spool := inputSpoolFromContext(r.Context())
+	threshold := s.Config.SpoolThreshold
+	if spool == nil || threshold <= 0 || threshold >= limit {
+		spool, threshold = nil, maxMemory
+	}
+
+	var buf []byte
+	var err error
+	switch {
+	case strings.HasPrefix(r.Header.Get("Content-Type"), multipartPrefix):
+		buf, err = readFormBody(r, limit, threshold, spool)
+	case spool != nil:
+		buf, err = spool.spoolRawBody(r, threshold, limit)
+	default:
+		buf, err = readRawBody(r, limit)
 	}
-	return readRawBody(r)
+
+	// The body may be limited per endpoint by http.MaxBytesReader
+	if err != nil && isBodyTooLarge(err) {
+		return nil, ErrEntityTooLarge
+	}
+	return buf, err
 }
 
-func readFormBody(r *http.Request) ([]byte, error) {
-	// Parse with memory limit
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
+func readFormBody(r *http.Request, limit, memory int64, spool *inputSpool) ([]byte, error) {
+	// Parse with memory limit, storing the exceeding files on disk
+	if err := r.ParseMultipartForm(memory); err != nil {
+		if isBodyTooLarge(err) {
+			return nil, ErrEntityTooLarge
+		}
 		return nil, err
 	}
-	defer r.MultipartForm.RemoveAll()
 
-	file, _, err := r.FormFile(formFieldName)
+	file, header, err := r.FormFile(formFieldName)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	if spool != nil {
+		return spool.spoolFormFile(file, header.Size, limit)
+	}
+	return readFormFile(file, header.Size, limit)
+}
+
+func readFormFile(file multipart.File, size, limit int64) ([]byte, error) {
 	// Use buffer pooling for large files
 	var buf *bytes.Buffer
-	if size := r.ContentLength; size > 0 && size <= maxMemory {
+	if size > 0 && size <= limit {
 		buf = bytes.NewBuffer(make([]byte, 0, size))
 	} else {
 		buf = bytes.NewBuffer(make([]byte, 0, bytes.MinRead))
 	}
 
 	// Copy with size limit
-	written, err := io.CopyN(buf, file, maxMemory+1)
+	written, err := io.CopyN(buf, file, limit+1)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	if written > maxMemory {
+	if written > limit {
 		return nil, ErrEntityTooLarge
 	}
 	if buf.Len() == 0 {
@@ -79,17 +109,17 @@ func readFormBody(r *http.Request) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func readRawBody(r *http.Request) ([]byte, error) {
+func readRawBody(r *http.Request, limit int64) ([]byte, error) {
 	defer r.Body.Close()
 
 	// Use LimitReader for memory safety
-	limitReader := io.LimitReader(r.Body, maxMemory+1)
+	limitReader := io.LimitReader(r.Body, limit+1)
 	body, err := io.ReadAll(limitReader)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(body) > maxMemory {
+	if int64(len(body)) > limit {
 		return nil, ErrEntityTooLarge
 	}
 	if len(body) == 0 {
@@ -99,6 +129,39 @@ func readRawBody(r *http.Request) ([]byte, error) {
 	return body, nil
 }
 
+// readFormFiles reads the multipart form files sent along with the image,
+// by field name. Only the first file of each field is read.
+func readFormFiles(r *http.Request) (map[string][]byte, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+
+	files := make(map[string][]byte, len(r.MultipartForm.File))
+	for field, headers := range r.MultipartForm.File {
+		if field == formFieldName || len(headers) == 0 {
+			continue
+		}
+
+		file, err := headers[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		buf, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[field] = buf
+	}
+	return files, nil
+}
+
+// isBodyTooLarge reports whether the error was caused by http.MaxBytesReader,
+// which only exposes its error message in the supported Go versions
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
+
 func init() {
 	RegisterSource(ImageSourceTypeBody, NewBodyImageSource)
 }
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -76,3 +79,76 @@ func testReadBody(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestBodyImageSourceMaxBodySize(t *testing.T) {
+	source := NewBodyImageSource(&SourceConfig{MaxBodySize: 10})
+
+	r := httptest.NewRequest(http.MethodPost, "http://foo/bar", strings.NewReader("0123456789abc"))
+	if _, err := source.GetImage(r); err != ErrEntityTooLarge {
+		t.Errorf("Expected entity too large error, got: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "http://foo/bar", strings.NewReader("0123456789"))
+	if body, err := source.GetImage(r); err != nil || string(body) != "0123456789" {
+		t.Errorf("Invalid body: %s (%v)", body, err)
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	o := ServerOptions{MaxBodySize: 100, MaxBodySizes: map[string]int64{"resize": 5}}
+	source := NewBodyImageSource(&SourceConfig{})
+
+	var readErr error
+	handler := limitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = source.GetImage(r)
+	}), o)
+
+	// Declared Content-Length is rejected before reading the body
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/resize", strings.NewReader("0123456789")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Invalid response status: %d", w.Code)
+	}
+
+	// Unknown Content-Length is limited while reading the body
+	r := httptest.NewRequest(http.MethodPost, "/resize", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if readErr != ErrEntityTooLarge {
+		t.Errorf("Expected entity too large error, got: %v", readErr)
+	}
+
+	// Other endpoints use the global limit
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/crop", strings.NewReader("0123456789")))
+	if w.Code != http.StatusOK || readErr != nil {
+		t.Errorf("Unexpected error: %d (%v)", w.Code, readErr)
+	}
+}
+
+func TestReadFormFiles(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for field, content := range map[string]string{"file": "image", "logo": "watermark"} {
+		part, _ := form.CreateFormFile(field, field+".png")
+		_, _ = part.Write([]byte(content))
+	}
+	_ = form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/watermarkimage?image=logo", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	buf, err := NewBodyImageSource(&SourceConfig{}).GetImage(r)
+	if err != nil || string(buf) != "image" {
+		t.Fatalf("Invalid image: %s (%v)", buf, err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files, err := readFormFiles(r)
+	if err != nil {
+		t.Fatalf("Cannot read form files: %s", err)
+	}
+	if len(files) != 1 || string(files["logo"]) != "watermark" {
+		t.Errorf("Invalid form files: %v", files)
+	}
+}
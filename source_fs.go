@@ -4,12 +4,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -34,30 +34,76 @@ func (s *FileSystemImageSource) Matches(r *http.Request) bool {
 }
 
 func (s *FileSystemImageSource) GetImage(r *http.Request) ([]byte, error) {
-	file, err := s.getFileParam(r)
+	fsys, name, err := s.resolve(r)
 	if err != nil {
 		return nil, err
 	}
 
+	// Read file with proper error handling
+	return s.read(fsys, name)
+}
+
+// ModTime returns the modification time of the requested file, without
+// reading it
+func (s *FileSystemImageSource) ModTime(r *http.Request) (time.Time, error) {
+	fsys, name, err := s.resolve(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return time.Time{}, ErrInvalidFilePath
+	}
+	return info.ModTime(), nil
+}
+
+// resolve returns the mount and the path within it of the requested file
+func (s *FileSystemImageSource) resolve(r *http.Request) (fs.FS, string, error) {
+	file, err := s.getFileParam(r)
+	if err != nil {
+		return nil, "", err
+	}
+
 	if file == "" {
-		return nil, ErrMissingParamFile
+		return nil, "", ErrMissingParamFile
 	}
 
-	// Build path and validate in one step
-	cleanPath := filepath.Clean(filepath.Join(s.Config.MountPath, file))
-	if !strings.HasPrefix(cleanPath, s.Config.MountPath) {
-		return nil, ErrInvalidFilePath
+	mount, err := selectMount(r, s.Config.MountPath, s.Config.Mounts)
+	if err != nil {
+		return nil, "", err
+	}
+	fsys, err := openMount(mount)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open mount: %w", err)
 	}
 
-	// Read file with proper error handling
-	return s.read(cleanPath)
+	name, err := mountFilePath(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Globs resolve to the newest match, unless a file is named alike
+	if isGlobPattern(name) {
+		if _, err := fs.Stat(fsys, name); errors.Is(err, fs.ErrNotExist) {
+			if name, err = newestMatch(fsys, name); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	return fsys, name, nil
 }
 
-func (s *FileSystemImageSource) read(file string) ([]byte, error) {
-	// Use os.Open instead of ReadFile for better memory control
-	f, err := os.Open(file)
+func (s *FileSystemImageSource) read(fsys fs.FS, file string) ([]byte, error) {
+	// Use Open instead of ReadFile for better memory control
+	f, err := fsys.Open(file)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrImageNotFound
+		}
+		if errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrInvalid) {
 			return nil, ErrInvalidFilePath
 		}
 		return nil, fmt.Errorf("failed to read file: %w", err)
@@ -69,10 +115,13 @@ func (s *FileSystemImageSource) read(file string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to stat file: %w", err)
 	}
+	if info.IsDir() {
+		return nil, ErrInvalidFilePath
+	}
 
 	// Pre-allocate buffer with exact size
 	buf := make([]byte, info.Size())
-	_, err = f.Read(buf)
+	_, err = io.ReadFull(f, buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file contents: %w", err)
 	}
@@ -80,6 +129,39 @@ func (s *FileSystemImageSource) read(file string) ([]byte, error) {
 	return buf, nil
 }
 
+// isGlobPattern reports whether the file param uses path.Match wildcards
+func isGlobPattern(file string) bool {
+	return strings.ContainsAny(file, "*?[")
+}
+
+// newestMatch returns the most recently modified file matching the pattern,
+// such as kiosk/screen-*.jpg for timestamped file names. The matches are
+// within the pattern directory, the mount directory or below.
+func newestMatch(fsys fs.FS, pattern string) (string, error) {
+	matches, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return "", ErrInvalidFilePath
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, match := range matches {
+		info, err := fs.Stat(fsys, match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// Equally old files resolve to the last name, as the timestamped ones
+		if newest == "" || info.ModTime().After(newestTime) || (info.ModTime().Equal(newestTime) && match > newest) {
+			newest, newestTime = match, info.ModTime()
+		}
+	}
+
+	if newest == "" {
+		return "", ErrImageNotFound
+	}
+	return newest, nil
+}
+
 func (s *FileSystemImageSource) getFileParam(r *http.Request) (string, error) {
 	// Get query value without allocating a new map
 	fileQuery := r.URL.Query().Get(fileParam)
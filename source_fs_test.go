@@ -4,8 +4,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFileSystemImageSource(t *testing.T) {
@@ -36,3 +39,87 @@ func TestFileSystemImageSource(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestFileSystemImageSourceGlob(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"screen-1.jpg", "screen-2.jpg", "screen-3.jpg"} {
+		file := filepath.Join(dir, name)
+		_ = ioutil.WriteFile(file, []byte(name), 0644)
+		// screen-2.jpg is the most recently modified
+		modified := now.Add(time.Duration(i) * -time.Hour)
+		if name == "screen-2.jpg" {
+			modified = now.Add(time.Hour)
+		}
+		_ = os.Chtimes(file, modified, modified)
+	}
+
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: dir})
+	cases := []struct {
+		file string
+		body string
+		err  error
+	}{
+		{"screen-*.jpg", "screen-2.jpg", nil},
+		{"screen-[13].jpg", "screen-1.jpg", nil},
+		{"other-*.jpg", "", ErrImageNotFound},
+		{"screen-[.jpg", "", ErrInvalidFilePath},
+		{"../*", "", ErrInvalidFilePath},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/resize?file="+url.QueryEscape(c.file), nil)
+		body, err := source.GetImage(r)
+		if err != c.err || string(body) != c.body {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", c.file, c.body, c.err, body, err)
+		}
+	}
+}
+
+func TestFileSystemImageSourceEscape(t *testing.T) {
+	dir := t.TempDir()
+	mount := filepath.Join(dir, "images")
+	_ = os.Mkdir(mount, 0755)
+	_ = ioutil.WriteFile(filepath.Join(dir, "images-private.jpg"), []byte("private"), 0644)
+
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: mount})
+	for _, file := range []string{"../images-private.jpg", "../../etc/passwd", "."} {
+		r := httptest.NewRequest(http.MethodGet, "/resize?file="+url.QueryEscape(file), nil)
+		if _, err := source.GetImage(r); err != ErrInvalidFilePath {
+			t.Errorf("%s: expected invalid file path error, got: %v", file, err)
+		}
+	}
+}
+
+func TestFileSystemImageSourceModTime(t *testing.T) {
+	dir := t.TempDir()
+	modified := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, name := range []string{"screen-1.jpg", "screen-2.jpg"} {
+		file := filepath.Join(dir, name)
+		_ = ioutil.WriteFile(file, []byte(name), 0644)
+		_ = os.Chtimes(file, modified, modified)
+		modified = modified.Add(time.Hour)
+	}
+	_ = os.Mkdir(filepath.Join(dir, "folder"), 0755)
+
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: dir}).(ModTimeSource)
+	cases := []struct {
+		file     string
+		expected time.Time
+		err      bool
+	}{
+		{"screen-1.jpg", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), false},
+		{"screen-*.jpg", time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), false},
+		{"missing.jpg", time.Time{}, true},
+		{"folder", time.Time{}, true},
+		{"../screen-1.jpg", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/resize?file="+url.QueryEscape(c.file), nil)
+		modTime, err := source.ModTime(r)
+		if (err != nil) != c.err || !modTime.Equal(c.expected) {
+			t.Errorf("%s: expected %s, got %s (%v)", c.file, c.expected, modTime, err)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,27 +18,52 @@ const (
 	ImageSourceTypeHTTP ImageSourceType = "http"
 	URLQueryKey                         = "url"
 	defaultTimeout                      = 60 * time.Second
+	// maxRedirects is the number of redirects followed by the origin requests
+	maxRedirects = 10
+	// sniffLength is the number of bytes sniffed by http.DetectContentType
+	sniffLength = 512
 )
 
+// errForbiddenOrigin is returned when the remote URL origin is not allowed
+var errForbiddenOrigin = errors.New("not allowed remote URL origin")
+
 type HTTPImageSource struct {
 	Config *SourceConfig
 	client *http.Client
 }
 
 func NewHTTPImageSource(config *SourceConfig) ImageSource {
-	return &HTTPImageSource{
-		Config: config,
-		client: &http.Client{
-			Timeout: defaultTimeout,
-			Transport: &http.Transport{
-				MaxIdleConns:       100,
-				IdleConnTimeout:    90 * time.Second,
-				DisableCompression: true,
-				MaxConnsPerHost:    10,
-				DisableKeepAlives:  false,
-			},
+	source := &HTTPImageSource{Config: config}
+	source.client = &http.Client{
+		Timeout:       defaultTimeout,
+		CheckRedirect: source.checkRedirect,
+		Transport: &http.Transport{
+			MaxIdleConns:       100,
+			IdleConnTimeout:    90 * time.Second,
+			DisableCompression: true,
+			MaxConnsPerHost:    10,
+			DisableKeepAlives:  false,
 		},
 	}
+	return source
+}
+
+// checkRedirect follows up to maxRedirects redirects, as the default policy,
+// to the allowed origins only, only sending the static origin headers to the
+// host of the image URL
+func (s *HTTPImageSource) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if s.shouldRestrictOrigin(req.URL) {
+		return fmt.Errorf("%w: %s%s", errForbiddenOrigin, req.URL.Host, req.URL.Path)
+	}
+	if req.URL.Host != via[0].URL.Host {
+		for name := range s.Config.Headers {
+			req.Header.Del(name)
+		}
+	}
+	return nil
 }
 
 func (s *HTTPImageSource) Matches(r *http.Request) bool {
@@ -48,97 +77,225 @@ func (s *HTTPImageSource) GetImage(req *http.Request) ([]byte, error) {
 	}
 
 	if s.shouldRestrictOrigin(u) {
-		return nil, fmt.Errorf("not allowed remote URL origin: %s%s", u.Host, u.Path)
+		return nil, fmt.Errorf("%w: %s%s", errForbiddenOrigin, u.Host, u.Path)
+	}
+
+	if size := s.metadataRangeSize(req); size > 0 {
+		buf, partial, err := s.fetchImageRange(u, req, size)
+		if err != nil || !partial || imageHeaderComplete(buf) {
+			return buf, err
+		}
+		// The image header exceeds the fetched range, fetch the whole image
 	}
 
 	return s.fetchImage(u, req)
 }
 
-func (s *HTTPImageSource) shouldRestrictOrigin(url *url.URL) bool {
-	if len(s.Config.AllowedOrigins) == 0 {
-		return false
+// metadataRangeSize returns the bytes fetched via Range requests for the
+// metadata only endpoints, which only read the image header, or 0
+func (s *HTTPImageSource) metadataRangeSize(req *http.Request) int64 {
+	if s.Config.MetadataRange <= 0 || path.Base(req.URL.Path) != "info" {
+		return 0
 	}
+	return int64(s.Config.MetadataRange)
+}
 
-	urlPath := url.Path
-	urlHost := url.Host
-	for _, origin := range s.Config.AllowedOrigins {
-		if origin.Host == urlHost && strings.HasPrefix(urlPath, origin.Path) {
-			return false
-		}
-
-		if strings.HasPrefix(origin.Host, "*.") {
-			suffix := origin.Host[1:]
-			if (urlHost == origin.Host[2:] || strings.HasSuffix(urlHost, suffix)) &&
-				strings.HasPrefix(urlPath, origin.Path) {
-				return false
-			}
-		}
-	}
-	return true
+func (s *HTTPImageSource) shouldRestrictOrigin(url *url.URL) bool {
+	return shouldRestrictOrigin(url, s.Config.AllowedOrigins)
 }
 
 func (s *HTTPImageSource) fetchImage(url *url.URL, ireq *http.Request) ([]byte, error) {
 	ctx := ireq.Context()
 
-	if s.Config.MaxAllowedSize > 0 {
-		if err := s.checkImageSize(ctx, url, ireq); err != nil {
-			return nil, err
-		}
-	}
-
 	req := s.newRequest(ctx, http.MethodGet, url, ireq)
 	res, err := s.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching remote http image: %w", err)
+		return nil, originFetchError(err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, NewError(fmt.Sprintf("error fetching remote http image: (status=%d) (url=%s)",
-			res.StatusCode, req.URL.String()), res.StatusCode)
+		return nil, originStatusError(fmt.Sprintf("error fetching remote http image: (status=%d) (url=%s)",
+			res.StatusCode, url.String()), res.StatusCode)
 	}
 
-	// Use io.ReadAll directly since we don't need the pre-allocated buffer
-	return io.ReadAll(io.LimitReader(res.Body, int64(s.Config.MaxAllowedSize)))
+	return s.readImage(res, res.ContentLength, int64(s.Config.MaxAllowedSize))
 }
 
-func (s *HTTPImageSource) checkImageSize(ctx context.Context, url *url.URL, ireq *http.Request) error {
-	req := s.newRequest(ctx, http.MethodHead, url, ireq)
+// fetchImageRange fetches the first bytes of the image via a Range request,
+// reporting whether the image is partial. Origins ignoring the Range header
+// reply the whole image.
+func (s *HTTPImageSource) fetchImageRange(url *url.URL, ireq *http.Request, size int64) ([]byte, bool, error) {
+	req := s.newRequest(ireq.Context(), http.MethodGet, url, ireq)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
 	res, err := s.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error checking image size: %w", err)
+		return nil, false, originFetchError(err)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode < 200 || res.StatusCode > 206 {
-		return NewError(fmt.Sprintf("invalid status checking image size: (status=%d) (url=%s)",
+	switch res.StatusCode {
+	case http.StatusOK:
+		buf, err := s.readImage(res, res.ContentLength, int64(s.Config.MaxAllowedSize))
+		return buf, false, err
+	case http.StatusPartialContent:
+		total := contentRangeSize(res.Header.Get("Content-Range"))
+		buf, err := s.readImage(res, total, size)
+		return buf, total < 0 || int64(len(buf)) < total, err
+	default:
+		return nil, false, originStatusError(fmt.Sprintf("error fetching remote http image: (status=%d) (url=%s)",
 			res.StatusCode, url.String()), res.StatusCode)
 	}
+}
 
-	if contentLength := res.ContentLength; contentLength > int64(s.Config.MaxAllowedSize) {
-		return fmt.Errorf("content length %d exceeds maximum allowed %d bytes",
-			contentLength, s.Config.MaxAllowedSize)
+// readImage reads the origin response body, up to the given limit, if any.
+// The image size, declared via the Content-Length or Content-Range headers,
+// is optional and not trusted, the read aborts once it exceeds the limit.
+func (s *HTTPImageSource) readImage(res *http.Response, imageSize, limit int64) ([]byte, error) {
+	// Reject HTML error pages, videos and alike before downloading them
+	if contentType := res.Header.Get("Content-Type"); isNonImageMediaType(contentType) {
+		return nil, originMediaTypeError(contentType)
 	}
 
-	return nil
+	maxSize := int64(s.Config.MaxAllowedSize)
+	if maxSize > 0 && imageSize > maxSize {
+		return nil, s.imageTooLargeError(imageSize)
+	}
+	var reader io.Reader = res.Body
+	if limit > 0 {
+		reader = io.LimitReader(res.Body, limit+1)
+	}
+
+	body := bufio.NewReaderSize(reader, sniffLength)
+	if head, _ := body.Peek(sniffLength); len(head) > 0 {
+		if mimeType := detectMimeType(head); isNonImageMediaType(mimeType) {
+			return nil, originMediaTypeError(mimeType)
+		}
+	}
+
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		return nil, NewError("error reading remote http image: "+err.Error(), http.StatusBadRequest).WithKind(KindOriginUnreachable)
+	}
+	// The size is unknown, since the read aborts after the limit
+	if maxSize > 0 && int64(len(buf)) > maxSize {
+		return nil, s.imageTooLargeError(0)
+	}
+	if limit > 0 && int64(len(buf)) > limit {
+		buf = buf[:limit]
+	}
+	return buf, nil
+}
+
+// contentRangeSize returns the complete length of the Content-Range header,
+// such as bytes 0-1023/146515, or -1 if unknown
+func contentRangeSize(contentRange string) int64 {
+	slash := strings.LastIndexByte(contentRange, '/')
+	if slash < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// imageTooLargeError returns the error of the remote image exceeding the
+// allowed size, reporting its size, if known
+func (s *HTTPImageSource) imageTooLargeError(size int64) Error {
+	return NewSizeError(NewError("Remote image size exceeds the allowed limit", http.StatusRequestEntityTooLarge).WithKind(ErrImageTooLarge.Kind),
+		size, int64(s.Config.MaxAllowedSize))
+}
+
+// isNonImageMediaType reports whether the media type is certainly not an
+// image, such as the origin HTML error pages or videos
+func isNonImageMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json", "text/css", "text/javascript",
+		"application/javascript", "application/zip", "application/x-gzip":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "font/")
+}
+
+func originMediaTypeError(mediaType string) Error {
+	return NewError("unsupported origin media type: "+mediaType, http.StatusUnsupportedMediaType).WithKind(ErrUnsupportedMedia.Kind)
+}
+
+// originFetchError returns the error of the failed origin request, keeping
+// the redirects to forbidden origins
+func originFetchError(err error) error {
+	if errors.Is(err, errForbiddenOrigin) {
+		return errors.Unwrap(err)
+	}
+	return NewError("error fetching remote http image: "+err.Error(), http.StatusBadRequest).WithKind(KindOriginUnreachable)
+}
+
+// originStatusError returns the error replied when the origin server replies
+// an unexpected status code, which is kept as reply status code
+func originStatusError(message string, status int) Error {
+	if status == http.StatusNotFound {
+		return NewError(message, status).WithKind(ErrImageNotFound.Kind)
+	}
+	return NewError(message, status).WithKind(KindOriginError)
 }
 
 func (s *HTTPImageSource) newRequest(ctx context.Context, method string, url *url.URL, ireq *http.Request) *http.Request {
+	url = s.originURL(url, ireq)
 	req, _ := http.NewRequestWithContext(ctx, method, url.String(), nil)
-	req.Header.Set("User-Agent", "imaginary/"+Version)
+	req.Header.Set("User-Agent", s.userAgent())
 	req.URL = url
 
+	if len(s.Config.ForwardHeaders) > 0 {
+		s.setForwardHeaders(req, ireq)
+	}
+
+	// The authorization header takes precedence over the forwarded ones
 	if s.Config.AuthForwarding || s.Config.Authorization != "" {
 		s.setAuthorizationHeader(req, ireq)
 	}
 
-	if len(s.Config.ForwardHeaders) > 0 {
-		s.setForwardHeaders(req, ireq)
+	// The static origin headers take precedence over the forwarded ones
+	for name, values := range s.Config.Headers {
+		req.Header[name] = append([]string(nil), values...)
 	}
 
 	return req
 }
 
+// originURL returns a copy of the origin URL including the forwarded query
+// params, and the static query params, which take precedence
+func (s *HTTPImageSource) originURL(u *url.URL, ireq *http.Request) *url.URL {
+	if len(s.Config.ForwardQuery) == 0 && len(s.Config.Query) == 0 {
+		return u
+	}
+
+	query := u.Query()
+	incoming := ireq.URL.Query()
+	for _, name := range s.Config.ForwardQuery {
+		if values, ok := incoming[name]; ok {
+			query[name] = values
+		}
+	}
+	for name, values := range s.Config.Query {
+		query[name] = values
+	}
+
+	origin := *u
+	origin.RawQuery = query.Encode()
+	return &origin
+}
+
+func (s *HTTPImageSource) userAgent() string {
+	if s.Config.UserAgent != "" {
+		return s.Config.UserAgent
+	}
+	return "imaginary/" + Version
+}
+
 func (s *HTTPImageSource) setAuthorizationHeader(req, ireq *http.Request) {
 	switch {
 	case s.Config.Authorization != "":
@@ -159,6 +316,28 @@ func (s *HTTPImageSource) setForwardHeaders(req, ireq *http.Request) {
 	}
 }
 
+// parseOriginHeaders parses the comma separated Name:Value list of static
+// headers sent to the image origin servers
+func parseOriginHeaders(input string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range strings.Split(input, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid header: %s", entry)
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid header value: %s", name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
 func init() {
 	RegisterSource(ImageSourceTypeHTTP, NewHTTPImageSource)
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const fixtureImage = "testdata/large.jpg"
@@ -100,6 +105,33 @@ func TestHttpImageSourceNotAllowedOrigin(t *testing.T) {
 	fakeHandler(w, r)
 }
 
+func TestHttpImageSourceNotAllowedRedirect(t *testing.T) {
+	var fetched bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/internal", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	for _, size := range []int{0, 4096} {
+		source := NewHTTPImageSource(&SourceConfig{AllowedOrigins: parseOrigins(ts.URL), MetadataRange: size})
+		r, _ := http.NewRequest(http.MethodGet, "http://foo/info?url="+ts.URL, nil)
+		_, err := source.GetImage(r)
+		if !errors.Is(err, errForbiddenOrigin) {
+			t.Errorf("Expected not allowed origin error, got: %v", err)
+		}
+		if xerr := sourceError(err); xerr.Kind != KindOriginForbidden {
+			t.Errorf("Invalid error kind: %s", xerr.Kind)
+		}
+	}
+	if fetched {
+		t.Error("Unexpected request to the not allowed origin")
+	}
+}
+
 func TestHttpImageSourceForwardAuthHeader(t *testing.T) {
 	cases := []string{
 		"X-Forward-Authorization",
@@ -110,7 +142,7 @@ func TestHttpImageSourceForwardAuthHeader(t *testing.T) {
 		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url=http://bar.com", nil)
 		r.Header.Set(header, "foobar")
 
-		source := &HTTPImageSource{&SourceConfig{AuthForwarding: true}}
+		source := &HTTPImageSource{Config: &SourceConfig{AuthForwarding: true}}
 		if !source.Matches(r) {
 			t.Fatal("Cannot match the request")
 		}
@@ -134,7 +166,7 @@ func TestHttpImageSourceForwardHeaders(t *testing.T) {
 		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url=http://bar.com", nil)
 		r.Header.Set(header, "foobar")
 
-		source := &HTTPImageSource{&SourceConfig{ForwardHeaders: cases}}
+		source := &HTTPImageSource{Config: &SourceConfig{ForwardHeaders: cases}}
 		if !source.Matches(r) {
 			t.Fatal("Cannot match the request")
 		}
@@ -159,12 +191,12 @@ func TestHttpImageSourceNotForwardHeaders(t *testing.T) {
 	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+testURL.String(), nil)
 	r.Header.Set("Not-Forward", "foobar")
 
-	source := &HTTPImageSource{&SourceConfig{ForwardHeaders: cases}}
+	source := &HTTPImageSource{Config: &SourceConfig{ForwardHeaders: cases}}
 	if !source.Matches(r) {
 		t.Fatal("Cannot match the request")
 	}
 
-	oreq := newHTTPRequest(source, r, http.MethodGet, testURL)
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
 
 	if oreq.Header.Get("Not-Forward") != "" {
 		t.Fatal("Forwarded unspecified header")
@@ -182,12 +214,12 @@ func TestHttpImageSourceForwardedHeadersNotOverride(t *testing.T) {
 	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+testURL.String(), nil)
 	r.Header.Set("Authorization", "foobar")
 
-	source := &HTTPImageSource{&SourceConfig{Authorization: "ValidAPIKey", ForwardHeaders: cases}}
+	source := &HTTPImageSource{Config: &SourceConfig{Authorization: "ValidAPIKey", ForwardHeaders: cases}}
 	if !source.Matches(r) {
 		t.Fatal("Cannot match the request")
 	}
 
-	oreq := newHTTPRequest(source, r, http.MethodGet, testURL)
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
 
 	if oreq.Header.Get("Authorization") != "ValidAPIKey" {
 		t.Fatal("Authorization header override")
@@ -205,12 +237,12 @@ func TestHttpImageSourceCaseSensitivityInForwardedHeaders(t *testing.T) {
 	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+testURL.String(), nil)
 	r.Header.Set("x-custom", "foobar")
 
-	source := &HTTPImageSource{&SourceConfig{ForwardHeaders: cases}}
+	source := &HTTPImageSource{Config: &SourceConfig{ForwardHeaders: cases}}
 	if !source.Matches(r) {
 		t.Fatal("Cannot match the request")
 	}
 
-	oreq := newHTTPRequest(source, r, http.MethodGet, testURL)
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
 
 	if oreq.Header.Get("X-Custom") == "" {
 		t.Fatal("Case sensitive not working on forwarded headers")
@@ -224,7 +256,7 @@ func TestHttpImageSourceEmptyForwardedHeaders(t *testing.T) {
 
 	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+testURL.String(), nil)
 
-	source := &HTTPImageSource{&SourceConfig{ForwardHeaders: cases}}
+	source := &HTTPImageSource{Config: &SourceConfig{ForwardHeaders: cases}}
 	if !source.Matches(r) {
 		t.Fatal("Cannot match the request")
 	}
@@ -234,13 +266,139 @@ func TestHttpImageSourceEmptyForwardedHeaders(t *testing.T) {
 		t.Fatal("Set empty custom header")
 	}
 
-	oreq := newHTTPRequest(source, r, http.MethodGet, testURL)
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
 
 	if oreq == nil {
 		t.Fatal("Error creating request using empty custom headers")
 	}
 }
 
+func TestHttpImageSourceOriginHeaders(t *testing.T) {
+	testURL := createURL("http://bar.com", t)
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+testURL.String(), nil)
+	r.Header.Set("X-Origin-Secret", "forged")
+
+	headers := http.Header{"X-Origin-Secret": {"s3cr3t"}}
+	source := &HTTPImageSource{Config: &SourceConfig{UserAgent: "Mozilla/5.0", Headers: headers, ForwardHeaders: []string{"X-Origin-Secret"}}}
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
+
+	if oreq.Header.Get("User-Agent") != "Mozilla/5.0" {
+		t.Errorf("Invalid User-Agent header: %s", oreq.Header.Get("User-Agent"))
+	}
+	if oreq.Header.Get("X-Origin-Secret") != "s3cr3t" {
+		t.Errorf("Static header overridden: %s", oreq.Header.Get("X-Origin-Secret"))
+	}
+
+	source = &HTTPImageSource{Config: &SourceConfig{}}
+	oreq = source.newRequest(r.Context(), http.MethodGet, testURL, r)
+	if oreq.Header.Get("User-Agent") != "imaginary/"+Version {
+		t.Errorf("Invalid default User-Agent header: %s", oreq.Header.Get("User-Agent"))
+	}
+}
+
+func TestHttpImageSourceRedirectHeaders(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	var secrets []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets = append(secrets, r.Header.Get("X-Origin-Secret"))
+		_, _ = w.Write(buf)
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets = append(secrets, r.Header.Get("X-Origin-Secret"))
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/image.jpg", http.StatusFound)
+		case "/other":
+			http.Redirect(w, r, other.URL+"/image.jpg", http.StatusFound)
+		default:
+			_, _ = w.Write(buf)
+		}
+	}))
+	defer ts.Close()
+
+	headers := http.Header{"X-Origin-Secret": {"s3cr3t"}}
+	source := NewHTTPImageSource(&SourceConfig{Headers: headers, AllowedOrigins: parseOrigins(ts.URL + "," + other.URL)})
+
+	cases := []struct {
+		path    string
+		secrets []string
+	}{
+		{"/same", []string{"s3cr3t", "s3cr3t"}},
+		{"/other", []string{"s3cr3t", ""}},
+	}
+	for _, c := range cases {
+		secrets = nil
+		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL+c.path, nil)
+		if _, err := source.GetImage(r); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(secrets, c.secrets) {
+			t.Errorf("%s: invalid origin headers: %q", c.path, secrets)
+		}
+	}
+}
+
+func TestHttpImageSourceOriginQuery(t *testing.T) {
+	testURL := createURL("http://bar.com/image.jpg?v=1&key=forged", t)
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?width=300&expires=1700000000&url="+url.QueryEscape(testURL.String()), nil)
+
+	source := &HTTPImageSource{Config: &SourceConfig{ForwardQuery: []string{"expires", "token"}, Query: url.Values{"key": {"s3cr3t"}}}}
+	oreq := source.newRequest(r.Context(), http.MethodGet, testURL, r)
+
+	if query := oreq.URL.Query(); query.Get("v") != "1" || query.Get("expires") != "1700000000" || query.Get("key") != "s3cr3t" || len(query) != 3 {
+		t.Errorf("Invalid origin URL: %s", oreq.URL)
+	}
+	if testURL.RawQuery != "v=1&key=forged" {
+		t.Errorf("Image URL modified: %s", testURL)
+	}
+}
+
+func TestParseOriginHeaders(t *testing.T) {
+	headers, err := parseOriginHeaders("X-Origin-Secret: s3cr3t, accept:image/*,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if headers.Get("X-Origin-Secret") != "s3cr3t" || headers.Get("Accept") != "image/*" || len(headers) != 2 {
+		t.Errorf("Invalid headers: %v", headers)
+	}
+
+	for _, input := range []string{"X-Origin-Secret", ":s3cr3t", "X Origin:s3cr3t"} {
+		if _, err := parseOriginHeaders(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestHttpImageSourceNonImageContent(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/html; charset=utf-8", "<html><body>Not found</body></html>"},
+		{"video/mp4", "\x00\x00\x00\x18ftypmp42"},
+		{"application/octet-stream", "<!DOCTYPE html><html><body>Not found</body></html>"},
+		{"", "\x1aE\xdf\xa3webm"},
+	}
+
+	for _, c := range cases {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			_, _ = w.Write([]byte(c.body))
+		}))
+
+		source := NewHTTPImageSource(&SourceConfig{MaxAllowedSize: 1024})
+		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+		_, err := source.GetImage(r)
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected unsupported media type error for %q, got: %v", c.contentType, err)
+		}
+		ts.Close()
+	}
+}
+
 func TestHttpImageSourceError(t *testing.T) {
 	var err error
 
@@ -297,6 +455,85 @@ func TestHttpImageSourceExceedsMaximumAllowedLength(t *testing.T) {
 	fakeHandler(w, r)
 }
 
+func TestHttpImageSourceStreamedExceedsMaximumAllowedSize(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	var heads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		// Flushing the chunks omits the Content-Length header
+		for chunk := buf; len(chunk) > 0; {
+			n := 4096
+			if n > len(chunk) {
+				n = len(chunk)
+			}
+			_, _ = w.Write(chunk[:n])
+			w.(http.Flusher).Flush()
+			chunk = chunk[n:]
+		}
+	}))
+	defer ts.Close()
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+
+	source := NewHTTPImageSource(&SourceConfig{MaxAllowedSize: len(buf) - 1})
+	_, err := source.GetImage(r)
+	if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected image too large error, got: %v", err)
+	}
+
+	source = NewHTTPImageSource(&SourceConfig{MaxAllowedSize: len(buf)})
+	if body, err := source.GetImage(r); err != nil || len(body) != len(buf) {
+		t.Errorf("Invalid image body (%d bytes): %v", len(body), err)
+	}
+	if heads != 0 {
+		t.Errorf("Unexpected %d HEAD requests", heads)
+	}
+}
+
+func TestHttpImageSourceMetadataRange(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "large.jpg", time.Time{}, bytes.NewReader(buf))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		path   string
+		size   int
+		length int
+		ranges []string
+	}{
+		{"/info", 4096, 4096, []string{"bytes=0-4095"}},
+		{"/info", 100, len(buf), []string{"bytes=0-99", ""}},
+		{"/info", len(buf) * 2, len(buf), []string{fmt.Sprintf("bytes=0-%d", len(buf)*2-1)}},
+		{"/info", 0, len(buf), []string{""}},
+		{"/resize", 4096, len(buf), []string{""}},
+	}
+
+	for _, c := range cases {
+		ranges = nil
+		source := NewHTTPImageSource(&SourceConfig{MetadataRange: c.size, MaxAllowedSize: len(buf)})
+		r, _ := http.NewRequest(http.MethodGet, "http://foo"+c.path+"?url="+ts.URL, nil)
+		body, err := source.GetImage(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(body) != c.length || !reflect.DeepEqual(ranges, c.ranges) {
+			t.Errorf("%s with %d bytes range: invalid fetch of %d bytes via %q", c.path, c.size, len(body), ranges)
+		}
+	}
+
+	source := NewHTTPImageSource(&SourceConfig{MetadataRange: 4096, MaxAllowedSize: len(buf) - 1})
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/info?url="+ts.URL, nil)
+	if _, err := source.GetImage(r); err == nil {
+		t.Error("Expected image too large error")
+	}
+}
+
 func TestShouldRestrictOrigin(t *testing.T) {
 	plainOrigins := parseOrigins(
 		"https://example.org",
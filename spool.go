@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// inputSpool holds the request bodies spooled to temporary files, memory
+// mapped instead of read into the heap, so libvips reads the image from the
+// file pages. The files are unmapped once the request, and the transformations
+// still running in background after exceeding their budget, are done.
+type inputSpool struct {
+	mu     sync.Mutex
+	refs   int
+	unmaps []func() error
+}
+
+type inputSpoolKey struct{}
+
+// withInputSpool returns the request spooling its large bodies, along with the
+// function releasing them once the request is done
+func withInputSpool(r *http.Request) (*http.Request, func()) {
+	spool := &inputSpool{refs: 1}
+	return r.WithContext(context.WithValue(r.Context(), inputSpoolKey{}, spool)), spool.release
+}
+
+func inputSpoolFromContext(ctx context.Context) *inputSpool {
+	spool, _ := ctx.Value(inputSpoolKey{}).(*inputSpool)
+	return spool
+}
+
+// retainInputSpool keeps the request spooled bodies mapped until the returned
+// function is called
+func retainInputSpool(ctx context.Context) func() {
+	spool := inputSpoolFromContext(ctx)
+	if spool == nil {
+		return func() {}
+	}
+	spool.mu.Lock()
+	spool.refs++
+	spool.mu.Unlock()
+	return spool.release
+}
+
+func (s *inputSpool) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return
+	}
+	for _, unmap := range s.unmaps {
+		if err := unmap(); err != nil {
+			log.Printf("cannot unmap spooled request body: %s", err)
+		}
+	}
+	s.unmaps = nil
+}
+
+// mapFile maps the file and registers its unmapping on release
+func (s *inputSpool) mapFile(file *os.File, size int64) ([]byte, error) {
+	buf, unmap, err := mapFile(file, size)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.unmaps = append(s.unmaps, unmap)
+	s.mu.Unlock()
+	return buf, nil
+}
+
+// spoolRawBody reads the request body, up to the limit, spooling it to a
+// temporary file once it exceeds the threshold
+func (s *inputSpool) spoolRawBody(r *http.Request, threshold, limit int64) ([]byte, error) {
+	defer r.Body.Close()
+
+	head, err := io.ReadAll(io.LimitReader(r.Body, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) <= threshold {
+		if len(head) == 0 {
+			return nil, ErrEmptyBody
+		}
+		return head, nil
+	}
+
+	file, err := ioutil.TempFile("", "imaginary-body-")
+	if err != nil {
+		return nil, err
+	}
+	// The mapping outlives the file, which is removed right away
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(head); err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(file, io.LimitReader(r.Body, limit+1-int64(len(head))))
+	if err != nil {
+		return nil, err
+	}
+	if size := int64(len(head)) + written; size > limit {
+		return nil, ErrEntityTooLarge
+	}
+	return s.mapFile(file, int64(len(head))+written)
+}
+
+// spoolFormFile maps the multipart form file, if stored on disk for exceeding
+// the form parsing memory, or reads it otherwise
+func (s *inputSpool) spoolFormFile(file multipart.File, size, limit int64) ([]byte, error) {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return readFormFile(file, size, limit)
+	}
+
+	info, err := osFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > limit {
+		return nil, ErrEntityTooLarge
+	}
+	if info.Size() == 0 {
+		return nil, ErrEmptyBody
+	}
+	return s.mapFile(osFile, info.Size())
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file privately, so writes to the buffer never reach the file
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	buf, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, func() error { return syscall.Munmap(buf) }, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBodyImageSourceSpool(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	source := NewBodyImageSource(&SourceConfig{MaxBodySize: int64(len(buf)), SpoolThreshold: 1024})
+
+	r, release := withInputSpool(httptest.NewRequest(http.MethodPost, "/resize", bytes.NewReader(buf)))
+	body, err := source.GetImage(r)
+	if err != nil || !bytes.Equal(body, buf) {
+		t.Fatalf("Invalid spooled body (%d bytes): %v", len(body), err)
+	}
+	if spool := inputSpoolFromContext(r.Context()); len(spool.unmaps) != 1 {
+		t.Errorf("Expected the body to be mapped, got %d mappings", len(spool.unmaps))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Temporary files not removed: %d", len(files))
+	}
+	release()
+
+	// Bodies within the threshold are kept in memory
+	r, release = withInputSpool(httptest.NewRequest(http.MethodPost, "/resize", bytes.NewReader(buf[:1024])))
+	defer release()
+	if body, err := source.GetImage(r); err != nil || len(body) != 1024 || len(inputSpoolFromContext(r.Context()).unmaps) != 0 {
+		t.Errorf("Invalid in memory body (%d bytes): %v", len(body), err)
+	}
+
+	source = NewBodyImageSource(&SourceConfig{MaxBodySize: int64(len(buf) - 1), SpoolThreshold: 1024})
+	r, release = withInputSpool(httptest.NewRequest(http.MethodPost, "/resize", bytes.NewReader(buf)))
+	defer release()
+	if _, err := source.GetImage(r); err != ErrEntityTooLarge {
+		t.Errorf("Expected entity too large error, got: %v", err)
+	}
+}
+
+func TestBodyImageSourceSpoolForm(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile(formFieldName, "large.jpg")
+	_, _ = part.Write(buf)
+	_ = form.Close()
+
+	source := NewBodyImageSource(&SourceConfig{MaxBodySize: int64(body.Len()), SpoolThreshold: 1024})
+	r, release := withInputSpool(httptest.NewRequest(http.MethodPost, "/resize", &body))
+	defer release()
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	image, err := source.GetImage(r)
+	defer r.MultipartForm.RemoveAll()
+	if err != nil || !bytes.Equal(image, buf) {
+		t.Fatalf("Invalid spooled form file (%d bytes): %v", len(image), err)
+	}
+	if spool := inputSpoolFromContext(r.Context()); len(spool.unmaps) != 1 {
+		t.Errorf("Expected the form file to be mapped, got %d mappings", len(spool.unmaps))
+	}
+}
+
+func TestRetainInputSpool(t *testing.T) {
+	var unmapped bool
+	r, release := withInputSpool(httptest.NewRequest(http.MethodPost, "/resize", nil))
+	spool := inputSpoolFromContext(r.Context())
+	spool.unmaps = append(spool.unmaps, func() error { unmapped = true; return nil })
+
+	retained := retainInputSpool(r.Context())
+	release()
+	if unmapped {
+		t.Fatal("Unmapped while retained")
+	}
+	retained()
+	if !unmapped {
+		t.Error("Not unmapped once released")
+	}
+
+	// Requests without spool are a no-op
+	retainInputSpool(context.Background())()
+}
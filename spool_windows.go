@@ -0,0 +1,12 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the file, since the spooled files are not memory mapped on Windows
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	buf, err := io.ReadAll(io.NewSectionReader(file, 0, size))
+	return buf, func() error { return nil }, err
+}
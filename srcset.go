@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// SrcsetOutputJSON is the srcset output replying the JSON manifest
+const SrcsetOutputJSON = "json"
+
+// maxSrcsetWidths limits the number of renditions per srcset request
+const maxSrcsetWidths = 10
+
+// SrcsetManifest represents the renditions of the source image, referenced
+// by URL, and the resulting srcset attribute
+type SrcsetManifest struct {
+	Renditions []SrcsetRendition `json:"renditions"`
+	Srcset     string            `json:"srcset"`
+}
+
+// SrcsetRendition represents an image rendition, generated by the resize
+// endpoint URL
+type SrcsetRendition struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// Srcset generates the renditions of the image for the given widths, bundled
+// as ZIP archive (default) or multipart body, or replies the JSON manifest of
+// the renditions URLs. Widths larger than the image are skipped, as the image
+// is never enlarged. The image is decoded once, resized to the largest width
+// as lossless intermediate image the renditions are generated from.
+func Srcset(buf []byte, o ImageOptions) (Image, error) {
+	if len(o.Widths) == 0 {
+		return Image{}, NewMissingParamError("Missing required param: widths", "widths")
+	}
+	if len(o.Widths) > maxSrcsetWidths {
+		return Image{}, NewParamError(fmt.Sprintf("Maximum srcset widths (%d) exceeded", maxSrcsetWidths), "widths")
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return Image{}, NewError("Cannot read image: "+err.Error(), http.StatusBadRequest)
+	}
+	widths := srcsetWidths(o.Widths, size.Width)
+
+	if o.Output == SrcsetOutputJSON {
+		return srcsetManifest(widths, size, o)
+	}
+
+	outputType := outputImageType(buf, o)
+
+	source := buf
+	if len(widths) > 1 {
+		intermediate, err := Process(buf, bimg.Options{
+			Width:        widths[len(widths)-1],
+			Type:         bimg.PNG,
+			Compression:  pipelineIntermediateCompression,
+			NoAutoRotate: o.NoRotation,
+		})
+		if err != nil {
+			return Image{}, err
+		}
+		source = intermediate.Body
+	}
+
+	names := make([]string, len(widths))
+	results := make([]Image, len(widths))
+	for i, width := range widths {
+		opts := o
+		opts.Width = width
+		opts.Height = 0
+		opts.Type = bimg.ImageTypeName(outputType)
+		if results[i], err = Process(source, BimgOptions(opts)); err != nil {
+			return Image{}, fmt.Errorf("srcset rendition %dw failed: %w", width, err)
+		}
+		names[i] = strconv.Itoa(width) + "w"
+	}
+
+	if o.Output == PipelineOutputMultipart {
+		return multipartBranches(names, results, o)
+	}
+	return zipBranches(names, results, o)
+}
+
+// srcsetManifest replies the JSON manifest of the renditions URLs, which
+// requires a source image referenced by URL
+func srcsetManifest(widths []int, size bimg.ImageSize, o ImageOptions) (Image, error) {
+	renditions, err := srcsetRenditions(widths, size, nil, o)
+	if err != nil {
+		return Image{}, err
+	}
+
+	body, err := json.Marshal(SrcsetManifest{Renditions: renditions, Srcset: srcsetAttribute(renditions)})
+	if err != nil {
+		return Image{}, NewError("Cannot encode srcset manifest: "+err.Error(), http.StatusInternalServerError)
+	}
+	return Image{Body: body, Mime: "application/json"}, nil
+}
+
+// srcsetRenditions returns the renditions for the given widths, referenced by
+// the resize endpoint URL of the same source image, overriding the given params
+func srcsetRenditions(widths []int, size bimg.ImageSize, params map[string]string, o ImageOptions) ([]SrcsetRendition, error) {
+	renditions := make([]SrcsetRendition, len(widths))
+	for i, width := range widths {
+		overrides := map[string]string{
+			"width":  strconv.Itoa(width),
+			"widths": "",
+			"output": "",
+			"height": "",
+		}
+		for key, value := range params {
+			overrides[key] = value
+		}
+
+		url, ok := o.ImageURL("/resize", overrides)
+		if !ok {
+			return nil, NewError("Image URLs require a GET request with url or file param", http.StatusBadRequest)
+		}
+		renditions[i] = SrcsetRendition{
+			Width:  width,
+			Height: int(float64(size.Height)*float64(width)/float64(size.Width) + 0.5),
+			URL:    url,
+		}
+	}
+	return renditions, nil
+}
+
+// srcsetAttribute returns the srcset attribute value of the renditions
+func srcsetAttribute(renditions []SrcsetRendition) string {
+	candidates := make([]string, len(renditions))
+	for i, rendition := range renditions {
+		candidates[i] = fmt.Sprintf("%s %dw", rendition.URL, rendition.Width)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// srcsetWidths returns the sorted unique widths not larger than the image
+// width, or the image width if every width is larger
+func srcsetWidths(widths []int, imageWidth int) []int {
+	seen := make(map[int]bool, len(widths))
+	var result []int
+	for _, width := range widths {
+		if width <= imageWidth && !seen[width] {
+			seen[width] = true
+			result = append(result, width)
+		}
+	}
+	if len(result) == 0 {
+		return []int{imageWidth}
+	}
+	sort.Ints(result)
+	return result
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestSrcsetWidths(t *testing.T) {
+	cases := []struct {
+		widths   []int
+		expected []int
+	}{
+		{[]int{1280, 320, 640}, []int{320, 640, 1280}},
+		{[]int{320, 320, 640}, []int{320, 640}},
+		{[]int{320, 2000, 640}, []int{320, 640}},
+		{[]int{2000, 3000}, []int{1500}},
+	}
+
+	for _, tc := range cases {
+		if widths := srcsetWidths(tc.widths, 1500); !reflect.DeepEqual(widths, tc.expected) {
+			t.Errorf("Invalid widths for %v: %v", tc.widths, widths)
+		}
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	image, err := Srcset(readTestFile(t, "large.jpg"), ImageOptions{Widths: []int{320, 100, 640}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if image.Mime != "application/zip" {
+		t.Fatalf("Invalid content type: %s", image.Mime)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(image.Body), int64(len(image.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name  string
+		width int
+	}{
+		{"100w.jpeg", 100},
+		{"320w.jpeg", 320},
+		{"640w.jpeg", 640},
+	}
+	if len(archive.File) != len(expected) {
+		t.Fatalf("Invalid number of renditions: %d", len(archive.File))
+	}
+	for i, file := range archive.File {
+		if file.Name != expected[i].name {
+			t.Errorf("Invalid rendition name: %s", file.Name)
+		}
+		rc, _ := file.Open()
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(rc)
+		rc.Close()
+		if size, _ := bimg.Size(buf.Bytes()); size.Width != expected[i].width {
+			t.Errorf("Invalid rendition width: %d", size.Width)
+		}
+	}
+}
+
+func TestSrcsetErrors(t *testing.T) {
+	buf := readTestFile(t, "large.jpg")
+	cases := []struct {
+		name string
+		opts ImageOptions
+	}{
+		{"missing widths", ImageOptions{}},
+		{"too many widths", ImageOptions{Widths: make([]int, maxSrcsetWidths+1)}},
+	}
+
+	for _, tc := range cases {
+		_, err := Srcset(buf, tc.opts)
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestSrcsetManifest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/srcset?url=http://example.org/image.jpg&widths=320,640&output=json&type=auto&sign=foo", nil)
+	o := ServerOptions{PathPrefix: "/", EnableURLSignature: true, URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	opts := ImageOptions{Output: SrcsetOutputJSON}.WithImageURL(requestImageURL(r, o))
+
+	image, err := srcsetManifest([]int{320, 640}, bimg.ImageSize{Width: 1600, Height: 900}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var manifest SrcsetManifest
+	if err := json.Unmarshal(image.Body, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Renditions) != 2 || manifest.Renditions[1].Width != 640 || manifest.Renditions[1].Height != 360 {
+		t.Fatalf("Invalid renditions: %+v", manifest.Renditions)
+	}
+
+	// Rendition URLs are valid signed resize URLs
+	signed := checkURLSignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), o)
+	for _, rendition := range manifest.Renditions {
+		u, _ := url.Parse(rendition.URL)
+		query := u.Query()
+		if u.Path != "/resize" || query.Get("url") != "http://example.org/image.jpg" || query.Get("type") != "auto" || query.Get("widths") != "" || query.Get("output") != "" {
+			t.Errorf("Invalid rendition URL: %s", rendition.URL)
+		}
+
+		w := httptest.NewRecorder()
+		signed.ServeHTTP(w, httptest.NewRequest(http.MethodGet, rendition.URL, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Invalid rendition URL signature: %s", rendition.URL)
+		}
+	}
+	if !strings.HasSuffix(manifest.Srcset, " 640w") || !strings.Contains(manifest.Srcset, " 320w, ") {
+		t.Errorf("Invalid srcset: %s", manifest.Srcset)
+	}
+
+	// Images sent in the request body can't be referenced by URL
+	_, err = srcsetManifest([]int{320}, bimg.ImageSize{Width: 1600, Height: 900}, ImageOptions{})
+	if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+		t.Errorf("Expected bad request error, got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-Timing metric names. libvips streams the image decoding, the
+// transformations and the encoding in a single pass, so the transform metric
+// covers all of them, while decode measures the input image header parsing.
+const (
+	TimingFetch     = "fetch"
+	TimingDecode    = "decode"
+	TimingTransform = "transform"
+)
+
+// addServerTiming appends a Server-Timing metric to the response headers.
+// Metrics must be added before writing the response status.
+func addServerTiming(w http.ResponseWriter, o ServerOptions, name string, d time.Duration) {
+	if !o.ServerTiming {
+		return
+	}
+	w.Header().Add("Server-Timing", fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond)))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAddServerTiming(t *testing.T) {
+	w := httptest.NewRecorder()
+	o := ServerOptions{ServerTiming: true}
+	addServerTiming(w, o, TimingFetch, 1500*time.Microsecond)
+	addServerTiming(w, o, TimingTransform, 20*time.Millisecond)
+
+	metrics := w.Header().Values("Server-Timing")
+	if len(metrics) != 2 || metrics[0] != "fetch;dur=1.500" || metrics[1] != "transform;dur=20.000" {
+		t.Errorf("Invalid Server-Timing header: %v", metrics)
+	}
+
+	w = httptest.NewRecorder()
+	addServerTiming(w, ServerOptions{}, TimingFetch, time.Second)
+	if w.Header().Get("Server-Timing") != "" {
+		t.Error("Unexpected Server-Timing header")
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"strings"
 )
 
+// imageFormats are the names of the image formats supported by libvips builds
+var imageFormats = []string{"jpeg", "png", "webp", "gif", "tiff", "avif", "heif", "svg", "pdf"}
+
 func ExtractImageTypeFromMime(mime string) string {
 	parts := strings.SplitN(mime, ";", 2)[0]
 	subParts := strings.SplitN(parts, "/", 2)
@@ -38,6 +41,10 @@ func ImageType(name string) bimg.ImageType {
 		return bimg.SVG
 	case "pdf":
 		return bimg.PDF
+	case "avif":
+		return bimg.AVIF
+	case "heif":
+		return bimg.HEIF
 	default:
 		return bimg.UNKNOWN
 	}
@@ -51,6 +58,8 @@ func GetImageMimeType(code bimg.ImageType) string {
 		bimg.GIF:  "image/gif",
 		bimg.SVG:  "image/svg+xml",
 		bimg.PDF:  "application/pdf",
+		bimg.AVIF: "image/avif",
+		bimg.HEIF: "image/heif",
 	}
 
 	if mime, ok := mimeTypes[code]; ok {
@@ -58,3 +67,31 @@ func GetImageMimeType(code bimg.ImageType) string {
 	}
 	return "image/jpeg"
 }
+
+// ImageTypeFromMime returns the image type of the given MIME type
+func ImageTypeFromMime(mime string) bimg.ImageType {
+	if mime == "application/pdf" {
+		return bimg.PDF
+	}
+	if !strings.HasPrefix(mime, "image/") {
+		return bimg.UNKNOWN
+	}
+	return ImageType(ExtractImageTypeFromMime(mime))
+}
+
+// ImageTypes represents the allowed input or output image types. An empty list
+// allows every type.
+type ImageTypes []bimg.ImageType
+
+// Allows checks if the image type is allowed
+func (t ImageTypes) Allows(imageType bimg.ImageType) bool {
+	if len(t) == 0 {
+		return true
+	}
+	for _, allowed := range t {
+		if imageType == allowed {
+			return true
+		}
+	}
+	return false
+}
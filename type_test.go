@@ -101,3 +101,36 @@ func TestGetImageMimeType(t *testing.T) {
 		}
 	}
 }
+
+func TestImageTypeFromMime(t *testing.T) {
+	cases := []struct {
+		mime     string
+		expected bimg.ImageType
+	}{
+		{"image/jpeg", bimg.JPEG},
+		{"image/svg+xml", bimg.SVG},
+		{"application/pdf", bimg.PDF},
+		{"application/json", bimg.UNKNOWN},
+		{"multipart/mixed; boundary=foo", bimg.UNKNOWN},
+	}
+
+	for _, tc := range cases {
+		if imageType := ImageTypeFromMime(tc.mime); imageType != tc.expected {
+			t.Errorf("Invalid image type for %s: %v", tc.mime, imageType)
+		}
+	}
+}
+
+func TestImageTypesAllows(t *testing.T) {
+	if !(ImageTypes{}).Allows(bimg.PDF) {
+		t.Error("Empty output types should allow every type")
+	}
+
+	allowed := ImageTypes{bimg.JPEG, bimg.PNG}
+	if !allowed.Allows(bimg.JPEG) || !allowed.Allows(bimg.PNG) {
+		t.Error("Allowed output types should be allowed")
+	}
+	if allowed.Allows(bimg.PDF) || allowed.Allows(bimg.UNKNOWN) {
+		t.Error("Not allowed output types should not be allowed")
+	}
+}
@@ -0,0 +1,145 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment variables passing the inherited listener and readiness pipe
+// file descriptors to the upgraded process
+const (
+	listenerFDEnv = "IMAGINARY_LISTENER_FD"
+	readyFDEnv    = "IMAGINARY_READY_FD"
+)
+
+// upgradeTimeout is the time given to the upgraded process to start serving
+const upgradeTimeout = 30 * time.Second
+
+// listen returns the listener inherited from the parent process on upgrade,
+// or a new listener on the address
+func listen(addr string) (net.Listener, error) {
+	file, err := inheritedFile(listenerFDEnv, "listener")
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return net.Listen("tcp", addr)
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// notifyReady notifies the parent process the upgraded process is serving
+func notifyReady() {
+	file, err := inheritedFile(readyFDEnv, "ready")
+	if err != nil {
+		log.Printf("cannot notify upgrade readiness: %s", err)
+	}
+	if file != nil {
+		_, _ = file.Write([]byte{1})
+		file.Close()
+	}
+}
+
+// inheritedFile returns the file descriptor inherited from the parent process,
+// if defined by the environment variable
+func inheritedFile(env, name string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("invalid %s file descriptor: %s", name, value)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// upgradeOnSignal starts a new process of the current executable, inheriting
+// the listener, when receiving SIGUSR2. The returned channel is closed once
+// the new process is serving, so the current one can drain and exit. The
+// current process keeps serving if the new one fails to start.
+func upgradeOnSignal(l net.Listener) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	upgraded := make(chan struct{})
+	go func() {
+		for range signals {
+			if err := upgrade(l); err != nil {
+				log.Printf("upgrade failed: %s", err)
+				continue
+			}
+			signal.Stop(signals)
+			close(upgraded)
+			return
+		}
+	}()
+	return upgraded
+}
+
+func upgrade(l net.Listener) error {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("listener cannot be inherited")
+	}
+	listener, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	// Inherited files are numbered from 3, after stdin, stdout and stderr
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{listener, notify}
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	notify.Close()
+	if err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+
+	// The pipe is closed without notification if the new process exits
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("process %d exited before serving", cmd.Process.Pid)
+		}
+		log.Printf("upgraded to process %d", cmd.Process.Pid)
+		return nil
+	case <-time.After(upgradeTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("process %d not serving after %s", cmd.Process.Pid, upgradeTimeout)
+	}
+}
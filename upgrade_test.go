@@ -0,0 +1,59 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenInherited(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+
+	file, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	os.Setenv(listenerFDEnv, strconv.Itoa(int(file.Fd())))
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot inherit listener: %s", err)
+	}
+	defer l.Close()
+
+	if l.Addr().String() != parent.Addr().String() {
+		t.Errorf("Invalid inherited listener address: %s", l.Addr())
+	}
+	if os.Getenv(listenerFDEnv) != "" {
+		t.Error("The listener file descriptor should not be inherited again")
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(readyFDEnv, strconv.Itoa(fd))
+	notifyReady()
+
+	if n, err := r.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("Expected readiness notification: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "net"
+
+// listen returns a new listener on the address, since the listener can't be
+// inherited on Windows
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// notifyReady is a no-op since upgrades are not supported on Windows
+func notifyReady() {}
+
+// upgradeOnSignal is a no-op since SIGUSR2 is not available on Windows
+func upgradeOnSignal(l net.Listener) <-chan struct{} {
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// ImageUpscalerRemote is the name of the remote HTTP upscaler
+const ImageUpscalerRemote = "remote"
+
+// Upscaler defines the interface implemented by super-resolution upscalers,
+// such as ONNX models, enlarging an image by an integer factor (2x or 4x).
+type Upscaler interface {
+	Upscale(ctx context.Context, buf []byte, factor int) ([]byte, error)
+}
+
+// upscalerRegistry manages the registered upscalers
+var upscalerRegistry = struct {
+	upscalers map[string]Upscaler
+	mu        sync.RWMutex
+}{upscalers: make(map[string]Upscaler)}
+
+// RegisterUpscaler registers a new upscaler by name
+func RegisterUpscaler(name string, upscaler Upscaler) {
+	if upscaler == nil {
+		return
+	}
+
+	upscalerRegistry.mu.Lock()
+	upscalerRegistry.upscalers[name] = upscaler
+	upscalerRegistry.mu.Unlock()
+}
+
+// GetUpscaler returns the upscaler registered with the given name, if any
+func GetUpscaler(name string) Upscaler {
+	upscalerRegistry.mu.RLock()
+	defer upscalerRegistry.mu.RUnlock()
+	return upscalerRegistry.upscalers[name]
+}
+
+// HTTPUpscaler delegates upscaling to an external HTTP service, which
+// receives the image as POST payload and the factor as query param.
+type HTTPUpscaler struct {
+	URL    *url.URL
+	client *http.Client
+}
+
+// NewHTTPUpscaler creates a new remote HTTP upscaler
+func NewHTTPUpscaler(endpoint *url.URL) *HTTPUpscaler {
+	return &HTTPUpscaler{
+		URL:    endpoint,
+		client: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// Upscale sends the image to the remote upscaler service
+func (u *HTTPUpscaler) Upscale(ctx context.Context, buf []byte, factor int) ([]byte, error) {
+	endpoint := *u.URL
+	query := endpoint.Query()
+	query.Set("factor", strconv.Itoa(factor))
+	endpoint.RawQuery = query.Encode()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(buf))
+	req.Header.Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling remote upscaler: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error calling remote upscaler: (status=%d)", res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxMemory+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading remote upscaler response: %w", err)
+	}
+	if len(body) > maxMemory {
+		return nil, ErrEntityTooLarge
+	}
+	return body, nil
+}
+
+// upscale runs the requested upscaler when the target dimensions are larger
+// than the source image, leaving the final resize to libvips.
+func upscale(buf []byte, o ImageOptions) ([]byte, error) {
+	if o.Upscaler == "" {
+		return buf, nil
+	}
+
+	upscaler := GetUpscaler(o.Upscaler)
+	if upscaler == nil {
+		return nil, NewParamError("Unsupported upscaler: "+o.Upscaler, "upscaler")
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	factor := upscaleFactor(size.Width, size.Height, o.Width, o.Height)
+	if factor == 0 {
+		return buf, nil
+	}
+
+	start := time.Now()
+	out, err := upscaler.Upscale(o.Context(), buf, factor)
+	if err != nil {
+		return nil, err
+	}
+	debug("upscaled image %dx with %s upscaler in %s", factor, o.Upscaler, time.Since(start))
+	return out, nil
+}
+
+// upscaleFactor returns the upscaling factor (2 or 4) required to reach the
+// target dimensions, or 0 if the image doesn't need to be enlarged.
+func upscaleFactor(width, height, targetWidth, targetHeight int) int {
+	if width == 0 || height == 0 {
+		return 0
+	}
+
+	ratio := float64(targetWidth) / float64(width)
+	if r := float64(targetHeight) / float64(height); r > ratio {
+		ratio = r
+	}
+
+	switch {
+	case ratio <= 1:
+		return 0
+	case ratio <= 2:
+		return 2
+	default:
+		return 4
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type fakeUpscaler struct {
+	factor int
+}
+
+func (u *fakeUpscaler) Upscale(ctx context.Context, buf []byte, factor int) ([]byte, error) {
+	u.factor = factor
+	return buf, nil
+}
+
+func TestUpscaleFactor(t *testing.T) {
+	cases := []struct {
+		width, height, targetWidth, targetHeight, expected int
+	}{
+		{100, 100, 50, 50, 0},
+		{100, 100, 100, 0, 0},
+		{100, 100, 150, 0, 2},
+		{100, 100, 0, 200, 2},
+		{100, 100, 300, 100, 4},
+		{0, 0, 300, 300, 0},
+	}
+
+	for _, test := range cases {
+		factor := upscaleFactor(test.width, test.height, test.targetWidth, test.targetHeight)
+		if factor != test.expected {
+			t.Errorf("Invalid upscale factor for %+v: %d", test, factor)
+		}
+	}
+}
+
+func TestRegisterUpscaler(t *testing.T) {
+	upscaler := &fakeUpscaler{}
+	RegisterUpscaler("fake", upscaler)
+
+	if GetUpscaler("fake") != upscaler {
+		t.Error("Cannot retrieve the registered upscaler")
+	}
+	if GetUpscaler("missing") != nil {
+		t.Error("Unknown upscalers must not be found")
+	}
+
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	if _, err := upscale(buf, ImageOptions{Upscaler: "fake", Width: 1100}); err != nil {
+		t.Fatalf("Cannot upscale image: %s", err)
+	}
+	// The original image is 550x740
+	if upscaler.factor != 2 {
+		t.Errorf("Invalid upscale factor: %d", upscaler.factor)
+	}
+
+	if _, err := upscale(buf, ImageOptions{Upscaler: "missing", Width: 1100}); err == nil {
+		t.Error("Expected unknown upscaler to fail")
+	}
+}
+
+func TestHTTPUpscaler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Query().Get("factor") != "4" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(append(body, body...))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	out, err := NewHTTPUpscaler(u).Upscale(context.Background(), []byte("image"), 4)
+	if err != nil {
+		t.Fatalf("Cannot upscale image: %s", err)
+	}
+	if string(out) != "imageimage" {
+		t.Errorf("Invalid upscaler response: %s", out)
+	}
+
+	if _, err := NewHTTPUpscaler(u).Upscale(context.Background(), []byte("image"), 2); err == nil {
+		t.Error("Expected invalid upscaler response status to fail")
+	}
+}
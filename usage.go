@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// UsageOutputPrometheus replies the usage counters in the Prometheus text
+// exposition format
+const UsageOutputPrometheus = "prometheus"
+
+// defaultUsageTenant accounts the requests without API key nor virtual host
+const defaultUsageTenant = "default"
+
+// UsageCounters holds the usage accounted to a tenant
+type UsageCounters struct {
+	Requests    uint64  `json:"requests"`
+	Megapixels  float64 `json:"megapixels"`
+	EgressBytes uint64  `json:"egressBytes"`
+}
+
+// Usage accounts the image requests, processed megapixels and egress bytes
+// per tenant: the API key name, or the virtual host
+type Usage struct {
+	mu      sync.Mutex
+	tenants map[string]*UsageCounters
+}
+
+type usageContextKey struct{}
+
+// usageRecord collects the usage of a request
+type usageRecord struct {
+	megapixels float64
+}
+
+// NewUsage creates the usage accounting
+func NewUsage() *Usage {
+	return &Usage{tenants: make(map[string]*UsageCounters)}
+}
+
+// Add accounts a request to the tenant. No-op if the usage is not accounted.
+func (u *Usage) Add(tenant string, megapixels float64, egress uint64) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counters, ok := u.tenants[tenant]
+	if !ok {
+		counters = &UsageCounters{}
+		u.tenants[tenant] = counters
+	}
+	counters.Requests++
+	counters.Megapixels += megapixels
+	counters.EgressBytes += egress
+}
+
+// Snapshot returns a copy of the usage counters per tenant
+func (u *Usage) Snapshot() map[string]UsageCounters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snapshot := make(map[string]UsageCounters, len(u.tenants))
+	for tenant, counters := range u.tenants {
+		snapshot[tenant] = *counters
+	}
+	return snapshot
+}
+
+// accountUsage accounts the request to its tenant once served, along with
+// the megapixels recorded by the controller and the response bytes
+func accountUsage(next http.Handler, o ServerOptions) http.Handler {
+	if o.Usage == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &usageRecord{}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), usageContextKey{}, record)))
+		o.Usage.Add(usageTenant(r, o), record.megapixels, cw.written)
+	})
+}
+
+// recordMegapixels records the megapixels processed by the request
+func recordMegapixels(r *http.Request, megapixels float64) {
+	if record, ok := r.Context().Value(usageContextKey{}).(*usageRecord); ok {
+		record.megapixels += megapixels
+	}
+}
+
+// usageTenant returns the tenant of the request: the authorized API key name,
+// the virtual host name or the default tenant
+func usageTenant(r *http.Request, o ServerOptions) string {
+	if key := authorizedAPIKey(r); key != "" {
+		return o.APIKeys[key].tenant(key)
+	}
+	if o.VirtualHostname != "" {
+		return o.VirtualHostname
+	}
+	return defaultUsageTenant
+}
+
+// tenant returns the API key name, or a fingerprint not disclosing the key
+func (l APIKeyLimits) tenant(key string) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// usageController replies the usage counters per tenant, as JSON or in the
+// Prometheus text exposition format, authorized by the usage key
+func usageController(o ServerOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(o.UsageKey)) != 1 {
+			o.AuditLog.Log(r, AuditInvalidAPIKey, "Authorization", ErrInvalidAPIKey)
+			ErrorReply(r, w, ErrInvalidAPIKey, o)
+			return
+		}
+
+		snapshot := o.Usage.Snapshot()
+		w.Header().Set("Cache-Control", "no-store")
+		if r.URL.Query().Get("format") == UsageOutputPrometheus {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writePrometheusUsage(w, snapshot)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+// prometheusLabelEscaper escapes the Prometheus label values
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheusUsage writes the usage counters, labeled by tenant
+func writePrometheusUsage(w http.ResponseWriter, snapshot map[string]UsageCounters) {
+	tenants := make([]string, 0, len(snapshot))
+	for tenant := range snapshot {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	metrics := []struct {
+		name, help string
+		value      func(UsageCounters) string
+	}{
+		{"imaginary_tenant_requests_total", "Image requests served per tenant.", func(c UsageCounters) string { return fmt.Sprint(c.Requests) }},
+		{"imaginary_tenant_megapixels_total", "Source image megapixels processed per tenant.", func(c UsageCounters) string { return fmt.Sprint(c.Megapixels) }},
+		{"imaginary_tenant_egress_bytes_total", "Response bytes sent per tenant.", func(c UsageCounters) string { return fmt.Sprint(c.EgressBytes) }},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, tenant := range tenants {
+			fmt.Fprintf(w, "%s{tenant=\"%s\"} %s\n", metric.name, prometheusLabelEscaper.Replace(tenant), metric.value(snapshot[tenant]))
+		}
+	}
+}
+
+// countingResponseWriter counts the response body bytes
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written uint64
+}
+
+// Write counts the bytes and forwards to ResponseWriter
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += uint64(n)
+	return n, err
+}
+
+// Flush forwards to ResponseWriter, if supported, allowing streaming responses
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, used by http.ResponseController
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccountUsage(t *testing.T) {
+	o := ServerOptions{
+		Usage:   NewUsage(),
+		APIKeys: APIKeys{"secret-a": {Name: "tenant-a"}, "secret-b": {}},
+	}
+	handler := accountUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordMegapixels(r, 1.5)
+		_, _ = w.Write([]byte("image"))
+	}), o)
+
+	for _, key := range []string{"secret-a", "secret-a", "secret-b", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		if key != "" {
+			r = withAPIKey(r, key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	usage := o.Usage.Snapshot()
+	if usage["tenant-a"] != (UsageCounters{Requests: 2, Megapixels: 3, EgressBytes: 10}) {
+		t.Errorf("Invalid named key usage: %+v", usage["tenant-a"])
+	}
+	if tenant := (APIKeyLimits{}).tenant("secret-b"); usage[tenant].Requests != 1 || strings.Contains(tenant, "secret") {
+		t.Errorf("Invalid unnamed key tenant %s: %+v", tenant, usage)
+	}
+	if usage[defaultUsageTenant].Requests != 1 {
+		t.Errorf("Invalid default usage: %+v", usage)
+	}
+}
+
+func TestUsageTenantVirtualHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	if tenant := usageTenant(r, ServerOptions{VirtualHostname: "images.brand-a.com"}); tenant != "images.brand-a.com" {
+		t.Errorf("Invalid virtual host tenant: %s", tenant)
+	}
+}
+
+func TestUsageController(t *testing.T) {
+	o := ServerOptions{Usage: NewUsage(), UsageKey: "usage-secret"}
+	o.Usage.Add("tenant-a", 2.5, 100)
+
+	cases := []struct {
+		auth   string
+		query  string
+		status int
+		body   string
+	}{
+		{"", "", http.StatusUnauthorized, ""},
+		{"Bearer invalid", "", http.StatusUnauthorized, ""},
+		{"Bearer usage-secret", "", http.StatusOK, ""},
+		{"Bearer usage-secret", "?format=prometheus", http.StatusOK, `imaginary_tenant_megapixels_total{tenant="tenant-a"} 2.5`},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/usage"+tc.query, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		usageController(o)(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.auth, tc.status, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if tc.body != "" {
+			if !strings.Contains(w.Body.String(), tc.body) {
+				t.Errorf("Invalid Prometheus body: %s", w.Body.String())
+			}
+			continue
+		}
+
+		var usage map[string]UsageCounters
+		if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil || usage["tenant-a"].EgressBytes != 100 {
+			t.Errorf("Invalid usage body: %s", w.Body.String())
+		}
+	}
+}
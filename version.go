@@ -3,9 +3,27 @@ package main
 // Version stores the current package semantic version
 var Version = "dev"
 
+// Build information, defined at compile time via -ldflags
+var (
+	Commit    = ""
+	BuildDate = ""
+)
+
 // Versions represents the used versions for several significant dependencies
 type Versions struct {
 	ImaginaryVersion string `json:"imaginary"`
 	BimgVersion      string `json:"bimg"`
 	VipsVersion      string `json:"libvips"`
 }
+
+// Capabilities represents the versions, build information and the features
+// enabled in the server, allowing to verify deployments programmatically
+type Capabilities struct {
+	Versions
+	Commit        string   `json:"commit,omitempty"`
+	BuildDate     string   `json:"buildDate,omitempty"`
+	InputFormats  []string `json:"inputFormats"`
+	OutputFormats []string `json:"outputFormats"`
+	Sources       []string `json:"sources"`
+	Endpoints     []string `json:"endpoints"`
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// minURLSignatureKeyLength is the minimum length of the URL signature keys
+const minURLSignatureKeyLength = 32
+
+// VirtualHost defines the server options overridden for the requests to a
+// hostname. Empty values fall back to the server options.
+type VirtualHost struct {
+	Mount           string         `json:"mount"`
+	AllowedOrigins  []string       `json:"allowed_origins"`
+	URLSignatureKey string         `json:"url_signature_key"`
+	DefaultParams   string         `json:"default_params"`
+	PicturePresets  PicturePresets `json:"picture_presets"`
+}
+
+// VirtualHosts maps the hostnames to their options
+type VirtualHosts map[string]VirtualHost
+
+// ReadVirtualHosts reads the virtual hosts options from a JSON file
+func ReadVirtualHosts(path string) (VirtualHosts, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts VirtualHosts
+	if err := json.Unmarshal(buf, &hosts); err != nil {
+		return nil, fmt.Errorf("invalid virtual hosts file: %w", err)
+	}
+
+	// Hostnames are case insensitive
+	normalized := make(VirtualHosts, len(hosts))
+	for name, host := range hosts {
+		if name == "" {
+			return nil, fmt.Errorf("invalid virtual hosts file: empty hostname")
+		}
+		if err := host.validate(); err != nil {
+			return nil, fmt.Errorf("invalid virtual host %q: %w", name, err)
+		}
+		normalized[strings.ToLower(name)] = host
+	}
+
+	return normalized, nil
+}
+
+func (h VirtualHost) validate() error {
+	if h.Mount != "" {
+		if err := validateMountDirectory(h.Mount); err != nil {
+			return err
+		}
+	}
+	if h.URLSignatureKey != "" && len(h.URLSignatureKey) < minURLSignatureKeyLength {
+		return fmt.Errorf("URL signature key must be a minimum of %d characters", minURLSignatureKeyLength)
+	}
+	if h.DefaultParams != "" {
+		if _, err := parseDefaultParams(h.DefaultParams); err != nil {
+			return fmt.Errorf("invalid default params: %w", err)
+		}
+	}
+	return h.PicturePresets.Validate()
+}
+
+// Apply returns the server options overridden by the virtual host options,
+// including its own image sources
+func (h VirtualHost) Apply(o ServerOptions) ServerOptions {
+	// The virtual host mount replaces the named mounts too
+	if h.Mount != "" {
+		o.Mount = h.Mount
+		o.Mounts = nil
+	}
+	if len(h.AllowedOrigins) > 0 {
+		o.AllowedOrigins = parseOrigins(strings.Join(h.AllowedOrigins, ","))
+	}
+	// The key IDs of the server keys aren't accepted by the virtual host
+	// defining its own key
+	if h.URLSignatureKey != "" {
+		o.EnableURLSignature = true
+		o.URLSignatureKey = h.URLSignatureKey
+		o.URLSignatureKeys = nil
+	}
+	if h.DefaultParams != "" {
+		// Already validated when reading the virtual hosts
+		o.DefaultParams, _ = parseDefaultParams(h.DefaultParams)
+	}
+	if len(h.PicturePresets) > 0 {
+		o.PicturePresets = h.PicturePresets
+	}
+
+	o.Sources = NewImageSources(o)
+	return o
+}
+
+// NewVirtualHostsHandler dispatches the requests by Host header to the server
+// mux of the virtual host, or the server options one for other hosts
+func NewVirtualHostsHandler(o ServerOptions) http.Handler {
+	mux := NewServerMux(o)
+	if len(o.VirtualHosts) == 0 {
+		return mux
+	}
+
+	hosts := make(map[string]http.Handler, len(o.VirtualHosts))
+	for name, host := range o.VirtualHosts {
+		opts := host.Apply(o)
+		opts.VirtualHostname = name
+		hosts[name] = NewServerMux(opts)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := hosts[requestHostname(r)]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// requestHostname returns the lower cased request hostname, without port
+func requestHostname(r *http.Request) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
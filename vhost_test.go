@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadVirtualHosts(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "vhosts.json")
+	_ = os.WriteFile(file, []byte(`{"Images.Brand-A.com": {"mount": "`+dir+`", "allowed_origins": ["https://cdn.brand-a.com"]}, "images.brand-b.com": {"default_params": "quality=75", "picture_presets": {"hero": {"widths": [640]}}}}`), 0600)
+	hosts, err := ReadVirtualHosts(file)
+	if err != nil {
+		t.Fatalf("Cannot read virtual hosts: %s", err)
+	}
+	if len(hosts) != 2 || hosts["images.brand-a.com"].Mount != dir || hosts["images.brand-b.com"].DefaultParams != "quality=75" {
+		t.Errorf("Invalid virtual hosts: %+v", hosts)
+	}
+
+	for _, vhosts := range []string{
+		`{"": {}}`,
+		`{"foo": {"mount": "/nonexistent"}}`,
+		`{"foo": {"url_signature_key": "short"}}`,
+		`{"foo": {"default_params": "foo=bar"}}`,
+		`{"foo": {"picture_presets": {"hero": {}}}}`,
+	} {
+		invalid := path.Join(dir, "invalid.json")
+		_ = os.WriteFile(invalid, []byte(vhosts), 0600)
+		if _, err := ReadVirtualHosts(invalid); err == nil {
+			t.Errorf("Expected error for virtual hosts %s", vhosts)
+		}
+	}
+}
+
+func TestVirtualHostApply(t *testing.T) {
+	host := VirtualHost{
+		Mount:           "/data/brand-a",
+		AllowedOrigins:  []string{"https://cdn.brand-a.com"},
+		URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997",
+		DefaultParams:   "quality=75",
+	}
+
+	opts := host.Apply(ServerOptions{Mount: "/data", Concurrency: 10})
+	if opts.Mount != host.Mount || !opts.EnableURLSignature || opts.URLSignatureKey != host.URLSignatureKey || opts.Concurrency != 10 {
+		t.Errorf("Invalid options: %+v", opts)
+	}
+	if len(opts.AllowedOrigins) != 1 || opts.AllowedOrigins[0].Host != "cdn.brand-a.com" {
+		t.Errorf("Invalid allowed origins: %v", opts.AllowedOrigins)
+	}
+	if opts.DefaultParams.Get("quality") != "75" {
+		t.Errorf("Invalid default params: %v", opts.DefaultParams)
+	}
+	if opts.Sources == nil {
+		t.Error("Expected virtual host image sources")
+	}
+}
+
+func TestVirtualHostsHandler(t *testing.T) {
+	o := ServerOptions{
+		PathPrefix:   "/",
+		VirtualHosts: VirtualHosts{"images.brand-a.com": {URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}},
+	}
+	handler := NewVirtualHostsHandler(o)
+
+	cases := []struct {
+		host   string
+		status int
+	}{
+		{"images.brand-a.com", http.StatusForbidden},
+		{"Images.Brand-A.com:8088", http.StatusForbidden},
+		{"images.brand-a.com.", http.StatusForbidden},
+		{"images.brand-b.com", http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/resize?width=300&sign=AAAA", nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.host, tc.status, w.Code)
+		}
+	}
+}
+
+func TestVirtualHostsURLSignatureKeys(t *testing.T) {
+	o := ServerOptions{
+		PathPrefix:         "/",
+		EnableURLSignature: true,
+		URLSignatureKey:    "4f46feebafc4b5e988f131c4ff8b5997",
+		URLSignatureKeys:   map[string]string{"2024": "9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2"},
+		VirtualHosts:       VirtualHosts{"images.brand-a.com": {URLSignatureKey: "0b8e3c9a7f2d41e6a5c4b3d2e1f0a9b8"}},
+	}
+	handler := NewVirtualHostsHandler(o)
+
+	query := url.Values{"width": {"300"}, "kid": {"2024"}}
+	query.Set("sign", base64.RawURLEncoding.EncodeToString(signURL("9c1a0e4b7d3f48a2b6e5c8d1f0a7b3e2", SignatureAlgSHA256, "/resize", query)))
+
+	cases := []struct {
+		host   string
+		status int
+	}{
+		// Signature accepted, then rejected for the missing image source
+		{"images.brand-b.com", http.StatusMethodNotAllowed},
+		{"images.brand-a.com", http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/resize?"+query.Encode(), nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.host, tc.status, w.Code)
+		}
+	}
+}
+
+func TestRequestHostname(t *testing.T) {
+	for host, expected := range map[string]string{
+		"example.org":      "example.org",
+		"Example.org:8088": "example.org",
+		"example.org.":     "example.org",
+		"[::1]:8088":       "::1",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		if hostname := requestHostname(r); hostname != expected {
+			t.Errorf("%s: expected hostname %s, got %s", host, expected, hostname)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// jpegsave_optimized encodes the image as JPEG using the mozjpeg compression
+// techniques, which libvips ignores when not built against mozjpeg
+static int jpegsave_optimized(void *buf, size_t len, void **out, size_t *outlen, int quality, int strip, int interlace) {
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	int err = vips_jpegsave_buffer(image, out, outlen,
+		"Q", quality,
+		"strip", strip,
+		"interlace", interlace,
+		"optimize_coding", TRUE,
+		"trellis_quant", TRUE,
+		"overshoot_deringing", TRUE,
+		"optimize_scans", interlace,
+		"quant_table", 3,
+		NULL);
+	g_object_unref(image);
+	return err;
+}
+
+// thumbnail_png shrinks the image on load to the bounding box, encoded as PNG
+static int thumbnail_png(void *buf, size_t len, void **out, size_t *outlen, int width, int height, int crop, int size, int no_rotate, int compression) {
+	VipsImage *image;
+	if (vips_thumbnail_buffer(buf, len, &image, width,
+		"height", height,
+		"crop", crop,
+		"size", size,
+		"no_rotate", no_rotate,
+		NULL)) {
+		return -1;
+	}
+
+	int err = vips_pngsave_buffer(image, out, outlen, "compression", compression, NULL);
+	g_object_unref(image);
+	return err;
+}
+
+// heifsave_depth encodes the image as AVIF or HEIF with 10 or 12 bits per
+// channel, keeping the high bit depth of 16-bit sources
+static int heifsave_depth(void *buf, size_t len, void **out, size_t *outlen, int quality, int bitdepth, int av1, int lossless, int strip) {
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	int err = vips_heifsave_buffer(image, out, outlen,
+		"Q", quality,
+		"bitdepth", bitdepth,
+		"compression", av1 ? VIPS_FOREIGN_HEIF_COMPRESSION_AV1 : VIPS_FOREIGN_HEIF_COMPRESSION_HEVC,
+		"lossless", lossless,
+		"strip", strip,
+		NULL);
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// vipsJPEGSaveOptimized encodes the image buffer as optimized JPEG. The encoder
+// options not exposed by bimg are passed to libvips directly.
+func vipsJPEGSaveOptimized(buf []byte, quality int, strip, interlace bool) ([]byte, error) {
+	input := C.CBytes(buf)
+	defer C.free(input)
+
+	var out unsafe.Pointer
+	var length C.size_t
+	if C.jpegsave_optimized(input, C.size_t(len(buf)), &out, &length, C.int(quality), cBool(strip), cBool(interlace)) != 0 {
+		err := errors.New(C.GoString(C.vips_error_buffer()))
+		C.vips_error_clear()
+		return nil, err
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(length)), nil
+}
+
+// vipsMaxCoord is the libvips maximum image dimension
+const vipsMaxCoord = 10000000
+
+// vipsThumbnail shrinks the image buffer to the bounding box, encoded as PNG,
+// using the libvips thumbnail operation, which shrinks JPEG, WebP and HEIF
+// images while loading them. Images are never enlarged, unless forced.
+func vipsThumbnail(buf []byte, width, height int, crop thumbnailCrop, force, noRotate bool) ([]byte, error) {
+	input := C.CBytes(buf)
+	defer C.free(input)
+
+	// The undefined dimension is unbounded
+	if width == 0 {
+		width = vipsMaxCoord
+	}
+	if height == 0 {
+		height = vipsMaxCoord
+	}
+
+	interesting := C.int(C.VIPS_INTERESTING_NONE)
+	switch crop {
+	case thumbnailCropCentre:
+		interesting = C.int(C.VIPS_INTERESTING_CENTRE)
+	case thumbnailCropAttention:
+		interesting = C.int(C.VIPS_INTERESTING_ATTENTION)
+	}
+
+	size := C.int(C.VIPS_SIZE_DOWN)
+	if force {
+		size = C.int(C.VIPS_SIZE_FORCE)
+	}
+
+	var out unsafe.Pointer
+	var length C.size_t
+	if C.thumbnail_png(input, C.size_t(len(buf)), &out, &length, C.int(width), C.int(height), interesting, size, cBool(noRotate), C.int(pipelineIntermediateCompression)) != 0 {
+		err := errors.New(C.GoString(C.vips_error_buffer()))
+		C.vips_error_clear()
+		return nil, err
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(length)), nil
+}
+
+// vipsHeifSaveDepth encodes the image buffer as AVIF, or HEIF, with the bit
+// depth, which bimg doesn't expose. It requires libvips 8.15 or later.
+func vipsHeifSaveDepth(buf []byte, quality, bitdepth int, av1, lossless, strip bool) ([]byte, error) {
+	input := C.CBytes(buf)
+	defer C.free(input)
+
+	var out unsafe.Pointer
+	var length C.size_t
+	if C.heifsave_depth(input, C.size_t(len(buf)), &out, &length, C.int(quality), C.int(bitdepth), cBool(av1), cBool(lossless), cBool(strip)) != 0 {
+		err := errors.New(C.GoString(C.vips_error_buffer()))
+		C.vips_error_clear()
+		return nil, err
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(length)), nil
+}
+
+// vipsSetConcurrency sets the libvips worker threads per image operation
+func vipsSetConcurrency(threads int) {
+	C.vips_concurrency_set(C.int(threads))
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	d "runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// watchdogInterval is the process memory sampling interval
+const watchdogInterval = 50 * time.Millisecond
+
+// memoryWatchdogInterval is the process memory sampling interval of the
+// memory watchdog, which runs regardless of the transformations
+const memoryWatchdogInterval = time.Second
+
+// Watchdog counters exposed by the health endpoint
+var (
+	watchdogTimeouts uint64
+	watchdogMemory   uint64
+	watchdogRunning  int64
+	watchdogReleases uint64
+)
+
+// TransformBudget limits the wall-clock time and the process resident memory
+// (RSS) of the image transformations. libvips calls can't be interrupted, so
+// transformations exceeding the budget are detected and replied right away,
+// while the transformation completes in background and its result is discarded.
+// Its worker, if any, is only released once completed.
+type TransformBudget struct {
+	Timeout   time.Duration
+	MaxMemory uint64
+}
+
+// Enabled reports whether any budget limit is defined
+func (b TransformBudget) Enabled() bool {
+	return b.Timeout > 0 || b.MaxMemory > 0
+}
+
+// Run runs the operation within the budget, returning ErrTransformTimeout or
+// ErrTransformMemory when exceeded
+func (b TransformBudget) Run(operation Operation, buf []byte, opts ImageOptions) (Image, error) {
+	if !b.Enabled() {
+		return operation.Run(buf, opts)
+	}
+
+	type result struct {
+		image Image
+		err   error
+		panic interface{}
+	}
+	done := make(chan result, 1)
+	atomic.AddInt64(&watchdogRunning, 1)
+	// The spooled input image must outlive the request if the budget is exceeded
+	release := retainInputSpool(opts.Context())
+	releaseWorker := retainWorker(opts.Context())
+	go func() {
+		defer atomic.AddInt64(&watchdogRunning, -1)
+		defer releaseWorker()
+		defer release()
+		// Panics are raised again by the request goroutine, which recovers them
+		defer func() {
+			if err := recover(); err != nil {
+				done <- result{panic: fmt.Sprintf("%v\n%s", err, d.Stack())}
+			}
+		}()
+		image, err := operation.Run(buf, opts)
+		done <- result{image, err, nil}
+	}()
+
+	var timeout <-chan time.Time
+	if b.Timeout > 0 {
+		timer := time.NewTimer(b.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var sample <-chan time.Time
+	if b.MaxMemory > 0 {
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+		sample = ticker.C
+	}
+
+	for {
+		select {
+		case res := <-done:
+			if res.panic != nil {
+				panic(res.panic)
+			}
+			return res.image, res.err
+		case <-timeout:
+			atomic.AddUint64(&watchdogTimeouts, 1)
+			return Image{}, ErrTransformTimeout
+		case <-sample:
+			if processMemory() > b.MaxMemory {
+				atomic.AddUint64(&watchdogMemory, 1)
+				// Release the memory not used by the running transformations
+				bimg.VipsCacheDropAll()
+				d.FreeOSMemory()
+				return Image{}, ErrTransformMemory
+			}
+		}
+	}
+}
+
+// processMemory returns the resident memory of the process. Platforms without
+// procfs fallback to the memory obtained by the Go runtime and libvips.
+func processMemory() uint64 {
+	if buf, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(buf)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	return mem.Sys + uint64(bimg.VipsMemory().Memory)
+}
+
+// watchMemory releases the libvips cache and the memory unused by the Go
+// runtime whenever the process resident memory exceeds the threshold,
+// preventing the slow memory creep of mixed workloads
+func watchMemory(threshold uint64) {
+	ticker := time.NewTicker(memoryWatchdogInterval)
+	go func() {
+		for range ticker.C {
+			releaseMemoryAbove(threshold)
+		}
+	}()
+}
+
+// releaseMemoryAbove releases the memory if the process resident memory
+// exceeds the threshold, reporting whether it did
+func releaseMemoryAbove(threshold uint64) bool {
+	rss := processMemory()
+	if rss <= threshold {
+		return false
+	}
+	atomic.AddUint64(&watchdogReleases, 1)
+	debug("memory watchdog: resident memory %d MB exceeds %d MB, releasing memory", rss/1024/1024, threshold/1024/1024)
+	bimg.VipsCacheDropAll()
+	d.FreeOSMemory()
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func slowOperation(delay time.Duration) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		time.Sleep(delay)
+		return Image{Body: buf, Mime: "image/jpeg"}, nil
+	}
+}
+
+func TestTransformBudget(t *testing.T) {
+	buf := []byte("image")
+
+	cases := []struct {
+		name   string
+		budget TransformBudget
+		delay  time.Duration
+		err    error
+	}{
+		{"no budget", TransformBudget{}, 20 * time.Millisecond, nil},
+		{"within time budget", TransformBudget{Timeout: time.Second}, 0, nil},
+		{"time budget exceeded", TransformBudget{Timeout: 10 * time.Millisecond}, 500 * time.Millisecond, ErrTransformTimeout},
+		{"memory budget exceeded", TransformBudget{MaxMemory: 1}, 500 * time.Millisecond, ErrTransformMemory},
+	}
+
+	for _, tc := range cases {
+		image, err := tc.budget.Run(slowOperation(tc.delay), buf, ImageOptions{})
+		if err != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if err == nil && string(image.Body) != "image" {
+			t.Errorf("%s: invalid image: %s", tc.name, image.Body)
+		}
+	}
+}
+
+func TestTransformBudgetPanic(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil || !strings.HasPrefix(err.(string), "oops") {
+			t.Errorf("Expected the operation panic, got %v", err)
+		}
+	}()
+
+	panicking := func(buf []byte, o ImageOptions) (Image, error) {
+		panic("oops")
+	}
+	_, _ = TransformBudget{Timeout: time.Second}.Run(panicking, nil, ImageOptions{})
+}
+
+func TestProcessMemory(t *testing.T) {
+	if memory := processMemory(); memory == 0 {
+		t.Error("Process memory should be greater than 0")
+	}
+}
+
+func TestImageHandlerTransformBudget(t *testing.T) {
+	o := ServerOptions{MaxAllowedPixels: 18.0, TransformBudget: TransformBudget{Timeout: 10 * time.Millisecond}}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		imageHandler(w, r, buf, slowOperation(500*time.Millisecond), o)
+	}
+	ts := testServer(fn)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=300", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), ErrTransformTimeout.Message) {
+		t.Errorf("Invalid response: %d %s", res.StatusCode, body)
+	}
+}
+
+func TestReleaseMemoryAbove(t *testing.T) {
+	releases := atomic.LoadUint64(&watchdogReleases)
+	if releaseMemoryAbove(math.MaxUint64) || atomic.LoadUint64(&watchdogReleases) != releases {
+		t.Error("Unexpected memory release below the threshold")
+	}
+	if !releaseMemoryAbove(1) || atomic.LoadUint64(&watchdogReleases) != releases+1 {
+		t.Error("Expected memory release above the threshold")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Webhook events
+const (
+	WebhookProcessingFailed = "processing_failed"
+	WebhookSSRFBlocked      = "ssrf_blocked"
+	WebhookJobCompleted     = "job_completed"
+)
+
+const (
+	// WebhookEventHeader is the webhook request header naming the event
+	WebhookEventHeader = "X-Webhook-Event"
+
+	// webhookTimeout is the webhook request timeout
+	webhookTimeout = 10 * time.Second
+
+	// webhookRetries is the number of retries of the failed webhook deliveries
+	webhookRetries = 3
+
+	// webhookQueueSize limits the events waiting for delivery, dropped beyond
+	webhookQueueSize = 1000
+)
+
+// webhookRetryDelay is the delay before the first retry, doubled on each retry
+var webhookRetryDelay = time.Second
+
+// defaultWebhookEvents are the events of the webhooks not defining any
+var defaultWebhookEvents = []string{WebhookProcessingFailed, WebhookSSRFBlocked}
+
+// Webhook defines an endpoint notified of the given events, signed with the
+// secret, if any
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// WebhookEvent is the JSON payload posted to the webhooks
+type WebhookEvent struct {
+	ID       string       `json:"id"`
+	Event    string       `json:"event"`
+	Time     string       `json:"time"`
+	ClientIP string       `json:"client_ip,omitempty"`
+	Method   string       `json:"method,omitempty"`
+	Path     string       `json:"path,omitempty"`
+	Param    string       `json:"param,omitempty"`
+	Value    string       `json:"value,omitempty"`
+	Status   int          `json:"status,omitempty"`
+	Kind     string       `json:"kind,omitempty"`
+	Message  string       `json:"message,omitempty"`
+	Job      *PrefetchJob `json:"job,omitempty"`
+}
+
+// Webhooks posts the events to the webhooks subscribed to them, in
+// background, one at a time, retrying the failed deliveries with exponential
+// backoff. Events are dropped when too many are waiting for delivery.
+// Payloads are signed by the X-Signature header, the URL-safe Base64-encoded
+// HMAC-SHA256 digest of the body with the webhook secret. Nil Webhooks
+// discard every event.
+type Webhooks struct {
+	hooks  []Webhook
+	client *http.Client
+	queue  chan webhookDelivery
+}
+
+// webhookDelivery is an event payload to post to a webhook
+type webhookDelivery struct {
+	hook  Webhook
+	event string
+	body  []byte
+}
+
+// ReadWebhooks reads the webhooks from a JSON file, and starts delivering
+// their events
+func ReadWebhooks(path string) (*Webhooks, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Webhook
+	if err := json.Unmarshal(buf, &hooks); err != nil {
+		return nil, fmt.Errorf("invalid webhooks file: %w", err)
+	}
+	for i, hook := range hooks {
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhooks file: invalid url %q", hook.URL)
+		}
+		for _, event := range hook.Events {
+			if event != WebhookProcessingFailed && event != WebhookSSRFBlocked && event != WebhookJobCompleted {
+				return nil, fmt.Errorf("invalid webhooks file: unknown event %q", event)
+			}
+		}
+		if len(hook.Events) == 0 {
+			hooks[i].Events = defaultWebhookEvents
+		}
+	}
+	return NewWebhooks(hooks), nil
+}
+
+// NewWebhooks creates the webhooks, delivering their events in background
+func NewWebhooks(hooks []Webhook) *Webhooks {
+	w := &Webhooks{
+		hooks:  hooks,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookDelivery, webhookQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+// Notify sends the event of the request to the webhooks subscribed to it.
+// The offending param value is included, as in the audit log.
+func (w *Webhooks) Notify(r *http.Request, event, param string, err error) {
+	if w == nil {
+		return
+	}
+
+	payload := WebhookEvent{
+		Event:    event,
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Param:    param,
+	}
+	if param != "" {
+		payload.Value = truncate(r.URL.Query().Get(param), auditMaxValueSize)
+	}
+	var xerr Error
+	if errors.As(err, &xerr) {
+		payload.Status, payload.Kind = xerr.HTTPCode(), xerr.Kind
+	}
+	if err != nil {
+		payload.Message = err.Error()
+	}
+	w.send(payload)
+}
+
+// NotifyJob sends the completion of the prefetch job to the webhooks
+// subscribed to it
+func (w *Webhooks) NotifyJob(job PrefetchJob) {
+	if w == nil {
+		return
+	}
+	w.send(WebhookEvent{Event: WebhookJobCompleted, Job: &job})
+}
+
+// send queues the event delivery to every webhook subscribed to it
+func (w *Webhooks) send(payload WebhookEvent) {
+	payload.ID = newRequestID()
+	payload.Time = time.Now().UTC().Format(time.RFC3339)
+	body, _ := json.Marshal(payload)
+
+	for _, hook := range w.hooks {
+		if !hook.subscribed(payload.Event) {
+			continue
+		}
+		select {
+		case w.queue <- webhookDelivery{hook: hook, event: payload.Event, body: body}:
+		default:
+			log.Printf("webhook queue full, dropping the %s event", payload.Event)
+		}
+	}
+}
+
+// subscribed checks if the webhook is notified of the event
+func (h Webhook) subscribed(event string) bool {
+	for _, name := range h.Events {
+		if name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// run delivers the queued events
+func (w *Webhooks) run() {
+	for delivery := range w.queue {
+		delay := webhookRetryDelay
+		for retry := 0; ; retry++ {
+			err := w.post(delivery)
+			if err == nil {
+				break
+			}
+			if retry >= webhookRetries {
+				log.Printf("cannot deliver the %s webhook to %s: %s", delivery.event, delivery.hook.URL, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// post sends the signed event payload to the webhook
+func (w *Webhooks) post(delivery webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	req.Header.Set(WebhookEventHeader, delivery.event)
+	if delivery.hook.Secret != "" {
+		req.Header.Set(BodySignatureHeader, signWebhook(delivery.hook.Secret, delivery.body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status=%d", res.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the URL-safe Base64-encoded HMAC-SHA256 digest of the
+// webhook payload
+func signWebhook(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadWebhooks(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "webhooks.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	hooks, err := ReadWebhooks(write(`[{"url": "https://alerts.example.com/imaginary"}, {"url": "http://ops.example.com", "events": ["job_completed"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks.hooks) != 2 || !hooks.hooks[0].subscribed(WebhookSSRFBlocked) || hooks.hooks[0].subscribed(WebhookJobCompleted) {
+		t.Errorf("Invalid default events: %+v", hooks.hooks)
+	}
+	if hooks.hooks[1].subscribed(WebhookProcessingFailed) || !hooks.hooks[1].subscribed(WebhookJobCompleted) {
+		t.Errorf("Invalid events: %+v", hooks.hooks[1])
+	}
+
+	for _, content := range []string{
+		`{`,
+		`[{"url": "ftp://alerts.example.com"}]`,
+		`[{"url": "https://alerts.example.com", "events": ["unknown"]}]`,
+	} {
+		if _, err := ReadWebhooks(write(content)); err == nil {
+			t.Errorf("%s: expected error", content)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	type delivery struct {
+		event string
+		sign  string
+		body  []byte
+	}
+	deliveries := make(chan delivery, 10)
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first delivery fails, then is retried
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Get(WebhookEventHeader), r.Header.Get(BodySignatureHeader), body}
+	}))
+	defer ts.Close()
+
+	hooks := NewWebhooks([]Webhook{{URL: ts.URL, Secret: "secret", Events: []string{WebhookSSRFBlocked}}})
+	r := httptest.NewRequest(http.MethodGet, "/resize?url=http://169.254.169.254/", nil)
+	hooks.Notify(r, WebhookProcessingFailed, "", ErrTransformTimeout)
+	hooks.Notify(r, WebhookSSRFBlocked, "url", errForbiddenOrigin)
+
+	select {
+	case d := <-deliveries:
+		if d.event != WebhookSSRFBlocked || d.sign != signWebhook("secret", d.body) {
+			t.Errorf("Invalid webhook delivery: %s %s", d.event, d.sign)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(d.body, &event); err != nil || event.ID == "" || event.Path != "/resize" || event.Param != "url" || event.Value != "http://169.254.169.254/" {
+			t.Errorf("Invalid webhook payload: %s", d.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+
+	// Nil webhooks discard the events
+	var none *Webhooks
+	none.Notify(r, WebhookSSRFBlocked, "url", errForbiddenOrigin)
+	none.NotifyJob(PrefetchJob{})
+}